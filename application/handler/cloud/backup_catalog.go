@@ -0,0 +1,454 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/cron"
+	"github.com/coscms/webcore/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/param"
+)
+
+// ErrCatalogNotFound 目标路径中没有目录快照
+var ErrCatalogNotFound = errors.New(`backup catalog not found`)
+
+const (
+	catalogFormat  = 1
+	catalogLatest  = `latest.json`
+	catalogJobName = `cloudBackupCatalog`
+)
+
+// catalogKeep 保留的目录快照数
+var catalogKeep = 5
+
+// CatalogJob 将云备份的索引和配置保存到云存储的系统任务。参数为备份配置ID，不指定时处理所有启用的配置
+var CatalogJob = &cron.Jobx{
+	Name:         catalogJobName,
+	Example:      `>` + catalogJobName + `:1`,
+	Description:  `保存云备份目录快照(索引和配置)到云存储`,
+	RunnerGetter: catalogRunnerGetter,
+}
+
+// CatalogMeta 目录快照。以明文保存，不包含存储账号的密码和加密口令
+type CatalogMeta struct {
+	Format  int                       `json:"format"`
+	ID      string                    `json:"id"`
+	Created time.Time                 `json:"created"`
+	Config  dbschema.NgingCloudBackup `json:"config"`
+	Extra   *BackupExtra              `json:"extra"`
+	Index   string                    `json:"index"`   // 索引对象名称(启用加密时索引加密保存)
+	Records int                       `json:"records"` // 索引记录数
+	MD5     string                    `json:"md5"`     // 索引(未加密)的 md5
+	History []string                  `json:"history,omitempty"`
+}
+
+// catalogRecord 索引中的一条记录
+type catalogRecord struct {
+	K []byte `json:"k"`
+	V []byte `json:"v"`
+}
+
+// catalogRoot 目录快照的存放路径(与目标路径同级，还原目标路径时不会下载)
+func catalogRoot(destPath string) string {
+	d := path.Clean(destPath)
+	switch d {
+	case `.`, `/`:
+		return path.Join(d, `.catalog`)
+	}
+	return d + `.catalog`
+}
+
+// stripStorageCredentials 去掉存储引擎配置中的密码等凭据
+func stripStorageCredentials(cfg dbschema.NgingCloudBackup) dbschema.NgingCloudBackup {
+	cfg.Result = ``
+	cfg.Status = ``
+	cfg.LastExecuted = 0
+	conf, err := storageConfig(cfg)
+	if err != nil {
+		cfg.StorageConfig = ``
+		return cfg
+	}
+	for _, f := range cloudbackup.Forms[cfg.StorageEngine] {
+		if f.Type == `password` {
+			delete(conf, strings.TrimPrefix(f.Name, `storageConfig.`))
+		}
+	}
+	b, _ := json.Marshal(conf)
+	cfg.StorageConfig = string(b)
+	return cfg
+}
+
+// newCatalogStorage 返回保存快照描述(明文)和索引的存储。索引不分块，启用加密时加密内容但不加密名称
+func newCatalogStorage(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, secret ...string) (plain cloudbackup.Storager, index cloudbackup.Storager, err error) {
+	plain, err = cloudbackup.NewStorage(ctx, cfg)
+	if err != nil {
+		return
+	}
+	index = plain
+	if extra.IsEncrypted() {
+		var c *backupCipher
+		c, err = extra.Cipher(secret...)
+		if err != nil {
+			return
+		}
+		index = newEncryptedStorage(plain, c, catalogRoot(cfg.DestPath), false)
+	}
+	return
+}
+
+// writeCatalogIndex 将索引的一个快照写入 w(gzip 压缩，每行一条记录)
+func writeCatalogIndex(ldb *leveldb.DB, w io.Writer) (int, error) {
+	snap, err := ldb.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	gw := gzip.NewWriter(w)
+	enc := json.NewEncoder(gw)
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+	var n int
+	for iter.Next() {
+		if err = enc.Encode(catalogRecord{K: iter.Key(), V: iter.Value()}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err = iter.Error(); err != nil {
+		return n, err
+	}
+	return n, gw.Close()
+}
+
+// readCatalogIndex 从 r 中读取索引记录写入 ldb
+func readCatalogIndex(r io.Reader, ldb *leveldb.DB) (int, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gr.Close()
+	dec := json.NewDecoder(bufio.NewReader(gr))
+	batch := new(leveldb.Batch)
+	var n int
+	for {
+		var rec catalogRecord
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		batch.Put(rec.K, rec.V)
+		n++
+		if batch.Len() >= 1000 {
+			if err = ldb.Write(batch, nil); err != nil {
+				return n, err
+			}
+			batch.Reset()
+		}
+	}
+	return n, ldb.Write(batch, nil)
+}
+
+// downloadCatalogMeta 下载目录快照描述
+func downloadCatalogMeta(ctx echo.Context, mgr cloudbackup.Storager, destPath string, name string) (*CatalogMeta, error) {
+	buf := &bytes.Buffer{}
+	if err := mgr.Download(ctx, path.Join(catalogRoot(destPath), name), buf); err != nil {
+		return nil, fmt.Errorf(`%w: %v`, ErrCatalogNotFound, err)
+	}
+	meta := &CatalogMeta{}
+	if err := json.Unmarshal(buf.Bytes(), meta); err != nil {
+		return nil, err
+	}
+	if meta.Format != catalogFormat || meta.Extra == nil {
+		return nil, fmt.Errorf(`unsupported backup catalog format: %d`, meta.Format)
+	}
+	return meta, nil
+}
+
+func uploadCatalogMeta(ctx echo.Context, mgr cloudbackup.Storager, destPath string, name string, meta *CatalogMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return mgr.Put(ctx, bytes.NewReader(b), path.Join(catalogRoot(destPath), name), int64(len(b)))
+}
+
+// exportCatalog 保存索引和配置的快照到目标路径同级的目录中，并删除超出保留数量的旧快照
+func exportCatalog(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra) (*CatalogMeta, error) {
+	if extra == nil {
+		extra = &BackupExtra{BackupId: cfg.Id}
+		extra.setDefaults()
+	}
+	ldb, err := cloudbackup.LevelDB().OpenDB(cfg.Id)
+	if err != nil {
+		return nil, err
+	}
+	plain, index, err := newCatalogStorage(ctx, cfg, extra)
+	if err != nil {
+		return nil, err
+	}
+	if err = plain.Connect(); err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	return writeCatalog(ctx, cfg, extra, ldb, plain, index)
+}
+
+func writeCatalog(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, ldb *leveldb.DB, plain cloudbackup.Storager, index cloudbackup.Storager) (*CatalogMeta, error) {
+	fp, err := os.CreateTemp(``, `nging-catalog-*.gz`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		fp.Close()
+		os.Remove(fp.Name())
+	}()
+	hash := md5.New()
+	records, err := writeCatalogIndex(ldb, io.MultiWriter(fp, hash))
+	if err != nil {
+		return nil, err
+	}
+	size, err := fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id := newVersionID(now)
+	meta := &CatalogMeta{
+		Format:  catalogFormat,
+		ID:      id,
+		Created: now,
+		Config:  stripStorageCredentials(cfg),
+		Extra:   extra,
+		Index:   path.Join(catalogRoot(cfg.DestPath), id+`.index.gz`),
+		Records: records,
+		MD5:     hex.EncodeToString(hash.Sum(nil)),
+	}
+	if err = cloudbackup.RetryablePut(ctx, index, fp, meta.Index, size); err != nil {
+		return nil, err
+	}
+	if err = uploadCatalogMeta(ctx, plain, cfg.DestPath, id+`.json`, meta); err != nil {
+		return nil, err
+	}
+	if prev, perr := downloadCatalogMeta(ctx, plain, cfg.DestPath, catalogLatest); perr == nil {
+		meta.History = prev.History
+	}
+	meta.History = append(meta.History, id)
+	if over := len(meta.History) - catalogKeep; over > 0 {
+		for _, old := range meta.History[:over] {
+			for _, name := range []string{old + `.json`, old + `.index.gz`} {
+				if rerr := plain.Remove(ctx, path.Join(catalogRoot(cfg.DestPath), name)); rerr != nil {
+					log.Warnf(`[cloudbackup] failed to remove old catalog %s: %v`, name, rerr)
+				}
+			}
+		}
+		meta.History = meta.History[over:]
+	}
+	return meta, uploadCatalogMeta(ctx, plain, cfg.DestPath, catalogLatest, meta)
+}
+
+// listCatalogs 列出目标路径中保存的目录快照(最新的快照描述，History 为所有快照ID)
+func listCatalogs(ctx echo.Context, cfg dbschema.NgingCloudBackup) (*CatalogMeta, error) {
+	plain, err := cloudbackup.NewStorage(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = plain.Connect(); err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	return downloadCatalogMeta(ctx, plain, cfg.DestPath, catalogLatest)
+}
+
+// importCatalog 从目标路径中的目录快照重建备份配置和索引(用于在新安装的系统上恢复)。
+// cfg 为表单中填写的存储引擎、存储账号和目标路径，id 为空时使用最新的快照。导入的配置默认停用
+func importCatalog(ctx echo.Context, cfg dbschema.NgingCloudBackup, secret string, id string) (*model.CloudBackup, error) {
+	plain, err := cloudbackup.NewStorage(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = plain.Connect(); err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	name := catalogLatest
+	if len(id) > 0 {
+		name = path.Base(id) + `.json`
+	}
+	meta, err := downloadCatalogMeta(ctx, plain, cfg.DestPath, name)
+	if err != nil {
+		return nil, err
+	}
+	extra := meta.Extra
+	extra.setDefaults()
+	if extra.IsEncrypted() {
+		if len(secret) == 0 {
+			return nil, ctx.NewError(code.InvalidParameter, `备份文件已加密，请输入口令或密钥`).SetZone(`encryptionSecret`)
+		}
+		if _, err = extra.Cipher(secret); err != nil {
+			return nil, ctx.NewError(code.InvalidParameter, `密钥不正确，无法解密备份文件`).SetZone(`encryptionSecret`)
+		}
+		extra.EncryptionSecret = common.Crypto().Encode(secret)
+	}
+	_, index, err := newCatalogStorage(ctx, cfg, extra, secret)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.CreateTemp(``, `nging-catalog-*.gz`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		fp.Close()
+		os.Remove(fp.Name())
+	}()
+	hash := md5.New()
+	if err = index.Download(ctx, meta.Index, io.MultiWriter(fp, hash)); err != nil {
+		return nil, err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != meta.MD5 {
+		return nil, fmt.Errorf(`backup catalog %s is corrupted: md5 %s != %s`, meta.ID, sum, meta.MD5)
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	recv := meta.Config
+	recv.Id = 0
+	if len(cfg.Name) > 0 {
+		recv.Name = cfg.Name
+	}
+	recv.StorageEngine = cfg.StorageEngine
+	recv.StorageConfig = cfg.StorageConfig
+	recv.DestStorage = cfg.DestStorage
+	recv.DestPath = cfg.DestPath
+	recv.Disabled = common.BoolY
+	recv.Status = `idle`
+	recv.Result = ``
+	recv.SetContext(ctx)
+	m := model.NewCloudBackup(ctx)
+	m.NgingCloudBackup = &recv
+	if _, err = m.Add(); err != nil {
+		return nil, err
+	}
+	rollback := func() {
+		m.Delete(nil, db.Cond{`id`: m.Id})
+		deleteBackupExtra(m.Id)
+		cloudbackup.LevelDB().RemoveDB(m.Id)
+	}
+	extra.BackupId = m.Id
+	if err = saveBackupExtra(extra); err != nil {
+		rollback()
+		return nil, err
+	}
+	cloudbackup.LevelDB().RemoveDB(m.Id) // 清除可能残留的同ID索引
+	ldb, err := cloudbackup.LevelDB().OpenDB(m.Id)
+	if err == nil {
+		_, err = readCatalogIndex(fp, ldb)
+	}
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	return m, nil
+}
+
+// saveCatalogAfterBackup 全量备份完成后保存目录快照，失败时只记录日志
+func saveCatalogAfterBackup(cfg dbschema.NgingCloudBackup, extra *BackupExtra) {
+	if _, err := exportCatalog(defaults.NewMockContext(), cfg, extra); err != nil {
+		log.Errorf(`[cloudbackup] %s: failed to save catalog: %v`, cfg.Name, err)
+	}
+}
+
+func catalogRunnerGetter(id string) cron.Runner {
+	return func(_ time.Duration) (string, string, error, bool) {
+		out, err := runCatalogJob(param.AsUint(id))
+		if err != nil {
+			return out, err.Error(), err, false
+		}
+		return out, ``, nil, false
+	}
+}
+
+// runCatalogJob 保存指定备份配置的目录快照，id 为 0 时处理所有启用的配置
+func runCatalogJob(id uint) (string, error) {
+	ctx := defaults.NewMockContext()
+	m := model.NewCloudBackup(ctx)
+	cond := db.Cond{`disabled`: `N`}
+	if id > 0 {
+		cond = db.Cond{`id`: id}
+	}
+	_, err := m.EventOFF().ListByOffset(nil, nil, 0, -1, cond)
+	if err != nil {
+		return ``, err
+	}
+	rows := m.Objects()
+	if id > 0 && len(rows) == 0 {
+		return ``, fmt.Errorf(`cloud backup %d: %w`, id, db.ErrNoMoreRows)
+	}
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = row.Id
+	}
+	extras, err := listBackupExtras(ids)
+	if err != nil {
+		return ``, err
+	}
+	var (
+		lines   []string
+		lastErr error
+	)
+	for _, row := range rows {
+		meta, err := exportCatalog(ctx, *row, extras[row.Id])
+		if err != nil {
+			lastErr = err
+			lines = append(lines, fmt.Sprintf(`[%d]%s: %v`, row.Id, row.Name, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`[%d]%s: %s (%d)`, row.Id, row.Name, meta.ID, meta.Records))
+	}
+	return strings.Join(lines, "\n"), lastErr
+}
@@ -0,0 +1,112 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/echo/defaults"
+)
+
+func TestCatalogRootAndCredentials(t *testing.T) {
+	assert.Equal(t, `/backup.catalog`, catalogRoot(`/backup/`))
+	assert.Equal(t, `/.catalog`, catalogRoot(`/`))
+
+	cfg := stripStorageCredentials(dbschema.NgingCloudBackup{
+		StorageEngine: `ftp`,
+		StorageConfig: `{"addr":"127.0.0.1:21","username":"nging","password":"secret"}`,
+		Result:        `ok`,
+		LastExecuted:  1,
+	})
+	conf, err := storageConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, `nging`, conf.String(`username`))
+	assert.NotContains(t, conf, `password`)
+	assert.Empty(t, cfg.Result)
+	assert.Zero(t, cfg.LastExecuted)
+}
+
+func TestCatalogIndexRoundTrip(t *testing.T) {
+	src, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `src`), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	require.NoError(t, src.Put([]byte(`/data/a.txt`), []byte(`md5a||1||3||2||5`), nil))
+	require.NoError(t, src.Put([]byte(`/data/b.txt`), []byte(`md5b||1||3||2||5`), nil))
+
+	buf := &bytes.Buffer{}
+	n, err := writeCatalogIndex(src, buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	dst, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `dst`), nil)
+	require.NoError(t, err)
+	defer dst.Close()
+	n, err = readCatalogIndex(buf, dst)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	v, err := dst.Get([]byte(`/data/b.txt`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, `md5b||1||3||2||5`, string(v))
+}
+
+func TestWriteCatalog(t *testing.T) {
+	ctx := defaults.NewMockContext()
+	old := catalogKeep
+	catalogKeep = 2
+	defer func() { catalogKeep = old }()
+
+	ldb, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer ldb.Close()
+	require.NoError(t, ldb.Put([]byte(`/data/a.txt`), []byte(`md5a||1||3||2||5`), nil))
+
+	mem := &memStorage{files: map[string][]byte{}}
+	index := newEncryptedStorage(mem, testCipher(t, testKey1), catalogRoot(`/backup`), false)
+	cfg := dbschema.NgingCloudBackup{Id: 200200, SourcePath: `/data`, DestPath: `/backup`}
+	extra := &BackupExtra{BackupId: cfg.Id, Encryption: EncryptionKey}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		meta, err := writeCatalog(ctx, cfg, extra, ldb, mem, index)
+		require.NoError(t, err)
+		assert.Equal(t, 1, meta.Records)
+		ids = append(ids, meta.ID)
+	}
+	latest, err := downloadCatalogMeta(ctx, mem, cfg.DestPath, catalogLatest)
+	require.NoError(t, err)
+	assert.Equal(t, ids[1:], latest.History)
+	assert.Equal(t, ids[2], latest.ID)
+	assert.NotContains(t, mem.files, `/backup.catalog/`+ids[0]+`.json`)
+	assert.NotContains(t, mem.files, `/backup.catalog/`+ids[0]+`.index.gz`)
+
+	// 索引内容已加密
+	assert.NotContains(t, string(mem.files[latest.Index]), `md5a`)
+	buf := &bytes.Buffer{}
+	require.NoError(t, index.Download(context.Background(), latest.Index, buf))
+	dst, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `dst`), nil)
+	require.NoError(t, err)
+	defer dst.Close()
+	n, err := readCatalogIndex(buf, dst)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestExcludeLister(t *testing.T) {
+	mem := &memStorage{files: map[string][]byte{
+		`/backup/a.txt`:          []byte(`a`),
+		`/backup.catalog/x.json`: []byte(`x`),
+		`/backup.chunks/ab/cd`:   []byte(`c`),
+	}}
+	lister := newExcludeLister(&memLister{mem: mem}, chunkRoot(`/backup`), catalogRoot(`/backup`))
+	var names []string
+	require.NoError(t, lister.List(context.Background(), ``, func(obj remoteObject) error {
+		names = append(names, obj.Name)
+		return nil
+	}))
+	assert.Equal(t, []string{`/backup/a.txt`}, names)
+}
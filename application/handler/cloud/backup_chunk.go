@@ -0,0 +1,477 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/klauspost/compress/zstd"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/webx-top/com"
+)
+
+// 分块大小(FastCDC)
+const (
+	chunkMinSize = 256 * 1024
+	chunkAvgSize = 1024 * 1024
+	chunkMaxSize = 4 * 1024 * 1024
+)
+
+// 文件清单格式
+const chunkManifestFormat = `nging-chunks/1`
+
+// 清理数据块时跳过最近上传的数据块(它们的文件清单可能还在上传中)
+var chunkSweepGrace = time.Hour
+
+// LevelDB 中的键前缀
+const (
+	chunkKeyPrefix    = "\x00c\x00" // 已上传的数据块
+	manifestKeyPrefix = "\x00m\x00" // 已上传的文件清单
+)
+
+// ErrInvalidManifest 不是有效的文件清单
+var ErrInvalidManifest = errors.New(`invalid chunk manifest`)
+
+// gear 表必须保持不变，否则相同的内容会被切分成不同的数据块
+var (
+	chunkGear     [256]uint64
+	chunkMaskS    uint64 // 小于平均大小时使用，更难切分
+	chunkMaskL    uint64 // 大于平均大小时使用，更易切分
+	zstdEncoder   *zstd.Encoder
+	zstdDecoder   *zstd.Decoder
+	zstdInitOnce  sync.Once
+	chunkInitOnce sync.Once
+)
+
+func initChunkGear() {
+	seed := uint64(0x6e67696e67636462) // "ngingcdb"
+	for i := range chunkGear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		chunkGear[i] = z ^ (z >> 31)
+	}
+	bits := 20 // log2(chunkAvgSize)
+	chunkMaskS = ^uint64(0) << (64 - (bits + 2))
+	chunkMaskL = ^uint64(0) << (64 - (bits - 2))
+}
+
+func initZstd() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// chunkCut 返回 data 中第一个数据块的长度(FastCDC 归一化分块)
+func chunkCut(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := chunkMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + chunkGear[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + chunkGear[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// newChunker 按内容将 r 切分为数据块
+func newChunker(r io.Reader) *chunker {
+	chunkInitOnce.Do(initChunkGear)
+	return &chunker{r: bufio.NewReaderSize(r, chunkMaxSize), buf: make([]byte, chunkMaxSize)}
+}
+
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// Next 返回下一个数据块，没有更多数据时返回 io.EOF。返回的数据在下次调用前有效
+func (c *chunker) Next() ([]byte, error) {
+	data, err := c.r.Peek(chunkMaxSize)
+	if len(data) == 0 {
+		if err == nil || err == bufio.ErrBufferFull {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	n := copy(c.buf, data[:chunkCut(data)])
+	if _, err = c.r.Discard(n); err != nil {
+		return nil, err
+	}
+	return c.buf[:n], nil
+}
+
+// chunkManifest 文件清单，记录文件由哪些数据块组成
+type chunkManifest struct {
+	Format string     `json:"format"`
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+type chunkRef struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+func parseChunkManifest(b []byte) (*chunkManifest, error) {
+	m := &chunkManifest{}
+	if err := json.Unmarshal(b, m); err != nil || m.Format != chunkManifestFormat {
+		return nil, ErrInvalidManifest
+	}
+	return m, nil
+}
+
+// chunkRoot 数据块的存放路径(与目标路径同级，还原目标路径时不会下载数据块)
+func chunkRoot(destPath string) string {
+	d := path.Clean(destPath)
+	switch d {
+	case `.`, `/`:
+		return path.Join(d, `.chunks`)
+	}
+	return d + `.chunks`
+}
+
+func newChunkedStorage(mgr cloudbackup.Storager, db *leveldb.DB, destPath string, chunkID func([]byte) string) *chunkedStorage {
+	zstdInitOnce.Do(initZstd)
+	if chunkID == nil {
+		chunkID = func(data []byte) string {
+			sum := sha256.Sum256(data)
+			return hex.EncodeToString(sum[:])
+		}
+	}
+	return &chunkedStorage{Storager: mgr, db: db, root: chunkRoot(destPath), chunkID: chunkID}
+}
+
+// chunkedStorage 分块去重存储。文件按内容切分为数据块，压缩后以哈希值命名上传，
+// 已上传过的数据块不再上传；原来的文件对象中保存的是文件清单
+type chunkedStorage struct {
+	cloudbackup.Storager
+	db      *leveldb.DB
+	root    string
+	chunkID func([]byte) string
+}
+
+func (s *chunkedStorage) chunkObject(id string) string {
+	return path.Join(s.root, id[:2], id)
+}
+
+// remoteObjects 返回文件清单对象及其引用的数据块对象。没有文件清单记录时大小未知
+func (s *chunkedStorage) remoteObjects(ppath string, size int64) []remoteObject {
+	b, err := s.db.Get(com.Str2bytes(manifestKeyPrefix+ppath), nil)
+	if err != nil {
+		return mapRemoteObjects(s.Storager, ppath, -1)
+	}
+	objects := mapRemoteObjects(s.Storager, ppath, int64(len(b)))
+	m, err := parseChunkManifest(b)
+	if err != nil {
+		return objects
+	}
+	for _, ref := range m.Chunks {
+		chunkSize := int64(-1)
+		if val, err := s.db.Get(com.Str2bytes(chunkKeyPrefix+ref.ID), nil); err == nil && len(val) >= 8 {
+			chunkSize = int64(binary.BigEndian.Uint64(val))
+		}
+		objects = append(objects, mapRemoteObjects(s.Storager, s.chunkObject(ref.ID), chunkSize)...)
+	}
+	return objects
+}
+
+func (s *chunkedStorage) Put(ctx context.Context, reader io.Reader, ppath string, size int64) error {
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+	}
+	m := &chunkManifest{Format: chunkManifestFormat, Chunks: []chunkRef{}}
+	c := newChunker(reader)
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		id := s.chunkID(data)
+		if err = s.putChunk(ctx, id, data); err != nil {
+			return err
+		}
+		m.Chunks = append(m.Chunks, chunkRef{ID: id, Size: len(data)})
+		m.Size += int64(len(data))
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = s.Storager.Put(ctx, bytes.NewReader(b), ppath, int64(len(b))); err != nil {
+		return err
+	}
+	return s.db.Put(com.Str2bytes(manifestKeyPrefix+ppath), b, nil)
+}
+
+// putChunk 上传尚未上传过的数据块
+func (s *chunkedStorage) putChunk(ctx context.Context, id string, data []byte) error {
+	key := com.Str2bytes(chunkKeyPrefix + id)
+	if has, err := s.db.Has(key, nil); err != nil || has {
+		return err
+	}
+	compressed := zstdEncoder.EncodeAll(data, nil)
+	if err := s.Storager.Put(ctx, bytes.NewReader(compressed), s.chunkObject(id), int64(len(compressed))); err != nil {
+		return err
+	}
+	val := make([]byte, 16)
+	binary.BigEndian.PutUint64(val, uint64(len(compressed)))
+	binary.BigEndian.PutUint64(val[8:], uint64(time.Now().Unix()))
+	return s.db.Put(key, val, nil)
+}
+
+// readChunk 下载并解压数据块，同时校验内容
+func (s *chunkedStorage) readChunk(ctx context.Context, ref chunkRef) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := s.Storager.Download(ctx, s.chunkObject(ref.ID), buf); err != nil {
+		return nil, fmt.Errorf(`chunk %s: %w`, ref.ID, err)
+	}
+	data, err := zstdDecoder.DecodeAll(buf.Bytes(), make([]byte, 0, ref.Size))
+	if err != nil {
+		return nil, fmt.Errorf(`chunk %s: %w`, ref.ID, err)
+	}
+	if len(data) != ref.Size || s.chunkID(data) != ref.ID {
+		return nil, fmt.Errorf(`chunk %s: checksum mismatch`, ref.ID)
+	}
+	return data, nil
+}
+
+// writeManifest 按文件清单依次将数据块写入 w
+func (s *chunkedStorage) writeManifest(ctx context.Context, m *chunkManifest, w io.Writer) error {
+	for _, ref := range m.Chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := s.readChunk(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *chunkedStorage) Download(ctx context.Context, ppath string, w io.Writer) error {
+	buf := &bytes.Buffer{}
+	if err := s.Storager.Download(ctx, ppath, buf); err != nil {
+		return err
+	}
+	m, err := parseChunkManifest(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf(`%s: %w`, ppath, err)
+	}
+	return s.writeManifest(ctx, m, w)
+}
+
+func (s *chunkedStorage) Remove(ctx context.Context, ppath string) error {
+	if err := s.Storager.Remove(ctx, ppath); err != nil {
+		return err
+	}
+	return s.db.Delete(com.Str2bytes(manifestKeyPrefix+ppath), nil)
+}
+
+func (s *chunkedStorage) RemoveDir(ctx context.Context, ppath string) error {
+	if err := s.Storager.RemoveDir(ctx, ppath); err != nil {
+		return err
+	}
+	prefix := manifestKeyPrefix + strings.TrimSuffix(ppath, `/`) + `/`
+	iter := s.db.NewIterator(util.BytesPrefix(com.Str2bytes(prefix)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *chunkedStorage) SetProgressor(prog notice.Progressor) {
+	if st, ok := s.Storager.(cloudbackup.ProgressorSetter); ok {
+		st.SetProgressor(prog)
+	}
+}
+
+// Restore 先将文件清单下载到 destpath 下的临时目录，再逐个按清单重建文件到 destpath
+func (s *chunkedStorage) Restore(ctx context.Context, ppath string, destpath string, callback func(from, to string)) error {
+	if err := com.MkdirAll(destpath, os.ModePerm); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(destpath, `.restore-`)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err = s.Storager.Restore(ctx, ppath, staging, nil); err != nil {
+		return err
+	}
+	skipDir := filepath.Join(staging, path.Base(s.root))
+	return filepath.Walk(staging, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if fpath == skipDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(staging, fpath)
+		if err != nil {
+			return err
+		}
+		from := path.Join(ppath, filepath.ToSlash(rel))
+		dest := filepath.Join(destpath, rel)
+		if callback != nil {
+			callback(from, dest)
+		}
+		if err = s.rebuildFile(ctx, fpath, dest); err != nil {
+			return fmt.Errorf(`%s: %w`, from, err)
+		}
+		return nil
+	})
+}
+
+func (s *chunkedStorage) rebuildFile(ctx context.Context, manifestFile string, dest string) error {
+	b, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return err
+	}
+	m, err := parseChunkManifest(b)
+	if err != nil {
+		return err
+	}
+	if err = com.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	err = s.writeManifest(ctx, m, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// sweepChunks 删除不再被任何文件清单引用的数据块，返回删除的数量
+func (s *chunkedStorage) sweepChunks(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-chunkSweepGrace).Unix()
+	referenced := map[string]struct{}{}
+	iter := s.db.NewIterator(util.BytesPrefix(com.Str2bytes(manifestKeyPrefix)), nil)
+	for iter.Next() {
+		m, err := parseChunkManifest(iter.Value())
+		if err != nil {
+			continue
+		}
+		for _, ref := range m.Chunks {
+			referenced[ref.ID] = struct{}{}
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	var unused []string
+	iter = s.db.NewIterator(util.BytesPrefix(com.Str2bytes(chunkKeyPrefix)), nil)
+	for iter.Next() {
+		if val := iter.Value(); len(val) >= 16 && int64(binary.BigEndian.Uint64(val[8:])) > cutoff {
+			continue
+		}
+		id := strings.TrimPrefix(string(iter.Key()), chunkKeyPrefix)
+		if _, ok := referenced[id]; !ok {
+			unused = append(unused, id)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, id := range unused {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if err := s.Storager.Remove(ctx, s.chunkObject(id)); err != nil {
+			return removed, fmt.Errorf(`chunk %s: %w`, id, err)
+		}
+		if err := s.db.Delete(com.Str2bytes(chunkKeyPrefix+id), nil); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,156 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func splitChunks(t *testing.T, data []byte) [][]byte {
+	c := newChunker(bytes.NewReader(data))
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+	return chunks
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(1, 20*1024*1024)
+	chunks := splitChunks(t, data)
+	require.True(t, len(chunks) > 5)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), chunkMaxSize)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), chunkMinSize)
+		}
+	}
+
+	// 在开头插入数据后，只有前面的数据块会改变
+	modified := append([]byte(`inserted bytes`), data...)
+	ids := map[string]bool{}
+	s := newChunkedStorage(nil, nil, `/backup`, nil)
+	for _, chunk := range chunks {
+		ids[s.chunkID(chunk)] = true
+	}
+	var changed int
+	for _, chunk := range splitChunks(t, modified) {
+		if !ids[s.chunkID(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+
+	assert.Empty(t, splitChunks(t, nil))
+}
+
+func TestChunkedStorage(t *testing.T) {
+	ctx := context.Background()
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer db.Close()
+	mem := &memStorage{files: map[string][]byte{}}
+	s := newChunkedStorage(mem, db, `/backup`, nil)
+
+	data := randomData(2, 6*1024*1024)
+	require.NoError(t, s.Put(ctx, bytes.NewReader(data), `/backup/db.sql`, int64(len(data))))
+	require.NoError(t, s.Put(ctx, strings.NewReader(``), `/backup/empty.txt`, 0))
+	countChunks := func() (n int) {
+		for name := range mem.files {
+			if strings.HasPrefix(name, `/backup.chunks/`) {
+				n++
+			}
+		}
+		return
+	}
+	first := countChunks()
+	assert.True(t, first > 1)
+
+	// 修改少量内容后只上传有变化的数据块
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, s.Put(ctx, bytes.NewReader(data), `/backup/db.sql`, int64(len(data))))
+	assert.LessOrEqual(t, countChunks()-first, 2)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, s.Download(ctx, `/backup/db.sql`, buf))
+	assert.Equal(t, data, buf.Bytes())
+
+	dest := t.TempDir()
+	var restored []string
+	require.NoError(t, s.Restore(ctx, `/backup`, dest, func(from, to string) {
+		restored = append(restored, from)
+	}))
+	assert.ElementsMatch(t, []string{`/backup/db.sql`, `/backup/empty.txt`}, restored)
+	b, err := os.ReadFile(filepath.Join(dest, `db.sql`))
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+	b, err = os.ReadFile(filepath.Join(dest, `empty.txt`))
+	require.NoError(t, err)
+	assert.Empty(t, b)
+
+	// 清理不再被引用的数据块
+	removed, err := s.sweepChunks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed) // 最近上传的数据块被跳过
+
+	grace := chunkSweepGrace
+	chunkSweepGrace = -time.Minute
+	defer func() { chunkSweepGrace = grace }()
+	removed, err = s.sweepChunks(ctx)
+	require.NoError(t, err)
+	assert.True(t, removed > 0)
+	assert.Equal(t, first, countChunks()) // 修改前的数据块已删除
+	buf.Reset()
+	require.NoError(t, s.Download(ctx, `/backup/db.sql`, buf))
+	assert.Equal(t, data, buf.Bytes())
+
+	require.NoError(t, s.Remove(ctx, `/backup/db.sql`))
+	removed, err = s.sweepChunks(ctx)
+	require.NoError(t, err)
+	assert.True(t, removed > 0)
+	assert.Equal(t, 0, countChunks()) // 空文件没有数据块
+}
+
+func TestChunkedEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer db.Close()
+	mem := &memStorage{files: map[string][]byte{}}
+	c := testCipher(t, testKey1)
+	s := newChunkedStorage(newEncryptedStorage(mem, c, `/backup`, true), db, `/backup`, c.ChunkID)
+
+	data := randomData(3, 3*1024*1024)
+	require.NoError(t, s.Put(ctx, bytes.NewReader(data), `/backup/dir/db.sql`, int64(len(data))))
+	for name, b := range mem.files {
+		assert.NotContains(t, name, `db.sql`)
+		assert.True(t, bytes.HasPrefix(b, []byte(encryptMagic)), name)
+	}
+	dest := t.TempDir()
+	require.NoError(t, s.Restore(ctx, `/backup`, dest, nil))
+	b, err := os.ReadFile(filepath.Join(dest, `dir`, `db.sql`))
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+}
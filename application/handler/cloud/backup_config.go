@@ -21,7 +21,9 @@ package cloud
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/webx-top/db"
 	"github.com/webx-top/echo"
@@ -30,6 +32,7 @@ import (
 	"github.com/webx-top/echo/param"
 
 	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
 	"github.com/coscms/webcore/library/backend"
 	"github.com/coscms/webcore/library/background"
 	"github.com/coscms/webcore/library/cloudbackup"
@@ -45,7 +48,13 @@ func BackupConfigList(ctx echo.Context) error {
 		if id < 1 {
 			data.SetError(ctx.NewError(code.InvalidParameter, ``).SetZone(`id`))
 		} else {
-			data.SetData(echo.H{`backuping`: fullBackupIsRunning(id)})
+			progress, ok := fullBackupProgress(id)
+			data.SetData(echo.H{
+				`backuping`: ok,
+				`progress`:  progress,
+				`percent`:   progress.Percent(),
+				`text`:      progress.Text(ctx),
+			})
 		}
 		return ctx.JSON(data)
 	}
@@ -56,9 +65,20 @@ func BackupConfigList(ctx echo.Context) error {
 		cond.AddKV(`name`, db.Like(`%`+q+`%`))
 	}
 	list, err := m.ListPage(cond, `-id`)
-	for _, row := range list {
+	ids := make([]uint, len(list))
+	fullBackups := map[uint]*FullBackupProgress{}
+	for i, row := range list {
 		row.Watching = cloudbackup.BackupTasks.Has(row.Id)
-		row.FullBackuping = fullBackupIsRunning(row.Id)
+		if progress, ok := fullBackupProgress(row.Id); ok {
+			fullBackups[row.Id] = &progress
+		}
+		ids[i] = row.Id
+	}
+	ctx.Set(`fullBackups`, fullBackups)
+	if err == nil {
+		var extras map[uint]*BackupExtra
+		extras, err = listBackupExtras(ids)
+		ctx.Set(`extras`, extras)
 	}
 	ctx.Set(`listData`, list)
 	return ctx.Render(`cloud/backup`, common.Err(ctx, err))
@@ -121,10 +141,20 @@ func BackupConfigAdd(ctx echo.Context) error {
 			goto END
 		}
 		m.StorageConfig = getStorageConfig(ctx, m.StorageEngine)
+		var extra *BackupExtra
+		extra, err = bindBackupExtra(ctx, 0)
+		if err != nil {
+			goto END
+		}
 		_, err = m.Add()
 		if err != nil {
 			goto END
 		}
+		extra.BackupId = m.Id
+		err = saveBackupExtra(extra)
+		if err != nil {
+			goto END
+		}
 		common.SendOk(ctx, ctx.T(`操作成功`))
 		return ctx.Redirect(backend.URLFor(`/cloud/backup`))
 	}
@@ -137,6 +167,11 @@ func BackupConfigAdd(ctx echo.Context) error {
 			})
 			setStorageConfigForm(ctx, m.StorageConfig)
 			ctx.Request().Form().Set(`id`, `0`)
+			var extra *BackupExtra
+			extra, err = getBackupExtra(id)
+			if err == nil {
+				setBackupExtraForm(ctx, extra)
+			}
 		}
 	}
 
@@ -145,6 +180,7 @@ END:
 	ctx.Set(`title`, ctx.T(`添加云备份配置`))
 	ctx.Set(`engines`, model.CloudBackupStorageEngines.Slice())
 	ctx.Set(`fileSources`, GetFileSources())
+	ctx.Set(`dumpSources`, GetDumpSources())
 	ctx.Set(`engineForms`, cloudbackup.Forms)
 	ctx.Set(`activeURL`, `/cloud/backup`)
 	return ctx.Render(`cloud/backup_edit`, err)
@@ -165,10 +201,28 @@ func BackupConfigEdit(ctx echo.Context) error {
 		}
 		m.StorageConfig = getStorageConfig(ctx, m.StorageEngine)
 		m.Id = id
+		var extra, oldExtra *BackupExtra
+		oldExtra, err = getBackupExtra(id)
+		if err != nil {
+			goto END
+		}
+		extra, err = bindBackupExtra(ctx, id)
+		if err != nil {
+			goto END
+		}
 		err = m.Edit(nil, db.Cond{`id`: id})
 		if err != nil {
 			goto END
 		}
+		err = saveBackupExtra(extra)
+		if err != nil {
+			goto END
+		}
+		if extra.storageFormatChanged(oldExtra) {
+			if rerr := resetBackupIndex(id); rerr != nil {
+				log.Errorf(`failed to resetBackupIndex(%v): %v`, id, rerr)
+			}
+		}
 		common.SendOk(ctx, ctx.T(`操作成功`))
 		return ctx.Redirect(backend.URLFor(`/cloud/backup`))
 	} else if ctx.IsAjax() {
@@ -198,6 +252,11 @@ func BackupConfigEdit(ctx echo.Context) error {
 			return echo.LowerCaseFirstLetter(topName, fieldName)
 		})
 		setStorageConfigForm(ctx, m.StorageConfig)
+		var extra *BackupExtra
+		extra, err = getBackupExtra(id)
+		if err == nil {
+			setBackupExtraForm(ctx, extra)
+		}
 	}
 
 END:
@@ -205,6 +264,7 @@ END:
 	ctx.Set(`title`, ctx.T(`修改云备份配置`))
 	ctx.Set(`engines`, model.CloudBackupStorageEngines.Slice())
 	ctx.Set(`fileSources`, GetFileSources())
+	ctx.Set(`dumpSources`, GetDumpSources())
 	ctx.Set(`engineForms`, cloudbackup.Forms)
 	ctx.Set(`activeURL`, `/cloud/backup`)
 	return ctx.Render(`cloud/backup_edit`, err)
@@ -219,6 +279,7 @@ func BackupConfigDelete(ctx echo.Context) error {
 			if rerr := cloudbackup.LevelDB().RemoveDB(m.Id); rerr != nil {
 				log.Errorf(`failed to cloudbackup.LevelDB().RemoveDB(%v): %v`, m.Id, rerr.Error())
 			}
+			err = deleteBackupExtra(id)
 		}
 	}
 	if err == nil {
@@ -238,16 +299,68 @@ func BackupRestore(ctx echo.Context) error {
 	if err != nil {
 		return err
 	}
-	if m.Disabled == common.BoolN {
-		return ctx.NewError(code.DataStatusIncorrect, `必须停用后才能进行还原操作`)
+	extra, err := getBackupExtra(id)
+	if err != nil {
+		return err
+	}
+	cfg := *m.NgingCloudBackup
+	asOf := time.Now()
+	if extra.IsVersioned() {
+		if t := ctx.Formx(`asOf`).String(); len(t) > 0 {
+			asOf, err = parseAsOf(t)
+			if err != nil {
+				return ctx.NewError(code.InvalidParameter, `时间格式不正确`).SetZone(`asOf`)
+			}
+		}
+	}
+	var secret string
+	if extra.IsEncrypted() {
+		secret = ctx.Formx(`encryptionSecret`).String()
+		if len(secret) > 0 {
+			if _, err = extra.Cipher(secret); err != nil {
+				return ctx.NewError(code.InvalidParameter, `密钥不正确，无法解密备份文件`).SetZone(`encryptionSecret`)
+			}
+		}
+	}
+	if ctx.Form(`op`) == `browse` {
+		return backupRestoreBrowse(ctx, cfg, extra, secret, asOf)
 	}
 	if ctx.IsPost() {
-		cfg := *m.NgingCloudBackup
-		localSavePath := ctx.Formx(`localSavePath`).String()
-		if len(localSavePath) == 0 {
-			err = ctx.NewError(code.InvalidParameter, `请指定本机保存路径`)
+		var target restoreTarget
+		switch ctx.Formx(`target`, `local`).String() {
+		case `storage`:
+			storageID := ctx.Formx(`destStorage`).Uint()
+			if storageID == 0 {
+				return ctx.NewError(code.InvalidParameter, `请选择云存储账号`).SetZone(`destStorage`)
+			}
+			target, err = newStorageRestoreTarget(ctx, storageID, ctx.Formx(`destStoragePath`).String())
+		default:
+			localSavePath := ctx.Formx(`localSavePath`).String()
+			if len(localSavePath) == 0 {
+				return ctx.NewError(code.InvalidParameter, `请指定本机保存路径`).SetZone(`localSavePath`)
+			}
+			target, err = newLocalRestoreTarget(localSavePath)
+		}
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		mgr, err := newStorage(ctx, cfg, extra, secret)
+		if err != nil {
 			return err
 		}
+		entries, err := loadRestoreEntries(ctx, cfg, extra, mgr, asOf)
+		if err != nil {
+			return err
+		}
+		selected := ctx.FormValues(`paths`)
+		entries = selectRestoreEntries(entries, selected)
+		_, toLocal := target.(*localRestoreTarget)
+		// 没有索引并且不支持列出对象时只能还原目标路径下的所有文件
+		restoreAll := len(entries) == 0 && len(selected) == 0 && toLocal
+		if len(entries) == 0 && !restoreAll {
+			return ctx.NewError(code.DataNotFound, `没有可还原的文件`)
+		}
 		actionIdent := `cloudbackup`
 		bgKey := `restore.` + param.AsString(cfg.Id)
 		bg := background.New(context.Background(), nil)
@@ -259,10 +372,32 @@ func BackupRestore(ctx echo.Context) error {
 		user := backend.User(ctx)
 		noticer := notice.NewP(ctx, actionIdent, user.Username, bg.Context()).AutoComplete(true)
 		defer group.Cancel(bgKey)
-		cfg.SourcePath = localSavePath
-		err = cloudbackup.Restore(ctx, cfg, func(from, to string) {
+		var restored []string
+		callback := func(from, to string) {
 			noticer.Send(from+` => `+to, notice.StateSuccess)
-		}, noticer)
+		}
+		if restoreAll {
+			defer func() {
+				endRestoring(restored...)
+			}()
+			cfg.SourcePath = target.(*localRestoreTarget).root
+			callback = func(from, to string) {
+				beginRestoring(to)
+				restored = append(restored, to)
+				noticer.Send(from+` => `+to, notice.StateSuccess)
+			}
+			if extra.IsVersioned() {
+				err = restoreVersionsAsOf(ctx, cfg, extra, secret, asOf, callback, noticer)
+			} else {
+				err = restoreBackup(ctx, cfg, extra, secret, callback, noticer)
+			}
+		} else if err = mgr.Connect(); err == nil {
+			err = restoreEntries(bg.Context(), mgr, entries, target, callback, noticer)
+			mgr.Close()
+		}
+		if errors.Is(err, ErrWrongEncryptionKey) {
+			err = ctx.NewError(code.InvalidParameter, `密钥不正确，无法解密备份文件`).SetZone(`encryptionSecret`)
+		}
 		if err != nil {
 			noticer.Send(err.Error(), notice.StateFailure)
 			common.SendErr(ctx, err)
@@ -274,8 +409,104 @@ func BackupRestore(ctx echo.Context) error {
 		return ctx.Redirect(backend.URLFor(`/cloud/backup`))
 	}
 
+	if extra.IsVersioned() {
+		var stats *VersionStats
+		stats, err = backupVersionStats(m.Id)
+		ctx.Set(`versionStats`, stats)
+	}
+	storages := model.NewCloudStorage(ctx)
+	if _, serr := storages.ListByOffset(nil, nil, 0, -1); serr != nil && err == nil {
+		err = serr
+	}
+	ctx.Set(`storageAccounts`, storages.Objects())
 	ctx.Set(`title`, ctx.T(`还原备份文件`))
 	ctx.Set(`data`, m.NgingCloudBackup)
+	ctx.Set(`extra`, extra)
 	ctx.Set(`activeURL`, `/cloud/backup`)
 	return ctx.Render(`cloud/backup_restore`, err)
 }
+
+// backupRestoreBrowse 浏览可还原的文件
+func backupRestoreBrowse(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, secret string, asOf time.Time) error {
+	data := ctx.Data()
+	mgr, err := newStorage(ctx, cfg, extra, secret)
+	if err != nil {
+		return ctx.JSON(data.SetError(err))
+	}
+	entries, err := loadRestoreEntries(ctx, cfg, extra, mgr, asOf)
+	if err != nil {
+		return ctx.JSON(data.SetError(err))
+	}
+	dir := restoreRelPath(ctx.Form(`dir`))
+	data.SetData(echo.H{
+		`dir`:   dir,
+		`total`: len(entries),
+		`nodes`: browseRestoreEntries(entries, dir),
+	})
+	return ctx.JSON(data)
+}
+
+// BackupImport 从云存储中的目录快照导入备份配置和索引
+func BackupImport(ctx echo.Context) error {
+	var err error
+	if ctx.IsPost() {
+		cfg := dbschema.NgingCloudBackup{
+			Name:          ctx.Formx(`name`).String(),
+			StorageEngine: ctx.Formx(`storageEngine`).String(),
+			DestStorage:   ctx.Formx(`destStorage`).Uint(),
+			DestPath:      ctx.Formx(`destPath`).String(),
+		}
+		cfg.StorageConfig = getStorageConfig(ctx, cfg.StorageEngine)
+		if !model.CloudBackupStorageEngines.Has(cfg.StorageEngine) {
+			err = ctx.NewError(code.InvalidParameter, `存储引擎无效`).SetZone(`storageEngine`)
+		} else if len(cfg.DestPath) == 0 {
+			err = ctx.NewError(code.InvalidParameter, `请输入目标路径`).SetZone(`destPath`)
+		}
+		if ctx.Form(`op`) == `catalogs` {
+			data := ctx.Data()
+			if err != nil {
+				return ctx.JSON(data.SetError(err))
+			}
+			var meta *CatalogMeta
+			meta, err = listCatalogs(ctx, cfg)
+			if err != nil {
+				if errors.Is(err, ErrCatalogNotFound) {
+					err = ctx.NewError(code.DataNotFound, `目标路径中没有目录快照`)
+				}
+				return ctx.JSON(data.SetError(err))
+			}
+			history := make([]string, len(meta.History))
+			for i, id := range meta.History {
+				history[len(history)-1-i] = id
+			}
+			data.SetData(echo.H{
+				`latest`: echo.H{
+					`id`:         meta.ID,
+					`name`:       meta.Config.Name,
+					`sourcePath`: meta.Config.SourcePath,
+					`created`:    meta.Created.Unix(),
+					`records`:    meta.Records,
+					`encryption`: meta.Extra.Encryption,
+				},
+				`history`: history,
+			})
+			return ctx.JSON(data)
+		}
+		if err == nil {
+			var m *model.CloudBackup
+			m, err = importCatalog(ctx, cfg, ctx.Formx(`encryptionSecret`).String(), ctx.Formx(`catalog`).String())
+			if errors.Is(err, ErrCatalogNotFound) {
+				err = ctx.NewError(code.DataNotFound, `目标路径中没有目录快照`)
+			}
+			if err == nil {
+				common.SendOk(ctx, ctx.T(`导入成功。配置“%s”已停用，请检查源路径后再启用`, m.Name))
+				return ctx.Redirect(backend.URLFor(`/cloud/backup`))
+			}
+		}
+	}
+	ctx.Set(`title`, ctx.T(`从云存储导入备份配置`))
+	ctx.Set(`engines`, model.CloudBackupStorageEngines.Slice())
+	ctx.Set(`engineForms`, cloudbackup.Forms)
+	ctx.Set(`activeURL`, `/cloud/backup`)
+	return ctx.Render(`cloud/backup_import`, err)
+}
@@ -0,0 +1,363 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrWrongEncryptionKey 密钥不正确
+	ErrWrongEncryptionKey = errors.New(`decryption failed: the encryption key is wrong`)
+	// ErrNotEncrypted 文件不是加密格式
+	ErrNotEncrypted = errors.New(`decryption failed: the file is not encrypted by cloud backup`)
+	// ErrCorruptedCiphertext 加密文件已损坏
+	ErrCorruptedCiphertext = errors.New(`decryption failed: the encrypted file is corrupted`)
+	// ErrTruncatedCiphertext 加密文件不完整
+	ErrTruncatedCiphertext = errors.New(`decryption failed: the encrypted file is truncated`)
+)
+
+const (
+	encryptMagic         = "NGCBENC1"
+	encryptKeyIDSize     = 8
+	encryptNoncePrefix   = 7
+	encryptHeaderSize    = len(encryptMagic) + encryptKeyIDSize + encryptNoncePrefix
+	encryptChunkSize     = 64 * 1024
+	encryptTagSize       = 16
+	encryptKeySize       = 32
+	encryptSaltSize      = 16
+	encryptPBKDF2Iter    = 210000
+	encryptNameSeparator = `/`
+)
+
+// deriveBackupKey 从口令派生主密钥
+func deriveBackupKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, encryptPBKDF2Iter, encryptKeySize)
+}
+
+// parseBackupKey 解析十六进制格式的主密钥
+func parseBackupKey(key string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(b) != encryptKeySize {
+		return nil, errors.New(`the encryption key must be 64 hexadecimal characters`)
+	}
+	return b, nil
+}
+
+func generateBackupKey() string {
+	return hex.EncodeToString(randomBytes(encryptKeySize))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// backupCipher 云备份客户端加密(AES-256-GCM)
+type backupCipher struct {
+	content  cipher.AEAD
+	name     cipher.AEAD
+	nameMAC  []byte
+	chunkMAC []byte
+	keyID    []byte
+}
+
+func newBackupCipher(master []byte) (*backupCipher, error) {
+	c := &backupCipher{}
+	var err error
+	if c.content, err = newGCM(master, `content`); err != nil {
+		return nil, err
+	}
+	if c.name, err = newGCM(master, `name`); err != nil {
+		return nil, err
+	}
+	if c.nameMAC, err = hkdf.Key(sha256.New, master, nil, `name-iv`, encryptKeySize); err != nil {
+		return nil, err
+	}
+	if c.chunkMAC, err = hkdf.Key(sha256.New, master, nil, `chunk-id`, encryptKeySize); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(`key-id`))
+	c.keyID = mac.Sum(nil)[:encryptKeyIDSize]
+	return c, nil
+}
+
+func newGCM(master []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, master, nil, info, encryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyID 密钥标识(十六进制)，用于在解密前识别密钥是否正确
+func (c *backupCipher) KeyID() string {
+	return hex.EncodeToString(c.keyID)
+}
+
+// EncryptedSize 明文大小为 size 的文件加密后的大小
+func (c *backupCipher) EncryptedSize(size int64) int64 {
+	chunks := (size + encryptChunkSize - 1) / encryptChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptHeaderSize) + size + chunks*encryptTagSize
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptNoncePrefix:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptReader 返回读取 r 的加密内容的 Reader。
+// 内容按 64KiB 分块加密，每块的 nonce 包含序号和结尾标记，可以识别被截断或重排的文件
+func (c *backupCipher) EncryptReader(r io.Reader) io.Reader {
+	prefix := randomBytes(encryptNoncePrefix)
+	header := make([]byte, 0, encryptHeaderSize)
+	header = append(header, encryptMagic...)
+	header = append(header, c.keyID...)
+	header = append(header, prefix...)
+	return &encryptReader{
+		aead:   c.content,
+		src:    bufio.NewReaderSize(r, encryptChunkSize+1),
+		prefix: prefix,
+		buf:    header,
+		chunk:  make([]byte, encryptChunkSize),
+	}
+}
+
+type encryptReader struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	chunk   []byte
+	done    bool
+	err     error
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		e.fill()
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *encryptReader) fill() {
+	n, err := io.ReadFull(e.src, e.chunk)
+	last := false
+	switch err {
+	case nil:
+		if _, perr := e.src.Peek(1); perr == io.EOF {
+			last = true
+		} else if perr != nil {
+			e.err = perr
+			return
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		e.err = err
+		return
+	}
+	e.buf = e.aead.Seal(e.buf[:0], chunkNonce(e.prefix, e.counter, last), e.chunk[:n], nil)
+	e.counter++
+	e.done = last
+}
+
+// DecryptWriter 返回将解密后的内容写入 w 的 Writer，必须调用 Close 来校验最后一块数据
+func (c *backupCipher) DecryptWriter(w io.Writer) io.WriteCloser {
+	return &decryptWriter{aead: c.content, keyID: c.keyID, dst: w}
+}
+
+type decryptWriter struct {
+	aead    cipher.AEAD
+	keyID   []byte
+	dst     io.Writer
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	err     error
+	closed  bool
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+	d.buf = append(d.buf, p...)
+	if d.prefix == nil {
+		if len(d.buf) < encryptHeaderSize {
+			return len(p), nil
+		}
+		if d.err = d.parseHeader(); d.err != nil {
+			return 0, d.err
+		}
+	}
+	const sealed = encryptChunkSize + encryptTagSize
+	for len(d.buf) > sealed { // 后面还有数据，所以当前块不是最后一块
+		if d.err = d.open(d.buf[:sealed], false); d.err != nil {
+			return 0, d.err
+		}
+		d.buf = d.buf[sealed:]
+	}
+	return len(p), nil
+}
+
+func (d *decryptWriter) parseHeader() error {
+	if string(d.buf[:len(encryptMagic)]) != encryptMagic {
+		return ErrNotEncrypted
+	}
+	keyID := d.buf[len(encryptMagic) : len(encryptMagic)+encryptKeyIDSize]
+	if !hmac.Equal(keyID, d.keyID) {
+		return ErrWrongEncryptionKey
+	}
+	d.prefix = append([]byte{}, d.buf[len(encryptMagic)+encryptKeyIDSize:encryptHeaderSize]...)
+	d.buf = d.buf[encryptHeaderSize:]
+	return nil
+}
+
+func (d *decryptWriter) open(chunk []byte, last bool) error {
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.counter, last), chunk, nil)
+	if err != nil { // 文件头中的密钥标识已经匹配，所以这里不会是密钥错误
+		return ErrCorruptedCiphertext
+	}
+	d.counter++
+	_, err = d.dst.Write(plain)
+	return err
+}
+
+func (d *decryptWriter) Close() error {
+	if d.err != nil || d.closed {
+		return d.err
+	}
+	d.closed = true
+	if d.prefix == nil {
+		if len(d.buf) < encryptHeaderSize {
+			return ErrTruncatedCiphertext
+		}
+		if d.err = d.parseHeader(); d.err != nil {
+			return d.err
+		}
+	}
+	if len(d.buf) < encryptTagSize {
+		return ErrTruncatedCiphertext
+	}
+	d.err = d.open(d.buf, true)
+	if d.err == ErrCorruptedCiphertext && len(d.buf) == encryptChunkSize+encryptTagSize {
+		d.err = ErrTruncatedCiphertext // 在块的边界处被截断
+	}
+	d.buf = nil
+	return d.err
+}
+
+// ChunkID 数据块的名称。使用带密钥的哈希，避免从名称推断出数据块的内容
+func (c *backupCipher) ChunkID(data []byte) string {
+	mac := hmac.New(sha256.New, c.chunkMAC)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// EncryptName 加密文件名(确定性加密，同一文件名总是得到相同的结果)
+func (c *backupCipher) EncryptName(name string) string {
+	mac := hmac.New(sha256.New, c.nameMAC)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:c.name.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(c.name.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// DecryptName 解密文件名
+func (c *backupCipher) DecryptName(name string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	nonceSize := c.name.NonceSize()
+	if err != nil || len(b) < nonceSize+c.name.Overhead() {
+		return ``, ErrWrongEncryptionKey
+	}
+	plain, err := c.name.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+	if err != nil {
+		return ``, ErrWrongEncryptionKey
+	}
+	return string(plain), nil
+}
+
+// EncryptPath 依次加密路径中的每一级名称
+func (c *backupCipher) EncryptPath(ppath string) string {
+	parts := strings.Split(ppath, encryptNameSeparator)
+	for i, part := range parts {
+		if len(part) > 0 {
+			parts[i] = c.EncryptName(part)
+		}
+	}
+	return strings.Join(parts, encryptNameSeparator)
+}
+
+// DecryptPath 依次解密路径中的每一级名称
+func (c *backupCipher) DecryptPath(ppath string) (string, error) {
+	parts := strings.Split(ppath, encryptNameSeparator)
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		name, err := c.DecryptName(part)
+		if err != nil {
+			return ``, err
+		}
+		parts[i] = name
+	}
+	return path.Clean(strings.Join(parts, encryptNameSeparator)), nil
+}
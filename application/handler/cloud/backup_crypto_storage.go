@@ -0,0 +1,226 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo"
+)
+
+// newStorage 创建云存储客户端，启用了客户端加密时对上传和下载的文件进行加解密，
+// 启用了分块去重时按文件清单和数据块进行存储。
+// secret 用于临时指定口令或密钥(比如在另一台服务器上还原)，为空时使用保存的配置
+func newStorage(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, secret ...string) (cloudbackup.Storager, error) {
+	mgr, err := cloudbackup.NewStorage(ctx, cfg)
+	if err != nil || extra == nil {
+		return mgr, err
+	}
+	var chunkID func([]byte) string
+	if extra.IsEncrypted() {
+		c, err := extra.Cipher(secret...)
+		if err != nil {
+			return nil, err
+		}
+		mgr = newEncryptedStorage(mgr, c, cfg.DestPath, extra.IsEncryptName())
+		chunkID = c.ChunkID
+	}
+	if extra.IsChunked() {
+		db, err := cloudbackup.LevelDB().OpenDB(cfg.Id)
+		if err != nil {
+			return nil, err
+		}
+		mgr = newChunkedStorage(mgr, db, cfg.DestPath, chunkID)
+	}
+	return mgr, nil
+}
+
+func newEncryptedStorage(mgr cloudbackup.Storager, c *backupCipher, destPath string, encryptName bool) *encryptedStorage {
+	return &encryptedStorage{Storager: mgr, cipher: c, destPath: destPath, encryptName: encryptName}
+}
+
+// encryptedStorage 客户端加密存储。文件内容总是加密，目标路径之下的文件名可选加密
+type encryptedStorage struct {
+	cloudbackup.Storager
+	cipher      *backupCipher
+	destPath    string
+	encryptName bool
+}
+
+// relPath 获取 ppath 相对于目标路径的路径
+func (s *encryptedStorage) relPath(ppath string) (string, bool) {
+	p := path.Clean(ppath)
+	d := path.Clean(s.destPath)
+	switch {
+	case p == d:
+		return ``, true
+	case d == `.`:
+		return p, !strings.HasPrefix(p, `/`)
+	case d == `/`:
+		return strings.TrimPrefix(p, `/`), strings.HasPrefix(p, `/`)
+	case strings.HasPrefix(p, d+`/`):
+		return p[len(d)+1:], true
+	}
+	return ``, false
+}
+
+// objectName 获取云存储中实际的对象名称
+func (s *encryptedStorage) objectName(ppath string) string {
+	if !s.encryptName {
+		return ppath
+	}
+	rel, ok := s.relPath(ppath)
+	if !ok || len(rel) == 0 {
+		return ppath
+	}
+	return path.Join(s.destPath, s.cipher.EncryptPath(rel))
+}
+
+func (s *encryptedStorage) remoteObjects(ppath string, size int64) []remoteObject {
+	if size >= 0 {
+		size = s.cipher.EncryptedSize(size)
+	}
+	return mapRemoteObjects(s.Storager, s.objectName(ppath), size)
+}
+
+func (s *encryptedStorage) Put(ctx context.Context, reader io.Reader, ppath string, size int64) error {
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+	}
+	return s.Storager.Put(ctx, s.cipher.EncryptReader(reader), s.objectName(ppath), s.cipher.EncryptedSize(size))
+}
+
+func (s *encryptedStorage) Download(ctx context.Context, ppath string, w io.Writer) error {
+	dw := s.cipher.DecryptWriter(w)
+	if err := s.Storager.Download(ctx, s.objectName(ppath), dw); err != nil {
+		return err
+	}
+	return dw.Close()
+}
+
+func (s *encryptedStorage) RemoveDir(ctx context.Context, ppath string) error {
+	return s.Storager.RemoveDir(ctx, s.objectName(ppath))
+}
+
+func (s *encryptedStorage) Remove(ctx context.Context, ppath string) error {
+	return s.Storager.Remove(ctx, s.objectName(ppath))
+}
+
+func (s *encryptedStorage) SetProgressor(prog notice.Progressor) {
+	if st, ok := s.Storager.(cloudbackup.ProgressorSetter); ok {
+		st.SetProgressor(prog)
+	}
+}
+
+// Restore 先将加密文件下载到 destpath 下的临时目录，再逐个解密到 destpath
+func (s *encryptedStorage) Restore(ctx context.Context, ppath string, destpath string, callback func(from, to string)) error {
+	if err := com.MkdirAll(destpath, os.ModePerm); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(destpath, `.restore-`)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err = s.Storager.Restore(ctx, s.objectName(ppath), staging, nil); err != nil {
+		return err
+	}
+	return filepath.Walk(staging, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(staging, fpath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.encryptName {
+			rel, err = s.cipher.DecryptPath(rel)
+			if err != nil {
+				return fmt.Errorf(`%s: %w`, fpath, err)
+			}
+			if rel == `..` || strings.HasPrefix(rel, `../`) || path.IsAbs(rel) {
+				return fmt.Errorf(`%s: invalid file name %q`, fpath, rel)
+			}
+		}
+		dest := filepath.Join(destpath, filepath.FromSlash(rel))
+		if callback != nil {
+			callback(path.Join(ppath, rel), dest)
+		}
+		if err = s.decryptFile(fpath, dest); err != nil {
+			return fmt.Errorf(`%s: %w`, path.Join(ppath, rel), err)
+		}
+		return nil
+	})
+}
+
+func (s *encryptedStorage) decryptFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = com.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	dw := s.cipher.DecryptWriter(out)
+	_, err = io.Copy(dw, in)
+	if err == nil {
+		err = dw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// restoreBackup 从云存储还原文件到 cfg.SourcePath
+func restoreBackup(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, secret string, callback func(from, to string), prog notice.Progressor) error {
+	mgr, err := newStorage(ctx, cfg, extra, secret)
+	if err != nil {
+		return err
+	}
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	defer mgr.Close()
+	if prog != nil {
+		if st, ok := mgr.(cloudbackup.ProgressorSetter); ok {
+			st.SetProgressor(prog)
+		}
+	}
+	return mgr.Restore(ctx, cfg.DestPath, cfg.SourcePath, callback)
+}
@@ -0,0 +1,189 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCipher(t *testing.T, key string) *backupCipher {
+	master, err := parseBackupKey(key)
+	require.NoError(t, err)
+	c, err := newBackupCipher(master)
+	require.NoError(t, err)
+	return c
+}
+
+const (
+	testKey1 = `000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f`
+	testKey2 = `1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100`
+)
+
+func TestBackupCipherContent(t *testing.T) {
+	c := testCipher(t, testKey1)
+	for _, size := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 3*encryptChunkSize + 7} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+		encrypted, err := io.ReadAll(c.EncryptReader(bytes.NewReader(plain)))
+		require.NoError(t, err)
+		assert.Equal(t, c.EncryptedSize(int64(size)), int64(len(encrypted)), `size: %d`, size)
+
+		out := &bytes.Buffer{}
+		w := c.DecryptWriter(out)
+		for _, part := range [][]byte{encrypted[:len(encrypted)/3], encrypted[len(encrypted)/3:]} {
+			_, err = w.Write(part)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		assert.Equal(t, string(plain), out.String(), `size: %d`, size)
+	}
+}
+
+func TestBackupCipherErrors(t *testing.T) {
+	c := testCipher(t, testKey1)
+	plain := bytes.Repeat([]byte{'y'}, 2*encryptChunkSize)
+	encrypted, err := io.ReadAll(c.EncryptReader(bytes.NewReader(plain)))
+	require.NoError(t, err)
+
+	decrypt := func(c *backupCipher, data []byte) error {
+		w := c.DecryptWriter(io.Discard)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	assert.ErrorIs(t, decrypt(testCipher(t, testKey2), encrypted), ErrWrongEncryptionKey)
+	assert.ErrorIs(t, decrypt(c, plain), ErrNotEncrypted)
+	assert.ErrorIs(t, decrypt(c, encrypted[:encryptHeaderSize+encryptChunkSize+encryptTagSize]), ErrTruncatedCiphertext)
+	assert.ErrorIs(t, decrypt(c, encrypted[:10]), ErrTruncatedCiphertext)
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[encryptHeaderSize+5] ^= 1
+	assert.ErrorIs(t, decrypt(c, tampered), ErrCorruptedCiphertext)
+}
+
+func TestBackupCipherName(t *testing.T) {
+	c := testCipher(t, testKey1)
+	name := c.EncryptName(`report.txt@20260301T000000.000000000Z`)
+	assert.Equal(t, name, c.EncryptName(`report.txt@20260301T000000.000000000Z`))
+	assert.NotContains(t, name, `report`)
+	plain, err := c.DecryptName(name)
+	require.NoError(t, err)
+	assert.Equal(t, `report.txt@20260301T000000.000000000Z`, plain)
+
+	_, err = testCipher(t, testKey2).DecryptName(name)
+	assert.ErrorIs(t, err, ErrWrongEncryptionKey)
+
+	encrypted := c.EncryptPath(`a/b/c.txt`)
+	assert.Equal(t, 3, len(strings.Split(encrypted, `/`)))
+	plain, err = c.DecryptPath(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, `a/b/c.txt`, plain)
+}
+
+// memStorage 用于测试的内存存储
+type memStorage struct {
+	files map[string][]byte
+}
+
+func (s *memStorage) Connect() error { return nil }
+func (s *memStorage) Close() error   { return nil }
+
+func (s *memStorage) Put(ctx context.Context, reader io.Reader, ppath string, size int64) error {
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return io.ErrShortWrite
+	}
+	s.files[ppath] = b
+	return nil
+}
+
+func (s *memStorage) Download(ctx context.Context, ppath string, w io.Writer) error {
+	b, ok := s.files[ppath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (s *memStorage) RemoveDir(ctx context.Context, ppath string) error {
+	for name := range s.files {
+		if strings.HasPrefix(name, ppath+`/`) {
+			delete(s.files, name)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Remove(ctx context.Context, ppath string) error {
+	delete(s.files, ppath)
+	return nil
+}
+
+func (s *memStorage) Restore(ctx context.Context, ppath string, destpath string, callback func(from, to string)) error {
+	for name, b := range s.files {
+		if !strings.HasPrefix(name, ppath+`/`) {
+			continue
+		}
+		dest := filepath.Join(destpath, filepath.FromSlash(strings.TrimPrefix(name, ppath+`/`)))
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dest, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	mem := &memStorage{files: map[string][]byte{}}
+	s := newEncryptedStorage(mem, testCipher(t, testKey1), `/backup`, true)
+
+	files := map[string]string{`/backup/a.txt`: `hello`, `/backup/dir/b.txt`: `world`}
+	for name, content := range files {
+		require.NoError(t, s.Put(ctx, strings.NewReader(content+`(grown)`), name, int64(len(content))))
+	}
+	for name := range mem.files {
+		assert.True(t, strings.HasPrefix(name, `/backup/`))
+		assert.NotContains(t, name, `.txt`)
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, s.Download(ctx, `/backup/dir/b.txt`, buf))
+	assert.Equal(t, `world`, buf.String())
+
+	dest := t.TempDir()
+	var restored []string
+	err := s.Restore(ctx, `/backup`, dest, func(from, to string) {
+		restored = append(restored, from)
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{`/backup/a.txt`, `/backup/dir/b.txt`}, restored)
+	for name, content := range files {
+		b, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(name, `/backup/`))))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+	entries, err := os.ReadDir(dest)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2) // 临时目录已删除
+
+	require.NoError(t, s.Remove(ctx, `/backup/a.txt`))
+	assert.Len(t, mem.files, 1)
+
+	wrong := newEncryptedStorage(mem, testCipher(t, testKey2), `/backup`, false)
+	for name := range mem.files {
+		assert.ErrorIs(t, wrong.Download(ctx, name, io.Discard), ErrWrongEncryptionKey)
+	}
+}
@@ -0,0 +1,338 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/config"
+	"github.com/coscms/webcore/library/cron"
+	"github.com/coscms/webcore/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/com"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/param"
+)
+
+// ErrDumpSourceUnavailable 数据库导出源不可用(例如本程序没有使用该类型的数据库)
+var ErrDumpSourceUnavailable = errors.New(`the database dump source is unavailable`)
+
+const dumpJobName = `cloudBackupDump`
+
+var dumpSources = map[string]*DumpSource{}
+
+// DumpFunc 将数据库 target 导出为 SQL 语句写入 w，filter 返回 false 的数据表不导出。
+// 导出过程中应使用同一个快照以保证数据的一致性
+type DumpFunc func(ctx context.Context, target string, filter func(table string) bool, w io.Writer) error
+
+// DumpSource 数据库导出源。备份源路径为“<名称>:<数据库>”时，每次备份导出整个数据库并上传
+type DumpSource struct {
+	Name        string
+	Description string
+	dump        DumpFunc
+}
+
+func RegisterDumpSource(name string, description string, dump DumpFunc) {
+	dumpSources[name] = &DumpSource{Name: name, Description: description, dump: dump}
+}
+
+func GetDumpSources() []DumpSource {
+	names := make([]string, 0, len(dumpSources))
+	for name := range dumpSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]DumpSource, 0, len(names))
+	for _, name := range names {
+		r := *dumpSources[name]
+		r.Name = name + `:`
+		results = append(results, r)
+	}
+	return results
+}
+
+func GetDumpSource(name string) *DumpSource {
+	return dumpSources[name]
+}
+
+// backupDumpSource 备份源为数据库导出源时返回导出源和数据库，否则返回 nil
+func backupDumpSource(cfg dbschema.NgingCloudBackup) (*DumpSource, string) {
+	parts := strings.SplitN(cfg.SourcePath, `:`, 2)
+	if len(parts) != 2 {
+		return nil, ``
+	}
+	return GetDumpSource(parts[0]), parts[1]
+}
+
+// dumpFileName 导出文件的名称
+func dumpFileName(cfg dbschema.NgingCloudBackup) string {
+	_, target := backupDumpSource(cfg)
+	if len(target) == 0 { // 本程序配置的数据库
+		target = config.FromFile().DB.Database
+	}
+	name := strings.TrimSuffix(filepath.Base(target), filepath.Ext(target))
+	if len(name) == 0 || name == `.` || name == `/` || name == `\` {
+		name = `database`
+	}
+	return name + `.sql.gz`
+}
+
+// tableFilter 用备份配置中的“匹配规则”和“忽略路径”筛选数据表，与文件一样“匹配规则”优先
+func tableFilter(cfg *dbschema.NgingCloudBackup) (func(table string) bool, error) {
+	var (
+		ignoreRE *regexp.Regexp
+		matchRE  *regexp.Regexp
+		err      error
+	)
+	if len(cfg.IgnoreRule) > 0 {
+		ignoreRE, err = regexp.Compile(cfg.IgnoreRule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.MatchRule) > 0 {
+		matchRE, err = regexp.Compile(cfg.MatchRule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(table string) bool {
+		if matchRE != nil {
+			return matchRE.MatchString(table)
+		}
+		if ignoreRE != nil {
+			return !ignoreRE.MatchString(table)
+		}
+		return true
+	}, nil
+}
+
+// dumpBackupStart 导出数据库并上传。与全量备份共用进度、暂停和取消
+func dumpBackupStart(cfg dbschema.NgingCloudBackup, extra *BackupExtra, username string, msgType string) error {
+	task, mgr, db, err := prepareDumpBackup(cfg, extra)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer func() {
+			mgr.Close()
+			task.finish()
+		}()
+		err := dumpBackup(task, cfg, extra, mgr, db)
+		if err == nil {
+			saveCatalogAfterBackup(cfg, extra)
+		}
+		reportFullBackupResult(cfg, username, msgType, task, err)
+	}()
+	return nil
+}
+
+func prepareDumpBackup(cfg dbschema.NgingCloudBackup, extra *BackupExtra) (*fullBackupTask, cloudbackup.Storager, *leveldb.DB, error) {
+	task, err := startFullBackupTask(cfg.Id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx := defaults.NewMockContext()
+	mgr, err := newStorage(ctx, cfg, extra)
+	if err != nil {
+		task.finish()
+		return nil, nil, nil, err
+	}
+	db, err := cloudbackup.LevelDB().OpenDB(cfg.Id)
+	if err != nil {
+		task.finish()
+		return nil, nil, nil, err
+	}
+	if err = mgr.Connect(); err != nil {
+		task.finish()
+		return nil, nil, nil, err
+	}
+	return task, mgr, db, nil
+}
+
+// dumpBackup 导出数据库到临时文件(gzip 压缩)后上传。导出内容与上次相同时跳过上传
+func dumpBackup(task *fullBackupTask, cfg dbschema.NgingCloudBackup, extra *BackupExtra, mgr cloudbackup.Storager, db *leveldb.DB) (err error) {
+	source, target := backupDumpSource(cfg)
+	if source == nil {
+		return ErrDumpSourceUnavailable
+	}
+	if extra == nil {
+		extra = &BackupExtra{BackupId: cfg.Id}
+		extra.setDefaults()
+	}
+	filter, err := tableFilter(&cfg)
+	if err != nil {
+		return err
+	}
+	fp, err := os.CreateTemp(``, `nging-dump-*.sql.gz`)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		fp.Close()
+		os.Remove(fp.Name())
+	}()
+	startTime := time.Now()
+	hash := md5.New()
+	gw := gzip.NewWriter(io.MultiWriter(fp, hash))
+	if err = source.dump(task.ctx, target, filter, gw); err != nil {
+		return fmt.Errorf(`failed to dump %s: %w`, cfg.SourcePath, err)
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	task.addTotal(info.Size())
+	defer task.addScanned(info.Size())
+	md5 := hex.EncodeToString(hash.Sum(nil))
+	fileName := dumpFileName(cfg)
+	ppath := cfg.SourcePath + `/` + fileName
+	dbKey := com.Str2bytes(ppath)
+	operation := model.CloudBackupOperationCreate
+	if cv, gerr := db.Get(dbKey, nil); gerr == nil {
+		oldMd5, _, _, _, _ := cloudbackup.ParseDBValue(cv)
+		if oldMd5 == md5 {
+			log.Infof(`[cloudbackup] %s: 数据库没有改变【跳过】`, cfg.SourcePath)
+			return nil
+		}
+		operation = model.CloudBackupOperationUpdate
+	} else if gerr != leveldb.ErrNotFound {
+		return gerr
+	}
+	task.setStatus(FullBackupStatusRunning)
+	var objectName string
+	if extra.IsVersioned() {
+		objectName = versionObjectName(cfg.DestPath, `/`+fileName, newVersionID(startTime))
+	} else {
+		objectName = path.Join(cfg.DestPath, fileName)
+	}
+	defer func() {
+		cloudbackup.RecordLog(nil, err, &cfg, ppath, objectName, operation, startTime, uint64(info.Size()), model.CloudBackupTypeFull)
+	}()
+	throttle := newUploadThrottle(extra)
+	if err = cloudbackup.RetryablePut(task.ctx, mgr, throttle.Reader(task.ctx, fp), objectName, info.Size()); err != nil {
+		return err
+	}
+	task.addUploaded(info.Size())
+	if err = db.Put(dbKey, backupDBValue(md5, info), nil); err != nil {
+		return err
+	}
+	if !extra.IsVersioned() {
+		return nil
+	}
+	err = addVersion(db, ppath, &BackupVersion{
+		Path:    `/` + fileName,
+		Object:  objectName,
+		MD5:     md5,
+		Size:    info.Size(),
+		ModTime: info.ModTime().Unix(),
+		Created: startTime,
+	})
+	if err != nil {
+		return err
+	}
+	if err = pruneVersions(task.ctx, db, mgr, ppath, extra.Retention()); err != nil {
+		return err
+	}
+	return sweepUnusedChunks(task.ctx, cfg, mgr)
+}
+
+// DumpJob 导出数据库并上传到云存储的系统任务，参数为备份配置ID(备份源须为数据库导出源)
+var DumpJob = &cron.Jobx{
+	Name:         dumpJobName,
+	Example:      `>` + dumpJobName + `:1`,
+	Description:  `导出数据库并备份到云存储`,
+	RunnerGetter: dumpRunnerGetter,
+}
+
+func dumpRunnerGetter(id string) cron.Runner {
+	return func(_ time.Duration) (string, string, error, bool) {
+		out, err := runDumpJob(param.AsUint(id))
+		if err != nil {
+			return out, err.Error(), err, false
+		}
+		return out, ``, nil, false
+	}
+}
+
+// runDumpJob 同步执行指定备份配置的数据库导出备份
+func runDumpJob(id uint) (string, error) {
+	ctx := defaults.NewMockContext()
+	m := model.NewCloudBackup(ctx)
+	if err := m.Get(nil, db.Cond{`id`: id}); err != nil {
+		return ``, fmt.Errorf(`cloud backup %d: %w`, id, err)
+	}
+	cfg := *m.NgingCloudBackup
+	if source, _ := backupDumpSource(cfg); source == nil {
+		return ``, fmt.Errorf(`cloud backup %d: %w`, id, ErrDumpSourceUnavailable)
+	}
+	extra, err := getBackupExtra(id)
+	if err != nil {
+		return ``, err
+	}
+	task, mgr, ldb, err := prepareDumpBackup(cfg, extra)
+	if err != nil {
+		return ``, err
+	}
+	defer func() {
+		mgr.Close()
+		task.finish()
+	}()
+	err = dumpBackup(task, cfg, extra, mgr, ldb)
+	if err != nil && task.ctx.Err() != nil {
+		err = echo.ErrExit
+	}
+	if err == nil {
+		saveCatalogAfterBackup(cfg, extra)
+	}
+	result := echo.H{`last_executed`: time.Now().Unix(), `result`: ctx.T(`全量备份完成`), `status`: `idle`}
+	if err != nil {
+		result[`result`] = err.Error()
+		result[`status`] = `failure`
+	}
+	m.UpdateFields(nil, result, `id`, id)
+	if err != nil {
+		return ``, err
+	}
+	return cfg.Name + `: ` + ctx.T(`全量备份完成`), nil
+}
@@ -0,0 +1,400 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coscms/webcore/library/config"
+	"github.com/webx-top/com"
+	"github.com/webx-top/db/lib/sqlbuilder"
+	"github.com/webx-top/db/mysql"
+	"github.com/webx-top/db/sqlite"
+	"github.com/webx-top/echo"
+)
+
+// dumpBatchRows 每条 INSERT 语句最多包含的行数
+const dumpBatchRows = 100
+
+func init() {
+	RegisterDumpSource(`mysql`, `导出 MySQL 数据库(例如：mysql: 代表本程序使用的数据库；mysql:dbname 代表同一服务器上的其它数据库)`, dumpMySQL)
+	RegisterDumpSource(`sqlite`, `导出 SQLite 数据库文件(例如：sqlite: 代表本程序使用的数据库；sqlite:/path/to/file.db)`, dumpSQLite)
+}
+
+// sqlQueryer 用于导出的连接或事务
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sqlDumper 将数据表中的数据写为 INSERT 语句
+type sqlDumper struct {
+	w          *bufio.Writer
+	quoteIdent func(string) string
+	literal    func(v interface{}, col *sql.ColumnType) string
+}
+
+func (d *sqlDumper) dumpRows(ctx context.Context, q sqlQueryer, table string) error {
+	ident := d.quoteIdent(table)
+	rows, err := q.QueryContext(ctx, `SELECT * FROM `+ident)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var n int
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return err
+		}
+		if n%dumpBatchRows == 0 {
+			if n > 0 {
+				d.w.WriteString(";\n")
+			}
+			d.w.WriteString(`INSERT INTO ` + ident + ` VALUES `)
+		} else {
+			d.w.WriteString(`,`)
+		}
+		d.w.WriteString(`(`)
+		for i, v := range values {
+			if i > 0 {
+				d.w.WriteString(`,`)
+			}
+			d.w.WriteString(d.literal(v, cols[i]))
+		}
+		d.w.WriteString(`)`)
+		n++
+		if n%dumpBatchRows == 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		d.w.WriteString(";\n")
+	}
+	return nil
+}
+
+func mysqlQuoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+var mysqlEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	"\x00", `\0`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\x1a", `\Z`,
+)
+
+// mysqlLiteral 将 MySQL 的字段值转为 SQL 字面量
+func mysqlLiteral(v interface{}, col *sql.ColumnType) string {
+	var typeName string
+	if col != nil {
+		typeName = strings.ToUpper(col.DatabaseTypeName())
+	}
+	switch r := v.(type) {
+	case nil:
+		return `NULL`
+	case int64:
+		return strconv.FormatInt(r, 10)
+	case uint64:
+		return strconv.FormatUint(r, 10)
+	case float32:
+		return strconv.FormatFloat(float64(r), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(r, 'g', -1, 64)
+	case bool:
+		if r {
+			return `1`
+		}
+		return `0`
+	case time.Time:
+		return `'` + r.Format(`2006-01-02 15:04:05.999999`) + `'`
+	case []byte:
+		switch {
+		case strings.Contains(typeName, `BINARY`), strings.Contains(typeName, `BLOB`), typeName == `BIT`, typeName == `GEOMETRY`:
+			if len(r) == 0 {
+				return `''`
+			}
+			return `0x` + hex.EncodeToString(r)
+		case strings.Contains(typeName, `INT`), typeName == `DECIMAL`, typeName == `FLOAT`, typeName == `DOUBLE`, typeName == `YEAR`:
+			return string(r)
+		}
+		return `'` + mysqlEscaper.Replace(string(r)) + `'`
+	case string:
+		return `'` + mysqlEscaper.Replace(r) + `'`
+	default:
+		return `'` + mysqlEscaper.Replace(fmt.Sprint(r)) + `'`
+	}
+}
+
+// dumpMySQL 在一致性快照中导出 MySQL 数据库。target 为空时导出本程序使用的数据库
+func dumpMySQL(ctx context.Context, target string, filter func(table string) bool, w io.Writer) error {
+	c := config.FromFile().DB
+	if c.Type != `mysql` {
+		return ErrDumpSourceUnavailable
+	}
+	if len(target) > 0 {
+		c.Database = target
+	}
+	sess, err := mysql.Open(c.ToMySQL())
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	conn, err := sess.Driver().(*sql.DB).Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, query := range []string{
+		`SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ`,
+		`START TRANSACTION WITH CONSISTENT SNAPSHOT`,
+	} {
+		if _, err = conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	defer conn.ExecContext(context.Background(), `ROLLBACK`)
+	tables, err := queryStrings(ctx, conn, `SHOW FULL TABLES WHERE Table_type = 'BASE TABLE'`)
+	if err != nil {
+		return err
+	}
+	d := &sqlDumper{w: bufio.NewWriter(w), quoteIdent: mysqlQuoteIdent, literal: mysqlLiteral}
+	d.w.WriteString("-- Nging database dump\n-- Database: " + c.Database + "\n\n")
+	d.w.WriteString("SET NAMES utf8mb4;\nSET FOREIGN_KEY_CHECKS=0;\n\n")
+	for _, table := range tables {
+		if !filter(table) {
+			continue
+		}
+		var name, create string
+		err = conn.QueryRowContext(ctx, `SHOW CREATE TABLE `+mysqlQuoteIdent(table)).Scan(&name, &create)
+		if err != nil {
+			return err
+		}
+		d.w.WriteString(`DROP TABLE IF EXISTS ` + mysqlQuoteIdent(table) + ";\n" + create + ";\n")
+		if err = d.dumpRows(ctx, conn, table); err != nil {
+			return fmt.Errorf(`%s: %w`, table, err)
+		}
+		d.w.WriteString("\n")
+	}
+	d.w.WriteString("SET FOREIGN_KEY_CHECKS=1;\n")
+	return d.w.Flush()
+}
+
+// queryStrings 查询每一行第一列的值
+func queryStrings(ctx context.Context, q sqlQueryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	dest := make([]interface{}, len(cols))
+	for i := range dest {
+		dest[i] = &sql.RawBytes{}
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		results = append(results, string(*dest[0].(*sql.RawBytes)))
+	}
+	return results, rows.Err()
+}
+
+func sqliteQuoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteLiteral 将 SQLite 的字段值转为 SQL 字面量
+func sqliteLiteral(v interface{}, _ *sql.ColumnType) string {
+	switch r := v.(type) {
+	case nil:
+		return `NULL`
+	case int64:
+		return strconv.FormatInt(r, 10)
+	case float64:
+		s := strconv.FormatFloat(r, 'g', -1, 64)
+		if !strings.ContainsAny(s, `.eEIN`) { // 保持为浮点数
+			s += `.0`
+		}
+		return s
+	case bool:
+		if r {
+			return `1`
+		}
+		return `0`
+	case []byte:
+		return `X'` + hex.EncodeToString(r) + `'`
+	case string:
+		return `'` + strings.ReplaceAll(r, `'`, `''`) + `'`
+	case time.Time:
+		return `'` + r.Format(`2006-01-02 15:04:05.999999999-07:00`) + `'`
+	default:
+		return `'` + strings.ReplaceAll(fmt.Sprint(r), `'`, `''`) + `'`
+	}
+}
+
+// sqliteFile 返回 SQLite 数据库文件。target 为空时为本程序使用的数据库
+func sqliteFile(target string) (string, error) {
+	if len(target) == 0 {
+		c := config.FromFile().DB
+		if c.Type != `sqlite` {
+			return ``, ErrDumpSourceUnavailable
+		}
+		target = c.Database
+		if !filepath.IsAbs(target) && !com.FileExists(target) {
+			target = filepath.Join(echo.Wd(), target)
+		}
+	}
+	if !com.FileExists(target) {
+		return ``, fmt.Errorf(`%w: %s`, ErrDumpSourceUnavailable, target)
+	}
+	return target, nil
+}
+
+// dumpSQLite 在一个读事务中导出 SQLite 数据库
+func dumpSQLite(ctx context.Context, target string, filter func(table string) bool, w io.Writer) error {
+	file, err := sqliteFile(target)
+	if err != nil {
+		return err
+	}
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: file})
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	return dumpSQLiteDB(ctx, sess, filter, w)
+}
+
+func dumpSQLiteDB(ctx context.Context, sess sqlbuilder.Database, filter func(table string) bool, w io.Writer) error {
+	tx, err := sess.Driver().(*sql.DB).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT name, sql FROM sqlite_master WHERE type='table' AND sql IS NOT NULL ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	var tables, creates []string
+	var hasSequence bool
+	for rows.Next() {
+		var name, create string
+		if err = rows.Scan(&name, &create); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == `sqlite_sequence` {
+			hasSequence = true
+			continue
+		}
+		if strings.HasPrefix(name, `sqlite_`) || !filter(name) {
+			continue
+		}
+		tables = append(tables, name)
+		creates = append(creates, create)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	d := &sqlDumper{w: bufio.NewWriter(w), quoteIdent: sqliteQuoteIdent, literal: sqliteLiteral}
+	d.w.WriteString("-- Nging database dump\n\nPRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	for i, table := range tables {
+		d.w.WriteString(`DROP TABLE IF EXISTS ` + sqliteQuoteIdent(table) + ";\n" + creates[i] + ";\n")
+		if err = d.dumpRows(ctx, tx, table); err != nil {
+			return fmt.Errorf(`%s: %w`, table, err)
+		}
+	}
+	if hasSequence && len(tables) > 0 {
+		// 保留自增序号，避免还原后重复使用已删除的ID
+		d.w.WriteString("DELETE FROM sqlite_sequence;\n")
+		placeholders := strings.TrimSuffix(strings.Repeat(`?,`, len(tables)), `,`)
+		args := make([]interface{}, len(tables))
+		for i, table := range tables {
+			args[i] = table
+		}
+		rows, err = tx.QueryContext(ctx, `SELECT name, seq FROM sqlite_sequence WHERE name IN (`+placeholders+`) ORDER BY name`, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name string
+			var seq int64
+			if err = rows.Scan(&name, &seq); err != nil {
+				rows.Close()
+				return err
+			}
+			d.w.WriteString(`INSERT INTO sqlite_sequence VALUES(` + sqliteLiteral(name, nil) + `,` + strconv.FormatInt(seq, 10) + ");\n")
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	// 视图的 tbl_name 即视图名称
+	rows, err = tx.QueryContext(ctx, `SELECT tbl_name, sql FROM sqlite_master WHERE type IN ('index','trigger','view') AND sql IS NOT NULL ORDER BY type='view', name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, create string
+		if err = rows.Scan(&table, &create); err != nil {
+			return err
+		}
+		if !filter(table) {
+			continue
+		}
+		d.w.WriteString(create + ";\n")
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	d.w.WriteString("COMMIT;\n")
+	return d.w.Flush()
+}
@@ -0,0 +1,140 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/db/sqlite"
+)
+
+func openTestSQLite(t *testing.T, file string) *sql.DB {
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: file})
+	require.NoError(t, err)
+	t.Cleanup(func() { sess.Close() })
+	return sess.Driver().(*sql.DB)
+}
+
+func TestDumpSQLite(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), `source.db`)
+	src := openTestSQLite(t, file)
+	_, err := src.Exec(`CREATE TABLE user (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, avatar BLOB, score REAL);
+CREATE INDEX idx_user_name ON user (name);
+CREATE VIEW user_name AS SELECT name FROM user;
+CREATE TABLE log (id INTEGER PRIMARY KEY, message TEXT);
+INSERT INTO user (name, avatar, score) VALUES ('it''s', X'00ff', 2.0), (NULL, NULL, 1.5), ('deleted', NULL, 0);
+DELETE FROM user WHERE name = 'deleted';
+INSERT INTO log (message) VALUES ('skipped');`)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	err = dumpSQLite(ctx, file, func(table string) bool { return table != `log` }, buf)
+	require.NoError(t, err)
+	dump := buf.String()
+	assert.Contains(t, dump, `INSERT INTO "user" VALUES (1,'it''s',X'00ff',2.0),(2,NULL,NULL,1.5);`)
+	assert.Contains(t, dump, `CREATE INDEX idx_user_name`)
+	assert.Contains(t, dump, `CREATE VIEW user_name`)
+	assert.NotContains(t, dump, `skipped`)
+
+	dest := openTestSQLite(t, filepath.Join(t.TempDir(), `dest.db`))
+	_, err = dest.Exec(dump)
+	require.NoError(t, err)
+	var (
+		name   string
+		avatar []byte
+		score  float64
+		seq    int64
+	)
+	require.NoError(t, dest.QueryRow(`SELECT name, avatar, score FROM user WHERE id = 1`).Scan(&name, &avatar, &score))
+	assert.Equal(t, `it's`, name)
+	assert.Equal(t, []byte{0, 0xff}, avatar)
+	assert.Equal(t, 2.0, score)
+	require.NoError(t, dest.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'user'`).Scan(&seq))
+	assert.Equal(t, int64(3), seq) // 已删除的ID不会被重复使用
+
+	err = dumpSQLite(ctx, filepath.Join(t.TempDir(), `none.db`), func(string) bool { return true }, io.Discard)
+	assert.ErrorIs(t, err, ErrDumpSourceUnavailable)
+}
+
+func TestMySQLLiteral(t *testing.T) {
+	assert.Equal(t, `NULL`, mysqlLiteral(nil, nil))
+	assert.Equal(t, `-3`, mysqlLiteral(int64(-3), nil))
+	assert.Equal(t, `1.5`, mysqlLiteral(float64(1.5), nil))
+	assert.Equal(t, `'a\'b\\c\n\0'`, mysqlLiteral([]byte("a'b\\c\n\x00"), nil))
+	assert.Equal(t, "`a``b`", mysqlQuoteIdent("a`b"))
+}
+
+func TestTableFilter(t *testing.T) {
+	filter, err := tableFilter(&dbschema.NgingCloudBackup{IgnoreRule: `^nging_cloud_backup_log$`})
+	require.NoError(t, err)
+	assert.True(t, filter(`nging_user`))
+	assert.False(t, filter(`nging_cloud_backup_log`))
+	filter, err = tableFilter(&dbschema.NgingCloudBackup{MatchRule: `^nging_user`, IgnoreRule: `.`})
+	require.NoError(t, err)
+	assert.True(t, filter(`nging_user_role`))
+	assert.False(t, filter(`nging_config`))
+}
+
+func TestDumpBackup(t *testing.T) {
+	content := `CREATE TABLE a (id INT);`
+	RegisterDumpSource(`testdump`, ``, func(ctx context.Context, target string, filter func(string) bool, w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+	defer delete(dumpSources, `testdump`)
+
+	ldb, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer ldb.Close()
+	mem := &memStorage{files: map[string][]byte{}}
+	cfg := dbschema.NgingCloudBackup{Id: 200100, SourcePath: `testdump:/data/app.db`, DestPath: `/backup`}
+	extra := &BackupExtra{BackupId: cfg.Id, Versioned: common.BoolY, KeepLast: 1}
+	run := func() {
+		task, err := startFullBackupTask(cfg.Id)
+		require.NoError(t, err)
+		defer task.finish()
+		require.NoError(t, dumpBackup(task, cfg, extra, mem, ldb))
+	}
+	uploaded := func() []string {
+		var names []string
+		for name := range mem.files {
+			names = append(names, name)
+		}
+		return names
+	}
+
+	run()
+	require.Len(t, mem.files, 1)
+	first := uploaded()[0]
+	assert.True(t, strings.HasPrefix(first, `/backup/app.sql.gz@`))
+	gr, err := gzip.NewReader(bytes.NewReader(mem.files[first]))
+	require.NoError(t, err)
+	b, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(b))
+
+	run() // 没有变化时不上传
+	assert.Equal(t, []string{first}, uploaded())
+
+	content += `INSERT INTO a VALUES (1);`
+	run() // 只保留最新的一个版本
+	require.Len(t, mem.files, 1)
+	assert.NotEqual(t, first, uploaded()[0])
+
+	entries, err := restoreEntriesFromIndex(ldb, cfg, cfg.SourcePath, true, time.Now())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, `app.sql.gz`, entries[0].Path)
+}
@@ -0,0 +1,436 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/webx-top/com"
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/common"
+)
+
+const tableCloudBackupExtra = `nging_cloud_backup_extra`
+
+// 单个文件的最大保留版本数
+const maxKeepVersions = 10000
+
+// 客户端加密方式
+const (
+	EncryptionNone       = `none`       // 不加密
+	EncryptionPassphrase = `passphrase` // 从口令派生密钥
+	EncryptionKey        = `key`        // 随机生成的密钥
+)
+
+// 加密口令的最小长度
+const minPassphraseLength = 8
+
+// newParam 创建本模块数据表的查询参数
+func newParam(table string) *factory.Param {
+	return factory.NewParam(factory.DefaultFactory).SetCollection(dbschema.WithPrefix(table))
+}
+
+// BackupExtra 云备份扩展配置
+type BackupExtra struct {
+	BackupId    uint   `db:"backup_id,pk" json:"backup_id" xml:"backup_id"`
+	Versioned   string `db:"versioned" json:"versioned" xml:"versioned"`       // 是否(Y/N)保留历史版本
+	KeepLast    uint   `db:"keep_last" json:"keep_last" xml:"keep_last"`       // 保留最近的版本数
+	KeepDaily   uint   `db:"keep_daily" json:"keep_daily" xml:"keep_daily"`    // 保留最近若干天每天的最后一个版本
+	KeepWeekly  uint   `db:"keep_weekly" json:"keep_weekly" xml:"keep_weekly"` // 保留最近若干周每周的最后一个版本
+	KeepMonthly uint   `db:"keep_monthly" json:"keep_monthly" xml:"keep_monthly"`
+	KeepYearly  uint   `db:"keep_yearly" json:"keep_yearly" xml:"keep_yearly"`
+
+	Encryption       string `db:"encryption" json:"encryption" xml:"encryption"`                // 客户端加密方式
+	EncryptionSecret string `db:"encryption_secret" json:"-" xml:"-"`                           // 加密口令或密钥(加密存储)
+	EncryptionSalt   string `db:"encryption_salt" json:"encryption_salt" xml:"encryption_salt"` // 从口令派生密钥时使用的盐
+	EncryptName      string `db:"encrypt_name" json:"encrypt_name" xml:"encrypt_name"`          // 是否(Y/N)加密文件名
+	KeyId            string `db:"key_id" json:"key_id" xml:"key_id"`                            // 密钥标识
+	Chunked          string `db:"chunked" json:"chunked" xml:"chunked"`                         // 是否(Y/N)分块去重存储
+
+	Workers        uint   `db:"workers" json:"workers" xml:"workers"`                         // 全量备份时的并行上传数(0为使用系统设置)
+	BandwidthLimit uint64 `db:"bandwidth_limit" json:"bandwidth_limit" xml:"bandwidth_limit"` // 上传速度上限(字节/秒)
+	ThrottleStart  string `db:"throttle_start" json:"throttle_start" xml:"throttle_start"`    // 限速时段开始时间(时:分)
+	ThrottleEnd    string `db:"throttle_end" json:"throttle_end" xml:"throttle_end"`          // 限速时段结束时间(时:分)
+	PollInterval   uint   `db:"poll_interval" json:"poll_interval" xml:"poll_interval"`       // 文件源监控备份的轮询间隔(秒)
+	Updated        uint   `db:"updated" json:"updated" xml:"updated"`
+}
+
+func (b *BackupExtra) setDefaults() {
+	if b.Versioned != common.BoolY {
+		b.Versioned = common.BoolN
+	}
+	switch b.Encryption {
+	case EncryptionPassphrase, EncryptionKey:
+	default:
+		b.Encryption = EncryptionNone
+	}
+	if b.EncryptName != common.BoolY {
+		b.EncryptName = common.BoolN
+	}
+	if b.Chunked != common.BoolY {
+		b.Chunked = common.BoolN
+	}
+}
+
+// UploadWorkers 全量备份时的并行上传数
+func (b *BackupExtra) UploadWorkers() int {
+	workers := int(b.Workers)
+	if workers <= 0 {
+		workers = defaultWorkers()
+	}
+	if workers > maxUploadWorkers {
+		workers = maxUploadWorkers
+	}
+	return workers
+}
+
+// PollDuration 文件源监控备份的轮询间隔
+func (b *BackupExtra) PollDuration() time.Duration {
+	if b.PollInterval == 0 {
+		return defaultPollInterval
+	}
+	d := time.Duration(b.PollInterval) * time.Second
+	if d < minPollInterval {
+		d = minPollInterval
+	}
+	return d
+}
+
+// IsChunked 是否分块去重存储
+func (b *BackupExtra) IsChunked() bool {
+	return b.Chunked == common.BoolY
+}
+
+// storageFormatChanged 云存储中文件的存储格式(加密、分块)是否与 old 不同
+func (b *BackupExtra) storageFormatChanged(old *BackupExtra) bool {
+	return b.Encryption != old.Encryption || b.KeyId != old.KeyId ||
+		b.IsEncryptName() != old.IsEncryptName() || b.Chunked != old.Chunked
+}
+
+// IsEncrypted 是否启用了客户端加密
+func (b *BackupExtra) IsEncrypted() bool {
+	return b.Encryption == EncryptionPassphrase || b.Encryption == EncryptionKey
+}
+
+// IsEncryptName 是否加密文件名
+func (b *BackupExtra) IsEncryptName() bool {
+	return b.IsEncrypted() && b.EncryptName == common.BoolY
+}
+
+// Cipher 获取加解密工具。secret 用于临时指定口令或密钥，为空时使用保存的配置。
+// 密钥与保存的密钥标识不一致时返回 ErrWrongEncryptionKey
+func (b *BackupExtra) Cipher(secret ...string) (*backupCipher, error) {
+	var value string
+	if len(secret) > 0 && len(secret[0]) > 0 {
+		value = secret[0]
+	} else {
+		value = common.Crypto().Decode(b.EncryptionSecret)
+	}
+	var (
+		master []byte
+		err    error
+	)
+	switch b.Encryption {
+	case EncryptionPassphrase:
+		var salt []byte
+		salt, err = hex.DecodeString(b.EncryptionSalt)
+		if err == nil {
+			master, err = deriveBackupKey(value, salt)
+		}
+	case EncryptionKey:
+		master, err = parseBackupKey(value)
+		if err != nil && len(secret) > 0 && len(secret[0]) > 0 {
+			err = ErrWrongEncryptionKey
+		}
+	default:
+		return nil, errors.New(`encryption is not enabled`)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := newBackupCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.KeyId) > 0 && c.KeyID() != b.KeyId {
+		return nil, ErrWrongEncryptionKey
+	}
+	return c, nil
+}
+
+// setSecret 设置加密口令或密钥，secret 为空时沿用原来的设置(密钥方式下首次启用时自动生成)。
+// 口令未改变时沿用原来的盐和密钥标识；已有历史版本或数据块时不允许更改加密方式或密钥，否则这些数据将无法解密
+func (b *BackupExtra) setSecret(ctx echo.Context, encryption string, secret string) error {
+	oldEncryption, oldKeyID := b.Encryption, b.KeyId
+	switch encryption {
+	case EncryptionNone:
+		b.Encryption = EncryptionNone
+		b.EncryptionSecret = ``
+		b.EncryptionSalt = ``
+		b.KeyId = ``
+		return b.checkKeyChange(ctx, oldEncryption, oldKeyID)
+	case EncryptionPassphrase, EncryptionKey:
+	default:
+		return ctx.NewError(code.InvalidParameter, `加密方式无效`).SetZone(`encryption`)
+	}
+	if len(secret) == 0 {
+		if b.Encryption == encryption && len(b.EncryptionSecret) > 0 {
+			return nil
+		}
+		if encryption == EncryptionPassphrase {
+			return ctx.NewError(code.InvalidParameter, `请输入加密口令`).SetZone(`encryptionSecret`)
+		}
+		secret = generateBackupKey()
+	}
+	if encryption == EncryptionPassphrase {
+		if len(secret) < minPassphraseLength {
+			return ctx.NewError(code.InvalidParameter, `加密口令不能少于%d个字符`, minPassphraseLength).SetZone(`encryptionSecret`)
+		}
+		// 用原来的盐派生的密钥与密钥标识一致时，说明口令未改变
+		if b.Encryption != EncryptionPassphrase || len(b.KeyId) == 0 {
+			b.EncryptionSalt = hex.EncodeToString(randomBytes(encryptSaltSize))
+		} else if _, err := b.Cipher(secret); err != nil {
+			b.EncryptionSalt = hex.EncodeToString(randomBytes(encryptSaltSize))
+		}
+	} else {
+		if _, err := parseBackupKey(secret); err != nil {
+			return ctx.NewError(code.InvalidParameter, `密钥必须是64个十六进制字符`).SetZone(`encryptionSecret`)
+		}
+		secret = strings.TrimSpace(secret)
+		b.EncryptionSalt = ``
+	}
+	b.Encryption = encryption
+	b.EncryptionSecret = common.Crypto().Encode(secret)
+	b.KeyId = ``
+	c, err := b.Cipher()
+	if err != nil {
+		return err
+	}
+	b.KeyId = c.KeyID()
+	return b.checkKeyChange(ctx, oldEncryption, oldKeyID)
+}
+
+// checkKeyChange 加密方式或密钥改变时，检查是否已有需要用原来的密钥解密的历史版本或数据块
+func (b *BackupExtra) checkKeyChange(ctx echo.Context, oldEncryption string, oldKeyID string) error {
+	if b.BackupId == 0 || (b.Encryption == oldEncryption && b.KeyId == oldKeyID) {
+		return nil
+	}
+	exists, err := hasBackupHistory(b.BackupId)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ctx.NewError(code.InvalidParameter, `已有历史版本或分块存储的数据，更改加密方式或密钥后这些数据将无法解密。如需更换，请新建备份配置`).SetZone(`encryptionSecret`)
+	}
+	return nil
+}
+
+// hasBackupHistory 是否有历史版本记录或数据块记录
+func hasBackupHistory(backupID uint) (bool, error) {
+	db, err := cloudbackup.LevelDB().OpenDB(backupID)
+	if err != nil {
+		return false, err
+	}
+	for _, prefix := range []string{versionKeyPrefix, chunkKeyPrefix} {
+		iter := db.NewIterator(util.BytesPrefix(com.Str2bytes(prefix)), nil)
+		found := iter.Next()
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IsVersioned 是否为版本化备份
+func (b *BackupExtra) IsVersioned() bool {
+	return b.Versioned == common.BoolY
+}
+
+// Retention 历史版本保留规则
+func (b *BackupExtra) Retention() VersionRetention {
+	return VersionRetention{
+		KeepLast:    b.KeepLast,
+		KeepDaily:   b.KeepDaily,
+		KeepWeekly:  b.KeepWeekly,
+		KeepMonthly: b.KeepMonthly,
+		KeepYearly:  b.KeepYearly,
+	}
+}
+
+// getBackupExtra 获取云备份扩展配置，不存在时返回默认值
+func getBackupExtra(backupID uint) (*BackupExtra, error) {
+	row := &BackupExtra{}
+	err := newParam(tableCloudBackupExtra).SetArgs(db.Cond{`backup_id`: backupID}).SetRecv(row).One()
+	if err != nil {
+		if err != db.ErrNoMoreRows {
+			return nil, err
+		}
+		err = nil
+	}
+	row.BackupId = backupID
+	row.setDefaults()
+	return row, err
+}
+
+// listBackupExtras 批量获取云备份扩展配置
+func listBackupExtras(backupIDs []uint) (map[uint]*BackupExtra, error) {
+	extras := map[uint]*BackupExtra{}
+	if len(backupIDs) == 0 {
+		return extras, nil
+	}
+	var rows []*BackupExtra
+	err := newParam(tableCloudBackupExtra).SetArgs(db.Cond{`backup_id`: db.In(backupIDs)}).SetRecv(&rows).All()
+	if err != nil {
+		return extras, err
+	}
+	for _, row := range rows {
+		extras[row.BackupId] = row
+	}
+	return extras, nil
+}
+
+func saveBackupExtra(row *BackupExtra) error {
+	row.setDefaults()
+	row.Updated = uint(time.Now().Unix())
+	cond := db.Cond{`backup_id`: row.BackupId}
+	exists, err := newParam(tableCloudBackupExtra).SetArgs(cond).Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return newParam(tableCloudBackupExtra).SetArgs(cond).SetSend(row).Update()
+	}
+	_, err = newParam(tableCloudBackupExtra).SetSend(row).Insert()
+	return err
+}
+
+func deleteBackupExtra(backupID uint) error {
+	return newParam(tableCloudBackupExtra).SetArgs(db.Cond{`backup_id`: backupID}).Delete()
+}
+
+// bindBackupExtra 从表单获取云备份扩展配置
+func bindBackupExtra(ctx echo.Context, backupID uint) (*BackupExtra, error) {
+	row, err := getBackupExtra(backupID)
+	if err != nil {
+		return nil, err
+	}
+	row.Versioned = ctx.Formx(`versioned`, common.BoolN).String()
+	row.KeepLast = ctx.Formx(`keepLast`).Uint()
+	row.KeepDaily = ctx.Formx(`keepDaily`).Uint()
+	row.KeepWeekly = ctx.Formx(`keepWeekly`).Uint()
+	row.KeepMonthly = ctx.Formx(`keepMonthly`).Uint()
+	row.KeepYearly = ctx.Formx(`keepYearly`).Uint()
+	for _, v := range []struct {
+		name  string
+		value uint
+	}{
+		{`keepLast`, row.KeepLast},
+		{`keepDaily`, row.KeepDaily},
+		{`keepWeekly`, row.KeepWeekly},
+		{`keepMonthly`, row.KeepMonthly},
+		{`keepYearly`, row.KeepYearly},
+	} {
+		if v.value > maxKeepVersions {
+			return nil, ctx.NewError(code.InvalidParameter, `保留数量不能超过%d`, maxKeepVersions).SetZone(v.name)
+		}
+	}
+	err = row.setSecret(ctx, ctx.Formx(`encryption`, EncryptionNone).String(), ctx.Formx(`encryptionSecret`).String())
+	if err != nil {
+		return nil, err
+	}
+	row.EncryptName = ctx.Formx(`encryptName`, common.BoolN).String()
+	row.Chunked = ctx.Formx(`chunked`, common.BoolN).String()
+	row.Workers = ctx.Formx(`workers`).Uint()
+	if row.Workers > maxUploadWorkers {
+		return nil, ctx.NewError(code.InvalidParameter, `并行上传数不能超过%d`, maxUploadWorkers).SetZone(`workers`)
+	}
+	row.BandwidthLimit = ctx.Formx(`bandwidthLimit`).Uint64()
+	row.PollInterval = ctx.Formx(`pollInterval`).Uint()
+	row.ThrottleStart = strings.TrimSpace(ctx.Formx(`throttleStart`).String())
+	row.ThrottleEnd = strings.TrimSpace(ctx.Formx(`throttleEnd`).String())
+	if len(row.ThrottleStart) > 0 || len(row.ThrottleEnd) > 0 {
+		if _, err = parseThrottleWindow(row.ThrottleStart, row.ThrottleEnd); err != nil {
+			return nil, ctx.NewError(code.InvalidParameter, `限速时段的格式无效，请输入“时:分”格式的开始和结束时间`).SetZone(`throttleStart`)
+		}
+	}
+	row.setDefaults()
+	return row, nil
+}
+
+func setBackupExtraForm(ctx echo.Context, row *BackupExtra) {
+	form := ctx.Request().Form()
+	form.Set(`versioned`, row.Versioned)
+	form.Set(`keepLast`, param.AsString(row.KeepLast))
+	form.Set(`keepDaily`, param.AsString(row.KeepDaily))
+	form.Set(`keepWeekly`, param.AsString(row.KeepWeekly))
+	form.Set(`keepMonthly`, param.AsString(row.KeepMonthly))
+	form.Set(`keepYearly`, param.AsString(row.KeepYearly))
+	form.Set(`encryption`, row.Encryption)
+	form.Set(`encryptName`, row.EncryptName)
+	form.Set(`chunked`, row.Chunked)
+	form.Set(`workers`, param.AsString(row.Workers))
+	form.Set(`bandwidthLimit`, param.AsString(row.BandwidthLimit))
+	form.Set(`pollInterval`, param.AsString(row.PollInterval))
+	form.Set(`throttleStart`, row.ThrottleStart)
+	form.Set(`throttleEnd`, row.ThrottleEnd)
+	if row.Encryption == EncryptionKey { // 显示密钥以便用户另外保存
+		form.Set(`encryptionSecret`, common.Crypto().Decode(row.EncryptionSecret))
+	}
+}
+
+// resetBackupIndex 清除文件备份记录和数据块记录，使下次全量备份时重新上传所有文件。
+// 在存储格式改变后调用，历史版本记录保持不变
+func resetBackupIndex(backupID uint) error {
+	db, err := cloudbackup.LevelDB().OpenDB(backupID)
+	if err != nil {
+		return err
+	}
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) > 0 && key[0] == 0 && !bytes.HasPrefix(key, []byte(chunkKeyPrefix)) {
+			continue
+		}
+		batch.Delete(append([]byte{}, key...))
+	}
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	return db.Write(batch, nil)
+}
@@ -0,0 +1,54 @@
+package cloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/defaults"
+)
+
+// plainCodec 测试时代替系统配置中的加解密工具
+type plainCodec struct{}
+
+func (plainCodec) Encode(raw string, _ ...string) string { return raw }
+
+func (plainCodec) Decode(encrypted string, _ ...string) string { return encrypted }
+
+func TestSetSecretKeepsKey(t *testing.T) {
+	if echo.Get(common.ConfigName) == nil {
+		echo.Set(common.ConfigName, plainCodec{})
+		defer echo.Delete(common.ConfigName)
+	}
+	ctx := defaults.NewMockContext()
+	cloudbackup.LevelDBDir = `./testdata/db`
+	extra := &BackupExtra{BackupId: 200300}
+	defer cloudbackup.LevelDB().RemoveDB(extra.BackupId)
+	require.NoError(t, extra.setSecret(ctx, EncryptionPassphrase, `passphrase-1`))
+	salt, keyID := extra.EncryptionSalt, extra.KeyId
+
+	// 再次保存相同的口令时沿用原来的盐和密钥标识
+	require.NoError(t, extra.setSecret(ctx, EncryptionPassphrase, `passphrase-1`))
+	assert.Equal(t, salt, extra.EncryptionSalt)
+	assert.Equal(t, keyID, extra.KeyId)
+
+	// 没有历史数据时可以更换口令
+	require.NoError(t, extra.setSecret(ctx, EncryptionPassphrase, `passphrase-2`))
+	assert.NotEqual(t, salt, extra.EncryptionSalt)
+	assert.NotEqual(t, keyID, extra.KeyId)
+
+	// 有历史版本时不允许更换口令或关闭加密
+	ldb, err := cloudbackup.LevelDB().OpenDB(extra.BackupId)
+	require.NoError(t, err)
+	require.NoError(t, addVersion(ldb, `/data/a.txt`, &BackupVersion{Path: `a.txt`, Created: time.Now()}))
+	salt, keyID = extra.EncryptionSalt, extra.KeyId
+	assert.Error(t, extra.setSecret(ctx, EncryptionPassphrase, `passphrase-3`))
+	assert.Error(t, extra.setSecret(ctx, EncryptionNone, ``))
+	extra.Encryption, extra.EncryptionSalt, extra.KeyId = EncryptionPassphrase, salt, keyID
+	assert.NoError(t, extra.setSecret(ctx, EncryptionPassphrase, `passphrase-2`))
+	assert.Equal(t, salt, extra.EncryptionSalt)
+}
@@ -1,6 +1,7 @@
 package cloud
 
 import (
+	"context"
 	"errors"
 	"io"
 	"io/fs"
@@ -11,10 +12,8 @@ import (
 	"regexp"
 	"sort"
 	"strings"
-	"sync/atomic"
 	"time"
 
-	"github.com/admpub/checksum"
 	"github.com/admpub/log"
 	"github.com/coscms/webcore/dbschema"
 	"github.com/coscms/webcore/library/cloudbackup"
@@ -25,13 +24,11 @@ import (
 	"github.com/webx-top/com"
 	"github.com/webx-top/echo"
 	"github.com/webx-top/echo/defaults"
-	"github.com/webx-top/echo/param"
 )
 
 var (
 	// ErrRunningPleaseWait 正在运行中
 	ErrRunningPleaseWait = errors.New("running, please wait")
-	fullBackupExit       atomic.Bool
 	fileSources          = map[string]*FileSource{}
 )
 
@@ -67,12 +64,6 @@ func GetFileSource(name string) (fs *FileSource) {
 	return
 }
 
-func fullBackupIsRunning(id uint) bool {
-	idKey := com.String(id)
-	key := `cloud.backup-task.` + idKey
-	return echo.Bool(key)
-}
-
 func fileFilter(rootPath string, cfg *dbschema.NgingCloudBackup) (func(file string) bool, error) {
 	var (
 		ignoreRE *regexp.Regexp
@@ -115,59 +106,70 @@ func fileFilter(rootPath string, cfg *dbschema.NgingCloudBackup) (func(file stri
 	}, nil
 }
 
-// 全量备份
-func fullBackupStart(cfg dbschema.NgingCloudBackup, username string, msgType string) error {
-	idKey := com.String(cfg.Id)
-	key := `cloud.backup-task.` + idKey
-	if echo.Bool(key) {
-		return ErrRunningPleaseWait
-	}
-	echo.Set(key, true)
+// backupSource 解析备份源路径。源路径为“<文件源名称>:<路径>”时 fileSystem 为注册的文件源，
+// 为数据库导出源时原样返回源路径，否则为本地路径(已转为绝对路径并解析软链接)
+func backupSource(cfg dbschema.NgingCloudBackup) (sourcePath string, fileSystem http.FileSystem, err error) {
 	parts := strings.SplitN(cfg.SourcePath, `:`, 2)
-	var fileSystem http.FileSystem
-	var sourcePath string
-	var err error
 	if len(parts) == 2 {
 		if fss := GetFileSource(parts[0]); fss != nil {
-			fileSystem = fss.fileSystem()
-			sourcePath = parts[1]
-		}
-	}
-	if fileSystem == nil {
-		sourcePath, err = filepath.Abs(cfg.SourcePath)
-		if err != nil {
-			echo.Delete(key)
-			return err
+			return parts[1], fss.fileSystem(), nil
 		}
-		sourcePath, err = filepath.EvalSymlinks(sourcePath)
-		if err != nil {
-			echo.Delete(key)
-			return err
+		if GetDumpSource(parts[0]) != nil { // 数据库导出源没有本地文件
+			return cfg.SourcePath, nil, nil
 		}
 	}
+	sourcePath, err = filepath.Abs(cfg.SourcePath)
+	if err != nil {
+		return
+	}
+	sourcePath, err = filepath.EvalSymlinks(sourcePath)
+	return
+}
+
+// 全量备份。extra 为 nil 时不保留历史版本
+func fullBackupStart(cfg dbschema.NgingCloudBackup, extra *BackupExtra, username string, msgType string) error {
+	if source, _ := backupDumpSource(cfg); source != nil {
+		return dumpBackupStart(cfg, extra, username, msgType)
+	}
+	task, err := startFullBackupTask(cfg.Id)
+	if err != nil {
+		return err
+	}
+	sourcePath, fileSystem, err := backupSource(cfg)
+	if err != nil {
+		task.finish()
+		return err
+	}
 	debug := !config.FromFile().Sys.IsEnv(`prod`)
 	filter, err := fileFilter(sourcePath, &cfg)
 	if err != nil {
-		echo.Delete(key)
+		task.finish()
 		return err
 	}
+	if extra == nil {
+		extra = &BackupExtra{BackupId: cfg.Id}
+		extra.setDefaults()
+	}
 	ctx := defaults.NewMockContext()
-	mgr, err := cloudbackup.NewStorage(ctx, cfg)
+	mgr, err := newStorage(ctx, cfg, extra)
 	if err != nil {
-		echo.Delete(key)
+		task.finish()
 		return err
 	}
 	if err := mgr.Connect(); err != nil {
-		echo.Delete(key)
+		task.finish()
 		return err
 	}
-	noticeTitle := ctx.T(`全量备份`)
+	retention := extra.Retention()
 	go func() {
 		ctx := defaults.NewMockContext()
 		var err error
+		mgrs := openWorkerStorages(ctx, cfg, extra, mgr, extra.UploadWorkers())
 		defer func() {
-			mgr.Close()
-			echo.Delete(key)
+			for _, m := range mgrs {
+				m.Close()
+			}
+			task.finish()
 		}()
 		recv := cfg
 		recv.SetContext(ctx)
@@ -180,20 +182,41 @@ func fullBackupStart(cfg dbschema.NgingCloudBackup, username string, msgType str
 			}, `id`, recv.Id)
 			return
 		}
-		fullBackupExit.Store(false)
-		putFile := func(ppath string, info os.FileInfo) error {
-			if fullBackupExit.Load() {
-				return echo.ErrExit
-			}
-			if !filter(ppath) {
+		walk := func(fn func(string, os.FileInfo) error) error {
+			walkFn := func(ppath string, info os.FileInfo) error {
+				if task.wait() != nil {
+					return echo.ErrExit
+				}
+				if !filter(ppath) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
 				if info.IsDir() {
-					return filepath.SkipDir
+					return nil
 				}
-				return nil
+				return fn(ppath, info)
 			}
-			if info.IsDir() {
-				return nil
+			if fileSystem == nil {
+				return filepath.Walk(sourcePath, func(ppath string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					return walkFn(ppath, info)
+				})
 			}
+			return recursiveDir(sourcePath, fileSystem, walkFn)
+		}
+		throttle := newUploadThrottle(extra)
+		putFile := func(worker int, ppath string, info os.FileInfo) error {
+			defer task.addScanned(info.Size())
+			mgr := mgrs[worker] // 每个协程使用各自的云存储客户端
+			if task.wait() != nil {
+				return echo.ErrExit
+			}
+			ctx := defaults.NewMockContext() // 多个协程并行上传，各自使用独立的 ctx
+			var err error
 			var md5 string
 			var (
 				oldMd5                 string
@@ -219,7 +242,7 @@ func fullBackupStart(cfg dbschema.NgingCloudBackup, username string, msgType str
 				operation = model.CloudBackupOperationUpdate
 			}
 			if len(oldMd5) > 0 {
-				md5, err = checksum.MD5sum(ppath)
+				md5, err = sourceFileMD5(fileSystem, ppath)
 				if err != nil {
 					return err
 				}
@@ -238,8 +261,14 @@ func fullBackupStart(cfg dbschema.NgingCloudBackup, username string, msgType str
 				}
 			}
 
-			objectName := path.Join(recv.DestPath, strings.TrimPrefix(ppath, sourcePath))
+			relPath := strings.TrimPrefix(ppath, sourcePath)
 			startTime := time.Now()
+			var objectName string
+			if extra.IsVersioned() {
+				objectName = versionObjectName(recv.DestPath, relPath, newVersionID(startTime))
+			} else {
+				objectName = path.Join(recv.DestPath, relPath)
+			}
 			defer func() {
 				cloudbackup.RecordLog(ctx, err, &cfg, ppath, objectName, operation, startTime, uint64(info.Size()), model.CloudBackupTypeFull)
 			}()
@@ -262,53 +291,100 @@ func fullBackupStart(cfg dbschema.NgingCloudBackup, username string, msgType str
 				if err != nil {
 					return
 				}
-				parts := []string{
-					md5,                                   // md5
-					param.AsString(0),                     // taskStartTime
-					param.AsString(time.Now().Unix()),     // taskEndTime
-					param.AsString(info.ModTime().Unix()), // fileModifyTime
-					param.AsString(info.Size()),           // fileSize
-				}
-				err = db.Put(dbKey, com.Str2bytes(strings.Join(parts, `||`)), nil)
+				err = db.Put(dbKey, backupDBValue(md5, info), nil)
 				if err != nil {
 					log.Errorf(`failed to db.Put(%q): %v`, dbKey, err)
+					return
+				}
+				if !extra.IsVersioned() {
+					return
+				}
+				err = addVersion(db, ppath, &BackupVersion{
+					Path:    relPath,
+					Object:  objectName,
+					MD5:     md5,
+					Size:    info.Size(),
+					ModTime: info.ModTime().Unix(),
+					Created: startTime,
+				})
+				if err != nil {
+					log.Errorf(`failed to add backup version(%q): %v`, ppath, err)
+					return
+				}
+				if perr := pruneVersions(task.ctx, db, mgr, ppath, retention); perr != nil {
+					log.Errorf(`failed to prune backup versions(%q): %v`, ppath, perr)
 				}
 			}()
-			err = cloudbackup.RetryablePut(ctx, mgr, seekReader, objectName, info.Size())
+			err = cloudbackup.RetryablePut(task.ctx, mgr, throttle.Reader(task.ctx, seekReader), objectName, info.Size())
+			if err == nil {
+				task.addUploaded(info.Size())
+			}
 			return err
 		}
-		if fileSystem == nil {
-			err = filepath.Walk(sourcePath, func(ppath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				return putFile(ppath, info)
-			})
-		} else {
-			err = recursiveDir(sourcePath, fileSystem, putFile)
+		// 先统计需要检查的文件，用于计算进度和剩余时间
+		err = walk(func(_ string, info os.FileInfo) error {
+			task.addTotal(info.Size())
+			return nil
+		})
+		if err == nil {
+			task.setStatus(FullBackupStatusRunning)
+			err = parallelWalk(task.ctx, len(mgrs), walk, putFile)
 		}
-		if err != nil {
-			if err == echo.ErrExit {
-				errMsg := ctx.T(`强制退出全量备份`)
-				notice.Send(username, notice.NewMessageWithValue(msgType, noticeTitle, errMsg, notice.StateFailure))
-			} else {
-				notice.Send(username, notice.NewMessageWithValue(msgType, noticeTitle, err.Error(), notice.StateFailure))
-				recv.UpdateFields(nil, echo.H{
-					`result`: err.Error(),
-					`status`: `failure`,
-				}, `id`, recv.Id)
-			}
+		if err == nil && extra.IsVersioned() {
+			err = pruneAllVersions(task.ctx, db, mgr, retention)
+		}
+		if err == nil {
+			err = sweepUnusedChunks(task.ctx, cfg, mgr)
+		}
+		if err == nil {
+			saveCatalogAfterBackup(cfg, extra)
+		}
+		reportFullBackupResult(cfg, username, msgType, task, err)
+	}()
+	return nil
+}
+
+// sweepUnusedChunks 删除不再被引用的数据块(仅分块存储)
+func sweepUnusedChunks(ctx context.Context, cfg dbschema.NgingCloudBackup, mgr cloudbackup.Storager) error {
+	cs, ok := mgr.(*chunkedStorage)
+	if !ok {
+		return nil
+	}
+	removed, err := cs.sweepChunks(ctx)
+	if removed > 0 {
+		log.Infof(`[cloudbackup] %s: removed %d unused chunks`, cfg.Name, removed)
+	}
+	return err
+}
+
+// reportFullBackupResult 通知全量备份结果并记录到备份配置
+func reportFullBackupResult(cfg dbschema.NgingCloudBackup, username string, msgType string, task *fullBackupTask, err error) {
+	ctx := defaults.NewMockContext()
+	recv := cfg
+	recv.SetContext(ctx)
+	noticeTitle := ctx.T(`全量备份`)
+	if err != nil && task.ctx.Err() != nil {
+		err = echo.ErrExit
+	}
+	if err != nil {
+		if err == echo.ErrExit {
+			errMsg := ctx.T(`强制退出全量备份`)
+			notice.Send(username, notice.NewMessageWithValue(msgType, noticeTitle, errMsg, notice.StateFailure))
 		} else {
-			successMsg := ctx.T(`全量备份完成`)
-			notice.Send(username, notice.NewMessageWithValue(msgType, noticeTitle, successMsg, notice.StateSuccess))
+			notice.Send(username, notice.NewMessageWithValue(msgType, noticeTitle, err.Error(), notice.StateFailure))
 			recv.UpdateFields(nil, echo.H{
-				`result`: successMsg,
-				`status`: `idle`,
+				`result`: err.Error(),
+				`status`: `failure`,
 			}, `id`, recv.Id)
 		}
-		fullBackupExit.Store(false)
-	}()
-	return nil
+		return
+	}
+	successMsg := ctx.T(`全量备份完成`)
+	notice.Send(username, notice.NewMessageWithValue(msgType, noticeTitle, successMsg, notice.StateSuccess))
+	recv.UpdateFields(nil, echo.H{
+		`result`: successMsg,
+		`status`: `idle`,
+	}, `id`, recv.Id)
 }
 
 func recursiveDir(ppath string, fileSystem http.FileSystem, fileFn func(string, os.FileInfo) error) error {
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coscms/webcore/dbschema"
@@ -37,17 +38,63 @@ import (
 
 var ErrNotSupportMonitor = errors.New(`This type of file does not support monitoring change status`)
 
-// 通过监控文件变动来进行备份
-func monitorBackupStart(cfg dbschema.NgingCloudBackup, debug ...bool) error {
+// restoreEventGrace 还原完成后继续忽略文件变动的时间(文件变动事件是异步送达的)
+var restoreEventGrace = 10 * time.Second
+
+// restoringFiles 正在还原的本地文件 => 忽略变动的截止时间(0表示还原中)。
+// 监控备份忽略这些文件的变动，避免将刚还原的文件再次上传，因此还原时不需要停止监控
+var restoringFiles sync.Map
+
+func beginRestoring(file string) {
+	restoringFiles.Store(file, int64(0))
+}
+
+func endRestoring(files ...string) {
+	deadline := time.Now().Add(restoreEventGrace).UnixNano()
+	for _, file := range files {
+		restoringFiles.Store(file, deadline)
+	}
+}
+
+func isRestoring(file string) bool {
+	v, ok := restoringFiles.Load(file)
+	if !ok {
+		return false
+	}
+	deadline := v.(int64)
+	if deadline == 0 || time.Now().UnixNano() < deadline {
+		return true
+	}
+	restoringFiles.CompareAndDelete(file, v)
+	return false
+}
+
+// fileEventHandler 文件变动处理
+type fileEventHandler interface {
+	OnCreate(file string)
+	OnModify(file string)
+	OnDelete(file string)
+	OnRename(file string)
+}
+
+// 通过监控文件变动来进行备份。extra 为 nil 时不保留历史版本
+func monitorBackupStart(cfg dbschema.NgingCloudBackup, extra *BackupExtra, debug ...bool) error {
 	parts := strings.SplitN(cfg.SourcePath, `:`, 2)
 	if len(parts) == 2 {
-		return ErrNotSupportMonitor
+		fss := GetFileSource(parts[0])
+		if fss == nil {
+			return ErrNotSupportMonitor
+		}
+		if err := monitorBackupStop(cfg.Id); err != nil {
+			return err
+		}
+		return pollBackupStart(cfg, extra, fss.fileSystem(), parts[1], debug...) // 文件源没有变动通知，改为定期轮询
 	}
 	if err := monitorBackupStop(cfg.Id); err != nil {
 		return err
 	}
 	ctx := defaults.NewMockContext()
-	mgr, err := cloudbackup.NewStorage(ctx, cfg)
+	mgr, err := newStorage(ctx, cfg, extra)
 	if err != nil {
 		return err
 	}
@@ -95,15 +142,30 @@ func monitorBackupStart(cfg dbschema.NgingCloudBackup, debug ...bool) error {
 		sourcePath += echo.FilePathSeparator
 	}
 
-	backup := cloudbackup.New(mgr, cfg)
-	backup.DestPath = cfg.DestPath
-	backup.SourcePath = sourcePath
-	backup.Filter = filter
-	backup.WaitFillCompleted = waitFillCompleted
-	backup.IgnoreWaitRegexp = ignoreWaitRegexp
+	var backup fileEventHandler
+	if extra != nil && extra.IsVersioned() {
+		vb := newVersionedBackup(mgr, cfg, extra.Retention())
+		vb.DestPath = cfg.DestPath
+		vb.SourcePath = sourcePath
+		vb.Filter = filter
+		vb.WaitFillCompleted = waitFillCompleted
+		vb.IgnoreWaitRegexp = ignoreWaitRegexp
+		backup = vb
+	} else {
+		cb := cloudbackup.New(mgr, cfg)
+		cb.DestPath = cfg.DestPath
+		cb.SourcePath = sourcePath
+		cb.Filter = filter
+		cb.WaitFillCompleted = waitFillCompleted
+		cb.IgnoreWaitRegexp = ignoreWaitRegexp
+		backup = cb
+	}
 
 	var sg singleflight.Group
 	monitor.Create = func(file string) {
+		if isRestoring(file) {
+			return
+		}
 		if monitor.Debug {
 			msgbox.Success(`Create`, file)
 		}
@@ -116,12 +178,18 @@ func monitorBackupStart(cfg dbschema.NgingCloudBackup, debug ...bool) error {
 		})
 	}
 	monitor.Delete = func(file string) {
+		if isRestoring(file) {
+			return
+		}
 		if monitor.Debug {
 			msgbox.Error(`Delete`, file)
 		}
 		backup.OnDelete(file)
 	}
 	monitor.Modify = func(file string) {
+		if isRestoring(file) {
+			return
+		}
 		if monitor.Debug {
 			msgbox.Info(`Modify`, file)
 		}
@@ -134,13 +202,16 @@ func monitorBackupStart(cfg dbschema.NgingCloudBackup, debug ...bool) error {
 		})
 	}
 	monitor.Rename = func(file string) {
+		if isRestoring(file) {
+			return
+		}
 		if monitor.Debug {
 			msgbox.Warn(`Rename`, file)
 		}
 		backup.OnRename(file)
 	}
-	msgbox.Success(`Cloud-Backup`, `Watch Dir: `+backup.SourcePath)
-	err = monitor.AddDir(backup.SourcePath)
+	msgbox.Success(`Cloud-Backup`, `Watch Dir: `+sourcePath)
+	err = monitor.AddDir(sourcePath)
 	if err != nil {
 		monitorBackupStop(cfg.Id)
 		return err
@@ -150,5 +221,6 @@ func monitorBackupStart(cfg dbschema.NgingCloudBackup, debug ...bool) error {
 }
 
 func monitorBackupStop(id uint) error {
+	stopPollBackup(id)
 	return cloudbackup.MonitorBackupStop(id)
 }
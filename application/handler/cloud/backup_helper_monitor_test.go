@@ -58,7 +58,7 @@ func TestMonitorBackup(t *testing.T) {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		err := monitorBackupStart(cfg, false)
+		err := monitorBackupStart(cfg, nil, false)
 		assert.NoError(t, err)
 	}()
 
@@ -0,0 +1,350 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/checksum"
+	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/config"
+	"github.com/coscms/webcore/library/msgbox"
+	"github.com/coscms/webcore/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo/defaults"
+)
+
+var (
+	// defaultPollInterval 文件源(http.FileSystem)监控备份的默认轮询间隔
+	defaultPollInterval = time.Minute
+	// minPollInterval 允许设置的最小轮询间隔
+	minPollInterval = 5 * time.Second
+)
+
+// pollers 正在轮询的监控备份(备份配置ID => *pollBackup)
+var pollers sync.Map
+
+// pollBackup 定期列出文件源中的文件并与索引比对，以此代替文件变动通知进行监控备份。
+// 与 fsnotify 方式相同：新文件和有改动的文件上传(保留历史版本时上传为新版本)，已删除的文件从云存储删除(保留历史版本时只记录删除标记)
+type pollBackup struct {
+	mgr        cloudbackup.Storager
+	cfg        dbschema.NgingCloudBackup
+	fileSystem http.FileSystem
+	versioned  bool
+	retention  VersionRetention
+	SourcePath string
+	DestPath   string
+	Filter     func(string) bool
+	Debug      bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// pollResult 一次轮询的结果
+type pollResult struct {
+	Created  int
+	Modified int
+	Deleted  int
+}
+
+// pollFile 文件源中的一个文件
+type pollFile struct {
+	path string
+	info os.FileInfo
+}
+
+// pollBackupStart 通过定期轮询文件源来进行监控备份
+func pollBackupStart(cfg dbschema.NgingCloudBackup, extra *BackupExtra, fileSystem http.FileSystem, sourcePath string, debug ...bool) error {
+	ctx := defaults.NewMockContext()
+	mgr, err := newStorage(ctx, cfg, extra)
+	if err != nil {
+		return err
+	}
+	filter, err := fileFilter(sourcePath, &cfg)
+	if err != nil {
+		return err
+	}
+	p := &pollBackup{
+		mgr:        mgr,
+		cfg:        cfg,
+		fileSystem: fileSystem,
+		SourcePath: sourcePath,
+		DestPath:   cfg.DestPath,
+		Filter:     filter,
+		done:       make(chan struct{}),
+	}
+	if extra != nil && extra.IsVersioned() {
+		p.versioned = true
+		p.retention = extra.Retention()
+	}
+	if len(debug) > 0 {
+		p.Debug = debug[0]
+	} else {
+		p.Debug = !config.FromFile().Sys.IsEnv(`prod`)
+	}
+	// 文件源没有变动通知，Monitor 只用于登记任务以便统一停止
+	cloudbackup.BackupTasks.Set(cfg.Id, cloudbackup.NewTask(com.NewMonitor(), mgr))
+	if err := mgr.Connect(); err != nil {
+		monitorBackupStop(cfg.Id)
+		return err
+	}
+	var pctx context.Context
+	pctx, p.cancel = context.WithCancel(context.Background())
+	pollers.Store(cfg.Id, p)
+	interval := defaultPollInterval
+	if extra != nil {
+		interval = extra.PollDuration()
+	}
+	msgbox.Success(`Cloud-Backup`, `Poll Dir: `+cfg.SourcePath+` (every `+interval.String()+`)`)
+	go p.run(pctx, interval)
+	return nil
+}
+
+// stopPollBackup 停止轮询并等待正在进行的轮询结束
+func stopPollBackup(id uint) {
+	v, ok := pollers.LoadAndDelete(id)
+	if !ok {
+		return
+	}
+	p := v.(*pollBackup)
+	p.cancel()
+	<-p.done
+}
+
+func (p *pollBackup) run(ctx context.Context, interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		db, err := cloudbackup.LevelDB().OpenDB(p.cfg.Id)
+		if err == nil {
+			var r pollResult
+			r, err = p.poll(ctx, db)
+			if p.Debug && (r.Created > 0 || r.Modified > 0 || r.Deleted > 0) {
+				msgbox.Info(`Poll`, p.cfg.SourcePath+`: `+com.String(r.Created)+` created, `+com.String(r.Modified)+` modified, `+com.String(r.Deleted)+` deleted`)
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Errorf(`[cloudbackup] failed to poll %s: %v`, p.cfg.SourcePath, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll 列出文件源中的文件并与索引比对，上传新增和有改动的文件，处理已删除的文件
+func (p *pollBackup) poll(ctx context.Context, db *leveldb.DB) (r pollResult, err error) {
+	seen := map[string]struct{}{}
+	var files []pollFile
+	err = recursiveDir(p.SourcePath, p.fileSystem, func(ppath string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !p.Filter(ppath) {
+			return nil
+		}
+		seen[ppath] = struct{}{}
+		files = append(files, pollFile{path: ppath, info: info})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var operation string
+		operation, err = p.putFile(ctx, db, f.path, f.info)
+		if err != nil {
+			log.Errorf(`[cloudbackup] %s: %v`, f.path, err)
+			err = nil
+			continue
+		}
+		switch operation {
+		case model.CloudBackupOperationCreate:
+			r.Created++
+		case model.CloudBackupOperationUpdate:
+			r.Modified++
+		}
+	}
+	var deleted []string
+	iter := db.NewIterator(util.BytesPrefix(com.Str2bytes(p.SourcePath)), nil)
+	for iter.Next() {
+		file := string(bytes.Clone(iter.Key()))
+		if _, ok := seen[file]; ok || !p.isSourceFile(file) || !p.Filter(file) {
+			continue
+		}
+		deleted = append(deleted, file)
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return
+	}
+	for _, file := range deleted {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if derr := p.deleteFile(ctx, db, file); derr != nil {
+			log.Errorf(`[cloudbackup] %s: %v`, file, derr)
+			continue
+		}
+		r.Deleted++
+	}
+	return
+}
+
+// isSourceFile 索引中的文件是否位于源路径之下
+func (p *pollBackup) isSourceFile(file string) bool {
+	relPath := strings.TrimPrefix(file, p.SourcePath)
+	if len(relPath) == 0 {
+		return false
+	}
+	return strings.HasSuffix(p.SourcePath, `/`) || strings.HasPrefix(relPath, `/`)
+}
+
+// putFile 上传新增或有改动的文件，返回所做的操作(没有变动时为空)
+func (p *pollBackup) putFile(ctx context.Context, db *leveldb.DB, file string, info os.FileInfo) (operation string, err error) {
+	dbKey := com.Str2bytes(file)
+	var oldMd5 string
+	cv, err := db.Get(dbKey, nil)
+	if err == nil {
+		var fileModifyTs, fileSize int64
+		oldMd5, _, _, fileModifyTs, fileSize = cloudbackup.ParseDBValue(cv)
+		if info.Size() == fileSize && info.ModTime().Unix() == fileModifyTs {
+			return
+		}
+		operation = model.CloudBackupOperationUpdate
+	} else if err == leveldb.ErrNotFound {
+		operation = model.CloudBackupOperationCreate
+	} else {
+		return
+	}
+	fp, err := p.fileSystem.Open(file)
+	if err != nil {
+		return ``, err
+	}
+	defer fp.Close()
+	md5, err := fileSystemMD5(fp)
+	if err != nil {
+		return ``, err
+	}
+	if len(oldMd5) > 0 && md5 == oldMd5 { // 只是修改时间有变化
+		return ``, db.Put(dbKey, backupDBValue(md5, info), nil)
+	}
+	relPath := strings.TrimPrefix(file, p.SourcePath)
+	startTime := time.Now()
+	var objectName string
+	if p.versioned {
+		objectName = versionObjectName(p.DestPath, relPath, newVersionID(startTime))
+	} else {
+		objectName = path.Join(p.DestPath, relPath)
+	}
+	err = cloudbackup.RetryablePut(ctx, p.mgr, fp, objectName, info.Size())
+	cloudbackup.RecordLog(nil, err, &p.cfg, file, objectName, operation, startTime, uint64(info.Size()), model.CloudBackupTypeChange)
+	if err != nil {
+		return ``, err
+	}
+	if err = db.Put(dbKey, backupDBValue(md5, info), nil); err != nil {
+		return ``, err
+	}
+	if !p.versioned {
+		return
+	}
+	err = addVersion(db, file, &BackupVersion{
+		Path:    relPath,
+		Object:  objectName,
+		MD5:     md5,
+		Size:    info.Size(),
+		ModTime: info.ModTime().Unix(),
+		Created: startTime,
+	})
+	if err != nil {
+		return ``, err
+	}
+	if perr := pruneVersions(ctx, db, p.mgr, file, p.retention); perr != nil {
+		log.Errorf(`failed to prune backup versions(%q): %v`, file, perr)
+	}
+	return
+}
+
+// deleteFile 处理已从文件源中删除的文件
+func (p *pollBackup) deleteFile(ctx context.Context, db *leveldb.DB, file string) error {
+	relPath := strings.TrimPrefix(file, p.SourcePath)
+	startTime := time.Now()
+	var (
+		objectName string
+		err        error
+	)
+	if p.versioned {
+		objectName = versionObjectName(p.DestPath, relPath, `*`)
+		err = addTombstone(db, file, relPath)
+	} else {
+		objectName = path.Join(p.DestPath, relPath)
+		err = p.mgr.Remove(ctx, objectName)
+	}
+	if err == nil {
+		err = db.Delete(com.Str2bytes(file), nil)
+	}
+	cloudbackup.RecordLog(nil, err, &p.cfg, file, objectName, model.CloudBackupOperationDelete, startTime, 0)
+	return err
+}
+
+// sourceFileMD5 计算源文件的 MD5。fileSystem 为 nil 时为本地文件
+func sourceFileMD5(fileSystem http.FileSystem, file string) (string, error) {
+	if fileSystem == nil {
+		return checksum.MD5sum(file)
+	}
+	fp, err := fileSystem.Open(file)
+	if err != nil {
+		return ``, err
+	}
+	defer fp.Close()
+	return fileSystemMD5(fp)
+}
+
+// fileSystemMD5 计算文件源中文件的 MD5，计算后重新定位到文件开头
+func fileSystemMD5(fp http.File) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return ``, err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
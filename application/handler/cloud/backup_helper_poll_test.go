@@ -0,0 +1,105 @@
+package cloud
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func newTestPollBackup(t *testing.T, fsys fstest.MapFS, versioned bool) (*pollBackup, *memStorage, *leveldb.DB) {
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	mem := &memStorage{files: map[string][]byte{}}
+	cfg := dbschema.NgingCloudBackup{Id: 200300, SourcePath: `testfs:src`, DestPath: `/backup`}
+	filter, err := fileFilter(`src`, &cfg)
+	require.NoError(t, err)
+	p := &pollBackup{
+		mgr:        mem,
+		cfg:        cfg,
+		fileSystem: http.FS(fsys),
+		versioned:  versioned,
+		SourcePath: `src`,
+		DestPath:   cfg.DestPath,
+		Filter:     filter,
+	}
+	return p, mem, db
+}
+
+func TestPollBackup(t *testing.T) {
+	ctx := context.Background()
+	modTime := time.Now().Add(-time.Hour)
+	fsys := fstest.MapFS{
+		`src/a.txt`:     {Data: []byte(`a`), ModTime: modTime},
+		`src/dir/b.txt`: {Data: []byte(`b`), ModTime: modTime},
+		`srcx/c.txt`:    {Data: []byte(`c`), ModTime: modTime},
+	}
+	p, mem, db := newTestPollBackup(t, fsys, false)
+
+	r, err := p.poll(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pollResult{Created: 2}, r)
+	assert.Equal(t, []byte(`b`), mem.files[`/backup/dir/b.txt`])
+	assert.Len(t, mem.files, 2)
+
+	r, err = p.poll(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pollResult{}, r)
+
+	fsys[`src/a.txt`] = &fstest.MapFile{Data: []byte(`a2`), ModTime: modTime.Add(time.Minute)}
+	fsys[`src/dir/b.txt`] = &fstest.MapFile{Data: []byte(`b`), ModTime: modTime.Add(time.Minute)} // 内容没有变化
+	r, err = p.poll(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pollResult{Modified: 1}, r)
+	assert.Equal(t, []byte(`a2`), mem.files[`/backup/a.txt`])
+
+	delete(fsys, `src/dir/b.txt`)
+	r, err = p.poll(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pollResult{Deleted: 1}, r)
+	assert.NotContains(t, mem.files, `/backup/dir/b.txt`)
+	_, err = db.Get([]byte(`src/dir/b.txt`), nil)
+	assert.ErrorIs(t, err, leveldb.ErrNotFound)
+}
+
+func TestPollBackupVersioned(t *testing.T) {
+	ctx := context.Background()
+	modTime := time.Now().Add(-time.Hour)
+	fsys := fstest.MapFS{
+		`src/a.txt`:    {Data: []byte(`a`), ModTime: modTime},
+		`src/keep.txt`: {Data: []byte(`k`), ModTime: modTime},
+	}
+	p, mem, db := newTestPollBackup(t, fsys, true)
+
+	_, err := p.poll(ctx, db)
+	require.NoError(t, err)
+	fsys[`src/a.txt`] = &fstest.MapFile{Data: []byte(`a2`), ModTime: modTime.Add(time.Minute)}
+	r, err := p.poll(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pollResult{Modified: 1}, r)
+	assert.Len(t, mem.files, 3)
+
+	delete(fsys, `src/a.txt`)
+	r, err = p.poll(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pollResult{Deleted: 1}, r)
+	assert.Len(t, mem.files, 3) // 历史版本保持不变
+	versions, err := listVersions(db, `src/a.txt`)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.True(t, versions[2].Deleted)
+}
+
+func TestPollDuration(t *testing.T) {
+	assert.Equal(t, defaultPollInterval, (&BackupExtra{}).PollDuration())
+	assert.Equal(t, minPollInterval, (&BackupExtra{PollInterval: 1}).PollDuration())
+	assert.Equal(t, 30*time.Second, (&BackupExtra{PollInterval: 30}).PollDuration())
+}
@@ -0,0 +1,220 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/admpub/checksum"
+	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/flock"
+	"github.com/coscms/webcore/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/com"
+)
+
+func newVersionedBackup(mgr cloudbackup.Storager, cfg dbschema.NgingCloudBackup, retention VersionRetention) *versionedBackup {
+	return &versionedBackup{mgr: mgr, cfg: cfg, retention: retention}
+}
+
+// versionedBackup 通过监控文件变动进行版本化备份。
+// 文件的每次变动都保存为一个新版本，删除或重命名时只记录删除标记
+type versionedBackup struct {
+	mgr        cloudbackup.Storager
+	cfg        dbschema.NgingCloudBackup
+	retention  VersionRetention
+	SourcePath string
+	DestPath   string
+	Filter     func(string) bool
+
+	WaitFillCompleted bool
+	IgnoreWaitRegexp  *regexp.Regexp
+}
+
+func (c *versionedBackup) OnCreate(file string) {
+	if !c.Filter(file) {
+		return
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		log.Error(file + `: ` + err.Error())
+		return
+	}
+	if !fi.IsDir() {
+		c.putFile(file, model.CloudBackupOperationCreate)
+		return
+	}
+	err = filepath.Walk(file, func(ppath string, info os.FileInfo, werr error) error {
+		if werr != nil {
+			return werr
+		}
+		if info.IsDir() || !c.Filter(ppath) {
+			return nil
+		}
+		c.putFile(ppath, model.CloudBackupOperationCreate)
+		return nil
+	})
+	if err != nil {
+		log.Errorf(`cloudbackup onCreate: %v`, err)
+	}
+}
+
+func (c *versionedBackup) OnModify(file string) {
+	if !c.Filter(file) {
+		return
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		log.Error(file + `: ` + err.Error())
+		return
+	}
+	if fi.IsDir() {
+		return
+	}
+	c.putFile(file, model.CloudBackupOperationUpdate)
+}
+
+func (c *versionedBackup) OnDelete(file string) {
+	c.markDeleted(file)
+}
+
+func (c *versionedBackup) OnRename(file string) {
+	c.markDeleted(file)
+}
+
+// markDeleted 为文件(或目录下的所有文件)记录删除标记，云存储中的历史版本保持不变
+func (c *versionedBackup) markDeleted(file string) {
+	if !c.Filter(file) {
+		return
+	}
+	relPath := strings.TrimPrefix(file, c.SourcePath)
+	if len(relPath) == 0 || relPath == `/` || relPath == `\` {
+		return
+	}
+	db, err := cloudbackup.LevelDB().OpenDB(c.cfg.Id)
+	if err != nil {
+		log.Error(file + `: ` + err.Error())
+		return
+	}
+	startTime := time.Now()
+	var files []string
+	err = eachVersionFile(db, file, func(ppath string, _ []*BackupVersion) error {
+		if ppath == file || strings.HasPrefix(ppath, file+string(filepath.Separator)) {
+			files = append(files, ppath)
+		}
+		return nil
+	})
+	for _, ppath := range files {
+		if err != nil {
+			break
+		}
+		err = addTombstone(db, ppath, strings.TrimPrefix(ppath, c.SourcePath))
+		if err == nil {
+			err = db.Delete(com.Str2bytes(ppath), nil)
+		}
+	}
+	if err != nil {
+		log.Error(file + `: ` + err.Error())
+	}
+	cloudbackup.RecordLog(nil, err, &c.cfg, file, versionObjectName(c.DestPath, relPath, `*`), model.CloudBackupOperationDelete, startTime, 0)
+}
+
+// putFile 文件有变动时上传为一个新版本
+func (c *versionedBackup) putFile(file string, operation string) {
+	db, err := cloudbackup.LevelDB().OpenDB(c.cfg.Id)
+	if err != nil {
+		log.Error(file + `: ` + err.Error())
+		return
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		log.Error(`Open ` + file + `: ` + err.Error())
+		return
+	}
+	defer fp.Close()
+	waitFillCompleted := c.WaitFillCompleted
+	if waitFillCompleted && c.IgnoreWaitRegexp != nil {
+		waitFillCompleted = c.IgnoreWaitRegexp.MatchString(file)
+	}
+	if waitFillCompleted && !flock.IsCompleted(fp, time.Now()) {
+		return
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		log.Error(`Stat ` + file + `: ` + err.Error())
+		return
+	}
+	dbKey := com.Str2bytes(file)
+	var oldMd5 string
+	cv, err := db.Get(dbKey, nil)
+	if err == nil {
+		var fileModifyTs, fileSize int64
+		oldMd5, _, _, fileModifyTs, fileSize = cloudbackup.ParseDBValue(cv)
+		if fi.Size() == fileSize && fi.ModTime().Unix() == fileModifyTs {
+			return
+		}
+		operation = model.CloudBackupOperationUpdate
+	} else if err != leveldb.ErrNotFound {
+		log.Error(file + `: ` + err.Error())
+		return
+	}
+	md5, err := checksum.MD5sum(file)
+	if err != nil {
+		log.Error(file + `: ` + err.Error())
+		return
+	}
+	if len(oldMd5) > 0 && md5 == oldMd5 {
+		return
+	}
+	relPath := strings.TrimPrefix(file, c.SourcePath)
+	startTime := time.Now()
+	objectName := versionObjectName(c.DestPath, relPath, newVersionID(startTime))
+	err = cloudbackup.RetryablePut(context.Background(), c.mgr, fp, objectName, fi.Size())
+	cloudbackup.RecordLog(nil, err, &c.cfg, file, objectName, operation, startTime, uint64(fi.Size()), model.CloudBackupTypeChange)
+	if err != nil {
+		log.Error(`Put ` + file + `: ` + err.Error())
+		return
+	}
+	if err = db.Put(dbKey, backupDBValue(md5, fi), nil); err != nil {
+		log.Errorf(`failed to db.Put(%q): %v`, dbKey, err)
+		return
+	}
+	err = addVersion(db, file, &BackupVersion{
+		Path:    relPath,
+		Object:  objectName,
+		MD5:     md5,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().Unix(),
+		Created: startTime,
+	})
+	if err != nil {
+		log.Errorf(`failed to add backup version(%q): %v`, file, err)
+		return
+	}
+	if err = pruneVersions(context.Background(), db, c.mgr, file, c.retention); err != nil {
+		log.Errorf(`failed to prune backup versions(%q): %v`, file, err)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo"
+)
+
+// 全量备份任务的状态
+const (
+	FullBackupStatusScanning = `scanning` // 统计需要检查的文件
+	FullBackupStatusRunning  = `running`
+	FullBackupStatusPaused   = `paused`
+	FullBackupStatusStopping = `stopping`
+)
+
+// FullBackupProgress 全量备份进度
+type FullBackupProgress struct {
+	Id            uint   `json:"id"`
+	Status        string `json:"status"`
+	TotalFiles    int64  `json:"totalFiles"` // 需要检查的文件总数(统计完成前为0)
+	TotalBytes    int64  `json:"totalBytes"`
+	ScannedFiles  int64  `json:"scannedFiles"` // 已检查的文件数(包含没有改变而跳过的文件)
+	ScannedBytes  int64  `json:"scannedBytes"`
+	UploadedFiles int64  `json:"uploadedFiles"`
+	UploadedBytes int64  `json:"uploadedBytes"`
+	Started       int64  `json:"started"`
+	Elapsed       int64  `json:"elapsed"` // 运行的秒数(不含暂停的时间)
+	ETA           int64  `json:"eta"`     // 预计剩余秒数，-1 表示未知
+}
+
+// Percent 按已检查的字节数计算的完成百分比
+func (p FullBackupProgress) Percent() float64 {
+	if p.TotalBytes <= 0 {
+		if p.TotalFiles <= 0 {
+			return 0
+		}
+		return float64(p.ScannedFiles) * 100 / float64(p.TotalFiles)
+	}
+	return float64(p.ScannedBytes) * 100 / float64(p.TotalBytes)
+}
+
+func (p FullBackupProgress) Text(ctx echo.Context) string {
+	if p.Status == FullBackupStatusScanning {
+		return ctx.T(`正在统计文件：%d个`, p.TotalFiles)
+	}
+	s := ctx.T(`已检查%d/%d个文件，已上传%d个(%s)`, p.ScannedFiles, p.TotalFiles, p.UploadedFiles, com.HumaneFileSize(uint64(p.UploadedBytes)))
+	if p.ETA >= 0 {
+		s += `，` + ctx.T(`预计剩余%s`, (time.Duration(p.ETA)*time.Second).String())
+	}
+	return s
+}
+
+// fullBackupTask 运行中的全量备份任务
+type fullBackupTask struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	progress FullBackupProgress
+	resume   chan struct{} // 暂停时不为 nil，恢复时关闭
+	started  time.Time
+	pausedAt time.Time
+	paused   time.Duration
+}
+
+var fullBackupTasks = struct {
+	sync.RWMutex
+	m map[uint]*fullBackupTask
+}{m: map[uint]*fullBackupTask{}}
+
+// startFullBackupTask 登记全量备份任务，同一个配置只能有一个运行中的全量备份
+func startFullBackupTask(id uint) (*fullBackupTask, error) {
+	fullBackupTasks.Lock()
+	defer fullBackupTasks.Unlock()
+	if _, ok := fullBackupTasks.m[id]; ok {
+		return nil, ErrRunningPleaseWait
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &fullBackupTask{ctx: ctx, cancel: cancel, started: time.Now()}
+	t.progress = FullBackupProgress{Id: id, Status: FullBackupStatusScanning, Started: t.started.Unix(), ETA: -1}
+	fullBackupTasks.m[id] = t
+	return t, nil
+}
+
+func getFullBackupTask(id uint) *fullBackupTask {
+	fullBackupTasks.RLock()
+	t := fullBackupTasks.m[id]
+	fullBackupTasks.RUnlock()
+	return t
+}
+
+func (t *fullBackupTask) finish() {
+	t.cancel()
+	fullBackupTasks.Lock()
+	if fullBackupTasks.m[t.progress.Id] == t {
+		delete(fullBackupTasks.m, t.progress.Id)
+	}
+	fullBackupTasks.Unlock()
+}
+
+func fullBackupIsRunning(id uint) bool {
+	return getFullBackupTask(id) != nil
+}
+
+// fullBackupProgress 获取运行中的全量备份的进度
+func fullBackupProgress(id uint) (FullBackupProgress, bool) {
+	t := getFullBackupTask(id)
+	if t == nil {
+		return FullBackupProgress{}, false
+	}
+	return t.Progress(), true
+}
+
+// stopFullBackup 取消全量备份
+func stopFullBackup(id uint) bool {
+	t := getFullBackupTask(id)
+	if t == nil {
+		return false
+	}
+	t.Cancel()
+	return true
+}
+
+func pauseFullBackup(id uint) bool {
+	t := getFullBackupTask(id)
+	return t != nil && t.Pause()
+}
+
+func resumeFullBackup(id uint) bool {
+	t := getFullBackupTask(id)
+	return t != nil && t.Resume()
+}
+
+func (t *fullBackupTask) Cancel() {
+	t.mu.Lock()
+	t.progress.Status = FullBackupStatusStopping
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// Pause 暂停。正在上传的文件会继续上传完
+func (t *fullBackupTask) Pause() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resume != nil || t.progress.Status == FullBackupStatusStopping {
+		return false
+	}
+	t.resume = make(chan struct{})
+	t.pausedAt = time.Now()
+	t.progress.Status = FullBackupStatusPaused
+	return true
+}
+
+func (t *fullBackupTask) Resume() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resume == nil {
+		return false
+	}
+	close(t.resume)
+	t.resume = nil
+	t.paused += time.Since(t.pausedAt)
+	if t.progress.Status == FullBackupStatusPaused {
+		t.progress.Status = FullBackupStatusRunning
+	}
+	return true
+}
+
+// wait 暂停时阻塞到恢复或取消，已取消时返回错误
+func (t *fullBackupTask) wait() error {
+	t.mu.Lock()
+	resume := t.resume
+	t.mu.Unlock()
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-t.ctx.Done():
+		}
+	}
+	return t.ctx.Err()
+}
+
+func (t *fullBackupTask) setStatus(status string) {
+	t.mu.Lock()
+	if t.progress.Status != FullBackupStatusStopping && t.progress.Status != FullBackupStatusPaused {
+		t.progress.Status = status
+	}
+	t.mu.Unlock()
+}
+
+func (t *fullBackupTask) addTotal(size int64) {
+	t.mu.Lock()
+	t.progress.TotalFiles++
+	t.progress.TotalBytes += size
+	t.mu.Unlock()
+}
+
+func (t *fullBackupTask) addScanned(size int64) {
+	t.mu.Lock()
+	t.progress.ScannedFiles++
+	t.progress.ScannedBytes += size
+	t.mu.Unlock()
+}
+
+func (t *fullBackupTask) addUploaded(size int64) {
+	t.mu.Lock()
+	t.progress.UploadedFiles++
+	t.progress.UploadedBytes += size
+	t.mu.Unlock()
+}
+
+// Progress 获取进度快照。剩余时间按已检查的字节数估算
+func (t *fullBackupTask) Progress() FullBackupProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress
+	elapsed := time.Since(t.started) - t.paused
+	if t.resume != nil {
+		elapsed -= time.Since(t.pausedAt)
+	}
+	p.Elapsed = int64(elapsed.Seconds())
+	p.ETA = -1
+	if p.Status != FullBackupStatusScanning && p.ScannedBytes > 0 && p.TotalBytes >= p.ScannedBytes {
+		p.ETA = int64(elapsed.Seconds() * float64(p.TotalBytes-p.ScannedBytes) / float64(p.ScannedBytes))
+	}
+	return p
+}
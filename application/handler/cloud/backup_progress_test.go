@@ -0,0 +1,81 @@
+package cloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFullBackupTaskRegistry(t *testing.T) {
+	a, err := startFullBackupTask(200001)
+	require.NoError(t, err)
+	defer a.finish()
+	b, err := startFullBackupTask(200002)
+	require.NoError(t, err)
+	defer b.finish()
+	_, err = startFullBackupTask(200001)
+	assert.Equal(t, ErrRunningPleaseWait, err)
+
+	// 取消一个配置的全量备份不影响其它配置
+	assert.True(t, stopFullBackup(200001))
+	assert.Error(t, a.wait())
+	assert.NoError(t, b.wait())
+	progress, ok := fullBackupProgress(200001)
+	assert.True(t, ok)
+	assert.Equal(t, FullBackupStatusStopping, progress.Status)
+
+	a.finish()
+	assert.False(t, fullBackupIsRunning(200001))
+	assert.True(t, fullBackupIsRunning(200002))
+	assert.False(t, stopFullBackup(200001))
+}
+
+func TestFullBackupTaskPause(t *testing.T) {
+	task, err := startFullBackupTask(200003)
+	require.NoError(t, err)
+	defer task.finish()
+	task.setStatus(FullBackupStatusRunning)
+
+	require.True(t, pauseFullBackup(200003))
+	assert.False(t, pauseFullBackup(200003))
+	progress, _ := fullBackupProgress(200003)
+	assert.Equal(t, FullBackupStatusPaused, progress.Status)
+
+	done := make(chan error, 1)
+	go func() { done <- task.wait() }()
+	select {
+	case <-done:
+		t.Fatal(`wait returned while paused`)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.True(t, resumeFullBackup(200003))
+	assert.NoError(t, <-done)
+	assert.False(t, resumeFullBackup(200003))
+
+	// 暂停中取消
+	require.True(t, pauseFullBackup(200003))
+	go func() { done <- task.wait() }()
+	task.Cancel()
+	assert.Error(t, <-done)
+}
+
+func TestFullBackupProgress(t *testing.T) {
+	task, err := startFullBackupTask(200004)
+	require.NoError(t, err)
+	defer task.finish()
+	task.addTotal(100)
+	task.addTotal(300)
+	assert.Equal(t, int64(-1), task.Progress().ETA)
+
+	task.setStatus(FullBackupStatusRunning)
+	task.started = time.Now().Add(-10 * time.Second)
+	task.addScanned(100)
+	task.addUploaded(100)
+	p := task.Progress()
+	assert.Equal(t, int64(2), p.TotalFiles)
+	assert.Equal(t, int64(1), p.UploadedFiles)
+	assert.Equal(t, 25.0, p.Percent())
+	assert.InDelta(t, 30, p.ETA, 1)
+}
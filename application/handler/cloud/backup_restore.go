@@ -0,0 +1,418 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/echo"
+)
+
+// ErrInvalidRestorePath 还原的文件路径无效(超出了还原目标路径)
+var ErrInvalidRestorePath = errors.New(`invalid restore path`)
+
+// RestoreEntry 可还原的文件
+type RestoreEntry struct {
+	Path       string `json:"path"`       // 相对于云存储目标路径的路径(以“/”分隔)
+	Object     string `json:"object"`     // 对象名称(未经加密和分块映射)
+	File       string `json:"file"`       // 备份时的本地文件
+	Size       int64  `json:"size"`       // 小于 0 时表示未知
+	MD5        string `json:"md5"`        // 可能为空
+	ModTime    int64  `json:"modTime"`    // 文件修改时间
+	BackupTime int64  `json:"backupTime"` // 备份时间
+	Version    string `json:"version"`    // 版本号(仅保留历史版本时)
+}
+
+// RestoreNode 浏览可还原文件时的一项
+type RestoreNode struct {
+	Name  string        `json:"name"`
+	Path  string        `json:"path"`
+	IsDir bool          `json:"isDir"`
+	Files int           `json:"files"` // 目录中的文件数
+	Size  int64         `json:"size"`  // 目录中已知大小的文件的总大小
+	Entry *RestoreEntry `json:"entry,omitempty"`
+}
+
+func restoreRelPath(p string) string {
+	return strings.Trim(path.Clean(`/`+filepath.ToSlash(p)), `/`)
+}
+
+// restoreEntriesFromIndex 从索引中获取可还原的文件。保留历史版本时获取 asOf 时间点的版本
+func restoreEntriesFromIndex(ldb *leveldb.DB, cfg dbschema.NgingCloudBackup, sourcePath string, versioned bool, asOf time.Time) ([]*RestoreEntry, error) {
+	var entries []*RestoreEntry
+	if versioned {
+		err := eachVersionFile(ldb, ``, func(file string, versions []*BackupVersion) error {
+			v := versionAsOf(versions, asOf)
+			if v == nil {
+				return nil
+			}
+			entries = append(entries, &RestoreEntry{
+				Path:       restoreRelPath(v.Path),
+				Object:     v.Object,
+				File:       file,
+				Size:       v.Size,
+				MD5:        v.MD5,
+				ModTime:    v.ModTime,
+				BackupTime: v.Created.Unix(),
+				Version:    v.ID,
+			})
+			return nil
+		})
+		sortRestoreEntries(entries)
+		return entries, err
+	}
+	iter := ldb.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		file := string(iter.Key())
+		if strings.HasPrefix(file, "\x00") {
+			continue
+		}
+		md5, _, endTs, modTs, size := cloudbackup.ParseDBValue(bytes.Clone(iter.Value()))
+		if endTs == 0 {
+			continue
+		}
+		rel := strings.TrimPrefix(file, sourcePath)
+		entries = append(entries, &RestoreEntry{
+			Path:       restoreRelPath(rel),
+			Object:     path.Join(cfg.DestPath, filepath.ToSlash(rel)),
+			File:       file,
+			Size:       size,
+			MD5:        md5,
+			ModTime:    modTs,
+			BackupTime: endTs,
+		})
+	}
+	sortRestoreEntries(entries)
+	return entries, iter.Error()
+}
+
+// objectNameDecoder 由存储包装层实现，将云存储中实际的对象名称还原为对象名称
+type objectNameDecoder interface {
+	logicalName(name string) (string, bool)
+}
+
+func (s *encryptedStorage) logicalName(name string) (string, bool) {
+	if !s.encryptName {
+		return name, true
+	}
+	rel, ok := s.relPath(name)
+	if !ok || len(rel) == 0 {
+		return name, ok
+	}
+	plain, err := s.cipher.DecryptPath(rel)
+	if err != nil {
+		return ``, false
+	}
+	return path.Join(s.destPath, plain), true
+}
+
+func (s *chunkedStorage) logicalName(name string) (string, bool) {
+	if d, ok := s.Storager.(objectNameDecoder); ok {
+		return d.logicalName(name)
+	}
+	return name, true
+}
+
+// restoreEntriesFromRemote 通过列出云存储中的对象获取可还原的文件(用于索引不存在时，比如在另一台服务器上还原)
+func restoreEntriesFromRemote(ctx context.Context, lister remoteLister, mgr cloudbackup.Storager, destPath string, versioned bool, asOf time.Time) ([]*RestoreEntry, error) {
+	dest := cleanObjectName(destPath)
+	decoder, wrapped := mgr.(objectNameDecoder)
+	latest := map[string]*RestoreEntry{}
+	err := lister.List(ctx, destPath, func(obj remoteObject) error {
+		name := cleanObjectName(obj.Name)
+		if wrapped {
+			var ok bool
+			if name, ok = decoder.logicalName(name); !ok {
+				return nil
+			}
+			name = cleanObjectName(name)
+		}
+		if dest != `/` && !strings.HasPrefix(name, dest+`/`) {
+			return nil
+		}
+		entry := &RestoreEntry{Path: strings.TrimPrefix(name[len(dest):], `/`), Object: name, Size: -1}
+		if !wrapped {
+			entry.Size = obj.Size
+		}
+		if versioned {
+			pos := strings.LastIndex(entry.Path, `@`)
+			if pos < 0 {
+				return nil
+			}
+			created, err := time.Parse(versionIDLayout, entry.Path[pos+1:])
+			if err != nil || created.After(asOf) {
+				return nil
+			}
+			entry.Version = entry.Path[pos+1:]
+			entry.Path = entry.Path[:pos]
+			entry.BackupTime = created.Unix()
+		}
+		if old, ok := latest[entry.Path]; !ok || old.Version < entry.Version {
+			latest[entry.Path] = entry
+		}
+		return nil
+	})
+	entries := make([]*RestoreEntry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+	sortRestoreEntries(entries)
+	return entries, err
+}
+
+func sortRestoreEntries(entries []*RestoreEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+}
+
+// selectRestoreEntries 筛选选中的文件或目录中的文件，selected 为空时返回全部
+func selectRestoreEntries(entries []*RestoreEntry, selected []string) []*RestoreEntry {
+	if len(selected) == 0 {
+		return entries
+	}
+	paths := make([]string, 0, len(selected))
+	for _, p := range selected {
+		p = restoreRelPath(p)
+		if len(p) == 0 { // 根目录
+			return entries
+		}
+		paths = append(paths, p)
+	}
+	var result []*RestoreEntry
+	for _, entry := range entries {
+		for _, p := range paths {
+			if entry.Path == p || strings.HasPrefix(entry.Path, p+`/`) {
+				result = append(result, entry)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// browseRestoreEntries 列出目录 dir 中的子目录和文件
+func browseRestoreEntries(entries []*RestoreEntry, dir string) []*RestoreNode {
+	dir = restoreRelPath(dir)
+	prefix := dir
+	if len(prefix) > 0 {
+		prefix += `/`
+	}
+	dirs := map[string]*RestoreNode{}
+	var nodes []*RestoreNode
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Path, prefix) {
+			continue
+		}
+		rest := entry.Path[len(prefix):]
+		if pos := strings.Index(rest, `/`); pos >= 0 {
+			name := rest[:pos]
+			node, ok := dirs[name]
+			if !ok {
+				node = &RestoreNode{Name: name, Path: prefix + name, IsDir: true}
+				dirs[name] = node
+				nodes = append(nodes, node)
+			}
+			node.Files++
+			if entry.Size > 0 {
+				node.Size += entry.Size
+			}
+			continue
+		}
+		nodes = append(nodes, &RestoreNode{Name: rest, Path: entry.Path, Files: 1, Size: entry.Size, Entry: entry})
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].IsDir != nodes[j].IsDir {
+			return nodes[i].IsDir
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// loadRestoreEntries 获取可还原的文件。优先使用索引，索引中没有记录时列出云存储中的对象
+func loadRestoreEntries(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, mgr cloudbackup.Storager, asOf time.Time) ([]*RestoreEntry, error) {
+	sourcePath, _, err := backupSource(cfg)
+	if err != nil {
+		sourcePath = cfg.SourcePath
+	}
+	ldb, err := cloudbackup.LevelDB().OpenDB(cfg.Id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := restoreEntriesFromIndex(ldb, cfg, sourcePath, extra.IsVersioned(), asOf)
+	if err != nil || len(entries) > 0 {
+		return entries, err
+	}
+	lister, err := newRemoteLister(ctx, cfg)
+	if err != nil || lister == nil {
+		return entries, err
+	}
+	defer lister.Close()
+	lister = newExcludeLister(lister, chunkRoot(cfg.DestPath), catalogRoot(cfg.DestPath))
+	return restoreEntriesFromRemote(ctx, lister, mgr, cfg.DestPath, extra.IsVersioned(), asOf)
+}
+
+// restoreTarget 还原目标
+type restoreTarget interface {
+	// Restore 从 mgr 下载 entry 并保存到还原目标，返回保存的位置
+	Restore(ctx context.Context, mgr cloudbackup.Storager, entry *RestoreEntry) (string, error)
+	Close() error
+}
+
+func newLocalRestoreTarget(root string) (*localRestoreTarget, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		root = real
+	}
+	return &localRestoreTarget{root: root}, nil
+}
+
+// localRestoreTarget 还原到本机路径。先下载到临时文件再替换，还原过程中监控备份忽略这些文件
+type localRestoreTarget struct {
+	root     string
+	restored []string
+}
+
+func (t *localRestoreTarget) Restore(ctx context.Context, mgr cloudbackup.Storager, entry *RestoreEntry) (string, error) {
+	dest := filepath.Join(t.root, filepath.FromSlash(restoreRelPath(entry.Path)))
+	if dest == t.root || !strings.HasPrefix(dest, t.root+string(filepath.Separator)) {
+		return dest, ErrInvalidRestorePath
+	}
+	tmp := filepath.Join(filepath.Dir(dest), `.`+filepath.Base(dest)+`.restoring.tmp`)
+	beginRestoring(dest)
+	beginRestoring(tmp)
+	t.restored = append(t.restored, dest, tmp)
+	if err := cloudbackup.DownloadFile(mgr, ctx, entry.Object, tmp); err != nil {
+		os.Remove(tmp)
+		return dest, err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return dest, err
+	}
+	if entry.ModTime > 0 {
+		mtime := time.Unix(entry.ModTime, 0)
+		os.Chtimes(dest, mtime, mtime)
+	}
+	return dest, nil
+}
+
+func (t *localRestoreTarget) Close() error {
+	endRestoring(t.restored...)
+	t.restored = nil
+	return nil
+}
+
+// newStorageRestoreTarget 还原到另一个云存储账号(用于迁移)
+func newStorageRestoreTarget(ctx echo.Context, storageID uint, prefix string) (*storageRestoreTarget, error) {
+	m := dbschema.NewNgingCloudStorage(ctx)
+	if err := m.Get(nil, `id`, storageID); err != nil {
+		return nil, err
+	}
+	m.Secret = common.Crypto().Decode(m.Secret)
+	s := cloudbackup.NewStorageS3(*m)
+	if err := s.Connect(); err != nil {
+		return nil, err
+	}
+	return &storageRestoreTarget{storage: s, prefix: prefix}, nil
+}
+
+type storageRestoreTarget struct {
+	storage cloudbackup.Storager
+	prefix  string
+}
+
+func (t *storageRestoreTarget) Restore(ctx context.Context, mgr cloudbackup.Storager, entry *RestoreEntry) (string, error) {
+	dest := path.Join(`/`, t.prefix, restoreRelPath(entry.Path))
+	if entry.Size < 0 { // 大小未知时先下载到临时文件
+		fp, err := os.CreateTemp(``, `nging-restore-*`)
+		if err != nil {
+			return dest, err
+		}
+		defer func() {
+			fp.Close()
+			os.Remove(fp.Name())
+		}()
+		if err = mgr.Download(ctx, entry.Object, fp); err != nil {
+			return dest, err
+		}
+		size, err := fp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return dest, err
+		}
+		if _, err = fp.Seek(0, io.SeekStart); err != nil {
+			return dest, err
+		}
+		return dest, t.storage.Put(ctx, fp, dest, size)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(mgr.Download(ctx, entry.Object, pw))
+	}()
+	err := t.storage.Put(ctx, pr, dest, entry.Size)
+	pr.CloseWithError(err)
+	return dest, err
+}
+
+func (t *storageRestoreTarget) Close() error {
+	return t.storage.Close()
+}
+
+// restoreEntries 将文件逐个还原到 target
+func restoreEntries(ctx context.Context, mgr cloudbackup.Storager, entries []*RestoreEntry, target restoreTarget, callback func(from, to string), prog notice.Progressor) error {
+	if prog != nil {
+		prog.Add(int64(len(entries)))
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		to, err := target.Restore(ctx, mgr, entry)
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, entry.Path, err)
+		}
+		if callback != nil {
+			callback(entry.Object, to)
+		}
+		if prog != nil {
+			prog.Done(1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package cloud
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func restorePaths(entries []*RestoreEntry) []string {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = entry.Path
+	}
+	return paths
+}
+
+func TestSelectAndBrowseRestoreEntries(t *testing.T) {
+	entries := []*RestoreEntry{
+		{Path: `a.txt`, Size: 1},
+		{Path: `dir/b.txt`, Size: 2},
+		{Path: `dir/sub/c.txt`, Size: -1},
+		{Path: `dir2/d.txt`, Size: 4},
+	}
+	assert.Len(t, selectRestoreEntries(entries, nil), 4)
+	assert.Len(t, selectRestoreEntries(entries, []string{`/`}), 4)
+	assert.Equal(t, []string{`dir/b.txt`, `dir/sub/c.txt`}, restorePaths(selectRestoreEntries(entries, []string{`/dir`})))
+	assert.Equal(t, []string{`a.txt`, `dir/sub/c.txt`}, restorePaths(selectRestoreEntries(entries, []string{`a.txt`, `dir/sub/`})))
+	assert.Empty(t, selectRestoreEntries(entries, []string{`di`}))
+
+	nodes := browseRestoreEntries(entries, `/`)
+	require.Len(t, nodes, 3)
+	assert.Equal(t, `dir`, nodes[0].Name)
+	assert.True(t, nodes[0].IsDir)
+	assert.Equal(t, 2, nodes[0].Files)
+	assert.Equal(t, int64(2), nodes[0].Size) // 大小未知的文件不计入
+	assert.Equal(t, `dir2`, nodes[1].Name)
+	assert.Equal(t, `a.txt`, nodes[2].Name)
+	assert.NotNil(t, nodes[2].Entry)
+
+	nodes = browseRestoreEntries(entries, `dir`)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, `dir/sub`, nodes[0].Path)
+	assert.Equal(t, `dir/b.txt`, nodes[1].Path)
+}
+
+func TestRestoreEntriesFromIndex(t *testing.T) {
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put([]byte(`/data/dir/b.txt`), []byte(`md5b||1||3||2||5`), nil))
+	require.NoError(t, db.Put([]byte(`/data/a.txt`), []byte(`md5a||1||3||2||5`), nil))
+	require.NoError(t, db.Put([]byte(`/data/uploading.txt`), []byte(`md5c||1||0||2||5`), nil))
+	cfg := dbschema.NgingCloudBackup{SourcePath: `/data`, DestPath: `/backup`}
+	entries, err := restoreEntriesFromIndex(db, cfg, `/data`, false, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{`a.txt`, `dir/b.txt`}, restorePaths(entries))
+	assert.Equal(t, `/backup/dir/b.txt`, entries[1].Object)
+	assert.Equal(t, `md5b`, entries[1].MD5)
+	assert.Equal(t, int64(3), entries[1].BackupTime)
+}
+
+func TestRestoreEntriesFromRemote(t *testing.T) {
+	ctx := context.Background()
+	mem := &memStorage{files: map[string][]byte{}}
+	s := newEncryptedStorage(mem, testCipher(t, testKey1), `/backup`, true)
+	old := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := old.Add(time.Hour)
+	for name, content := range map[string]string{
+		versionObjectName(`/backup`, `a.txt`, newVersionID(old)):     `old`,
+		versionObjectName(`/backup`, `a.txt`, newVersionID(now)):     `new`,
+		versionObjectName(`/backup`, `dir/b.txt`, newVersionID(now)): `b`,
+	} {
+		require.NoError(t, s.Put(ctx, strings.NewReader(content), name, int64(len(content))))
+	}
+	mem.files[`/other/x.txt`] = []byte(`x`)
+	lister := &memLister{mem: mem}
+
+	entries, err := restoreEntriesFromRemote(ctx, lister, s, `/backup`, true, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{`a.txt`, `dir/b.txt`}, restorePaths(entries))
+	assert.Equal(t, newVersionID(now), entries[0].Version)
+	assert.Equal(t, int64(-1), entries[0].Size) // 加密后的大小不是文件大小
+
+	entries, err = restoreEntriesFromRemote(ctx, lister, s, `/backup`, true, old)
+	require.NoError(t, err)
+	require.Equal(t, []string{`a.txt`}, restorePaths(entries))
+
+	// 还原到另一个存储
+	target := &storageRestoreTarget{storage: &memStorage{files: map[string][]byte{}}, prefix: `/migrate`}
+	require.NoError(t, restoreEntries(ctx, s, entries, target, nil, nil))
+	assert.Equal(t, []byte(`old`), target.storage.(*memStorage).files[`/migrate/a.txt`])
+}
+
+func TestLocalRestoreTarget(t *testing.T) {
+	ctx := context.Background()
+	mem := &memStorage{files: map[string][]byte{`/backup/dir/b.txt`: []byte(`hello`)}}
+	root := t.TempDir()
+	target, err := newLocalRestoreTarget(root)
+	require.NoError(t, err)
+	modTime := time.Now().Add(-time.Hour).Unix()
+	var restored []string
+	err = restoreEntries(ctx, mem, []*RestoreEntry{{Path: `dir/b.txt`, Object: `/backup/dir/b.txt`, ModTime: modTime}}, target, func(from, to string) {
+		restored = append(restored, to)
+		assert.True(t, isRestoring(to))
+	}, nil)
+	require.NoError(t, err)
+	dest := filepath.Join(target.root, `dir`, `b.txt`)
+	assert.Equal(t, []string{dest}, restored)
+	b, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, `hello`, string(b))
+	fi, err := os.Stat(dest)
+	require.NoError(t, err)
+	assert.Equal(t, modTime, fi.ModTime().Unix())
+
+	require.NoError(t, target.Close())
+	assert.True(t, isRestoring(dest)) // 关闭后短时间内仍忽略迟到的文件事件
+	restoringFiles.Store(dest, time.Now().Add(-time.Second).UnixNano())
+	assert.False(t, isRestoring(dest))
+
+	_, err = target.Restore(ctx, mem, &RestoreEntry{Path: `..`, Object: `/backup/dir/b.txt`})
+	assert.ErrorIs(t, err, ErrInvalidRestorePath)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/webx-top/db"
 	"github.com/webx-top/echo"
 	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/defaults"
 )
 
 func BackupStart(ctx echo.Context) error {
@@ -22,18 +23,67 @@ func BackupStart(ctx echo.Context) error {
 		}
 		return err
 	}
+	extra, err := getBackupExtra(m.Id)
+	if err != nil {
+		return err
+	}
 	switch ctx.Form(`op`) {
+	case "resume":
+		if !resumeFullBackup(m.Id) {
+			return ctx.NewError(code.Failure, `全量备份没有暂停`)
+		}
+		common.SendOk(ctx, ctx.T(`操作成功`))
+		return ctx.Redirect(backend.URLFor(`/cloud/backup`))
 	case "full":
 		user := backend.User(ctx)
 		notice.OpenMessage(user.Username, `cloudbackupFull`)
-		err = fullBackupStart(*m.NgingCloudBackup, user.Username, `cloudbackupFull`)
+		err = fullBackupStart(*m.NgingCloudBackup, extra, user.Username, `cloudbackupFull`)
 		if err != nil {
 			if err == ErrRunningPleaseWait {
 				err = ctx.NewError(code.OperationProcessing, `运行中，请稍候，如果文件很多可能会需要多等一会儿`)
 			}
 		}
+	case "catalog":
+		user := backend.User(ctx)
+		notice.OpenMessage(user.Username, `cloudbackupCatalog`)
+		cfg := *m.NgingCloudBackup
+		go func() {
+			ctx := defaults.NewMockContext()
+			noticeTitle := ctx.T(`保存目录快照`)
+			meta, err := exportCatalog(ctx, cfg, extra)
+			if err != nil {
+				notice.Send(user.Username, notice.NewMessageWithValue(`cloudbackupCatalog`, noticeTitle, err.Error(), notice.StateFailure))
+				return
+			}
+			msg := ctx.T(`目录快照已保存：%s (索引记录%d条)`, meta.ID, meta.Records)
+			notice.Send(user.Username, notice.NewMessageWithValue(`cloudbackupCatalog`, noticeTitle, msg, notice.StateSuccess))
+		}()
+		common.SendOk(ctx, ctx.T(`正在保存目录快照，完成后会通知您`))
+		return ctx.Redirect(backend.URLFor(`/cloud/backup`))
+	case "verify":
+		if verifyBackupIsRunning(m.Id) {
+			return ctx.NewError(code.OperationProcessing, `校验中，请稍候`)
+		}
+		user := backend.User(ctx)
+		notice.OpenMessage(user.Username, `cloudbackupVerify`)
+		cfg := *m.NgingCloudBackup
+		go func() {
+			ctx := defaults.NewMockContext()
+			noticeTitle := ctx.T(`校验备份`)
+			report, err := verifyBackup(ctx, cfg, extra)
+			switch {
+			case err != nil:
+				notice.Send(user.Username, notice.NewMessageWithValue(`cloudbackupVerify`, noticeTitle, err.Error(), notice.StateFailure))
+			case report.HasProblem():
+				notice.Send(user.Username, notice.NewMessageWithValue(`cloudbackupVerify`, noticeTitle, report.Summary(ctx), notice.StateFailure))
+			default:
+				notice.Send(user.Username, notice.NewMessageWithValue(`cloudbackupVerify`, noticeTitle, report.Summary(ctx), notice.StateSuccess))
+			}
+		}()
+		common.SendOk(ctx, ctx.T(`已开始校验，完成后会通知您，校验结果请查看备份日志`))
+		return ctx.Redirect(backend.URLFor(`/cloud/backup`))
 	default:
-		err = monitorBackupStart(*m.NgingCloudBackup)
+		err = monitorBackupStart(*m.NgingCloudBackup, extra)
 	}
 	if err != nil {
 		return err
@@ -58,8 +108,10 @@ func BackupStop(ctx echo.Context) error {
 	}
 	switch ctx.Form(`op`) {
 	case "full":
-		if fullBackupIsRunning(m.Id) {
-			fullBackupExit.Store(true)
+		stopFullBackup(m.Id)
+	case "pause":
+		if !pauseFullBackup(m.Id) {
+			return ctx.NewError(code.Failure, `全量备份没有在运行或已暂停`)
 		}
 	default:
 		err = monitorBackupStop(m.Id)
@@ -72,8 +124,6 @@ func BackupStop(ctx echo.Context) error {
 }
 
 func allBackupStop(id uint) error {
-	if fullBackupIsRunning(id) {
-		fullBackupExit.Store(true)
-	}
+	stopFullBackup(id)
 	return monitorBackupStop(id)
 }
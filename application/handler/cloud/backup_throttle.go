@@ -0,0 +1,299 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+	"golang.org/x/time/rate"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/registry/settings"
+	"github.com/webx-top/echo"
+)
+
+// 全量备份的全局设置(系统设置中的“云备份”)
+const settingGroup = `cloudbackup`
+
+// 默认的并行上传数
+const defaultUploadWorkers = 4
+
+// 最大的并行上传数
+const maxUploadWorkers = 64
+
+// 每次限速等待的最大字节数
+const throttleMaxBurst = 64 * 1024
+
+func init() {
+	settings.AddDefaultConfig(settingGroup, map[string]*dbschema.NgingConfig{
+		`workers`: {
+			Key:         `workers`,
+			Label:       echo.T(`并行上传数`),
+			Description: echo.T(`全量备份时同时上传的文件数(备份配置中未设置时使用)`),
+			Value:       fmt.Sprint(defaultUploadWorkers),
+			Group:       settingGroup,
+			Type:        `text`,
+			Sort:        10,
+			Disabled:    `N`,
+		},
+		`bandwidthLimit`: {
+			Key:         `bandwidthLimit`,
+			Label:       echo.T(`总带宽限制`),
+			Description: echo.T(`所有全量备份上传的总速度上限(字节/秒)，0为不限制`),
+			Value:       `0`,
+			Group:       settingGroup,
+			Type:        `text`,
+			Sort:        20,
+			Disabled:    `N`,
+		},
+	})
+}
+
+// globalBandwidth 所有全量备份共享的限速器
+var globalBandwidth = struct {
+	sync.Mutex
+	limit   int64
+	limiter *rate.Limiter
+}{limiter: rate.NewLimiter(rate.Inf, throttleMaxBurst)}
+
+// globalBandwidthLimiter 按系统设置更新并返回全局限速器，未限速时返回 nil
+func globalBandwidthLimiter() *rate.Limiter {
+	limit := common.Setting(settingGroup).Int64(`bandwidthLimit`)
+	globalBandwidth.Lock()
+	defer globalBandwidth.Unlock()
+	if limit != globalBandwidth.limit {
+		globalBandwidth.limit = limit
+		setBandwidthLimit(globalBandwidth.limiter, limit)
+	}
+	if limit <= 0 {
+		return nil
+	}
+	return globalBandwidth.limiter
+}
+
+// defaultWorkers 系统设置中的并行上传数
+func defaultWorkers() int {
+	workers := common.Setting(settingGroup).Int(`workers`)
+	if workers <= 0 {
+		return defaultUploadWorkers
+	}
+	return workers
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, throttleMaxBurst)
+	setBandwidthLimit(l, bytesPerSecond)
+	return l
+}
+
+func setBandwidthLimit(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(bytesPerSecond)
+	if burst > throttleMaxBurst {
+		burst = throttleMaxBurst
+	}
+	l.SetBurst(burst)
+	l.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// throttleWindow 每天的限速时段，以分钟计。开始时间大于结束时间时表示跨越零点
+type throttleWindow struct {
+	start, end int
+	always     bool
+}
+
+// parseClock 解析“时:分”格式的时间
+func parseClock(value string) (int, error) {
+	t, err := time.Parse(`15:04`, strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseThrottleWindow 解析限速时段，开始和结束时间都为空时全天限速
+func parseThrottleWindow(start, end string) (w throttleWindow, err error) {
+	if len(start) == 0 && len(end) == 0 {
+		w.always = true
+		return
+	}
+	if w.start, err = parseClock(start); err != nil {
+		return
+	}
+	w.end, err = parseClock(end)
+	return
+}
+
+// Contains t 是否在限速时段内
+func (w throttleWindow) Contains(t time.Time) bool {
+	if w.always {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// uploadThrottle 单个全量备份任务的限速规则
+type uploadThrottle struct {
+	limiter *rate.Limiter // 本配置的限速器，未限速时为 nil
+	window  throttleWindow
+	global  func() *rate.Limiter
+	now     func() time.Time
+}
+
+func newUploadThrottle(extra *BackupExtra) *uploadThrottle {
+	t := &uploadThrottle{global: globalBandwidthLimiter, now: time.Now}
+	if extra.BandwidthLimit > 0 {
+		t.limiter = newBandwidthLimiter(int64(extra.BandwidthLimit))
+		t.window, _ = parseThrottleWindow(extra.ThrottleStart, extra.ThrottleEnd)
+	}
+	return t
+}
+
+// limiters 当前生效的限速器
+func (t *uploadThrottle) limiters() []*rate.Limiter {
+	var limiters []*rate.Limiter
+	if t.global != nil {
+		if l := t.global(); l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	if t.limiter != nil && t.window.Contains(t.now()) {
+		limiters = append(limiters, t.limiter)
+	}
+	return limiters
+}
+
+// Reader 对上传的文件限速。返回的 ReadSeekCloser 支持重试上传时的 Seek
+func (t *uploadThrottle) Reader(ctx context.Context, r io.ReadSeekCloser) io.ReadSeekCloser {
+	return &throttledReader{ReadSeekCloser: r, ctx: ctx, throttle: t}
+}
+
+type throttledReader struct {
+	io.ReadSeekCloser
+	ctx      context.Context
+	throttle *uploadThrottle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	limiters := r.throttle.limiters()
+	for _, l := range limiters {
+		if burst := l.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := r.ReadSeekCloser.Read(p)
+	for _, l := range limiters {
+		if werr := l.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// parallelWalk 由 walk 遍历文件，交给 workers 个协程并行调用 fn 处理，worker 为协程序号(从0开始)。
+// 遇到错误时停止遍历，等待正在处理的文件完成后返回第一个错误
+func parallelWalk(ctx context.Context, workers int, walk func(func(string, os.FileInfo) error) error, fn func(worker int, ppath string, info os.FileInfo) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	type job struct {
+		ppath string
+		info  os.FileInfo
+	}
+	var (
+		jobs     = make(chan job)
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	getErr := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := range jobs {
+				if getErr() != nil {
+					continue
+				}
+				if err := fn(worker, j.ppath, j.info); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+	err := walk(func(ppath string, info os.FileInfo) error {
+		if err := getErr(); err != nil {
+			return err
+		}
+		select {
+		case jobs <- job{ppath: ppath, info: info}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	if ferr := getErr(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// openWorkerStorages 为每个上传协程准备独立的云存储客户端。FTP、SMB 等客户端只有一个连接，
+// 不能在多个协程中同时使用。mgr 为已连接的客户端，供第一个协程使用；其余客户端连接失败时减少协程数
+func openWorkerStorages(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, mgr cloudbackup.Storager, workers int) []cloudbackup.Storager {
+	mgrs := []cloudbackup.Storager{mgr}
+	for i := 1; i < workers; i++ {
+		m, err := newStorage(ctx, cfg, extra)
+		if err == nil {
+			err = m.Connect()
+		}
+		if err != nil {
+			log.Warnf(`failed to connect storage for upload worker %d of backup %d: %v`, i, cfg.Id, err)
+			break
+		}
+		mgrs = append(mgrs, m)
+	}
+	return mgrs
+}
@@ -0,0 +1,139 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestThrottleWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		v, err := time.Parse(`15:04`, clock)
+		require.NoError(t, err)
+		return v
+	}
+	w, err := parseThrottleWindow(`09:00`, `18:00`)
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(`09:00`)))
+	assert.True(t, w.Contains(at(`17:59`)))
+	assert.False(t, w.Contains(at(`18:00`)))
+	assert.False(t, w.Contains(at(`03:00`)))
+
+	// 跨越零点
+	w, err = parseThrottleWindow(`22:00`, `06:00`)
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(`23:30`)))
+	assert.True(t, w.Contains(at(`05:59`)))
+	assert.False(t, w.Contains(at(`12:00`)))
+
+	w, err = parseThrottleWindow(``, ``)
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(`12:00`)))
+
+	_, err = parseThrottleWindow(`9`, `18:00`)
+	assert.Error(t, err)
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func TestUploadThrottle(t *testing.T) {
+	data := make([]byte, 150000)
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.Local)
+	throttle := &uploadThrottle{
+		limiter: newBandwidthLimiter(100000),
+		now:     func() time.Time { return now },
+	}
+	throttle.window, _ = parseThrottleWindow(`09:00`, `18:00`)
+
+	read := func() time.Duration {
+		start := time.Now()
+		r := throttle.Reader(context.Background(), nopSeekCloser{bytes.NewReader(data)})
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, len(data), len(b))
+		return time.Since(start)
+	}
+	assert.GreaterOrEqual(t, read(), 700*time.Millisecond)
+
+	// 限速时段之外不限速
+	now = time.Date(2026, 3, 1, 20, 0, 0, 0, time.Local)
+	throttle.limiter = newBandwidthLimiter(100000)
+	assert.Less(t, read(), 200*time.Millisecond)
+
+	// 全局限速始终生效
+	global := rate.NewLimiter(rate.Inf, throttleMaxBurst)
+	setBandwidthLimit(global, 100000)
+	throttle.global = func() *rate.Limiter { return global }
+	assert.GreaterOrEqual(t, read(), 700*time.Millisecond)
+}
+
+func TestParallelWalk(t *testing.T) {
+	walk := func(n int) func(func(string, os.FileInfo) error) error {
+		return func(fn func(string, os.FileInfo) error) error {
+			for i := 0; i < n; i++ {
+				if err := fn(`file`, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	var running, maxRunning, done int32
+	var workers sync.Map
+	err := parallelWalk(context.Background(), 4, walk(20), func(worker int, _ string, _ os.FileInfo) error {
+		workers.Store(worker, true)
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&done, 1)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(20), done)
+	assert.Equal(t, int32(4), maxRunning)
+	workers.Range(func(k, _ any) bool { // 协程序号用于选择各自的云存储客户端
+		assert.True(t, k.(int) >= 0 && k.(int) < 4)
+		return true
+	})
+
+	// 出错后停止遍历
+	errFailed := errors.New(`failed`)
+	var calls int32
+	err = parallelWalk(context.Background(), 2, walk(1000), func(int, string, os.FileInfo) error {
+		if atomic.AddInt32(&calls, 1) == 3 {
+			return errFailed
+		}
+		return nil
+	})
+	assert.Equal(t, errFailed, err)
+	assert.Less(t, atomic.LoadInt32(&calls), int32(1000))
+
+	// 取消
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = parallelWalk(ctx, 1, walk(1000), func(int, string, os.FileInfo) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,497 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/cron"
+	"github.com/coscms/webcore/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/webx-top/com"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/param"
+)
+
+// verifySampleSize 每次校验时下载抽查的文件数
+var verifySampleSize = 10
+
+// verifyMaxLogs 每次校验最多记录的问题日志数(超出的只计入汇总)
+const verifyMaxLogs = 1000
+
+const (
+	verifyMissing  = `missing`
+	verifyExtra    = `extra`
+	verifyMismatch = `mismatch`
+)
+
+// verifyJobName 校验云备份的系统任务名称
+const verifyJobName = `cloudBackupVerify`
+
+// VerifyJob 校验云备份的系统任务。参数为备份配置ID，不指定时校验所有启用的配置
+var VerifyJob = &cron.Jobx{
+	Name:         verifyJobName,
+	Example:      `>` + verifyJobName + `:1`,
+	Description:  `校验云备份与索引是否一致`,
+	RunnerGetter: verifyRunnerGetter,
+}
+
+// verifyItem 索引中记录的已备份文件
+type verifyItem struct {
+	File    string // 本地文件路径
+	Object  string // 对象名称(未经加密和分块映射)
+	MD5     string // 可能为空
+	Size    int64
+	ModTime int64
+}
+
+// verifyProblem 校验发现的问题
+type verifyProblem struct {
+	Kind   string
+	File   string
+	Object string
+	Size   int64
+	Reason string
+}
+
+// VerifyReport 备份校验结果
+type VerifyReport struct {
+	Files    int  // 索引中的文件数
+	Objects  int  // 应该存在的对象数
+	Sampled  int  // 下载抽查的文件数
+	Listed   bool // 是否列出了云存储中的对象(不支持的存储引擎无法检查多余对象)
+	Problems []verifyProblem
+}
+
+func (r *VerifyReport) add(p verifyProblem) {
+	r.Problems = append(r.Problems, p)
+}
+
+func (r *VerifyReport) count(kind string) (n int) {
+	for _, p := range r.Problems {
+		if p.Kind == kind {
+			n++
+		}
+	}
+	return
+}
+
+func (r *VerifyReport) HasProblem() bool {
+	return len(r.Problems) > 0
+}
+
+func (r *VerifyReport) Summary(ctx echo.Context) string {
+	s := ctx.T(`校验完成：文件%d个，对象%d个，下载抽查%d个；缺失%d个，多余%d个，不一致%d个`,
+		r.Files, r.Objects, r.Sampled, r.count(verifyMissing), r.count(verifyExtra), r.count(verifyMismatch))
+	if !r.Listed {
+		s += ctx.T(`(该存储引擎不支持列出对象，未检查多余的对象)`)
+	}
+	return s
+}
+
+// objectMapper 由存储包装层实现，将对象名称映射为云存储中实际保存的对象
+type objectMapper interface {
+	remoteObjects(ppath string, size int64) []remoteObject
+}
+
+// mapRemoteObjects 获取对象 ppath 在云存储中实际对应的对象及其大小
+func mapRemoteObjects(mgr cloudbackup.Storager, ppath string, size int64) []remoteObject {
+	if m, ok := mgr.(objectMapper); ok {
+		return m.remoteObjects(ppath, size)
+	}
+	return []remoteObject{{Name: ppath, Size: size}}
+}
+
+func cleanObjectName(name string) string {
+	return path.Clean(`/` + name)
+}
+
+// verifyItems 从索引中读取已备份的文件。保留历史版本时每个未删除的版本都是一个对象
+func verifyItems(ldb *leveldb.DB, cfg dbschema.NgingCloudBackup, sourcePath string, versioned bool) ([]verifyItem, error) {
+	var items []verifyItem
+	if versioned {
+		err := eachVersionFile(ldb, ``, func(file string, versions []*BackupVersion) error {
+			for _, v := range versions {
+				if v.Deleted {
+					continue
+				}
+				items = append(items, verifyItem{File: file, Object: v.Object, MD5: v.MD5, Size: v.Size, ModTime: v.ModTime})
+			}
+			return nil
+		})
+		return items, err
+	}
+	iter := ldb.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		file := string(iter.Key())
+		if strings.HasPrefix(file, "\x00") {
+			continue
+		}
+		// 迭代器会复用 Value 的内存，需复制后再解析
+		md5, _, endTs, modTs, size := cloudbackup.ParseDBValue(bytes.Clone(iter.Value()))
+		if endTs == 0 { // 未上传完成
+			continue
+		}
+		items = append(items, verifyItem{
+			File:    file,
+			Object:  path.Join(cfg.DestPath, strings.TrimPrefix(file, sourcePath)),
+			MD5:     md5,
+			Size:    size,
+			ModTime: modTs,
+		})
+	}
+	return items, iter.Error()
+}
+
+type verifyExpected struct {
+	item verifyItem
+	obj  remoteObject
+}
+
+// verifyObjects 校验云存储中的对象。
+// lister 不为 nil 时列出 prefixes 下的所有对象，检查缺失、多余以及大小或 ETag 不一致的对象；
+// 然后随机下载 sample 个文件(小于 0 时全部下载)校验大小和 md5。
+// 索引中未记录 md5 时通过 localMD5 计算本地文件的 md5(本地文件已更改时返回空字符串)
+func verifyObjects(ctx context.Context, mgr cloudbackup.Storager, lister remoteLister, prefixes []string, items []verifyItem, sample int, localMD5 func(verifyItem) string) (*VerifyReport, error) {
+	report := &VerifyReport{Files: len(items), Listed: lister != nil}
+	_, wrapped := mgr.(objectMapper)
+	var names []string
+	expected := map[string]verifyExpected{}
+	owners := map[string][]string{} // 对象被哪些文件引用(数据块可被多个文件共享)
+	for _, item := range items {
+		for _, obj := range mapRemoteObjects(mgr, item.Object, item.Size) {
+			name := cleanObjectName(obj.Name)
+			owners[name] = append(owners[name], item.Object)
+			if _, ok := expected[name]; ok {
+				continue
+			}
+			if !wrapped {
+				obj.ETag = item.MD5
+			}
+			expected[name] = verifyExpected{item: item, obj: obj}
+			names = append(names, name)
+		}
+	}
+	report.Objects = len(names)
+	failed := map[string]struct{}{}
+	if lister != nil {
+		listed := map[string]remoteObject{}
+		for _, prefix := range prefixes {
+			err := lister.List(ctx, prefix, func(obj remoteObject) error {
+				listed[cleanObjectName(obj.Name)] = obj
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			exp := expected[name]
+			obj, ok := listed[name]
+			problem := verifyProblem{File: exp.item.File, Object: name, Size: exp.obj.Size}
+			switch {
+			case !ok:
+				problem.Kind = verifyMissing
+				problem.Reason = `object not found`
+			case exp.obj.Size >= 0 && obj.Size != exp.obj.Size:
+				problem.Kind = verifyMismatch
+				problem.Reason = fmt.Sprintf(`size mismatch: remote %d, expected %d`, obj.Size, exp.obj.Size)
+			default:
+				etag := strings.Trim(obj.ETag, `"`)
+				// 分片上传的 ETag 不是内容的 md5
+				if len(exp.obj.ETag) == 0 || len(etag) == 0 || strings.Contains(etag, `-`) || strings.EqualFold(etag, exp.obj.ETag) {
+					continue
+				}
+				problem.Kind = verifyMismatch
+				problem.Reason = fmt.Sprintf(`etag mismatch: remote %s, expected %s`, etag, exp.obj.ETag)
+			}
+			report.add(problem)
+			for _, object := range owners[name] {
+				failed[object] = struct{}{}
+			}
+		}
+		extras := make([]string, 0)
+		for name := range listed {
+			if _, ok := expected[name]; !ok {
+				extras = append(extras, name)
+			}
+		}
+		sort.Strings(extras)
+		for _, name := range extras {
+			report.add(verifyProblem{Kind: verifyExtra, Object: name, Size: listed[name].Size, Reason: `object not in index`})
+		}
+	}
+	var candidates []verifyItem
+	for _, item := range items {
+		if _, ok := failed[item.Object]; !ok {
+			candidates = append(candidates, item)
+		}
+	}
+	if sample < 0 || sample > len(candidates) {
+		sample = len(candidates)
+	}
+	for _, i := range rand.Perm(len(candidates))[:sample] {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		item := candidates[i]
+		report.Sampled++
+		problem := verifyProblem{Kind: verifyMismatch, File: item.File, Object: item.Object, Size: item.Size}
+		h := md5.New()
+		w := &countWriter{Hash: h}
+		if err := mgr.Download(ctx, item.Object, w); err != nil {
+			if lister == nil {
+				problem.Kind = verifyMissing
+			}
+			problem.Reason = fmt.Sprintf(`download failed: %v`, err)
+			report.add(problem)
+			continue
+		}
+		if w.n != item.Size {
+			problem.Reason = fmt.Sprintf(`size mismatch: downloaded %d, expected %d`, w.n, item.Size)
+			report.add(problem)
+			continue
+		}
+		want := item.MD5
+		if len(want) == 0 && localMD5 != nil {
+			want = localMD5(item)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); len(want) > 0 && !strings.EqualFold(sum, want) {
+			problem.Reason = fmt.Sprintf(`md5 mismatch: downloaded %s, expected %s`, sum, want)
+			report.add(problem)
+		}
+	}
+	return report, nil
+}
+
+type countWriter struct {
+	hash.Hash
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Hash.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// localFileMD5 计算本地文件的 md5，文件大小或修改时间与索引不一致时返回空字符串
+func localFileMD5(fileSystem http.FileSystem) func(verifyItem) string {
+	return func(item verifyItem) string {
+		var (
+			fp  http.File
+			err error
+		)
+		if fileSystem == nil {
+			fp, err = os.Open(item.File)
+		} else {
+			fp, err = fileSystem.Open(item.File)
+		}
+		if err != nil {
+			return ``
+		}
+		defer fp.Close()
+		info, err := fp.Stat()
+		if err != nil || info.Size() != item.Size || info.ModTime().Unix() != item.ModTime {
+			return ``
+		}
+		h := md5.New()
+		if _, err = io.Copy(h, fp); err != nil {
+			return ``
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func verifyBackupIsRunning(id uint) bool {
+	return echo.Bool(`cloud.backup-verify.` + com.String(id))
+}
+
+// verifyBackup 校验云存储中的备份与索引是否一致，并将发现的问题和汇总记录到备份日志
+func verifyBackup(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra) (*VerifyReport, error) {
+	key := `cloud.backup-verify.` + com.String(cfg.Id)
+	if echo.Bool(key) {
+		return nil, ErrRunningPleaseWait
+	}
+	echo.Set(key, true)
+	defer echo.Delete(key)
+	if extra == nil {
+		extra = &BackupExtra{BackupId: cfg.Id}
+		extra.setDefaults()
+	}
+	startTime := time.Now()
+	report, err := runVerifyBackup(ctx, cfg, extra)
+	if report != nil {
+		recordVerifyLogs(ctx, cfg, report, err, startTime)
+	}
+	return report, err
+}
+
+func runVerifyBackup(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra) (*VerifyReport, error) {
+	sourcePath, fileSystem, err := backupSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ldb, err := cloudbackup.LevelDB().OpenDB(cfg.Id)
+	if err != nil {
+		return nil, err
+	}
+	items, err := verifyItems(ldb, cfg, sourcePath, extra.IsVersioned())
+	if err != nil {
+		return nil, err
+	}
+	mgr, err := newStorage(ctx, cfg, extra)
+	if err != nil {
+		return nil, err
+	}
+	if err = mgr.Connect(); err != nil {
+		return nil, err
+	}
+	defer mgr.Close()
+	lister, err := newRemoteLister(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if lister != nil {
+		defer lister.Close()
+		lister = newExcludeLister(lister, catalogRoot(cfg.DestPath))
+	}
+	prefixes := []string{cfg.DestPath}
+	if extra.IsChunked() {
+		prefixes = append(prefixes, chunkRoot(cfg.DestPath))
+	}
+	return verifyObjects(ctx, mgr, lister, prefixes, items, verifySampleSize, localFileMD5(fileSystem))
+}
+
+func recordVerifyLogs(ctx echo.Context, cfg dbschema.NgingCloudBackup, report *VerifyReport, err error, startTime time.Time) {
+	for i, p := range report.Problems {
+		if i >= verifyMaxLogs {
+			break
+		}
+		m := model.NewCloudBackupLog(ctx)
+		m.BackupId = cfg.Id
+		m.BackupType = model.CloudBackupTypeFull
+		m.BackupFile = p.File
+		m.RemoteFile = p.Object
+		m.Operation = model.CloudBackupOperationNone
+		m.Error = `verify ` + p.Kind + `: ` + p.Reason
+		m.Status = model.CloudBackupStatusFailure
+		if p.Size > 0 {
+			m.Size = uint64(p.Size)
+		}
+		if _, aerr := m.Add(); aerr != nil {
+			log.Errorf(`failed to add cloud backup log: %v`, aerr)
+		}
+	}
+	summary := report.Summary(ctx)
+	if err != nil {
+		summary += `: ` + err.Error()
+	}
+	m := model.NewCloudBackupLog(ctx)
+	m.BackupId = cfg.Id
+	m.BackupType = model.CloudBackupTypeFull
+	m.RemoteFile = cfg.DestPath
+	m.Operation = model.CloudBackupOperationNone
+	m.Error = summary
+	m.Elapsed = uint(time.Since(startTime).Milliseconds())
+	if err != nil || report.HasProblem() {
+		m.Status = model.CloudBackupStatusFailure
+	} else {
+		m.Status = model.CloudBackupStatusSuccess
+	}
+	if _, aerr := m.Add(); aerr != nil {
+		log.Errorf(`failed to add cloud backup log: %v`, aerr)
+	}
+	cfg.SetContext(ctx)
+	cfg.UpdateField(nil, `result`, summary, `id`, cfg.Id)
+}
+
+func verifyRunnerGetter(id string) cron.Runner {
+	return func(_ time.Duration) (string, string, error, bool) {
+		out, err := runVerifyJob(param.AsUint(id))
+		if err != nil {
+			return out, err.Error(), err, false
+		}
+		return out, ``, nil, false
+	}
+}
+
+// runVerifyJob 校验指定的备份配置，id 为 0 时校验所有启用的配置
+func runVerifyJob(id uint) (string, error) {
+	ctx := defaults.NewMockContext()
+	m := model.NewCloudBackup(ctx)
+	cond := db.Cond{`disabled`: `N`}
+	if id > 0 {
+		cond = db.Cond{`id`: id}
+	}
+	_, err := m.EventOFF().ListByOffset(nil, nil, 0, -1, cond)
+	if err != nil {
+		return ``, err
+	}
+	rows := m.Objects()
+	if id > 0 && len(rows) == 0 {
+		return ``, fmt.Errorf(`cloud backup %d: %w`, id, db.ErrNoMoreRows)
+	}
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = row.Id
+	}
+	extras, err := listBackupExtras(ids)
+	if err != nil {
+		return ``, err
+	}
+	var (
+		lines   []string
+		lastErr error
+	)
+	for _, row := range rows {
+		report, err := verifyBackup(ctx, *row, extras[row.Id])
+		switch {
+		case err != nil:
+			lastErr = err
+			lines = append(lines, fmt.Sprintf(`[%d]%s: %v`, row.Id, row.Name, err))
+		case report.HasProblem():
+			lastErr = fmt.Errorf(`cloud backup %q: verification found %d problems`, row.Name, len(report.Problems))
+			lines = append(lines, fmt.Sprintf(`[%d]%s: %s`, row.Id, row.Name, report.Summary(ctx)))
+		default:
+			lines = append(lines, fmt.Sprintf(`[%d]%s: %s`, row.Id, row.Name, report.Summary(ctx)))
+		}
+	}
+	return strings.Join(lines, "\n"), lastErr
+}
@@ -0,0 +1,240 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/s3manager/s3client"
+	"github.com/coscms/webcore/model"
+	"github.com/jlaffaye/ftp"
+	"github.com/minio/minio-go/v7"
+	"github.com/studio-b12/gowebdav"
+	"github.com/webx-top/echo"
+)
+
+// remoteObject 云存储中的对象
+type remoteObject struct {
+	Name string
+	Size int64 // 小于 0 时表示未知
+	ETag string
+}
+
+// remoteLister 列出云存储中指定路径下的所有对象(不含目录)
+type remoteLister interface {
+	List(ctx context.Context, prefix string, fn func(remoteObject) error) error
+	Close() error
+}
+
+// remoteListers 支持列出对象的存储引擎。不支持的存储引擎在校验时只能通过下载抽查
+var remoteListers = map[string]func(ctx echo.Context, cfg dbschema.NgingCloudBackup) (remoteLister, error){
+	model.StorageEngineS3:     newS3Lister,
+	model.StorageEngineWebDAV: newWebDAVLister,
+	model.StorageEngineFTP:    newFTPLister,
+}
+
+func newRemoteLister(ctx echo.Context, cfg dbschema.NgingCloudBackup) (remoteLister, error) {
+	fn, ok := remoteListers[cfg.StorageEngine]
+	if !ok {
+		return nil, nil
+	}
+	return fn(ctx, cfg)
+}
+
+// excludeLister 不列出指定路径之下的对象
+type excludeLister struct {
+	remoteLister
+	prefixes []string
+}
+
+func newExcludeLister(lister remoteLister, prefixes ...string) remoteLister {
+	if lister == nil {
+		return nil
+	}
+	return &excludeLister{remoteLister: lister, prefixes: prefixes}
+}
+
+func (l *excludeLister) List(ctx context.Context, prefix string, fn func(remoteObject) error) error {
+	return l.remoteLister.List(ctx, prefix, func(obj remoteObject) error {
+		name := cleanObjectName(obj.Name)
+		for _, p := range l.prefixes {
+			if strings.HasPrefix(name, cleanObjectName(p)+`/`) {
+				return nil
+			}
+		}
+		return fn(obj)
+	})
+}
+
+func storageConfig(cfg dbschema.NgingCloudBackup) (echo.H, error) {
+	conf := echo.H{}
+	if len(cfg.StorageConfig) == 0 {
+		return conf, nil
+	}
+	err := json.Unmarshal([]byte(cfg.StorageConfig), &conf)
+	return conf, err
+}
+
+func newS3Lister(ctx echo.Context, cfg dbschema.NgingCloudBackup) (remoteLister, error) {
+	m := dbschema.NewNgingCloudStorage(ctx)
+	err := m.Get(nil, `id`, cfg.DestStorage)
+	if err != nil {
+		return nil, err
+	}
+	m.Secret = common.Crypto().Decode(m.Secret)
+	mgr := s3client.New(m, 0)
+	client, err := mgr.Client()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Lister{client: client, bucket: mgr.BucketName()}, nil
+}
+
+type s3Lister struct {
+	client *minio.Client
+	bucket string
+}
+
+func (l *s3Lister) List(ctx context.Context, prefix string, fn func(remoteObject) error) error {
+	prefix = strings.TrimPrefix(prefix, `/`)
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, `/`) {
+		prefix += `/`
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range l.client.ListObjects(ctx, l.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if strings.HasSuffix(obj.Key, `/`) { // 目录占位对象
+			continue
+		}
+		if err := fn(remoteObject{Name: `/` + obj.Key, Size: obj.Size, ETag: obj.ETag}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *s3Lister) Close() error {
+	return nil
+}
+
+func newWebDAVLister(ctx echo.Context, cfg dbschema.NgingCloudBackup) (remoteLister, error) {
+	conf, err := storageConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	password := common.Crypto().Decode(conf.String(`password`))
+	conn := gowebdav.NewClient(conf.String(`uri`), conf.String(`username`), password)
+	if err = conn.Connect(); err != nil {
+		return nil, err
+	}
+	return &webDAVLister{conn: conn}, nil
+}
+
+type webDAVLister struct {
+	conn *gowebdav.Client
+}
+
+func (l *webDAVLister) List(ctx context.Context, prefix string, fn func(remoteObject) error) error {
+	infos, err := l.conn.ReadDir(prefix)
+	if err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name := path.Join(prefix, info.Name())
+		if info.IsDir() {
+			if err = l.List(ctx, name, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		obj := remoteObject{Name: name, Size: info.Size()}
+		if f, ok := info.(gowebdav.File); ok {
+			obj.ETag = f.ETag()
+		}
+		if err = fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *webDAVLister) Close() error {
+	return nil
+}
+
+func newFTPLister(ctx echo.Context, cfg dbschema.NgingCloudBackup) (remoteLister, error) {
+	conf, err := storageConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	addr := conf.String(`addr`)
+	if !strings.Contains(addr, `:`) {
+		addr += `:21`
+	}
+	conn, err := ftp.Dial(addr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	password := common.Crypto().Decode(conf.String(`password`))
+	if err = conn.Login(conf.String(`username`), password); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return &ftpLister{conn: conn}, nil
+}
+
+type ftpLister struct {
+	conn *ftp.ServerConn
+}
+
+func (l *ftpLister) List(ctx context.Context, prefix string, fn func(remoteObject) error) error {
+	w := l.conn.Walk(prefix)
+	for w.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry := w.Stat()
+		if entry.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if err := fn(remoteObject{Name: w.Path(), Size: int64(entry.Size)}); err != nil {
+			return err
+		}
+	}
+	return w.Err()
+}
+
+func (l *ftpLister) Close() error {
+	return l.conn.Quit()
+}
@@ -0,0 +1,126 @@
+package cloud
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// memLister 列出 memStorage 中的对象，ETag 为内容的 md5
+type memLister struct {
+	mem *memStorage
+}
+
+func (l *memLister) List(ctx context.Context, prefix string, fn func(remoteObject) error) error {
+	for name, b := range l.mem.files {
+		if !strings.HasPrefix(name, prefix+`/`) {
+			continue
+		}
+		sum := md5.Sum(b)
+		if err := fn(remoteObject{Name: name, Size: int64(len(b)), ETag: `"` + hex.EncodeToString(sum[:]) + `"`}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *memLister) Close() error { return nil }
+
+func verifyKinds(report *VerifyReport) map[string]string {
+	kinds := map[string]string{}
+	for _, p := range report.Problems {
+		kinds[p.Object] = p.Kind
+	}
+	return kinds
+}
+
+func testVerifyItem(object string, content string) verifyItem {
+	sum := md5.Sum([]byte(content))
+	return verifyItem{File: `/data` + strings.TrimPrefix(object, `/backup`), Object: object, MD5: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+}
+
+func TestVerifyObjects(t *testing.T) {
+	ctx := context.Background()
+	mem := &memStorage{files: map[string][]byte{
+		`/backup/a.txt`:     []byte(`hello`),
+		`/backup/b.txt`:     []byte(`world`),
+		`/backup/c.txt`:     []byte(`xxxxx`),
+		`/backup/extra.txt`: []byte(`extra`),
+	}}
+	items := []verifyItem{
+		testVerifyItem(`/backup/a.txt`, `hello`),
+		testVerifyItem(`/backup/b.txt`, `world`),
+		testVerifyItem(`/backup/c.txt`, `abcde`),
+		testVerifyItem(`/backup/d.txt`, `gone`),
+	}
+	report, err := verifyObjects(ctx, mem, &memLister{mem: mem}, []string{`/backup`}, items, -1, nil)
+	require.NoError(t, err)
+	assert.True(t, report.Listed)
+	assert.Equal(t, 4, report.Objects)
+	assert.Equal(t, 2, report.Sampled)
+	assert.Equal(t, map[string]string{
+		`/backup/c.txt`:     verifyMismatch,
+		`/backup/d.txt`:     verifyMissing,
+		`/backup/extra.txt`: verifyExtra,
+	}, verifyKinds(report))
+
+	// 不支持列出对象时只能通过下载发现问题
+	report, err = verifyObjects(ctx, mem, nil, []string{`/backup`}, items, -1, nil)
+	require.NoError(t, err)
+	assert.False(t, report.Listed)
+	assert.Equal(t, 4, report.Sampled)
+	assert.Equal(t, map[string]string{
+		`/backup/c.txt`: verifyMismatch,
+		`/backup/d.txt`: verifyMissing,
+	}, verifyKinds(report))
+
+	// 索引中没有 md5 时与本地文件比较
+	items = []verifyItem{{File: `/data/c.txt`, Object: `/backup/c.txt`, Size: 5}}
+	report, err = verifyObjects(ctx, mem, nil, nil, items, -1, func(verifyItem) string {
+		return testVerifyItem(`/backup/c.txt`, `abcde`).MD5
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{`/backup/c.txt`: verifyMismatch}, verifyKinds(report))
+}
+
+func TestVerifyChunkedEncryptedObjects(t *testing.T) {
+	ctx := context.Background()
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer db.Close()
+	mem := &memStorage{files: map[string][]byte{}}
+	c := testCipher(t, testKey1)
+	s := newChunkedStorage(newEncryptedStorage(mem, c, `/backup`, true), db, `/backup`, c.ChunkID)
+
+	contents := map[string]string{`/backup/a.txt`: `hello`, `/backup/dir/b.txt`: `hello`, `/backup/c.txt`: ``}
+	var items []verifyItem
+	for name, content := range contents {
+		require.NoError(t, s.Put(ctx, strings.NewReader(content), name, int64(len(content))))
+		items = append(items, testVerifyItem(name, content))
+	}
+	lister := &memLister{mem: mem}
+	prefixes := []string{`/backup`, chunkRoot(`/backup`)}
+	report, err := verifyObjects(ctx, s, lister, prefixes, items, -1, nil)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, len(mem.files), report.Objects) // 相同内容的数据块只保存一份
+	assert.Equal(t, 3, report.Sampled)
+
+	for name := range mem.files {
+		if strings.HasPrefix(name, chunkRoot(`/backup`)+`/`) {
+			delete(mem.files, name)
+		}
+	}
+	report, err = verifyObjects(ctx, s, lister, prefixes, items, -1, nil)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, verifyMissing, report.Problems[0].Kind)
+	assert.Equal(t, 1, report.Sampled) // 只抽查了空文件
+}
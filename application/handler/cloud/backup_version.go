@@ -0,0 +1,414 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/param"
+)
+
+// 版本索引在 LevelDB 中的键前缀(普通文件路径不会以 \x00 开头)
+const versionKeyPrefix = "\x00v\x00"
+
+// 版本号格式(UTC时间，定长以便按字符串排序)
+const versionIDLayout = `20060102T150405.000000000Z`
+
+// VersionRetention 历史版本保留规则(祖父-父-子)。全部为0时保留所有版本
+type VersionRetention struct {
+	KeepLast    uint // 保留最近的版本数
+	KeepDaily   uint // 保留最近若干天每天的最后一个版本
+	KeepWeekly  uint // 保留最近若干周每周的最后一个版本
+	KeepMonthly uint // 保留最近若干月每月的最后一个版本
+	KeepYearly  uint // 保留最近若干年每年的最后一个版本
+}
+
+func (r VersionRetention) IsZero() bool {
+	return r.KeepLast == 0 && r.KeepDaily == 0 && r.KeepWeekly == 0 && r.KeepMonthly == 0 && r.KeepYearly == 0
+}
+
+// BackupVersion 文件的一个备份版本
+type BackupVersion struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`             // 相对于源路径的文件路径
+	Object  string    `json:"object,omitempty"` // 云存储中的对象名称
+	MD5     string    `json:"md5,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime int64     `json:"modTime"`
+	Created time.Time `json:"created"`
+	Deleted bool      `json:"deleted,omitempty"` // 删除标记(文件在此时被删除或重命名)
+}
+
+func newVersionID(t time.Time) string {
+	return t.UTC().Format(versionIDLayout)
+}
+
+// versionObjectName 带版本号的对象名称
+func versionObjectName(destPath string, relPath string, versionID string) string {
+	return path.Join(destPath, filepath.ToSlash(relPath)) + `@` + versionID
+}
+
+func versionFilePrefix(file string) []byte {
+	return com.Str2bytes(versionKeyPrefix + file + "\x00")
+}
+
+func versionKey(file string, versionID string) []byte {
+	return append(versionFilePrefix(file), versionID...)
+}
+
+// versionKeyFile 从版本索引键中解析出文件路径
+func versionKeyFile(key []byte) string {
+	s := strings.TrimPrefix(string(key), versionKeyPrefix)
+	if pos := strings.LastIndexByte(s, 0); pos >= 0 {
+		s = s[:pos]
+	}
+	return s
+}
+
+// addVersion 记录文件的一个新版本
+func addVersion(db *leveldb.DB, file string, v *BackupVersion) error {
+	if len(v.ID) == 0 {
+		v.ID = newVersionID(v.Created)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.Put(versionKey(file, v.ID), b, nil)
+}
+
+// addTombstone 记录文件被删除
+func addTombstone(db *leveldb.DB, file string, relPath string) error {
+	versions, err := listVersions(db, file)
+	if err != nil || len(versions) == 0 || versions[len(versions)-1].Deleted {
+		return err
+	}
+	return addVersion(db, file, &BackupVersion{
+		Path:    relPath,
+		Created: time.Now(),
+		Deleted: true,
+	})
+}
+
+// listVersions 获取文件的所有版本(按时间从旧到新排列)
+func listVersions(db *leveldb.DB, file string) ([]*BackupVersion, error) {
+	iter := db.NewIterator(util.BytesPrefix(versionFilePrefix(file)), nil)
+	defer iter.Release()
+	var versions []*BackupVersion
+	for iter.Next() {
+		v := &BackupVersion{}
+		if err := json.Unmarshal(iter.Value(), v); err != nil {
+			return versions, fmt.Errorf(`%s: %w`, iter.Key(), err)
+		}
+		versions = append(versions, v)
+	}
+	return versions, iter.Error()
+}
+
+// eachVersionFile 依次遍历路径以 prefix 开头的每个文件的所有版本
+func eachVersionFile(db *leveldb.DB, prefix string, fn func(file string, versions []*BackupVersion) error) error {
+	iter := db.NewIterator(util.BytesPrefix(com.Str2bytes(versionKeyPrefix+prefix)), nil)
+	defer iter.Release()
+	var (
+		file     string
+		versions []*BackupVersion
+	)
+	for iter.Next() {
+		current := versionKeyFile(iter.Key())
+		if current != file && len(versions) > 0 {
+			if err := fn(file, versions); err != nil {
+				return err
+			}
+			versions = nil
+		}
+		file = current
+		v := &BackupVersion{}
+		if err := json.Unmarshal(iter.Value(), v); err != nil {
+			log.Errorf(`failed to parse backup version %q: %v`, iter.Key(), err)
+			continue
+		}
+		versions = append(versions, v)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		return fn(file, versions)
+	}
+	return nil
+}
+
+// selectKeptVersions 按保留规则将版本分为保留和删除两部分。
+// 最新的版本总是保留；早于最旧保留版本的删除标记将被删除
+func selectKeptVersions(versions []*BackupVersion, r VersionRetention) (kept []*BackupVersion, dropped []*BackupVersion) {
+	if r.IsZero() {
+		return versions, nil
+	}
+	data := make([]int, 0, len(versions)) // 从新到旧
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].Deleted {
+			data = append(data, i)
+		}
+	}
+	keep := map[int]bool{}
+	if len(data) > 0 {
+		keep[data[0]] = true
+	}
+	for i, idx := range data {
+		if uint(i) >= r.KeepLast {
+			break
+		}
+		keep[idx] = true
+	}
+	bucket := func(count uint, key func(t time.Time) string) {
+		if count == 0 {
+			return
+		}
+		seen := map[string]struct{}{}
+		for _, idx := range data {
+			k := key(versions[idx].Created.Local())
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			if uint(len(seen)) >= count {
+				break
+			}
+			seen[k] = struct{}{}
+			keep[idx] = true
+		}
+	}
+	bucket(r.KeepDaily, func(t time.Time) string {
+		return t.Format(`2006-01-02`)
+	})
+	bucket(r.KeepWeekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf(`%d-%02d`, y, w)
+	})
+	bucket(r.KeepMonthly, func(t time.Time) string {
+		return t.Format(`2006-01`)
+	})
+	bucket(r.KeepYearly, func(t time.Time) string {
+		return t.Format(`2006`)
+	})
+	var oldest time.Time
+	for idx := range keep {
+		if oldest.IsZero() || versions[idx].Created.Before(oldest) {
+			oldest = versions[idx].Created
+		}
+	}
+	for i, v := range versions {
+		if keep[i] || (v.Deleted && !oldest.IsZero() && !v.Created.Before(oldest)) {
+			kept = append(kept, v)
+		} else {
+			dropped = append(dropped, v)
+		}
+	}
+	return
+}
+
+// versionAsOf 获取指定时间点的文件版本。文件在该时间点不存在时返回nil
+func versionAsOf(versions []*BackupVersion, t time.Time) *BackupVersion {
+	var found *BackupVersion
+	for _, v := range versions {
+		if v.Created.After(t) {
+			break
+		}
+		found = v
+	}
+	if found == nil || found.Deleted {
+		return nil
+	}
+	return found
+}
+
+// pruneVersions 按保留规则删除文件的过期版本
+func pruneVersions(ctx context.Context, db *leveldb.DB, mgr cloudbackup.Storager, file string, r VersionRetention) error {
+	if r.IsZero() {
+		return nil
+	}
+	versions, err := listVersions(db, file)
+	if err != nil {
+		return err
+	}
+	return dropVersions(ctx, db, mgr, file, versions, r)
+}
+
+// pruneAllVersions 按保留规则删除所有文件的过期版本
+func pruneAllVersions(ctx context.Context, db *leveldb.DB, mgr cloudbackup.Storager, r VersionRetention) error {
+	if r.IsZero() {
+		return nil
+	}
+	return eachVersionFile(db, ``, func(file string, versions []*BackupVersion) error {
+		return dropVersions(ctx, db, mgr, file, versions, r)
+	})
+}
+
+func dropVersions(ctx context.Context, db *leveldb.DB, mgr cloudbackup.Storager, file string, versions []*BackupVersion, r VersionRetention) error {
+	_, dropped := selectKeptVersions(versions, r)
+	for _, v := range dropped {
+		if len(v.Object) > 0 {
+			if err := mgr.Remove(ctx, v.Object); err != nil {
+				log.Errorf(`failed to remove backup version %q: %v`, v.Object, err)
+				continue
+			}
+		}
+		if err := db.Delete(versionKey(file, v.ID), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VersionStats 版本统计信息
+type VersionStats struct {
+	Files    int
+	Versions int
+	Oldest   time.Time
+	Newest   time.Time
+}
+
+func versionStats(db *leveldb.DB) (*VersionStats, error) {
+	stats := &VersionStats{}
+	err := eachVersionFile(db, ``, func(_ string, versions []*BackupVersion) error {
+		stats.Files++
+		for _, v := range versions {
+			if v.Deleted {
+				continue
+			}
+			stats.Versions++
+			if stats.Oldest.IsZero() || v.Created.Before(stats.Oldest) {
+				stats.Oldest = v.Created
+			}
+			if v.Created.After(stats.Newest) {
+				stats.Newest = v.Created
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// restoreAsOf 将所有文件还原为指定时间点的版本
+func restoreAsOf(ctx context.Context, db *leveldb.DB, mgr cloudbackup.Storager, localSavePath string, asOf time.Time, callback func(from, to string), prog notice.Progressor) error {
+	var selected []*BackupVersion
+	err := eachVersionFile(db, ``, func(_ string, versions []*BackupVersion) error {
+		if v := versionAsOf(versions, asOf); v != nil {
+			selected = append(selected, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Path < selected[j].Path
+	})
+	if prog != nil {
+		prog.Add(int64(len(selected)))
+	}
+	for _, v := range selected {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dest := filepath.Join(localSavePath, filepath.FromSlash(v.Path))
+		if err := cloudbackup.DownloadFile(mgr, ctx, v.Object, dest); err != nil {
+			return fmt.Errorf(`%s: %w`, v.Object, err)
+		}
+		if v.ModTime > 0 {
+			mtime := time.Unix(v.ModTime, 0)
+			os.Chtimes(dest, mtime, mtime)
+		}
+		if callback != nil {
+			callback(v.Object, dest)
+		}
+		if prog != nil {
+			prog.Done(1)
+		}
+	}
+	return nil
+}
+
+// restoreVersionsAsOf 从云存储还原指定时间点的文件版本到 cfg.SourcePath
+func restoreVersionsAsOf(ctx echo.Context, cfg dbschema.NgingCloudBackup, extra *BackupExtra, secret string, asOf time.Time, callback func(from, to string), prog notice.Progressor) error {
+	db, err := cloudbackup.LevelDB().OpenDB(cfg.Id)
+	if err != nil {
+		return err
+	}
+	mgr, err := newStorage(ctx, cfg, extra, secret)
+	if err != nil {
+		return err
+	}
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	defer mgr.Close()
+	return restoreAsOf(ctx, db, mgr, cfg.SourcePath, asOf, callback, prog)
+}
+
+func backupVersionStats(backupID uint) (*VersionStats, error) {
+	db, err := cloudbackup.LevelDB().OpenDB(backupID)
+	if err != nil {
+		return nil, err
+	}
+	return versionStats(db)
+}
+
+var asOfLayouts = []string{`2006-01-02T15:04`, `2006-01-02T15:04:05`, `2006-01-02 15:04:05`, `2006-01-02 15:04`, `2006-01-02`}
+
+// parseAsOf 解析还原时间点(本地时间)
+func parseAsOf(value string) (t time.Time, err error) {
+	for _, layout := range asOfLayouts {
+		t, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			if layout == `2006-01-02` { // 只指定日期时还原到当天结束时的版本
+				t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+			return
+		}
+	}
+	return
+}
+
+// backupDBValue 生成文件备份记录的值(与 cloudbackup.ParseDBValue 对应)
+func backupDBValue(md5 string, info os.FileInfo) []byte {
+	parts := []string{
+		md5,                                   // md5
+		param.AsString(0),                     // taskStartTime
+		param.AsString(time.Now().Unix()),     // taskEndTime
+		param.AsString(info.ModTime().Unix()), // fileModifyTime
+		param.AsString(info.Size()),           // fileSize
+	}
+	return com.Str2bytes(strings.Join(parts, `||`))
+}
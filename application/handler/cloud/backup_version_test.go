@@ -0,0 +1,141 @@
+package cloud
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coscms/webcore/library/cloudbackup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func makeVersions(times ...time.Time) []*BackupVersion {
+	versions := make([]*BackupVersion, len(times))
+	for i, t := range times {
+		versions[i] = &BackupVersion{ID: newVersionID(t), Object: `a.txt@` + newVersionID(t), Created: t}
+	}
+	return versions
+}
+
+func keptTimes(versions []*BackupVersion) []string {
+	r := make([]string, len(versions))
+	for i, v := range versions {
+		r[i] = v.Created.Format(`2006-01-02 15:04`)
+	}
+	return r
+}
+
+func TestSelectKeptVersions(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2026, 3, d, h, 0, 0, 0, time.Local)
+	}
+	// 3月2日是周一
+	versions := makeVersions(day(2, 8), day(2, 20), day(3, 9), day(9, 10), day(10, 10), day(10, 18))
+
+	kept, dropped := selectKeptVersions(versions, VersionRetention{})
+	assert.Len(t, kept, 6)
+	assert.Empty(t, dropped)
+
+	kept, dropped = selectKeptVersions(versions, VersionRetention{KeepLast: 2})
+	assert.Equal(t, []string{`2026-03-10 10:00`, `2026-03-10 18:00`}, keptTimes(kept))
+	assert.Len(t, dropped, 4)
+
+	kept, _ = selectKeptVersions(versions, VersionRetention{KeepDaily: 3})
+	assert.Equal(t, []string{`2026-03-03 09:00`, `2026-03-09 10:00`, `2026-03-10 18:00`}, keptTimes(kept))
+
+	kept, _ = selectKeptVersions(versions, VersionRetention{KeepWeekly: 5})
+	assert.Equal(t, []string{`2026-03-03 09:00`, `2026-03-10 18:00`}, keptTimes(kept))
+
+	kept, _ = selectKeptVersions(versions, VersionRetention{KeepLast: 1, KeepMonthly: 1, KeepYearly: 1})
+	assert.Equal(t, []string{`2026-03-10 18:00`}, keptTimes(kept))
+
+	// 删除标记：早于最旧保留版本的被删除，其余保留
+	versions = makeVersions(day(2, 8), day(3, 9), day(4, 9), day(5, 9))
+	versions[1].Deleted = true
+	versions[3].Deleted = true
+	kept, dropped = selectKeptVersions(versions, VersionRetention{KeepLast: 1})
+	assert.Equal(t, []string{`2026-03-04 09:00`, `2026-03-05 09:00`}, keptTimes(kept))
+	assert.Equal(t, []string{`2026-03-02 08:00`, `2026-03-03 09:00`}, keptTimes(dropped))
+}
+
+func TestVersionAsOf(t *testing.T) {
+	base := time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)
+	versions := makeVersions(base, base.Add(time.Hour), base.Add(2*time.Hour), base.Add(3*time.Hour))
+	versions[2].Deleted = true
+
+	assert.Nil(t, versionAsOf(versions, base.Add(-time.Second)))
+	assert.Equal(t, versions[0], versionAsOf(versions, base))
+	assert.Equal(t, versions[1], versionAsOf(versions, base.Add(90*time.Minute)))
+	assert.Nil(t, versionAsOf(versions, base.Add(150*time.Minute)))
+	assert.Equal(t, versions[3], versionAsOf(versions, base.Add(24*time.Hour)))
+}
+
+func TestParseAsOf(t *testing.T) {
+	tm, err := parseAsOf(`2026-03-01T10:20`)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 10, 20, 0, 0, time.Local), tm)
+
+	tm, err = parseAsOf(`2026-03-01`)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 23, 59, 59, 999999999, time.Local), tm)
+
+	_, err = parseAsOf(`yesterday`)
+	assert.Error(t, err)
+}
+
+func TestVersionIndex(t *testing.T) {
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), `index`), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	base := time.Now().Add(-time.Hour)
+	for i, file := range []string{`/src/a.txt`, `/src/a.txt`, `/src/ab.txt`, `/src/a.txt`, `/src/dir/c.txt`} {
+		created := base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, addVersion(db, file, &BackupVersion{
+			Path:    file[4:],
+			Object:  versionObjectName(`/dest`, file[4:], newVersionID(created)),
+			Created: created,
+		}))
+	}
+	// 普通的文件备份记录不会被当作版本
+	require.NoError(t, db.Put([]byte(`/src/a.txt`), []byte(`md5||0||0||0||0`), nil))
+
+	versions, err := listVersions(db, `/src/a.txt`)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, `/a.txt`, versions[0].Path)
+	assert.Equal(t, `/dest/a.txt@`+newVersionID(base), versions[0].Object)
+
+	files := map[string]int{}
+	err = eachVersionFile(db, ``, func(file string, versions []*BackupVersion) error {
+		files[file] = len(versions)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{`/src/a.txt`: 3, `/src/ab.txt`: 1, `/src/dir/c.txt`: 1}, files)
+
+	require.NoError(t, addTombstone(db, `/src/ab.txt`, `/ab.txt`))
+	require.NoError(t, addTombstone(db, `/src/ab.txt`, `/ab.txt`)) // 已有删除标记时忽略
+	versions, err = listVersions(db, `/src/ab.txt`)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.True(t, versions[1].Deleted)
+
+	stats, err := versionStats(db)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Files)
+	assert.Equal(t, 5, stats.Versions)
+
+	err = pruneAllVersions(context.Background(), db, cloudbackup.NewStorageMock(), VersionRetention{KeepLast: 1})
+	require.NoError(t, err)
+	versions, err = listVersions(db, `/src/a.txt`)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, newVersionID(base.Add(3*time.Minute)), versions[0].ID)
+	versions, err = listVersions(db, `/src/ab.txt`)
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
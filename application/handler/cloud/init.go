@@ -22,6 +22,7 @@ import (
 	"github.com/admpub/log"
 	"github.com/coscms/webcore/library/config"
 	"github.com/coscms/webcore/library/config/startup"
+	"github.com/coscms/webcore/library/httpserver"
 	"github.com/coscms/webcore/model"
 	"github.com/coscms/webcore/registry/route"
 	"github.com/webx-top/db"
@@ -37,17 +38,35 @@ func init() {
 		g.Route(`GET,POST`, `/storage_delete`, StorageDelete)
 		g.Route(`GET,POST`, `/storage_file`, StorageFile)
 
+		g.Route(`GET,POST`, `/share`, ShareIndex)
+		g.Route(`GET,POST`, `/share_revoke`, ShareRevoke)
+		g.Route(`GET,POST`, `/share_delete`, ShareDelete)
+		g.Route(`GET,POST`, `/share_log`, ShareLog)
+
+		g.Route(`GET,POST`, `/sync`, SyncIndex)
+		g.Route(`GET,POST`, `/sync_add`, SyncAdd)
+		g.Route(`GET,POST`, `/sync_edit`, SyncEdit)
+		g.Route(`GET,POST`, `/sync_delete`, SyncDelete)
+		g.Route(`GET,POST`, `/sync_start`, SyncStart)
+		g.Route(`GET,POST`, `/sync_stop`, SyncStop)
+		g.Route(`GET,POST`, `/sync_log`, SyncLog)
+
 		g.Route(`GET,POST`, `/backup`, BackupConfigList)
 		g.Route(`GET,POST`, `/backup_add`, BackupConfigAdd)
 		g.Route(`GET,POST`, `/backup_edit`, BackupConfigEdit)
 		g.Route(`GET,POST`, `/backup_delete`, BackupConfigDelete)
 		g.Route(`GET,POST`, `/backup_restore`, BackupRestore)
+		g.Route(`GET,POST`, `/backup_import`, BackupImport)
 		g.Route(`GET,POST`, `/backup_start`, BackupStart)
 		g.Route(`GET,POST`, `/backup_stop`, BackupStop)
 		g.Route(`GET,POST`, `/backup_log`, Log)
 		g.Route(`GET,POST`, `/backup_log_delete`, LogDelete)
 	})
 
+	route.Register(func(e echo.RouteRegister) {
+		e.Route(`GET,POST`, `/share/:token`, ShareAccess).SetMetaKV(httpserver.PermGuestKV())
+	})
+
 	startup.OnBefore(`web`, func() {
 		if !config.IsInstalled() {
 			return
@@ -64,8 +83,18 @@ func startMonitorBackup() {
 		log.Errorf(`failed to query cloud_backup list: %v`, err)
 		return
 	}
-	for _, row := range m.Objects() {
-		err = monitorBackupStart(*row)
+	rows := m.Objects()
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = row.Id
+	}
+	extras, err := listBackupExtras(ids)
+	if err != nil {
+		log.Errorf(`failed to query cloud_backup_extra list: %v`, err)
+		return
+	}
+	for _, row := range rows {
+		err = monitorBackupStart(*row, extras[row.Id])
 		if err != nil && err != ErrNotSupportMonitor {
 			log.Errorf(`failed to monitorBackupStart(%q): %v`, row.Name, err)
 		}
@@ -0,0 +1,125 @@
+--
+-- Table structure for table `nging_cloud_backup_extra`
+--
+
+DROP TABLE IF EXISTS `nging_cloud_backup_extra`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_cloud_backup_extra` (
+  `backup_id` int unsigned NOT NULL COMMENT '云备份配置ID',
+  `versioned` enum('Y','N') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'N' COMMENT '是否保留历史版本',
+  `keep_last` int unsigned NOT NULL DEFAULT '0' COMMENT '保留最近的版本数',
+  `keep_daily` int unsigned NOT NULL DEFAULT '0' COMMENT '保留最近若干天每天的最后一个版本',
+  `keep_weekly` int unsigned NOT NULL DEFAULT '0' COMMENT '保留最近若干周每周的最后一个版本',
+  `keep_monthly` int unsigned NOT NULL DEFAULT '0' COMMENT '保留最近若干月每月的最后一个版本',
+  `keep_yearly` int unsigned NOT NULL DEFAULT '0' COMMENT '保留最近若干年每年的最后一个版本',
+  `encryption` enum('none','passphrase','key') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'none' COMMENT '客户端加密方式(none-不加密;passphrase-从口令派生密钥;key-随机生成的密钥)',
+  `encryption_secret` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '加密口令或密钥(加密存储)',
+  `encryption_salt` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '从口令派生密钥时使用的盐',
+  `encrypt_name` enum('Y','N') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'N' COMMENT '是否加密文件名',
+  `key_id` varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '密钥标识(用于识别密钥是否正确)',
+  `chunked` enum('Y','N') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'N' COMMENT '是否分块去重存储(按内容切分为压缩的数据块，只上传有变化的数据块)',
+  `workers` int unsigned NOT NULL DEFAULT '0' COMMENT '全量备份时的并行上传数(0为使用系统设置)',
+  `bandwidth_limit` bigint unsigned NOT NULL DEFAULT '0' COMMENT '上传速度上限(字节/秒，0为不限制)',
+  `throttle_start` varchar(5) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '限速时段开始时间(时:分，为空时全天限速)',
+  `throttle_end` varchar(5) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '限速时段结束时间(时:分)',
+  `poll_interval` int unsigned NOT NULL DEFAULT '0' COMMENT '文件源监控备份的轮询间隔(秒，0为使用默认值)',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '修改时间',
+  PRIMARY KEY (`backup_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='云备份扩展配置';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_cloud_sync`
+--
+
+DROP TABLE IF EXISTS `nging_cloud_sync`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_cloud_sync` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '名称',
+  `source_storage` int unsigned NOT NULL DEFAULT '0' COMMENT '源云存储账号ID',
+  `source_prefix` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '源路径前缀',
+  `dest_storage` int unsigned NOT NULL DEFAULT '0' COMMENT '目标云存储账号ID',
+  `dest_prefix` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '目标路径前缀',
+  `mode` enum('copy','mirror') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'copy' COMMENT '同步方式(copy-单向复制;mirror-镜像，删除目标中多余的文件)',
+  `status` enum('idle','running','failure') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'idle' COMMENT '状态',
+  `result` varchar(500) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '最近一次执行结果',
+  `last_executed` int unsigned NOT NULL DEFAULT '0' COMMENT '最近运行时间',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '修改时间',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='云存储同步任务';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_cloud_sync_log`
+--
+
+DROP TABLE IF EXISTS `nging_cloud_sync_log`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_cloud_sync_log` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `sync_id` int unsigned NOT NULL DEFAULT '0' COMMENT '同步任务ID',
+  `dry_run` enum('Y','N') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'N' COMMENT '是否为预演(只比对，不复制和删除)',
+  `copied` int unsigned NOT NULL DEFAULT '0' COMMENT '复制的文件数',
+  `copied_bytes` bigint unsigned NOT NULL DEFAULT '0' COMMENT '复制的字节数',
+  `deleted` int unsigned NOT NULL DEFAULT '0' COMMENT '删除的文件数',
+  `skipped` int unsigned NOT NULL DEFAULT '0' COMMENT '内容相同而跳过的文件数',
+  `failed` int unsigned NOT NULL DEFAULT '0' COMMENT '失败的文件数',
+  `error` varchar(500) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '错误信息',
+  `elapsed` int unsigned NOT NULL DEFAULT '0' COMMENT '耗时(毫秒)',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `cloud_sync_log_sync_id` (`sync_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='云存储同步日志';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_cloud_share`
+--
+
+DROP TABLE IF EXISTS `nging_cloud_share`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_cloud_share` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `storage_id` int unsigned NOT NULL DEFAULT '0' COMMENT '云存储账号ID',
+  `object_key` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '分享的文件',
+  `token` varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '链接标识',
+  `password` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '访问密码(散列值，为空表示不需要密码)',
+  `salt` varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '密码盐',
+  `mode` enum('redirect','proxy') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'redirect' COMMENT '下载方式(redirect-跳转到预签名地址;proxy-由本系统中转)',
+  `max_downloads` int unsigned NOT NULL DEFAULT '0' COMMENT '最大下载次数(0为不限)',
+  `downloads` int unsigned NOT NULL DEFAULT '0' COMMENT '已下载次数',
+  `expires` int unsigned NOT NULL DEFAULT '0' COMMENT '过期时间(0为永不过期)',
+  `revoked` enum('Y','N') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'N' COMMENT '是否已撤销',
+  `uid` int unsigned NOT NULL DEFAULT '0' COMMENT '创建者用户ID',
+  `last_accessed` int unsigned NOT NULL DEFAULT '0' COMMENT '最近下载时间',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `cloud_share_token` (`token`),
+  KEY `cloud_share_storage_id` (`storage_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='云存储文件分享链接';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_cloud_share_log`
+--
+
+DROP TABLE IF EXISTS `nging_cloud_share_log`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_cloud_share_log` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `share_id` int unsigned NOT NULL DEFAULT '0' COMMENT '分享链接ID',
+  `ip` varchar(150) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT 'IP',
+  `user_agent` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '浏览器标识',
+  `result` enum('success','password','expired','revoked','limited') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'success' COMMENT '访问结果(success-下载成功;password-密码错误;expired-已过期;revoked-已撤销;limited-超出下载次数)',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '访问时间',
+  PRIMARY KEY (`id`),
+  KEY `cloud_share_log_share_id` (`share_id`,`created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='云存储文件分享访问日志';
+/*!40101 SET character_set_client = @saved_cs_client */;
@@ -1,13 +1,44 @@
 package cloud
 
 import (
+	_ "embed"
+
+	"github.com/coscms/webcore/library/config"
+	"github.com/coscms/webcore/library/cron"
 	"github.com/coscms/webcore/library/module"
+	"github.com/coscms/webcore/registry/settings"
 )
 
 const ID = `cloud`
 
+//go:embed install.sql
+var installSQL string
+
 var Module = module.Module{
 	Navigate: func(nc module.Navigate) {
 		nc.Backend().AddLeftItems(-1, LeftNavigate)
 	},
+	SQLCollection: func(sc *config.SQLCollection) {
+		sc.RegisterInstall(ID, installSQL)
+	},
+	Settings: []*settings.SettingForm{
+		{
+			Short: `云备份`,
+			Label: `云备份设置`,
+			Group: settingGroup,
+			Tmpl:  []string{`cloud/settings/backup`},
+		},
+		{
+			Short: `云存储`,
+			Label: `云存储设置`,
+			Group: storageSettingGroup,
+			Tmpl:  []string{`cloud/settings/storage`},
+		},
+	},
+	CronJobs: []*cron.Jobx{
+		VerifyJob,
+		DumpJob,
+		CatalogJob,
+	},
+	DBSchemaVer: 0.0007,
 }
@@ -37,6 +37,62 @@ var LeftNavigate = &navigate.Item{
 			Name:    echo.T(`云存储文件管理`),
 			Action:  `storage_file`,
 		},
+		{
+			Display: false,
+			Name:    echo.T(`分享链接列表`),
+			Action:  `share`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`撤销分享链接`),
+			Action:  `share_revoke`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`删除分享链接`),
+			Action:  `share_delete`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`分享链接访问日志`),
+			Action:  `share_log`,
+		},
+		{
+			Display: true,
+			Name:    echo.T(`存储同步`),
+			Action:  `sync`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`添加同步任务`),
+			Action:  `sync_add`,
+			Icon:    `plus`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`修改同步任务`),
+			Action:  `sync_edit`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`删除同步任务`),
+			Action:  `sync_delete`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`启动同步任务`),
+			Action:  `sync_start`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`停止同步任务`),
+			Action:  `sync_stop`,
+		},
+		{
+			Display: false,
+			Name:    echo.T(`同步日志`),
+			Action:  `sync_log`,
+		},
 		{
 			Display: true,
 			Name:    echo.T(`文件备份`),
@@ -73,6 +129,11 @@ var LeftNavigate = &navigate.Item{
 			Name:    echo.T(`恢复备份文件`),
 			Action:  `backup_restore`,
 		},
+		{
+			Display: false,
+			Name:    echo.T(`导入备份配置`),
+			Action:  `backup_import`,
+		},
 		{
 			Display: false,
 			Name:    echo.T(`云备份日志列表`),
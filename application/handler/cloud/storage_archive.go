@@ -0,0 +1,600 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/minio/minio-go/v7"
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/backend"
+	"github.com/coscms/webcore/library/background"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/coscms/webcore/registry/settings"
+)
+
+// 云存储的全局设置(系统设置中的“云存储”)
+const storageSettingGroup = `cloudstorage`
+
+// 压缩包格式
+const (
+	ArchiveFormatZip   = `zip`
+	ArchiveFormatTarGz = `tar.gz`
+)
+
+// archiveNoticeType 打包和解压的消息类型，也用作后台任务的操作标识
+const archiveNoticeType = `cloudArchive`
+
+// 压缩包默认限制
+const (
+	defaultArchiveMaxSize    = 4096  // MB
+	defaultArchiveMaxEntries = 10000 // 文件数
+)
+
+// 跳过的字节数小于此值时继续读取当前数据流，否则重新发起范围请求
+const archiveMaxSkip = 64 * 1024
+
+var (
+	ErrArchiveFormat         = errors.New(`unsupported archive format`)
+	ErrArchiveTooLarge       = errors.New(`the archive exceeds the size limit`)
+	ErrArchiveTooManyEntries = errors.New(`the archive exceeds the entry count limit`)
+	ErrArchiveSizeChanged    = errors.New(`the object size changed while archiving`)
+)
+
+func init() {
+	settings.AddDefaultConfig(storageSettingGroup, map[string]*dbschema.NgingConfig{
+		`archiveMaxSize`: {
+			Key:         `archiveMaxSize`,
+			Label:       echo.T(`压缩包最大尺寸`),
+			Description: echo.T(`打包下载或在线解压时，文件解压后的总大小上限(MB)`),
+			Value:       fmt.Sprint(defaultArchiveMaxSize),
+			Group:       storageSettingGroup,
+			Type:        `text`,
+			Sort:        10,
+			Disabled:    `N`,
+		},
+		`archiveMaxEntries`: {
+			Key:         `archiveMaxEntries`,
+			Label:       echo.T(`压缩包最多文件数`),
+			Description: echo.T(`打包下载或在线解压时，最多包含的文件数`),
+			Value:       fmt.Sprint(defaultArchiveMaxEntries),
+			Group:       storageSettingGroup,
+			Type:        `text`,
+			Sort:        20,
+			Disabled:    `N`,
+		},
+	})
+}
+
+// archiveLimits 压缩包限制，用于防范压缩炸弹
+type archiveLimits struct {
+	MaxBytes   int64
+	MaxEntries int
+}
+
+// Check 检查文件数和总大小是否超出限制
+func (l archiveLimits) Check(entries int, bytes int64) error {
+	if entries > l.MaxEntries {
+		return ErrArchiveTooManyEntries
+	}
+	if bytes > l.MaxBytes {
+		return ErrArchiveTooLarge
+	}
+	return nil
+}
+
+// archiveLimitsFromSetting 系统设置中的压缩包限制
+func archiveLimitsFromSetting() archiveLimits {
+	cfg := common.Setting(storageSettingGroup)
+	maxSize := cfg.Int64(`archiveMaxSize`)
+	if maxSize <= 0 {
+		maxSize = defaultArchiveMaxSize
+	}
+	maxEntries := cfg.Int(`archiveMaxEntries`)
+	if maxEntries <= 0 {
+		maxEntries = defaultArchiveMaxEntries
+	}
+	return archiveLimits{MaxBytes: maxSize << 20, MaxEntries: maxEntries}
+}
+
+// archiveFormatOf 根据文件名获取压缩包格式
+func archiveFormatOf(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, `.zip`):
+		return ArchiveFormatZip
+	case strings.HasSuffix(name, `.tar.gz`), strings.HasSuffix(name, `.tgz`):
+		return ArchiveFormatTarGz
+	default:
+		return ``
+	}
+}
+
+// archiveExtractPrefix 默认的解压目录：与压缩包同级的同名文件夹
+func archiveExtractPrefix(key string) string {
+	name := path.Base(key)
+	lower := strings.ToLower(name)
+	for _, ext := range []string{`.tar.gz`, `.tgz`, `.zip`} {
+		if strings.HasSuffix(lower, ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	dir := path.Dir(strings.TrimPrefix(key, `/`))
+	if dir == `.` {
+		dir = ``
+	}
+	return strings.TrimPrefix(path.Join(dir, name), `/`) + `/`
+}
+
+// archiveEntryKey 压缩包内文件在存储桶中的路径。路径不安全(例如包含“..”)时返回空字符串
+func archiveEntryKey(prefix, name string) string {
+	name = strings.ReplaceAll(name, `\`, `/`)
+	cleaned := path.Clean(`/` + name)
+	if cleaned == `/` || cleaned != `/`+strings.TrimSuffix(strings.TrimPrefix(name, `./`), `/`) {
+		return ``
+	}
+	return prefix + cleaned[1:]
+}
+
+// archiveSummary 打包或解压结果
+type archiveSummary struct {
+	Entries int
+	Bytes   int64
+	Skipped int
+	Elapsed time.Duration
+}
+
+func (s *archiveSummary) String(ctx echo.Context) string {
+	return ctx.T(`已处理%d个文件(%s)，跳过%d个，耗时%s`, s.Entries, com.FormatBytes(s.Bytes), s.Skipped, s.Elapsed.Round(time.Second))
+}
+
+// archiveCounter 统计读取的字节数并更新进度，超出总大小限制时返回 ErrArchiveTooLarge
+type archiveCounter struct {
+	r       io.Reader
+	total   *int64
+	max     int64
+	noticer notice.NProgressor
+}
+
+func (c *archiveCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.total += int64(n)
+	if c.noticer != nil && n > 0 {
+		c.noticer.Done(int64(n))
+	}
+	if *c.total > c.max {
+		return n, ErrArchiveTooLarge
+	}
+	return n, err
+}
+
+// rangeReaderAt 用范围请求实现 io.ReaderAt。连续读取时复用同一个数据流，避免每次读取都发起请求
+type rangeReaderAt struct {
+	open func(offset int64) (io.ReadCloser, error)
+	rc   io.ReadCloser
+	pos  int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if r.rc != nil && offset >= r.pos && offset-r.pos <= archiveMaxSkip {
+		if _, err := io.CopyN(io.Discard, r.rc, offset-r.pos); err != nil {
+			r.Close()
+		} else {
+			r.pos = offset
+		}
+	}
+	if r.rc == nil || r.pos != offset {
+		r.Close()
+		rc, err := r.open(offset)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+		r.pos = offset
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil {
+		r.Close()
+	}
+	return n, err
+}
+
+func (r *rangeReaderAt) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// storageArchiver 云存储文件夹的打包下载和压缩包的在线解压
+type storageArchiver struct {
+	client  *minio.Client
+	bucket  string
+	limits  archiveLimits
+	noticer notice.NProgressor
+}
+
+func newStorageArchiver(client *minio.Client, bucket string, limits archiveLimits) *storageArchiver {
+	return &storageArchiver{client: client, bucket: bucket, limits: limits}
+}
+
+func (a *storageArchiver) send(msg string, state int) {
+	if a.noticer != nil {
+		a.noticer.Send(msg, state)
+	}
+}
+
+// Objects 列出文件夹下的所有文件并检查限制
+func (a *storageArchiver) Objects(ctx context.Context, prefix string) ([]minio.ObjectInfo, int64, error) {
+	var (
+		objects []minio.ObjectInfo
+		total   int64
+	)
+	for obj := range a.client.ListObjects(ctx, a.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, 0, obj.Err
+		}
+		if strings.HasSuffix(obj.Key, `/`) {
+			continue
+		}
+		objects = append(objects, obj)
+		total += obj.Size
+		if err := a.limits.Check(len(objects), total); err != nil {
+			return nil, 0, err
+		}
+	}
+	return objects, total, nil
+}
+
+// Compress 将文件夹下的文件以流的方式打包写入 w
+func (a *storageArchiver) Compress(ctx context.Context, w io.Writer, format string, prefix string, objects []minio.ObjectInfo) (*archiveSummary, error) {
+	summary := &archiveSummary{}
+	start := time.Now()
+	var err error
+	switch format {
+	case ArchiveFormatZip:
+		zw := zip.NewWriter(w)
+		err = a.compress(ctx, prefix, objects, summary, func(obj minio.ObjectInfo, name string, r io.Reader) error {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: obj.LastModified})
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fw, r)
+			return err
+		})
+		if err == nil {
+			err = zw.Close()
+		}
+	case ArchiveFormatTarGz:
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+		err = a.compress(ctx, prefix, objects, summary, func(obj minio.ObjectInfo, name string, r io.Reader) error {
+			err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: obj.Size, ModTime: obj.LastModified, Typeflag: tar.TypeReg, Format: tar.FormatPAX})
+			if err != nil {
+				return err
+			}
+			n, err := io.CopyN(tw, r, obj.Size)
+			if err == io.EOF || (err == nil && n != obj.Size) {
+				err = ErrArchiveSizeChanged
+			}
+			return err
+		})
+		if err == nil {
+			if err = tw.Close(); err == nil {
+				err = gw.Close()
+			}
+		}
+	default:
+		err = ErrArchiveFormat
+	}
+	summary.Elapsed = time.Since(start)
+	return summary, err
+}
+
+func (a *storageArchiver) compress(ctx context.Context, prefix string, objects []minio.ObjectInfo, summary *archiveSummary, write func(obj minio.ObjectInfo, name string, r io.Reader) error) error {
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		rc, err := a.client.GetObject(ctx, a.bucket, obj.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		err = write(obj, name, &archiveCounter{r: rc, total: &summary.Bytes, max: a.limits.MaxBytes, noticer: a.noticer})
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, obj.Key, err)
+		}
+		summary.Entries++
+	}
+	return nil
+}
+
+// Extract 将存储桶中的压缩包解压到 destPrefix。zip 格式通过范围请求按需读取，tar.gz 格式流式读取，都不需要下载到本地
+func (a *storageArchiver) Extract(ctx context.Context, key string, destPrefix string) (*archiveSummary, error) {
+	summary := &archiveSummary{}
+	start := time.Now()
+	var err error
+	switch archiveFormatOf(key) {
+	case ArchiveFormatZip:
+		err = a.extractZip(ctx, key, destPrefix, summary)
+	case ArchiveFormatTarGz:
+		err = a.extractTarGz(ctx, key, destPrefix, summary)
+	default:
+		err = ErrArchiveFormat
+	}
+	summary.Elapsed = time.Since(start)
+	return summary, err
+}
+
+func (a *storageArchiver) open(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := a.client.GetObject(ctx, a.bucket, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (a *storageArchiver) extractZip(ctx context.Context, key string, destPrefix string, summary *archiveSummary) error {
+	info, err := a.client.StatObject(ctx, a.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+	ra := &rangeReaderAt{open: func(offset int64) (io.ReadCloser, error) {
+		return a.open(ctx, key, offset)
+	}}
+	defer ra.Close()
+	zr, err := zip.NewReader(ra, info.Size)
+	if err != nil {
+		return err
+	}
+	// 先按文件头中记录的大小检查限制，实际解压时再按读取的字节数检查
+	var total int64
+	for _, f := range zr.File {
+		total += int64(f.UncompressedSize64)
+	}
+	if err = a.limits.Check(len(zr.File), total); err != nil {
+		return err
+	}
+	if a.noticer != nil {
+		a.noticer.Add(total)
+	}
+	var read int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		objectKey := archiveEntryKey(destPrefix, f.Name)
+		if len(objectKey) == 0 || !f.Mode().IsRegular() {
+			summary.Skipped++
+			a.send(defaults.MustGetContext(ctx).T(`跳过：%s`, f.Name), notice.StateFailure)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, f.Name, err)
+		}
+		err = a.put(ctx, objectKey, &archiveCounter{r: rc, total: &read, max: a.limits.MaxBytes, noticer: a.noticer}, int64(f.UncompressedSize64))
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, f.Name, err)
+		}
+		summary.Entries++
+		summary.Bytes += int64(f.UncompressedSize64)
+	}
+	return nil
+}
+
+func (a *storageArchiver) extractTarGz(ctx context.Context, key string, destPrefix string, summary *archiveSummary) error {
+	obj, err := a.open(ctx, key, 0)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	var r io.Reader = obj
+	if a.noticer != nil { // tar.gz 无法预先得知解压后的大小，按已读取的压缩包字节数显示进度
+		if info, err := a.client.StatObject(ctx, a.bucket, key, minio.StatObjectOptions{}); err == nil {
+			a.noticer.Add(info.Size)
+			r = &archiveCounter{r: obj, total: new(int64), max: info.Size, noticer: a.noticer}
+		}
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	// 读取每个文件头时累计检查限制，跳过的文件也计入总大小
+	var (
+		total   int64
+		entries int
+	)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entries++
+		total += hdr.Size
+		if err = a.limits.Check(entries, total); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		objectKey := archiveEntryKey(destPrefix, hdr.Name)
+		if len(objectKey) == 0 || hdr.Typeflag != tar.TypeReg {
+			summary.Skipped++
+			a.send(defaults.MustGetContext(ctx).T(`跳过：%s`, hdr.Name), notice.StateFailure)
+			continue
+		}
+		if err = a.put(ctx, objectKey, tr, hdr.Size); err != nil {
+			return fmt.Errorf(`%s: %w`, hdr.Name, err)
+		}
+		summary.Entries++
+		summary.Bytes += hdr.Size
+	}
+}
+
+func (a *storageArchiver) put(ctx context.Context, key string, r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{ContentType: mime.TypeByExtension(path.Ext(key))}
+	if len(opts.ContentType) == 0 {
+		opts.ContentType = `application/octet-stream`
+	}
+	_, err := a.client.PutObject(ctx, a.bucket, key, r, size, opts)
+	return err
+}
+
+// archiveBackgroundKey 解压任务的后台任务标识
+func archiveBackgroundKey(storageID uint, key string) string {
+	return `extract.` + param.AsString(storageID) + `.` + key
+}
+
+// storageArchive 打包下载文件夹
+func storageArchive(ctx echo.Context, a *storageArchiver, storage *dbschema.NgingCloudStorage, ppath string) error {
+	format := ctx.Form(`format`, ArchiveFormatZip)
+	if format != ArchiveFormatZip && format != ArchiveFormatTarGz {
+		return ctx.NewError(code.InvalidParameter, `无效参数: %s`, `format`).SetZone(`format`)
+	}
+	prefix := strings.TrimPrefix(ppath, `/`)
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, `/`) {
+		prefix += `/`
+	}
+	objects, total, err := a.Objects(ctx, prefix)
+	if err != nil {
+		return archiveLimitError(ctx, a.limits, err)
+	}
+	name := path.Base(strings.TrimSuffix(prefix, `/`))
+	if len(prefix) == 0 {
+		name = storage.Bucket
+	}
+	user := backend.User(ctx)
+	notice.OpenMessage(user.Username, archiveNoticeType)
+	a.noticer = notice.NewP(ctx, archiveNoticeType, user.Username, ctx).AutoComplete(true)
+	a.noticer.Add(total)
+	a.send(ctx.T(`正在打包“%s”`, name), notice.StateSuccess)
+	fileName := name + `.` + format
+	ctx.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename*=utf-8''`+com.URLEncode(fileName))
+	if format == ArchiveFormatZip {
+		ctx.Response().Header().Set(echo.HeaderContentType, `application/zip`)
+	} else {
+		ctx.Response().Header().Set(echo.HeaderContentType, `application/gzip`)
+	}
+	ctx.Response().WriteHeader(http.StatusOK)
+	summary, err := a.Compress(ctx, ctx.Response(), format, prefix, objects)
+	if err != nil {
+		// 响应头已经发送，只能通过消息通知错误
+		log.Errorf(`[cloudarchive] failed to compress %s: %v`, prefix, err)
+		a.send(ctx.T(`打包失败：%v`, err), notice.StateFailure)
+	} else {
+		a.send(summary.String(ctx), notice.StateSuccess)
+	}
+	a.noticer.Complete()
+	return nil
+}
+
+// archiveLimitError 超出限制时返回带有限制值的错误
+func archiveLimitError(ctx echo.Context, limits archiveLimits, err error) error {
+	switch {
+	case errors.Is(err, ErrArchiveTooLarge):
+		return ctx.NewError(code.ExceedLimitQuantity, `文件总大小超出限制(%s)`, com.FormatBytes(limits.MaxBytes))
+	case errors.Is(err, ErrArchiveTooManyEntries):
+		return ctx.NewError(code.ExceedLimitQuantity, `文件数量超出限制(%d)`, limits.MaxEntries)
+	case errors.Is(err, ErrArchiveFormat):
+		return ctx.NewError(code.Unsupported, `不支持的压缩包格式，仅支持zip和tar.gz`)
+	}
+	return err
+}
+
+// storageExtract 在后台将压缩包解压到指定目录
+func storageExtract(ctx echo.Context, a *storageArchiver, storage *dbschema.NgingCloudStorage, ppath string) error {
+	data := ctx.Data()
+	key := strings.TrimPrefix(ppath, `/`)
+	if len(archiveFormatOf(key)) == 0 {
+		return ctx.JSON(data.SetError(archiveLimitError(ctx, a.limits, ErrArchiveFormat)))
+	}
+	destPrefix := strings.Trim(ctx.Form(`dest`), `/`)
+	if len(destPrefix) > 0 {
+		if destPrefix = archiveEntryKey(``, destPrefix); len(destPrefix) == 0 {
+			return ctx.JSON(data.SetError(ctx.NewError(code.InvalidParameter, `无效参数: %s`, `dest`).SetZone(`dest`)))
+		}
+		destPrefix += `/`
+	} else if !ctx.Formx(`root`).Bool() { // 未指定时解压到与压缩包同级的同名文件夹
+		destPrefix = archiveExtractPrefix(key)
+	}
+	bgKey := archiveBackgroundKey(storage.Id, key)
+	bg := background.New(context.Background(), nil)
+	group, err := background.Register(ctx, archiveNoticeType, bgKey, bg)
+	if err != nil {
+		return ctx.JSON(data.SetError(err))
+	}
+	user := backend.User(ctx)
+	notice.OpenMessage(user.Username, archiveNoticeType)
+	a.noticer = notice.NewP(ctx, archiveNoticeType, user.Username, bg.Context()).AutoComplete(true)
+	go func() {
+		defer group.Cancel(bgKey)
+		eCtx := defaults.MustGetContext(bg.Context())
+		a.send(eCtx.T(`正在解压“%s”到“/%s”`, key, destPrefix), notice.StateSuccess)
+		summary, err := a.Extract(eCtx, key, destPrefix)
+		if err != nil {
+			if bg.Context().Err() != nil {
+				err = echo.ErrExit
+			}
+			log.Errorf(`[cloudarchive] failed to extract %s: %v`, key, err)
+			a.send(eCtx.T(`解压失败：%v`, archiveLimitError(eCtx, a.limits, err)), notice.StateFailure)
+		} else {
+			a.send(summary.String(eCtx), notice.StateSuccess)
+		}
+		a.noticer.Complete()
+	}()
+	return ctx.JSON(data.SetInfo(ctx.T(`已经开始在后台解压，请留意消息通知`), 1))
+}
@@ -0,0 +1,166 @@
+package cloud
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveNames(t *testing.T) {
+	assert.Equal(t, ArchiveFormatZip, archiveFormatOf(`a/B.ZIP`))
+	assert.Equal(t, ArchiveFormatTarGz, archiveFormatOf(`b.tar.gz`))
+	assert.Equal(t, ArchiveFormatTarGz, archiveFormatOf(`c.tgz`))
+	assert.Equal(t, ``, archiveFormatOf(`d.rar`))
+
+	assert.Equal(t, `dir/photos/`, archiveExtractPrefix(`/dir/photos.tar.gz`))
+	assert.Equal(t, `photos/`, archiveExtractPrefix(`photos.zip`))
+
+	assert.Equal(t, `out/a/b.txt`, archiveEntryKey(`out/`, `a/b.txt`))
+	assert.Equal(t, `out/a.txt`, archiveEntryKey(`out/`, `./a.txt`))
+	assert.Equal(t, `out/a/b.txt`, archiveEntryKey(`out/`, `a\b.txt`))
+	assert.Equal(t, ``, archiveEntryKey(`out/`, `../evil.txt`))
+	assert.Equal(t, ``, archiveEntryKey(`out/`, `a/../../evil.txt`))
+	assert.Equal(t, ``, archiveEntryKey(`out/`, `/etc/passwd`))
+}
+
+func TestRangeReaderAt(t *testing.T) {
+	data := bytes.Repeat([]byte(`0123456789`), 20000)
+	var opened int
+	ra := &rangeReaderAt{open: func(offset int64) (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	}}
+	defer ra.Close()
+	buf := make([]byte, 10)
+	for _, offset := range []int64{0, 10, 30, 150000, 5} {
+		n, err := ra.ReadAt(buf, offset)
+		require.NoError(t, err)
+		assert.Equal(t, data[offset:offset+10], buf[:n])
+	}
+	// 连续读取和小范围向后跳过复用数据流，向前或大范围跳过时重新请求
+	assert.Equal(t, 3, opened)
+
+	n, err := ra.ReadAt(buf, int64(len(data)-4))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 4, n)
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestStorageArchiveCompress(t *testing.T) {
+	bm, fake := newFakeBucketManager(t)
+	fake.put(`docs/a.txt`, []byte(`hello`), false)
+	fake.put(`docs/sub/b.txt`, []byte(`world`), false)
+	fake.put(`other.txt`, []byte(`other`), false)
+	a := newStorageArchiver(bm.client, fake.bucket, archiveLimits{MaxBytes: 1 << 20, MaxEntries: 10})
+	ctx := context.Background()
+
+	objects, total, err := a.Objects(ctx, `docs/`)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.EqualValues(t, 10, total)
+
+	buf := &bytes.Buffer{}
+	summary, err := a.Compress(ctx, buf, ArchiveFormatZip, `docs/`, objects)
+	require.NoError(t, err)
+	assert.Equal(t, 2, summary.Entries)
+	assert.EqualValues(t, 10, summary.Bytes)
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	assert.Equal(t, `a.txt`, zr.File[0].Name)
+	assert.Equal(t, `sub/b.txt`, zr.File[1].Name)
+
+	buf.Reset()
+	_, err = a.Compress(ctx, buf, ArchiveFormatTarGz, `docs/`, objects)
+	require.NoError(t, err)
+	gr, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, `a.txt`, hdr.Name)
+	content, _ := io.ReadAll(tr)
+	assert.Equal(t, `hello`, string(content))
+
+	a.limits.MaxEntries = 1
+	_, _, err = a.Objects(ctx, `docs/`)
+	assert.Equal(t, ErrArchiveTooManyEntries, err)
+	a.limits = archiveLimits{MaxBytes: 9, MaxEntries: 10}
+	_, _, err = a.Objects(ctx, `docs/`)
+	assert.Equal(t, ErrArchiveTooLarge, err)
+}
+
+func TestStorageArchiveExtract(t *testing.T) {
+	bm, fake := newFakeBucketManager(t)
+	a := newStorageArchiver(bm.client, fake.bucket, archiveLimits{MaxBytes: 1 << 20, MaxEntries: 10})
+	ctx := context.Background()
+
+	fake.put(`up/pack.zip`, makeZip(t, map[string]string{
+		`a.txt`:       `hello`,
+		`dir/`:        ``,
+		`dir/b.txt`:   `world`,
+		`../evil.txt`: `evil`,
+	}), false)
+	summary, err := a.Extract(ctx, `up/pack.zip`, `up/pack/`)
+	require.NoError(t, err)
+	assert.Equal(t, 2, summary.Entries)
+	assert.Equal(t, 1, summary.Skipped)
+	assert.Equal(t, `hello`, string(fake.latest(`up/pack/a.txt`).Data))
+	assert.Equal(t, `world`, string(fake.latest(`up/pack/dir/b.txt`).Data))
+	assert.Nil(t, fake.latest(`up/evil.txt`))
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range map[string]string{`x.txt`: `xx`, `../y.txt`: `yy`} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err = io.WriteString(tw, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	fake.put(`pack.tgz`, buf.Bytes(), false)
+	summary, err = a.Extract(ctx, `pack.tgz`, `out/`)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Entries)
+	assert.Equal(t, 1, summary.Skipped)
+	assert.Equal(t, `xx`, string(fake.latest(`out/x.txt`).Data))
+
+	// 压缩炸弹：文件数或解压后的大小超出限制
+	a.limits = archiveLimits{MaxBytes: 1 << 20, MaxEntries: 2}
+	_, err = a.Extract(ctx, `up/pack.zip`, `up/pack/`)
+	assert.Equal(t, ErrArchiveTooManyEntries, err)
+	fake.put(`bomb.zip`, makeZip(t, map[string]string{`zero.bin`: string(make([]byte, 2<<20))}), false)
+	a.limits = archiveLimits{MaxBytes: 1 << 20, MaxEntries: 10}
+	_, err = a.Extract(ctx, `bomb.zip`, `bomb/`)
+	assert.Equal(t, ErrArchiveTooLarge, err)
+	assert.Nil(t, fake.latest(`bomb/zero.bin`))
+
+	_, err = a.Extract(ctx, `a.rar`, `out/`)
+	assert.Equal(t, ErrArchiveFormat, err)
+}
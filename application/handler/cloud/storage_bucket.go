@@ -0,0 +1,271 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/common"
+)
+
+// maxObjectVersions 版本列表每次最多显示的数量
+const maxObjectVersions = 500
+
+var (
+	ErrLifecycleRuleID     = errors.New(`lifecycle rule ID is required and must be unique`)
+	ErrLifecycleRuleStatus = errors.New(`lifecycle rule status must be "Enabled" or "Disabled"`)
+	ErrLifecycleRuleAction = errors.New(`lifecycle rule has no action`)
+	ErrVersionIDRequired   = errors.New(`object version ID is required`)
+)
+
+// objectVersion 对象的某个版本或删除标记
+type objectVersion struct {
+	Key            string
+	VersionID      string
+	Size           int64
+	ETag           string
+	LastModified   time.Time
+	IsLatest       bool
+	IsDeleteMarker bool
+	IsDir          bool
+}
+
+// bucketManager 存储桶的生命周期和版本控制管理
+type bucketManager struct {
+	client *minio.Client
+	bucket string
+}
+
+func newBucketManager(client *minio.Client, bucket string) *bucketManager {
+	return &bucketManager{client: client, bucket: bucket}
+}
+
+// Lifecycle 获取生命周期规则。未配置时返回空列表
+func (b *bucketManager) Lifecycle(ctx context.Context) ([]lifecycle.Rule, error) {
+	cfg, err := b.client.GetBucketLifecycle(ctx, b.bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == `NoSuchLifecycleConfiguration` {
+			return []lifecycle.Rule{}, nil
+		}
+		return nil, err
+	}
+	return cfg.Rules, nil
+}
+
+// SetLifecycle 保存生命周期规则。规则为空时删除生命周期配置
+func (b *bucketManager) SetLifecycle(ctx context.Context, rules []lifecycle.Rule) error {
+	cfg := lifecycle.NewConfiguration()
+	cfg.Rules = rules
+	return b.client.SetBucketLifecycle(ctx, b.bucket, cfg)
+}
+
+// Versioning 获取版本控制状态: Enabled / Suspended / 空(从未开启)
+func (b *bucketManager) Versioning(ctx context.Context) (string, error) {
+	cfg, err := b.client.GetBucketVersioning(ctx, b.bucket)
+	if err != nil {
+		return ``, err
+	}
+	return cfg.Status, nil
+}
+
+// SetVersioning 开启或暂停版本控制(版本控制一旦开启就不能关闭，只能暂停)
+func (b *bucketManager) SetVersioning(ctx context.Context, enable bool) error {
+	if enable {
+		return b.client.EnableVersioning(ctx, b.bucket)
+	}
+	return b.client.SuspendVersioning(ctx, b.bucket)
+}
+
+// Versions 列出 prefix 下(不含子目录)所有对象的版本和删除标记。
+// prefix 不以“/”结尾时视为文件，只列出该文件的版本。结果超过 limit 时截断并返回 true
+func (b *bucketManager) Versions(ctx context.Context, prefix string, limit int) ([]objectVersion, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	isFile := len(prefix) > 0 && !strings.HasSuffix(prefix, `/`)
+	var list []objectVersion
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, WithVersions: true}) {
+		if obj.Err != nil {
+			return list, false, obj.Err
+		}
+		if isFile && obj.Key != prefix {
+			continue
+		}
+		if len(list) >= limit {
+			return list, true, nil
+		}
+		list = append(list, objectVersion{
+			Key:            obj.Key,
+			VersionID:      obj.VersionID,
+			Size:           obj.Size,
+			ETag:           obj.ETag,
+			LastModified:   obj.LastModified,
+			IsLatest:       obj.IsLatest,
+			IsDeleteMarker: obj.IsDeleteMarker,
+			IsDir:          strings.HasSuffix(obj.Key, `/`),
+		})
+	}
+	return list, false, nil
+}
+
+// RestoreVersion 将指定版本恢复为最新版本。
+// 如果指定的是删除标记则删除该标记，使对象重新可见；否则复制该版本为新的最新版本
+func (b *bucketManager) RestoreVersion(ctx context.Context, key string, versionID string) error {
+	if len(versionID) == 0 {
+		return ErrVersionIDRequired
+	}
+	info, err := b.client.StatObject(ctx, b.bucket, key, minio.StatObjectOptions{VersionID: versionID})
+	if err != nil {
+		// 对删除标记版本的 HEAD 请求会返回 405
+		if minio.ToErrorResponse(err).StatusCode == http.StatusMethodNotAllowed {
+			return b.RemoveVersion(ctx, key, versionID)
+		}
+		return err
+	}
+	if info.IsDeleteMarker {
+		return b.RemoveVersion(ctx, key, versionID)
+	}
+	_, err = b.client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket: b.bucket,
+		Object: key,
+	}, minio.CopySrcOptions{
+		Bucket:    b.bucket,
+		Object:    key,
+		VersionID: versionID,
+	})
+	return err
+}
+
+// RemoveVersion 永久删除指定版本或删除标记
+func (b *bucketManager) RemoveVersion(ctx context.Context, key string, versionID string) error {
+	if len(versionID) == 0 {
+		return ErrVersionIDRequired
+	}
+	return b.client.RemoveObject(ctx, b.bucket, key, minio.RemoveObjectOptions{VersionID: versionID})
+}
+
+// parseLifecycleRules 解析并校验 JSON 格式的生命周期规则
+func parseLifecycleRules(content string) ([]lifecycle.Rule, error) {
+	rules := []lifecycle.Rule{}
+	content = strings.TrimSpace(content)
+	if len(content) == 0 {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(content), &rules); err != nil {
+		return nil, err
+	}
+	ids := map[string]struct{}{}
+	for i, rule := range rules {
+		rule.ID = strings.TrimSpace(rule.ID)
+		if len(rule.ID) == 0 {
+			return nil, ErrLifecycleRuleID
+		}
+		if _, ok := ids[rule.ID]; ok {
+			return nil, ErrLifecycleRuleID
+		}
+		ids[rule.ID] = struct{}{}
+		switch rule.Status {
+		case ``:
+			rule.Status = `Enabled`
+		case `Enabled`, `Disabled`:
+		default:
+			return nil, ErrLifecycleRuleStatus
+		}
+		if rule.Expiration.IsNull() && rule.Transition.IsNull() &&
+			rule.AbortIncompleteMultipartUpload.IsDaysNull() &&
+			rule.NoncurrentVersionExpiration.IsDaysNull() &&
+			rule.NoncurrentVersionTransition.IsDaysNull() &&
+			rule.DelMarkerExpiration.IsNull() && rule.AllVersionsExpiration.IsNull() {
+			return nil, ErrLifecycleRuleAction
+		}
+		rules[i] = rule
+	}
+	return rules, nil
+}
+
+// storageLifecycle 查看和修改存储桶的生命周期规则
+func storageLifecycle(ctx echo.Context, bm *bucketManager, m *dbschema.NgingCloudStorage) error {
+	if ctx.IsPost() {
+		data := ctx.Data()
+		rules, err := parseLifecycleRules(ctx.Form(`rules`))
+		if err == nil {
+			err = bm.SetLifecycle(ctx, rules)
+		}
+		if err != nil {
+			data.SetInfo(err.Error(), 0)
+		} else {
+			data.SetInfo(ctx.T(`保存成功`), 1)
+		}
+		return ctx.JSON(data)
+	}
+	rules, err := bm.Lifecycle(ctx)
+	ctx.Set(`rules`, rules)
+	ctx.Set(`data`, m)
+	ctx.Set(`title`, ctx.T(`配置生命周期规则`))
+	return ctx.Render(`cloud/storage_lifecycle`, common.Err(ctx, err))
+}
+
+// storageVersions 切换版本控制状态，以及浏览、恢复和删除对象的历史版本
+func storageVersions(ctx echo.Context, bm *bucketManager, m *dbschema.NgingCloudStorage, ppath string) error {
+	if ctx.IsPost() {
+		data := ctx.Data()
+		var err error
+		switch ctx.Form(`op`) {
+		case `enable`:
+			err = bm.SetVersioning(ctx, true)
+		case `suspend`:
+			err = bm.SetVersioning(ctx, false)
+		case `restore`:
+			err = bm.RestoreVersion(ctx, ctx.Form(`key`), ctx.Form(`versionId`))
+		case `remove`:
+			err = bm.RemoveVersion(ctx, ctx.Form(`key`), ctx.Form(`versionId`))
+		default:
+			err = ctx.NewError(code.InvalidParameter, `无效参数: %s`, `op`).SetZone(`op`)
+		}
+		if err != nil {
+			data.SetInfo(err.Error(), 0)
+		} else {
+			data.SetInfo(ctx.T(`操作成功`), 1)
+		}
+		return ctx.JSON(data)
+	}
+	status, err := bm.Versioning(ctx)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimPrefix(ppath, `/`)
+	versions, truncated, err := bm.Versions(ctx, prefix, maxObjectVersions)
+	ctx.Set(`versioning`, status)
+	ctx.Set(`versions`, versions)
+	ctx.Set(`truncated`, truncated)
+	ctx.Set(`path`, ppath)
+	ctx.Set(`data`, m)
+	ctx.Set(`title`, ctx.T(`历史版本`))
+	return ctx.Render(`cloud/storage_versions`, common.Err(ctx, err))
+}
@@ -0,0 +1,458 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeS3Version struct {
+	ID           string
+	Data         []byte
+	DeleteMarker bool
+	ModTime      time.Time
+}
+
+// fakeS3 兼容 S3 接口的最小化存储服务，只实现生命周期、版本控制、版本、分片上传和简单的文件读写接口
+type fakeS3 struct {
+	mu         sync.Mutex
+	bucket     string
+	lifecycle  []byte
+	versioning string
+	objects    map[string][]*fakeS3Version // 最后一个为最新版本
+	uploads    map[string]map[int][]byte   // uploadID => partNumber => data
+	seq        int
+	now        time.Time
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string][]*fakeS3Version{},
+		uploads: map[string]map[int][]byte{},
+		now:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (f *fakeS3) put(key string, data []byte, deleteMarker bool) string {
+	f.seq++
+	f.now = f.now.Add(time.Minute)
+	v := &fakeS3Version{ID: fmt.Sprintf(`v%d`, f.seq), Data: data, DeleteMarker: deleteMarker, ModTime: f.now}
+	f.objects[key] = append(f.objects[key], v)
+	return v.ID
+}
+
+func (f *fakeS3) find(key, id string) (int, *fakeS3Version) {
+	for i, v := range f.objects[key] {
+		if v.ID == id {
+			return i, v
+		}
+	}
+	return -1, nil
+}
+
+func (f *fakeS3) latest(key string) *fakeS3Version {
+	versions := f.objects[key]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readFakeS3Body 读取请求内容，支持 aws-chunked 编码
+func readFakeS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get(`X-Amz-Content-Sha256`), `STREAMING-`) {
+		return io.ReadAll(r.Body)
+	}
+	br := bufio.NewReader(r.Body)
+	buf := &bytes.Buffer{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), `;`, 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.CopyN(buf, br, size+2); err != nil { // 数据后面是 \r\n
+			return nil, err
+		}
+		buf.Truncate(buf.Len() - 2)
+		if size == 0 {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set(`Content-Type`, `application/xml`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, `/`), `/`, 2)
+	if parts[0] != f.bucket {
+		writeS3Error(w, http.StatusNotFound, `NoSuchBucket`)
+		return
+	}
+	query := r.URL.Query()
+	if len(parts) == 1 || len(parts[1]) == 0 {
+		f.serveBucket(w, r, query)
+		return
+	}
+	f.serveObject(w, r, parts[1], query)
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, query url.Values) {
+	switch {
+	case query.Has(`lifecycle`):
+		switch r.Method {
+		case http.MethodGet:
+			if f.lifecycle == nil {
+				writeS3Error(w, http.StatusNotFound, `NoSuchLifecycleConfiguration`)
+				return
+			}
+			w.Write(f.lifecycle)
+		case http.MethodPut:
+			f.lifecycle, _ = io.ReadAll(r.Body)
+		case http.MethodDelete:
+			f.lifecycle = nil
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case query.Has(`versioning`):
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `<VersioningConfiguration><Status>%s</Status></VersioningConfiguration>`, f.versioning)
+		case http.MethodPut:
+			cfg := minio.BucketVersioningConfiguration{}
+			if err := xml.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				writeS3Error(w, http.StatusBadRequest, `MalformedXML`)
+				return
+			}
+			f.versioning = cfg.Status
+		}
+	case query.Has(`versions`):
+		f.listVersions(w, query.Get(`prefix`), query.Get(`delimiter`))
+	case query.Get(`list-type`) == `2`:
+		f.listObjects(w, query.Get(`prefix`))
+	default:
+		writeS3Error(w, http.StatusNotImplemented, `NotImplemented`)
+	}
+}
+
+func (f *fakeS3) listVersions(w http.ResponseWriter, prefix, delimiter string) {
+	keys := make([]string, 0, len(f.objects))
+	prefixes := map[string]struct{}{}
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if len(delimiter) > 0 {
+			if pos := strings.Index(key[len(prefix):], delimiter); pos >= 0 {
+				prefixes[key[:len(prefix)+pos+1]] = struct{}{}
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `<ListVersionsResult><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>`, f.bucket, prefix)
+	for _, key := range keys {
+		versions := f.objects[key]
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			tag := `Version`
+			if v.DeleteMarker {
+				tag = `DeleteMarker`
+			}
+			fmt.Fprintf(b, `<%s><Key>%s</Key><VersionId>%s</VersionId><IsLatest>%t</IsLatest><LastModified>%s</LastModified>`,
+				tag, key, v.ID, i == len(versions)-1, v.ModTime.Format(time.RFC3339))
+			if !v.DeleteMarker {
+				fmt.Fprintf(b, `<ETag>"%s"</ETag><Size>%d</Size>`, fakeETag(v.Data), len(v.Data))
+			}
+			fmt.Fprintf(b, `</%s>`, tag)
+		}
+	}
+	commonPrefixes := make([]string, 0, len(prefixes))
+	for p := range prefixes {
+		commonPrefixes = append(commonPrefixes, p)
+	}
+	sort.Strings(commonPrefixes)
+	for _, p := range commonPrefixes {
+		fmt.Fprintf(b, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, p)
+	}
+	b.WriteString(`</ListVersionsResult>`)
+	w.Header().Set(`Content-Type`, `application/xml`)
+	io.WriteString(w, b.String())
+}
+
+func (f *fakeS3) listObjects(w http.ResponseWriter, prefix string) {
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if v := f.latest(key); strings.HasPrefix(key, prefix) && !v.DeleteMarker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>`, f.bucket, prefix, len(keys))
+	for _, key := range keys {
+		v := f.latest(key)
+		fmt.Fprintf(b, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>"%s"</ETag><Size>%d</Size></Contents>`,
+			key, v.ModTime.Format(time.RFC3339), fakeETag(v.Data), len(v.Data))
+	}
+	b.WriteString(`</ListBucketResult>`)
+	w.Header().Set(`Content-Type`, `application/xml`)
+	io.WriteString(w, b.String())
+}
+
+func (f *fakeS3) serveObject(w http.ResponseWriter, r *http.Request, key string, query url.Values) {
+	if query.Has(`uploads`) || query.Has(`uploadId`) {
+		f.serveMultipart(w, r, key, query)
+		return
+	}
+	versionID := query.Get(`versionId`)
+	switch r.Method {
+	case http.MethodHead:
+		v := f.latest(key)
+		if len(versionID) > 0 {
+			_, v = f.find(key, versionID)
+		}
+		if v == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(`x-amz-version-id`, v.ID)
+		if v.DeleteMarker {
+			w.Header().Set(`x-amz-delete-marker`, `true`)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set(`ETag`, `"`+fakeETag(v.Data)+`"`)
+		w.Header().Set(`Last-Modified`, v.ModTime.Format(http.TimeFormat))
+		w.Header().Set(`Content-Length`, fmt.Sprint(len(v.Data)))
+	case http.MethodPut:
+		source := r.Header.Get(`X-Amz-Copy-Source`)
+		if len(source) == 0 {
+			data, err := readFakeS3Body(r)
+			if err != nil {
+				writeS3Error(w, http.StatusBadRequest, `IncompleteBody`)
+				return
+			}
+			id := f.put(key, data, false)
+			w.Header().Set(`x-amz-version-id`, id)
+			w.Header().Set(`ETag`, `"`+fakeETag(data)+`"`)
+			return
+		}
+		srcURL, err := url.Parse(source)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, `InvalidArgument`)
+			return
+		}
+		srcKey := strings.TrimPrefix(strings.TrimPrefix(srcURL.Path, `/`), f.bucket+`/`)
+		_, src := f.find(srcKey, srcURL.Query().Get(`versionId`))
+		if src == nil || src.DeleteMarker {
+			writeS3Error(w, http.StatusNotFound, `NoSuchVersion`)
+			return
+		}
+		id := f.put(key, src.Data, false)
+		w.Header().Set(`x-amz-version-id`, id)
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>"%s"</ETag><LastModified>%s</LastModified></CopyObjectResult>`,
+			fakeETag(src.Data), f.now.Format(time.RFC3339))
+	case http.MethodGet:
+		v := f.latest(key)
+		if v == nil || v.DeleteMarker {
+			writeS3Error(w, http.StatusNotFound, `NoSuchKey`)
+			return
+		}
+		w.Header().Set(`ETag`, `"`+fakeETag(v.Data)+`"`)
+		http.ServeContent(w, r, key, v.ModTime, bytes.NewReader(v.Data))
+	case http.MethodDelete:
+		if len(versionID) == 0 {
+			f.put(key, nil, true)
+		} else if i, _ := f.find(key, versionID); i >= 0 {
+			versions := f.objects[key]
+			f.objects[key] = append(versions[:i], versions[i+1:]...)
+			if len(f.objects[key]) == 0 {
+				delete(f.objects, key)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, `NotImplemented`)
+	}
+}
+
+func newFakeBucketManager(t *testing.T) (*bucketManager, *fakeS3) {
+	fake := newFakeS3(`test`)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := minio.New(strings.TrimPrefix(server.URL, `http://`), &minio.Options{
+		Creds:  credentials.NewStaticV4(`key`, `secret`, ``),
+		Region: `us-east-1`,
+	})
+	require.NoError(t, err)
+	return newBucketManager(client, fake.bucket), fake
+}
+
+func TestParseLifecycleRules(t *testing.T) {
+	rules, err := parseLifecycleRules(`  `)
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	rules, err = parseLifecycleRules(`[{"ID":" logs ","Filter":{"Prefix":"logs/"},"Expiration":{"Days":30}},` +
+		`{"ID":"mp","Status":"Disabled","AbortIncompleteMultipartUpload":{"DaysAfterInitiation":7}}]`)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, `logs`, rules[0].ID)
+	assert.Equal(t, `Enabled`, rules[0].Status)
+	assert.Equal(t, `Disabled`, rules[1].Status)
+
+	_, err = parseLifecycleRules(`[{"ID":"a","Expiration":{"Days":1}},{"ID":"a","Expiration":{"Days":2}}]`)
+	assert.Equal(t, ErrLifecycleRuleID, err)
+	_, err = parseLifecycleRules(`[{"Expiration":{"Days":1}}]`)
+	assert.Equal(t, ErrLifecycleRuleID, err)
+	_, err = parseLifecycleRules(`[{"ID":"a","Status":"On","Expiration":{"Days":1}}]`)
+	assert.Equal(t, ErrLifecycleRuleStatus, err)
+	_, err = parseLifecycleRules(`[{"ID":"a"}]`)
+	assert.Equal(t, ErrLifecycleRuleAction, err)
+	_, err = parseLifecycleRules(`{`)
+	assert.Error(t, err)
+}
+
+func TestBucketLifecycle(t *testing.T) {
+	bm, fake := newFakeBucketManager(t)
+	ctx := context.Background()
+
+	rules, err := bm.Lifecycle(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	rules, err = parseLifecycleRules(`[{"ID":"logs","Filter":{"Prefix":"logs/"},"Expiration":{"Days":90},` +
+		`"Transition":{"Days":30,"StorageClass":"STANDARD_IA"}},` +
+		`{"ID":"old","NoncurrentVersionExpiration":{"NoncurrentDays":10}},` +
+		`{"ID":"mp","AbortIncompleteMultipartUpload":{"DaysAfterInitiation":7}}]`)
+	require.NoError(t, err)
+	require.NoError(t, bm.SetLifecycle(ctx, rules))
+	assert.NotNil(t, fake.lifecycle)
+
+	saved, err := bm.Lifecycle(ctx)
+	require.NoError(t, err)
+	require.Len(t, saved, 3)
+	assert.Equal(t, `logs`, saved[0].ID)
+	assert.Equal(t, `logs/`, saved[0].RuleFilter.Prefix)
+	assert.EqualValues(t, 90, saved[0].Expiration.Days)
+	assert.EqualValues(t, 30, saved[0].Transition.Days)
+	assert.Equal(t, `STANDARD_IA`, saved[0].Transition.StorageClass)
+	assert.EqualValues(t, 10, saved[1].NoncurrentVersionExpiration.NoncurrentDays)
+	assert.EqualValues(t, 7, saved[2].AbortIncompleteMultipartUpload.DaysAfterInitiation)
+
+	// 保存空规则即删除生命周期配置
+	require.NoError(t, bm.SetLifecycle(ctx, nil))
+	assert.Nil(t, fake.lifecycle)
+	rules, err = bm.Lifecycle(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestBucketVersioning(t *testing.T) {
+	bm, _ := newFakeBucketManager(t)
+	ctx := context.Background()
+
+	status, err := bm.Versioning(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ``, status)
+
+	require.NoError(t, bm.SetVersioning(ctx, true))
+	status, err = bm.Versioning(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, `Enabled`, status)
+
+	require.NoError(t, bm.SetVersioning(ctx, false))
+	status, err = bm.Versioning(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, `Suspended`, status)
+}
+
+func TestBucketObjectVersions(t *testing.T) {
+	bm, fake := newFakeBucketManager(t)
+	ctx := context.Background()
+
+	v1 := fake.put(`a.txt`, []byte(`one`), false)
+	v2 := fake.put(`a.txt`, []byte(`two`), false)
+	marker := fake.put(`a.txt`, nil, true)
+	fake.put(`a.txt.bak`, []byte(`bak`), false)
+	fake.put(`dir/b.txt`, []byte(`b`), false)
+
+	versions, truncated, err := bm.Versions(ctx, ``, maxObjectVersions)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	require.Len(t, versions, 5)
+	assert.Equal(t, marker, versions[0].VersionID)
+	assert.True(t, versions[0].IsDeleteMarker)
+	assert.True(t, versions[0].IsLatest)
+	assert.Equal(t, v2, versions[1].VersionID)
+	assert.EqualValues(t, 3, versions[1].Size)
+	assert.False(t, versions[1].IsLatest)
+	assert.Equal(t, `a.txt.bak`, versions[3].Key)
+	assert.Equal(t, `dir/`, versions[4].Key)
+	assert.True(t, versions[4].IsDir)
+
+	// 只列出指定文件的版本，不包含同前缀的其它文件
+	versions, _, err = bm.Versions(ctx, `a.txt`, maxObjectVersions)
+	require.NoError(t, err)
+	assert.Len(t, versions, 3)
+
+	versions, truncated, err = bm.Versions(ctx, ``, 2)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Len(t, versions, 2)
+
+	// 恢复删除标记即撤销删除
+	require.NoError(t, bm.RestoreVersion(ctx, `a.txt`, marker))
+	assert.Equal(t, v2, fake.latest(`a.txt`).ID)
+
+	// 恢复历史版本会生成新的最新版本
+	require.NoError(t, bm.RestoreVersion(ctx, `a.txt`, v1))
+	latest := fake.latest(`a.txt`)
+	assert.NotEqual(t, v1, latest.ID)
+	assert.Equal(t, `one`, string(latest.Data))
+	assert.Len(t, fake.objects[`a.txt`], 3)
+
+	require.NoError(t, bm.RemoveVersion(ctx, `a.txt`, v2))
+	i, _ := fake.find(`a.txt`, v2)
+	assert.Equal(t, -1, i)
+	assert.Len(t, fake.objects[`a.txt`], 2)
+
+	assert.Equal(t, ErrVersionIDRequired, bm.RemoveVersion(ctx, `a.txt`, ``))
+	assert.Equal(t, ErrVersionIDRequired, bm.RestoreVersion(ctx, `a.txt`, ``))
+}
@@ -86,6 +86,28 @@ func StorageFile(ctx echo.Context) error {
 		ctx.Set(`data`, m.NgingCloudStorage)
 		ctx.Set(`title`, ctx.T(`配置CORS规则`))
 		return ctx.Render(`cloud/storage_cors`, common.Err(ctx, err))
+	case `lifecycle`, `versions`:
+		client, err := mgr.Client()
+		if err != nil {
+			return err
+		}
+		bm := newBucketManager(client, mgr.BucketName())
+		if do == `lifecycle` {
+			return storageLifecycle(ctx, bm, m.NgingCloudStorage)
+		}
+		return storageVersions(ctx, bm, m.NgingCloudStorage, ppath)
+	case `share`:
+		return storageShare(ctx, m.NgingCloudStorage, ppath)
+	case `archive`, `extract`:
+		client, err := mgr.Client()
+		if err != nil {
+			return err
+		}
+		a := newStorageArchiver(client, mgr.BucketName(), archiveLimitsFromSetting())
+		if do == `archive` {
+			return storageArchive(ctx, a, m.NgingCloudStorage, ppath)
+		}
+		return storageExtract(ctx, a, m.NgingCloudStorage, ppath)
 	case `edit`:
 		data := ctx.Data()
 		if _, ok := config.FromFile().Sys.Editable(ppath); !ok {
@@ -191,6 +213,12 @@ func StorageFile(ctx echo.Context) error {
 			data.SetURL(urlData.String())
 		}
 		return ctx.JSON(data)
+	case `multipart`:
+		client, err := mgr.Client()
+		if err != nil {
+			return ctx.JSON(ctx.Data().SetError(err))
+		}
+		return storageMultipart(ctx, newMultipartUploader(client, mgr.BucketName()), ppath)
 	case `upload`:
 		var cu *uploadClient.ChunkUpload
 		var opts []uploadClient.ChunkInfoOpter
@@ -240,6 +268,9 @@ func StorageFile(ctx echo.Context) error {
 		_, ok := config.FromFile().Sys.Editable(fileName)
 		return ok
 	})
+	ctx.SetFunc(`Extractable`, func(fileName string) bool {
+		return len(archiveFormatOf(fileName)) > 0
+	})
 	ctx.SetFunc(`Playable`, func(fileName string) string {
 		mime, _ := config.FromFile().Sys.Playable(fileName)
 		return mime
@@ -0,0 +1,236 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+)
+
+// 浏览器分片直传
+const (
+	minMultipartPartSize     = 5 << 20  // 除最后一个分片外，每个分片至少 5MiB
+	defaultMultipartPartSize = 16 << 20 // 默认分片大小
+	maxMultipartParts        = 10000    // 最多分片数
+	maxMultipartSignParts    = 100      // 每次最多签名的分片数
+)
+
+// multipartSignExpiry 分片上传地址的有效期
+var multipartSignExpiry = time.Hour
+
+var (
+	ErrMultipartTooLarge   = errors.New(`the file is too large for a multipart upload`)
+	ErrMultipartPartNumber = errors.New(`invalid multipart upload part number`)
+	ErrMultipartIncomplete = errors.New(`some parts of the multipart upload have not been uploaded`)
+)
+
+// multipartPartSize 按文件大小计算分片大小，保证分片数不超过 maxMultipartParts
+func multipartPartSize(size int64) (int64, error) {
+	partSize := int64(defaultMultipartPartSize)
+	if size > partSize*maxMultipartParts {
+		partSize = (size + maxMultipartParts - 1) / maxMultipartParts
+		partSize = (partSize + 1<<20 - 1) >> 20 << 20 // 按 MiB 向上取整
+	}
+	if partSize > 5<<30 { // 单个分片最大 5GiB
+		return 0, ErrMultipartTooLarge
+	}
+	return partSize, nil
+}
+
+// multipartPartCount 分片数。空文件也需要上传一个分片
+func multipartPartCount(size, partSize int64) int {
+	if size <= 0 {
+		return 1
+	}
+	return int((size + partSize - 1) / partSize)
+}
+
+// multipartPart 已上传的分片
+type multipartPart struct {
+	PartNumber int    `json:"partNumber"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag"`
+}
+
+// multipartUploader 浏览器直传到存储桶的分片上传会话管理。
+// 服务端只负责创建会话、签名分片上传地址以及完成或取消会话，文件内容不经过服务端
+type multipartUploader struct {
+	core   minio.Core
+	bucket string
+}
+
+func newMultipartUploader(client *minio.Client, bucket string) *multipartUploader {
+	return &multipartUploader{core: minio.Core{Client: client}, bucket: bucket}
+}
+
+// Create 创建分片上传会话
+func (u *multipartUploader) Create(ctx context.Context, key string) (string, error) {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if len(contentType) == 0 {
+		contentType = `application/octet-stream`
+	}
+	return u.core.NewMultipartUpload(ctx, u.bucket, key, minio.PutObjectOptions{ContentType: contentType})
+}
+
+// Sign 为指定的分片生成预签名的上传地址
+func (u *multipartUploader) Sign(ctx context.Context, key, uploadID string, partNumbers []int) (map[int]string, error) {
+	urls := make(map[int]string, len(partNumbers))
+	for _, partNumber := range partNumbers {
+		if partNumber < 1 || partNumber > maxMultipartParts {
+			return nil, ErrMultipartPartNumber
+		}
+		reqParams := url.Values{}
+		reqParams.Set(`partNumber`, strconv.Itoa(partNumber))
+		reqParams.Set(`uploadId`, uploadID)
+		signedURL, err := u.core.Presign(ctx, http.MethodPut, u.bucket, key, multipartSignExpiry, reqParams)
+		if err != nil {
+			return nil, err
+		}
+		urls[partNumber] = signedURL.String()
+	}
+	return urls, nil
+}
+
+// Parts 列出已上传的分片(按分片序号排列)
+func (u *multipartUploader) Parts(ctx context.Context, key, uploadID string) ([]multipartPart, error) {
+	var parts []multipartPart
+	var marker int
+	for {
+		result, err := u.core.ListObjectParts(ctx, u.bucket, key, uploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range result.ObjectParts {
+			parts = append(parts, multipartPart{PartNumber: part.PartNumber, Size: part.Size, ETag: part.ETag})
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// Complete 合并分片完成上传。
+// 分片的 ETag 从存储服务获取，不依赖浏览器(CORS未暴露ETag头时浏览器读取不到)
+func (u *multipartUploader) Complete(ctx context.Context, key, uploadID string, partCount int) error {
+	parts, err := u.Parts(ctx, key, uploadID)
+	if err != nil {
+		return err
+	}
+	if partCount < 1 || len(parts) != partCount {
+		return ErrMultipartIncomplete
+	}
+	completeParts := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return ErrMultipartIncomplete
+		}
+		completeParts[i] = minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}
+	}
+	_, err = u.core.CompleteMultipartUpload(ctx, u.bucket, key, uploadID, completeParts, minio.PutObjectOptions{})
+	return err
+}
+
+// Abort 取消分片上传会话并删除已上传的分片
+func (u *multipartUploader) Abort(ctx context.Context, key, uploadID string) error {
+	return u.core.AbortMultipartUpload(ctx, u.bucket, key, uploadID)
+}
+
+// storageMultipart 浏览器分片直传接口
+func storageMultipart(ctx echo.Context, u *multipartUploader, ppath string) error {
+	data := ctx.Data()
+	key := ctx.Form(`key`)
+	uploadID := ctx.Form(`uploadId`)
+	op := ctx.Form(`op`)
+	if op != `create` && (len(key) == 0 || len(uploadID) == 0) {
+		return ctx.JSON(data.SetError(ctx.NewError(code.InvalidParameter, `无效参数: %s`, `uploadId`).SetZone(`uploadId`)))
+	}
+	var err error
+	switch op {
+	case `create`:
+		name := path.Base(ctx.Form(`name`))
+		if len(name) == 0 || name == `.` || name == `/` {
+			return ctx.JSON(data.SetInfo(ctx.T(`参数name的值无效`), 0).SetZone(`name`))
+		}
+		size := ctx.Formx(`size`).Int64()
+		var partSize int64
+		partSize, err = multipartPartSize(size)
+		if err != nil {
+			break
+		}
+		key = strings.TrimPrefix(path.Join(ppath, name), `/`)
+		uploadID, err = u.Create(ctx, key)
+		if err != nil {
+			break
+		}
+		data.SetData(echo.H{
+			`key`:       key,
+			`uploadId`:  uploadID,
+			`partSize`:  partSize,
+			`partCount`: multipartPartCount(size, partSize),
+		})
+	case `sign`:
+		var partNumbers []int
+		for _, v := range strings.Split(ctx.Form(`parts`), `,`) {
+			n, _ := strconv.Atoi(strings.TrimSpace(v))
+			partNumbers = append(partNumbers, n)
+		}
+		if len(partNumbers) > maxMultipartSignParts {
+			partNumbers = partNumbers[:maxMultipartSignParts]
+		}
+		var urls map[int]string
+		urls, err = u.Sign(ctx, key, uploadID, partNumbers)
+		if err == nil {
+			data.SetData(echo.H{`urls`: urls})
+		}
+	case `parts`:
+		var parts []multipartPart
+		parts, err = u.Parts(ctx, key, uploadID)
+		if err == nil {
+			data.SetData(echo.H{`parts`: parts})
+		}
+	case `complete`:
+		err = u.Complete(ctx, key, uploadID, ctx.Formx(`partCount`).Int())
+		if err == nil {
+			data.SetInfo(ctx.T(`上传成功`), 1)
+		}
+	case `abort`:
+		err = u.Abort(ctx, key, uploadID)
+		if err == nil {
+			data.SetInfo(ctx.T(`已取消上传`), 1)
+		}
+	default:
+		err = ctx.NewError(code.InvalidParameter, `无效参数: %s`, `op`).SetZone(`op`)
+	}
+	if err != nil {
+		return ctx.JSON(data.SetError(err))
+	}
+	return ctx.JSON(data)
+}
@@ -0,0 +1,145 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (f *fakeS3) serveMultipart(w http.ResponseWriter, r *http.Request, key string, query url.Values) {
+	if r.Method == http.MethodPost && query.Has(`uploads`) {
+		f.seq++
+		uploadID := fmt.Sprintf(`upload%d`, f.seq)
+		f.uploads[uploadID] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`,
+			f.bucket, key, uploadID)
+		return
+	}
+	uploadID := query.Get(`uploadId`)
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, `NoSuchUpload`)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, _ := strconv.Atoi(query.Get(`partNumber`))
+		data, _ := io.ReadAll(r.Body)
+		parts[partNumber] = data
+		w.Header().Set(`ETag`, `"`+fakeETag(data)+`"`)
+	case http.MethodGet:
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		b := &strings.Builder{}
+		fmt.Fprintf(b, `<ListPartsResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId><IsTruncated>false</IsTruncated>`, f.bucket, key, uploadID)
+		for _, n := range numbers {
+			fmt.Fprintf(b, `<Part><PartNumber>%d</PartNumber><ETag>"%s"</ETag><Size>%d</Size></Part>`, n, fakeETag(parts[n]), len(parts[n]))
+		}
+		b.WriteString(`</ListPartsResult>`)
+		io.WriteString(w, b.String())
+	case http.MethodPost:
+		req := struct {
+			Parts []minio.CompletePart `xml:"Part"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeS3Error(w, http.StatusBadRequest, `MalformedXML`)
+			return
+		}
+		buf := &bytes.Buffer{}
+		for _, part := range req.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || `"`+fakeETag(data)+`"` != part.ETag {
+				writeS3Error(w, http.StatusBadRequest, `InvalidPart`)
+				return
+			}
+			buf.Write(data)
+		}
+		delete(f.uploads, uploadID)
+		f.put(key, buf.Bytes(), false)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"%s"</ETag></CompleteMultipartUploadResult>`,
+			f.bucket, key, fakeETag(buf.Bytes()))
+	case http.MethodDelete:
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, `NotImplemented`)
+	}
+}
+
+func TestMultipartPartSize(t *testing.T) {
+	partSize, err := multipartPartSize(0)
+	require.NoError(t, err)
+	assert.EqualValues(t, defaultMultipartPartSize, partSize)
+	assert.Equal(t, 1, multipartPartCount(0, partSize))
+	assert.Equal(t, 7, multipartPartCount(100<<20, partSize))
+
+	partSize, err = multipartPartSize(200 << 30)
+	require.NoError(t, err)
+	assert.EqualValues(t, 21<<20, partSize)
+	assert.LessOrEqual(t, multipartPartCount(200<<30, partSize), maxMultipartParts)
+
+	_, err = multipartPartSize(maxMultipartParts*(5<<30) + 1)
+	assert.Equal(t, ErrMultipartTooLarge, err)
+}
+
+func TestMultipartUploader(t *testing.T) {
+	bm, fake := newFakeBucketManager(t)
+	u := newMultipartUploader(bm.client, fake.bucket)
+	ctx := context.Background()
+
+	uploadID, err := u.Create(ctx, `dir/a.bin`)
+	require.NoError(t, err)
+	assert.NotEmpty(t, uploadID)
+
+	_, err = u.Sign(ctx, `dir/a.bin`, uploadID, []int{0})
+	assert.Equal(t, ErrMultipartPartNumber, err)
+	urls, err := u.Sign(ctx, `dir/a.bin`, uploadID, []int{1, 2})
+	require.NoError(t, err)
+	require.Len(t, urls, 2)
+	assert.Contains(t, urls[2], `partNumber=2`)
+	assert.Contains(t, urls[2], `uploadId=`+uploadID)
+
+	put := func(partNumber int, body string) {
+		req, err := http.NewRequest(http.MethodPut, urls[partNumber], strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 只上传了第2个分片（模拟中断），续传时能列出已完成的分片
+	put(2, `world`)
+	parts, err := u.Parts(ctx, `dir/a.bin`, uploadID)
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	assert.Equal(t, 2, parts[0].PartNumber)
+	assert.EqualValues(t, 5, parts[0].Size)
+	assert.Equal(t, ErrMultipartIncomplete, u.Complete(ctx, `dir/a.bin`, uploadID, 2))
+
+	put(1, `hello `)
+	require.NoError(t, u.Complete(ctx, `dir/a.bin`, uploadID, 2))
+	assert.Equal(t, `hello world`, string(fake.latest(`dir/a.bin`).Data))
+	_, err = u.Parts(ctx, `dir/a.bin`, uploadID)
+	assert.Error(t, err)
+
+	uploadID, err = u.Create(ctx, `b.bin`)
+	require.NoError(t, err)
+	require.NoError(t, u.Abort(ctx, `b.bin`, uploadID))
+	assert.Empty(t, fake.uploads)
+}
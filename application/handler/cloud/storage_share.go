@@ -0,0 +1,447 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/webx-top/com"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/backend"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/config"
+	"github.com/coscms/webcore/library/s3manager/s3client"
+	"github.com/coscms/webcore/model"
+)
+
+const (
+	tableCloudShare    = `nging_cloud_share`
+	tableCloudShareLog = `nging_cloud_share_log`
+)
+
+// 分享链接的下载方式
+const (
+	ShareModeRedirect = `redirect` // 跳转到预签名的下载地址
+	ShareModeProxy    = `proxy`    // 由本系统中转下载
+)
+
+// 分享链接的访问结果
+const (
+	ShareResultSuccess  = `success`
+	ShareResultPassword = `password` // 密码错误
+	ShareResultExpired  = `expired`
+	ShareResultRevoked  = `revoked`
+	ShareResultLimited  = `limited` // 超出下载次数
+)
+
+// sharePresignExpiry 预签名下载地址的有效期。
+// 有效期很短，撤销分享后已发出的下载地址也会很快失效
+var sharePresignExpiry = 10 * time.Minute
+
+// 同一IP在 sharePasswordWindow 内输错密码达到 maxSharePasswordFailures 次后暂时禁止访问
+const (
+	maxSharePasswordFailures = 5
+	sharePasswordWindow      = 10 * time.Minute
+)
+
+// 每个分享链接最多保留的访问日志数
+const maxShareLogs = 1000
+
+var (
+	ErrShareExpired  = errors.New(`the share link has expired`)
+	ErrShareRevoked  = errors.New(`the share link has been revoked`)
+	ErrShareLimited  = errors.New(`the share link has reached its download limit`)
+	ErrSharePassword = errors.New(`wrong share password`)
+)
+
+// CloudShare 云存储文件分享链接
+type CloudShare struct {
+	Id           uint   `db:"id,omitempty,pk" json:"id" xml:"id"`
+	StorageId    uint   `db:"storage_id" json:"storage_id" xml:"storage_id"`
+	ObjectKey    string `db:"object_key" json:"object_key" xml:"object_key"`
+	Token        string `db:"token" json:"token" xml:"token"`
+	Password     string `db:"password" json:"-" xml:"-"`
+	Salt         string `db:"salt" json:"-" xml:"-"`
+	Mode         string `db:"mode" json:"mode" xml:"mode"`                            // 下载方式(redirect/proxy)
+	MaxDownloads uint   `db:"max_downloads" json:"max_downloads" xml:"max_downloads"` // 最大下载次数(0为不限)
+	Downloads    uint   `db:"downloads" json:"downloads" xml:"downloads"`
+	Expires      uint   `db:"expires" json:"expires" xml:"expires"` // 过期时间(0为永不过期)
+	Revoked      string `db:"revoked" json:"revoked" xml:"revoked"` // 是否(Y/N)已撤销
+	Uid          uint   `db:"uid" json:"uid" xml:"uid"`
+	LastAccessed uint   `db:"last_accessed" json:"last_accessed" xml:"last_accessed"`
+	Created      uint   `db:"created" json:"created" xml:"created"`
+}
+
+// HasPassword 是否需要密码
+func (s *CloudShare) HasPassword() bool {
+	return len(s.Password) > 0
+}
+
+// SetPassword 设置访问密码。密码为空表示不需要密码
+func (s *CloudShare) SetPassword(password string) {
+	if len(password) == 0 {
+		s.Password = ``
+		s.Salt = ``
+		return
+	}
+	s.Salt = com.RandomAlphanumeric(16)
+	s.Password = com.MakePassword(password, s.Salt)
+}
+
+// CheckPassword 校验访问密码
+func (s *CloudShare) CheckPassword(password string) bool {
+	if !s.HasPassword() {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(s.Password), []byte(com.MakePassword(password, s.Salt))) == 1
+}
+
+// Check 检查分享链接在 now 时是否可用
+func (s *CloudShare) Check(now time.Time) error {
+	if s.Revoked == common.BoolY {
+		return ErrShareRevoked
+	}
+	if s.Expires > 0 && int64(s.Expires) <= now.Unix() {
+		return ErrShareExpired
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return ErrShareLimited
+	}
+	return nil
+}
+
+// IsActive 分享链接当前是否可用
+func (s *CloudShare) IsActive() bool {
+	return s.Check(time.Now()) == nil
+}
+
+// FileName 分享的文件名
+func (s *CloudShare) FileName() string {
+	return path.Base(s.ObjectKey)
+}
+
+// shareResult 访问出错时记录的访问结果
+func shareResult(err error) string {
+	switch err {
+	case nil:
+		return ShareResultSuccess
+	case ErrShareExpired:
+		return ShareResultExpired
+	case ErrShareRevoked:
+		return ShareResultRevoked
+	case ErrShareLimited:
+		return ShareResultLimited
+	case ErrSharePassword:
+		return ShareResultPassword
+	default:
+		return ``
+	}
+}
+
+// activeShareCond 可用的分享链接的查询条件
+func activeShareCond(now time.Time) db.Compound {
+	return db.And(
+		db.Cond{`revoked`: common.BoolN},
+		db.Or(db.Cond{`expires`: 0}, db.Cond{`expires`: db.Gt(now.Unix())}),
+		db.Or(db.Cond{`max_downloads`: 0}, db.Raw(`downloads < max_downloads`)),
+	)
+}
+
+// CloudShareLog 分享链接访问日志
+type CloudShareLog struct {
+	Id        uint   `db:"id,omitempty,pk" json:"id" xml:"id"`
+	ShareId   uint   `db:"share_id" json:"share_id" xml:"share_id"`
+	Ip        string `db:"ip" json:"ip" xml:"ip"`
+	UserAgent string `db:"user_agent" json:"user_agent" xml:"user_agent"`
+	Result    string `db:"result" json:"result" xml:"result"` // 访问结果
+	Created   uint   `db:"created" json:"created" xml:"created"`
+}
+
+func getCloudShare(cond db.Cond) (*CloudShare, error) {
+	row := &CloudShare{}
+	err := newParam(tableCloudShare).SetArgs(cond).SetRecv(row).One()
+	return row, err
+}
+
+// addCloudShareLog 记录一次访问，并删除超出保留数量的旧日志
+func addCloudShareLog(ctx echo.Context, shareID uint, result string) error {
+	row := &CloudShareLog{
+		ShareId:   shareID,
+		Ip:        ctx.RealIP(),
+		UserAgent: com.Substr(ctx.Request().UserAgent(), ``, 255),
+		Result:    result,
+		Created:   uint(time.Now().Unix()),
+	}
+	if _, err := newParam(tableCloudShareLog).SetSend(row).Insert(); err != nil {
+		return err
+	}
+	var old []*CloudShareLog // 第 maxShareLogs+1 新的日志
+	err := newParam(tableCloudShareLog).SetArgs(db.Cond{`share_id`: shareID}).SetMW(func(r db.Result) db.Result {
+		return r.Select(`id`).OrderBy(`-id`)
+	}).SetSize(1).SetOffset(maxShareLogs).SetRecv(&old).All()
+	if err != nil || len(old) == 0 {
+		return err
+	}
+	return newParam(tableCloudShareLog).SetArgs(db.Cond{`share_id`: shareID, `id`: db.Lte(old[0].Id)}).Delete()
+}
+
+// sharePasswordLocked 当前IP输错密码的次数是否过多
+func sharePasswordLocked(ctx echo.Context, shareID uint) (bool, error) {
+	n, err := newParam(tableCloudShareLog).SetArgs(db.Cond{
+		`share_id`: shareID,
+		`ip`:       ctx.RealIP(),
+		`result`:   ShareResultPassword,
+		`created`:  db.Gt(time.Now().Add(-sharePasswordWindow).Unix()),
+	}).Count()
+	return n >= maxSharePasswordFailures, err
+}
+
+// claimShareDownload 下载次数加1。已达到下载次数上限时返回 false
+func claimShareDownload(shareID uint) (bool, error) {
+	n, err := newParam(tableCloudShare).SetArgs(db.And(
+		db.Cond{`id`: shareID},
+		db.Or(db.Cond{`max_downloads`: 0}, db.Raw(`downloads < max_downloads`)),
+	)).SetSend(echo.H{
+		`downloads`:     db.Raw(`downloads + 1`),
+		`last_accessed`: time.Now().Unix(),
+	}).Updatex()
+	return n > 0, err
+}
+
+// storageShare 为云存储中的文件创建分享链接
+func storageShare(ctx echo.Context, m *dbschema.NgingCloudStorage, ppath string) error {
+	objectKey := strings.TrimPrefix(ppath, `/`)
+	if len(objectKey) == 0 || strings.HasSuffix(objectKey, `/`) {
+		return ctx.NewError(code.InvalidParameter, `只能分享文件`).SetZone(`path`)
+	}
+	var err error
+	if ctx.IsPost() {
+		row := &CloudShare{
+			StorageId:    m.Id,
+			ObjectKey:    objectKey,
+			Token:        com.RandomAlphanumeric(22),
+			Mode:         ctx.Formx(`mode`, ShareModeRedirect).String(),
+			MaxDownloads: ctx.Formx(`maxDownloads`).Uint(),
+			Revoked:      common.BoolN,
+			Created:      uint(time.Now().Unix()),
+		}
+		if user := backend.User(ctx); user != nil {
+			row.Uid = user.Id
+		}
+		if expire := ctx.Formx(`expire`).Int64(); expire > 0 {
+			row.Expires = uint(time.Now().Unix() + expire)
+		}
+		row.SetPassword(ctx.Form(`password`))
+		switch row.Mode {
+		case ShareModeRedirect, ShareModeProxy:
+			_, err = newParam(tableCloudShare).SetSend(row).Insert()
+		default:
+			err = ctx.NewError(code.InvalidParameter, `下载方式无效`).SetZone(`mode`)
+		}
+		if err == nil {
+			common.SendOk(ctx, ctx.T(`分享链接创建成功`))
+			return ctx.Redirect(backend.URLFor(`/cloud/share?storageId=` + param.AsString(m.Id)))
+		}
+	}
+	ctx.Set(`data`, m)
+	ctx.Set(`path`, ppath)
+	ctx.Set(`title`, ctx.T(`分享文件`))
+	return ctx.Render(`cloud/share_edit`, err)
+}
+
+// ShareIndex 云存储账号的分享链接列表。默认只列出可用的分享链接
+func ShareIndex(ctx echo.Context) error {
+	storageID := ctx.Formx(`storageId`).Uint()
+	m := model.NewCloudStorage(ctx)
+	if err := m.Get(nil, `id`, storageID); err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	all := ctx.Formx(`all`).Bool()
+	var cond db.Compound = db.Cond{`storage_id`: storageID}
+	if !all {
+		cond = db.And(cond, activeShareCond(time.Now()))
+	}
+	var rows []*CloudShare
+	err := newParam(tableCloudShare).SetArgs(cond).SetMW(func(r db.Result) db.Result {
+		return r.OrderBy(`-id`)
+	}).SetRecv(&rows).All()
+	if err == db.ErrNoMoreRows {
+		err = nil
+	}
+	ctx.Set(`data`, m.NgingCloudStorage)
+	ctx.Set(`listData`, rows)
+	ctx.Set(`all`, all)
+	ctx.Set(`activeURL`, `/cloud/storage`)
+	return ctx.Render(`cloud/share`, common.Err(ctx, err))
+}
+
+// ShareRevoke 撤销分享链接
+func ShareRevoke(ctx echo.Context) error {
+	row, err := getCloudShare(db.Cond{`id`: ctx.Formx(`id`).Uint()})
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	err = newParam(tableCloudShare).SetArgs(db.Cond{`id`: row.Id}).SetSend(echo.H{`revoked`: common.BoolY}).Update()
+	if err == nil {
+		common.SendOk(ctx, ctx.T(`操作成功`))
+	} else {
+		common.SendFail(ctx, err.Error())
+	}
+	return ctx.Redirect(backend.URLFor(`/cloud/share?storageId=` + param.AsString(row.StorageId)))
+}
+
+// ShareDelete 删除分享链接及其访问日志
+func ShareDelete(ctx echo.Context) error {
+	row, err := getCloudShare(db.Cond{`id`: ctx.Formx(`id`).Uint()})
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	err = newParam(tableCloudShare).SetArgs(db.Cond{`id`: row.Id}).Delete()
+	if err == nil {
+		err = newParam(tableCloudShareLog).SetArgs(db.Cond{`share_id`: row.Id}).Delete()
+	}
+	if err == nil {
+		common.SendOk(ctx, ctx.T(`操作成功`))
+	} else {
+		common.SendFail(ctx, err.Error())
+	}
+	return ctx.Redirect(backend.URLFor(`/cloud/share?storageId=` + param.AsString(row.StorageId) + `&all=1`))
+}
+
+// ShareLog 分享链接的访问日志
+func ShareLog(ctx echo.Context) error {
+	row, err := getCloudShare(db.Cond{`id`: ctx.Formx(`id`).Uint()})
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	var logs []*CloudShareLog
+	err = newParam(tableCloudShareLog).SetArgs(db.Cond{`share_id`: row.Id}).SetMW(func(r db.Result) db.Result {
+		return r.OrderBy(`-id`)
+	}).SetRecv(&logs).All()
+	if err == db.ErrNoMoreRows {
+		err = nil
+	}
+	ctx.Set(`data`, row)
+	ctx.Set(`listData`, logs)
+	ctx.Set(`activeURL`, `/cloud/storage`)
+	return ctx.Render(`cloud/share_log`, err)
+}
+
+// ShareAccess 访问分享链接(无需登录)
+func ShareAccess(ctx echo.Context) error {
+	row, err := getCloudShare(db.Cond{`token`: ctx.Param(`token`)})
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			return echo.ErrNotFound
+		}
+		return err
+	}
+	ctx.Set(`data`, row)
+	if err = row.Check(time.Now()); err != nil {
+		addCloudShareLog(ctx, row.Id, shareResult(err))
+		return ctx.Render(`cloud/share_access`, shareError(ctx, err))
+	}
+	// 先显示下载页面，避免聊天软件等预览链接时消耗下载次数
+	if row.HasPassword() {
+		if !ctx.IsPost() {
+			return ctx.Render(`cloud/share_access`, nil)
+		}
+		locked, err := sharePasswordLocked(ctx, row.Id)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return ctx.Render(`cloud/share_access`, ctx.NewError(code.FrequencyTooFast, `密码错误次数过多，请稍后再试`))
+		}
+		if !row.CheckPassword(ctx.Form(`password`)) {
+			addCloudShareLog(ctx, row.Id, ShareResultPassword)
+			return ctx.Render(`cloud/share_access`, shareError(ctx, ErrSharePassword))
+		}
+	} else if !ctx.Formx(`download`).Bool() {
+		return ctx.Render(`cloud/share_access`, nil)
+	}
+	m := model.NewCloudStorage(ctx)
+	if err = m.Get(nil, `id`, row.StorageId); err != nil {
+		return err
+	}
+	mgr := s3client.New(m.NgingCloudStorage, config.FromFile().Sys.EditableFileMaxBytes())
+	var signedURL *url.URL
+	if row.Mode != ShareModeProxy {
+		client, err := mgr.Client()
+		if err != nil {
+			return err
+		}
+		reqParams := url.Values{}
+		reqParams.Set(`response-content-disposition`, `attachment; filename*=UTF-8''`+url.PathEscape(row.FileName()))
+		signedURL, err = client.PresignedGetObject(ctx, mgr.BucketName(), row.ObjectKey, sharePresignExpiry, reqParams)
+		if err != nil {
+			return err
+		}
+	}
+	ok, err := claimShareDownload(row.Id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		addCloudShareLog(ctx, row.Id, ShareResultLimited)
+		return ctx.Render(`cloud/share_access`, shareError(ctx, ErrShareLimited))
+	}
+	addCloudShareLog(ctx, row.Id, ShareResultSuccess)
+	if signedURL == nil {
+		return mgr.Download(ctx, row.ObjectKey)
+	}
+	return ctx.Redirect(signedURL.String())
+}
+
+func shareError(ctx echo.Context, err error) error {
+	switch err {
+	case ErrShareExpired:
+		return ctx.NewError(code.DataHasExpired, `分享链接已过期`)
+	case ErrShareRevoked:
+		return ctx.NewError(code.DataUnavailable, `分享链接已被撤销`)
+	case ErrShareLimited:
+		return ctx.NewError(code.ExceedLimitQuantity, `分享链接的下载次数已用完`)
+	case ErrSharePassword:
+		return ctx.NewError(code.InvalidParameter, `密码错误`).SetZone(`password`)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,59 @@
+package cloud
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coscms/webcore/library/common"
+)
+
+func TestCloudSharePassword(t *testing.T) {
+	s := &CloudShare{}
+	assert.False(t, s.HasPassword())
+	assert.True(t, s.CheckPassword(``))
+	assert.True(t, s.CheckPassword(`anything`))
+
+	s.SetPassword(`secret`)
+	assert.True(t, s.HasPassword())
+	assert.NotEqual(t, `secret`, s.Password)
+	assert.NotEmpty(t, s.Salt)
+	assert.True(t, s.CheckPassword(`secret`))
+	assert.False(t, s.CheckPassword(`Secret`))
+	assert.False(t, s.CheckPassword(``))
+
+	s.SetPassword(``)
+	assert.False(t, s.HasPassword())
+	assert.Empty(t, s.Salt)
+}
+
+func TestCloudShareCheck(t *testing.T) {
+	now := time.Now()
+	s := &CloudShare{ObjectKey: `dir/report.pdf`, Revoked: common.BoolN}
+	assert.NoError(t, s.Check(now))
+	assert.Equal(t, `report.pdf`, s.FileName())
+
+	s.Expires = uint(now.Add(time.Hour).Unix())
+	assert.NoError(t, s.Check(now))
+	assert.Equal(t, ErrShareExpired, s.Check(now.Add(time.Hour)))
+
+	s.MaxDownloads = 2
+	s.Downloads = 1
+	assert.NoError(t, s.Check(now))
+	s.Downloads = 2
+	assert.Equal(t, ErrShareLimited, s.Check(now))
+
+	s.Revoked = common.BoolY
+	assert.Equal(t, ErrShareRevoked, s.Check(now))
+}
+
+func TestShareResult(t *testing.T) {
+	assert.Equal(t, ShareResultSuccess, shareResult(nil))
+	assert.Equal(t, ShareResultExpired, shareResult(ErrShareExpired))
+	assert.Equal(t, ShareResultRevoked, shareResult(ErrShareRevoked))
+	assert.Equal(t, ShareResultLimited, shareResult(ErrShareLimited))
+	assert.Equal(t, ShareResultPassword, shareResult(ErrSharePassword))
+	assert.Equal(t, ``, shareResult(errors.New(`other`)))
+}
@@ -0,0 +1,411 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/library/backend"
+	"github.com/coscms/webcore/library/background"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/coscms/webcore/model"
+)
+
+const (
+	tableCloudSync    = `nging_cloud_sync`
+	tableCloudSyncLog = `nging_cloud_sync_log`
+)
+
+// 同步方式
+const (
+	SyncModeCopy   = `copy`   // 单向复制
+	SyncModeMirror = `mirror` // 镜像(删除目标中多余的文件)
+)
+
+// syncNoticeType 同步任务的消息类型，也用作后台任务的操作标识
+const syncNoticeType = `cloudSync`
+
+// 每个同步任务最多保留的日志数
+const maxSyncLogs = 100
+
+// CloudSync 云存储同步任务
+type CloudSync struct {
+	Id            uint   `db:"id,omitempty,pk" json:"id" xml:"id"`
+	Name          string `db:"name" json:"name" xml:"name"`
+	SourceStorage uint   `db:"source_storage" json:"source_storage" xml:"source_storage"` // 源云存储账号ID
+	SourcePrefix  string `db:"source_prefix" json:"source_prefix" xml:"source_prefix"`
+	DestStorage   uint   `db:"dest_storage" json:"dest_storage" xml:"dest_storage"` // 目标云存储账号ID
+	DestPrefix    string `db:"dest_prefix" json:"dest_prefix" xml:"dest_prefix"`
+	Mode          string `db:"mode" json:"mode" xml:"mode"`       // 同步方式(copy/mirror)
+	Status        string `db:"status" json:"status" xml:"status"` // 状态(idle/running/failure)
+	Result        string `db:"result" json:"result" xml:"result"` // 最近一次执行结果
+	LastExecuted  uint   `db:"last_executed" json:"last_executed" xml:"last_executed"`
+	Created       uint   `db:"created" json:"created" xml:"created"`
+	Updated       uint   `db:"updated" json:"updated" xml:"updated"`
+}
+
+// IsMirror 是否为镜像方式
+func (s *CloudSync) IsMirror() bool {
+	return s.Mode == SyncModeMirror
+}
+
+// CloudSyncLog 云存储同步日志
+type CloudSyncLog struct {
+	Id          uint   `db:"id,omitempty,pk" json:"id" xml:"id"`
+	SyncId      uint   `db:"sync_id" json:"sync_id" xml:"sync_id"`
+	DryRun      string `db:"dry_run" json:"dry_run" xml:"dry_run"` // 是否(Y/N)为预演
+	Copied      uint   `db:"copied" json:"copied" xml:"copied"`
+	CopiedBytes uint64 `db:"copied_bytes" json:"copied_bytes" xml:"copied_bytes"`
+	Deleted     uint   `db:"deleted" json:"deleted" xml:"deleted"`
+	Skipped     uint   `db:"skipped" json:"skipped" xml:"skipped"`
+	Failed      uint   `db:"failed" json:"failed" xml:"failed"`
+	Error       string `db:"error" json:"error" xml:"error"`
+	Elapsed     uint   `db:"elapsed" json:"elapsed" xml:"elapsed"` // 耗时(毫秒)
+	Created     uint   `db:"created" json:"created" xml:"created"`
+}
+
+func getCloudSync(id uint) (*CloudSync, error) {
+	row := &CloudSync{}
+	err := newParam(tableCloudSync).SetArgs(db.Cond{`id`: id}).SetRecv(row).One()
+	return row, err
+}
+
+func updateCloudSync(id uint, fields echo.H) error {
+	return newParam(tableCloudSync).SetArgs(db.Cond{`id`: id}).SetSend(fields).Update()
+}
+
+// addCloudSyncLog 记录一次同步的结果，并删除超出保留数量的旧日志
+func addCloudSyncLog(row *CloudSyncLog) error {
+	row.Created = uint(time.Now().Unix())
+	if _, err := newParam(tableCloudSyncLog).SetSend(row).Insert(); err != nil {
+		return err
+	}
+	var old []*CloudSyncLog // 第 maxSyncLogs+1 新的日志
+	err := newParam(tableCloudSyncLog).SetArgs(db.Cond{`sync_id`: row.SyncId}).SetMW(func(r db.Result) db.Result {
+		return r.Select(`id`).OrderBy(`-id`)
+	}).SetSize(1).SetOffset(maxSyncLogs).SetRecv(&old).All()
+	if err != nil || len(old) == 0 {
+		return err
+	}
+	return newParam(tableCloudSyncLog).SetArgs(db.Cond{`sync_id`: row.SyncId, `id`: db.Lte(old[0].Id)}).Delete()
+}
+
+func syncBackgroundKey(id uint) string {
+	return `sync.` + param.AsString(id)
+}
+
+// isCloudSyncRunning 同步任务是否正在后台运行
+func isCloudSyncRunning(id uint) bool {
+	group := background.ListBy(syncNoticeType)
+	return group != nil && group.Exists(syncBackgroundKey(id))
+}
+
+// startCloudSync 在后台执行同步任务。dryRun 为 true 时只比对并列出需要复制和删除的文件
+func startCloudSync(ctx echo.Context, row *CloudSync, dryRun bool) error {
+	src, err := newS3SyncBucket(ctx, row.SourceStorage)
+	if err != nil {
+		return err
+	}
+	dst, err := newS3SyncBucket(ctx, row.DestStorage)
+	if err != nil {
+		return err
+	}
+	bgKey := syncBackgroundKey(row.Id)
+	bg := background.New(context.Background(), nil)
+	group, err := background.Register(ctx, syncNoticeType, bgKey, bg)
+	if err != nil {
+		return err
+	}
+	user := backend.User(ctx)
+	notice.OpenMessage(user.Username, syncNoticeType)
+	np := notice.NewP(ctx, syncNoticeType, user.Username, bg.Context()).AutoComplete(true)
+	syncer := &cloudSyncer{
+		src:       src,
+		srcPrefix: row.SourcePrefix,
+		dst:       dst,
+		dstPrefix: row.DestPrefix,
+		workers:   defaultWorkers(),
+		dryRun:    dryRun,
+		noticer:   np,
+	}
+	if !dryRun {
+		updateCloudSync(row.Id, echo.H{`status`: `running`, `last_executed`: time.Now().Unix()})
+	}
+	go func() {
+		defer group.Cancel(bgKey)
+		eCtx := defaults.NewMockContext()
+		summary, err := runCloudSync(bg.Context(), eCtx, syncer, row)
+		logRow := &CloudSyncLog{SyncId: row.Id, DryRun: common.BoolN}
+		if dryRun {
+			logRow.DryRun = common.BoolY
+		}
+		var result string
+		if summary != nil {
+			logRow.Copied = uint(summary.Copied)
+			logRow.CopiedBytes = uint64(summary.CopiedBytes)
+			logRow.Deleted = uint(summary.Deleted)
+			logRow.Skipped = uint(summary.Skipped)
+			logRow.Failed = uint(summary.Failed)
+			logRow.Elapsed = uint(summary.Elapsed.Milliseconds())
+			result = summary.String(eCtx, dryRun)
+		}
+		if err != nil {
+			if bg.Context().Err() != nil {
+				err = echo.ErrExit
+				logRow.Error = eCtx.T(`已取消`)
+			} else {
+				logRow.Error = err.Error()
+			}
+			result = strings.TrimSpace(logRow.Error + ` ` + result)
+		}
+		if lerr := addCloudSyncLog(logRow); lerr != nil {
+			log.Errorf(`[cloudsync] failed to add sync log: %v`, lerr)
+		}
+		log.Infof(`[cloudsync] %s: %s`, row.Name, result)
+		state := notice.StateSuccess
+		if err != nil || (summary != nil && summary.Failed > 0) {
+			state = notice.StateFailure
+		}
+		np.Send(result, state)
+		np.Complete()
+		if dryRun {
+			return
+		}
+		status := `idle`
+		if state == notice.StateFailure {
+			status = `failure`
+		}
+		if uerr := updateCloudSync(row.Id, echo.H{`status`: status, `result`: result}); uerr != nil {
+			log.Errorf(`[cloudsync] failed to update sync status: %v`, uerr)
+		}
+	}()
+	return nil
+}
+
+// runCloudSync 生成同步计划并执行
+func runCloudSync(ctx context.Context, eCtx echo.Context, syncer *cloudSyncer, row *CloudSync) (*SyncSummary, error) {
+	syncer.send(eCtx.T(`正在比对文件...`), notice.StateSuccess)
+	plan, err := planSync(ctx, syncer.src, syncer.srcPrefix, syncer.dst, syncer.dstPrefix, row.IsMirror())
+	if err != nil {
+		return nil, err
+	}
+	return syncer.run(ctx, eCtx, plan)
+}
+
+// bindCloudSync 从表单获取同步任务
+func bindCloudSync(ctx echo.Context, row *CloudSync) error {
+	row.Name = strings.TrimSpace(ctx.Form(`name`))
+	row.SourceStorage = ctx.Formx(`sourceStorage`).Uint()
+	row.SourcePrefix = syncPrefix(ctx.Form(`sourcePrefix`))
+	row.DestStorage = ctx.Formx(`destStorage`).Uint()
+	row.DestPrefix = syncPrefix(ctx.Form(`destPrefix`))
+	row.Mode = ctx.Formx(`mode`, SyncModeCopy).String()
+	if len(row.Name) == 0 {
+		return ctx.NewError(code.InvalidParameter, `请输入名称`).SetZone(`name`)
+	}
+	if row.SourceStorage == 0 {
+		return ctx.NewError(code.InvalidParameter, `请选择源云存储账号`).SetZone(`sourceStorage`)
+	}
+	if row.DestStorage == 0 {
+		return ctx.NewError(code.InvalidParameter, `请选择目标云存储账号`).SetZone(`destStorage`)
+	}
+	switch row.Mode {
+	case SyncModeCopy, SyncModeMirror:
+	default:
+		return ctx.NewError(code.InvalidParameter, `同步方式无效`).SetZone(`mode`)
+	}
+	if row.SourceStorage == row.DestStorage && (strings.HasPrefix(row.SourcePrefix, row.DestPrefix) || strings.HasPrefix(row.DestPrefix, row.SourcePrefix)) {
+		return ctx.NewError(code.InvalidParameter, `同一个账号中源路径和目标路径不能重叠`).SetZone(`destPrefix`)
+	}
+	return nil
+}
+
+func setCloudSyncForm(ctx echo.Context, row *CloudSync) {
+	form := ctx.Request().Form()
+	form.Set(`name`, row.Name)
+	form.Set(`sourceStorage`, param.AsString(row.SourceStorage))
+	form.Set(`sourcePrefix`, row.SourcePrefix)
+	form.Set(`destStorage`, param.AsString(row.DestStorage))
+	form.Set(`destPrefix`, row.DestPrefix)
+	form.Set(`mode`, row.Mode)
+}
+
+// setStorageAccounts 设置可选的云存储账号
+func setStorageAccounts(ctx echo.Context) error {
+	storages := model.NewCloudStorage(ctx)
+	_, err := storages.ListByOffset(nil, nil, 0, -1)
+	ctx.Set(`storageAccounts`, storages.Objects())
+	return err
+}
+
+func SyncIndex(ctx echo.Context) error {
+	var rows []*CloudSync
+	err := newParam(tableCloudSync).SetMW(func(r db.Result) db.Result {
+		return r.OrderBy(`-id`)
+	}).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return err
+	}
+	running := map[uint]bool{}
+	for _, row := range rows {
+		running[row.Id] = isCloudSyncRunning(row.Id)
+	}
+	storages := model.NewCloudStorage(ctx)
+	_, err = storages.ListByOffset(nil, nil, 0, -1)
+	names := map[uint]string{}
+	for _, s := range storages.Objects() {
+		names[s.Id] = s.Name
+	}
+	ctx.Set(`listData`, rows)
+	ctx.Set(`running`, running)
+	ctx.Set(`storageNames`, names)
+	ctx.Set(`activeURL`, `/cloud/sync`)
+	return ctx.Render(`cloud/sync`, common.Err(ctx, err))
+}
+
+func SyncAdd(ctx echo.Context) error {
+	var err error
+	row := &CloudSync{Mode: SyncModeCopy}
+	if ctx.IsPost() {
+		err = bindCloudSync(ctx, row)
+		if err == nil {
+			row.Status = `idle`
+			row.Created = uint(time.Now().Unix())
+			_, err = newParam(tableCloudSync).SetSend(row).Insert()
+		}
+		if err == nil {
+			common.SendOk(ctx, ctx.T(`操作成功`))
+			return ctx.Redirect(backend.URLFor(`/cloud/sync`))
+		}
+	} else {
+		setCloudSyncForm(ctx, row)
+	}
+	if serr := setStorageAccounts(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	ctx.Set(`title`, ctx.T(`添加同步任务`))
+	ctx.Set(`activeURL`, `/cloud/sync`)
+	return ctx.Render(`cloud/sync_edit`, err)
+}
+
+func SyncEdit(ctx echo.Context) error {
+	id := ctx.Formx(`id`).Uint()
+	row, err := getCloudSync(id)
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	if ctx.IsPost() {
+		err = bindCloudSync(ctx, row)
+		if err == nil {
+			row.Updated = uint(time.Now().Unix())
+			err = newParam(tableCloudSync).SetArgs(db.Cond{`id`: id}).SetSend(row).Update()
+		}
+		if err == nil {
+			common.SendOk(ctx, ctx.T(`操作成功`))
+			return ctx.Redirect(backend.URLFor(`/cloud/sync`))
+		}
+	} else {
+		setCloudSyncForm(ctx, row)
+	}
+	if serr := setStorageAccounts(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	ctx.Set(`title`, ctx.T(`修改同步任务`))
+	ctx.Set(`activeURL`, `/cloud/sync`)
+	return ctx.Render(`cloud/sync_edit`, err)
+}
+
+func SyncDelete(ctx echo.Context) error {
+	id := ctx.Formx(`id`).Uint()
+	background.Cancel(syncNoticeType, syncBackgroundKey(id))
+	err := newParam(tableCloudSync).SetArgs(db.Cond{`id`: id}).Delete()
+	if err == nil {
+		err = newParam(tableCloudSyncLog).SetArgs(db.Cond{`sync_id`: id}).Delete()
+	}
+	if err == nil {
+		common.SendOk(ctx, ctx.T(`操作成功`))
+	} else {
+		common.SendFail(ctx, err.Error())
+	}
+	return ctx.Redirect(backend.URLFor(`/cloud/sync`))
+}
+
+func SyncStart(ctx echo.Context) error {
+	row, err := getCloudSync(ctx.Formx(`id`).Uint())
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	dryRun := ctx.Form(`op`) == `dryrun`
+	if err = startCloudSync(ctx, row, dryRun); err != nil {
+		return err
+	}
+	if dryRun {
+		common.SendOk(ctx, ctx.T(`已开始预演，需要复制和删除的文件会通过消息通知，结果请查看同步日志`))
+	} else {
+		common.SendOk(ctx, ctx.T(`已开始同步，完成后会通知您`))
+	}
+	return ctx.Redirect(backend.URLFor(`/cloud/sync`))
+}
+
+func SyncStop(ctx echo.Context) error {
+	id := ctx.Formx(`id`).Uint()
+	if !isCloudSyncRunning(id) {
+		return ctx.NewError(code.Failure, `同步任务没有在运行`)
+	}
+	background.Cancel(syncNoticeType, syncBackgroundKey(id))
+	common.SendOk(ctx, ctx.T(`操作成功`))
+	return ctx.Redirect(backend.URLFor(`/cloud/sync`))
+}
+
+func SyncLog(ctx echo.Context) error {
+	row, err := getCloudSync(ctx.Formx(`id`).Uint())
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			err = ctx.NewError(code.DataNotFound, `数据不存在`)
+		}
+		return err
+	}
+	var logs []*CloudSyncLog
+	err = newParam(tableCloudSyncLog).SetArgs(db.Cond{`sync_id`: row.Id}).SetMW(func(r db.Result) db.Result {
+		return r.OrderBy(`-id`)
+	}).SetRecv(&logs).All()
+	if err == db.ErrNoMoreRows {
+		err = nil
+	}
+	ctx.Set(`data`, row)
+	ctx.Set(`listData`, logs)
+	ctx.Set(`activeURL`, `/cloud/sync`)
+	return ctx.Render(`cloud/sync_log`, err)
+}
@@ -0,0 +1,312 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/notice"
+	"github.com/coscms/webcore/library/s3manager/s3client"
+	"github.com/minio/minio-go/v7"
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo"
+)
+
+// syncObject 存储桶中的对象
+type syncObject struct {
+	Key     string // 对象名称(不含开头的“/”)
+	Size    int64
+	ETag    string
+	ModTime time.Time
+}
+
+// syncBucket 同步时读写的存储桶
+type syncBucket interface {
+	List(ctx context.Context, prefix string, fn func(syncObject) error) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Remove(ctx context.Context, key string) error
+}
+
+// newS3SyncBucket 连接云存储账号的存储桶
+func newS3SyncBucket(ctx echo.Context, storageID uint) (*s3SyncBucket, error) {
+	m := dbschema.NewNgingCloudStorage(ctx)
+	if err := m.Get(nil, `id`, storageID); err != nil {
+		return nil, err
+	}
+	m.Secret = common.Crypto().Decode(m.Secret)
+	client, err := s3client.Connect(m)
+	if err != nil {
+		return nil, err
+	}
+	return &s3SyncBucket{client: client, bucket: m.Bucket}, nil
+}
+
+type s3SyncBucket struct {
+	client *minio.Client
+	bucket string
+}
+
+func (b *s3SyncBucket) List(ctx context.Context, prefix string, fn func(syncObject) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if strings.HasSuffix(obj.Key, `/`) { // 目录占位对象
+			continue
+		}
+		if err := fn(syncObject{Key: obj.Key, Size: obj.Size, ETag: obj.ETag, ModTime: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *s3SyncBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return b.client.GetObject(ctx, b.bucket, key, minio.GetObjectOptions{})
+}
+
+func (b *s3SyncBucket) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{ContentType: mime.TypeByExtension(path.Ext(key))}
+	if len(opts.ContentType) == 0 {
+		opts.ContentType = `application/octet-stream`
+	}
+	_, err := b.client.PutObject(ctx, b.bucket, key, r, size, opts)
+	return err
+}
+
+func (b *s3SyncBucket) Remove(ctx context.Context, key string) error {
+	return b.client.RemoveObject(ctx, b.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// syncPrefix 规范化路径前缀：不以“/”开头，非空时以“/”结尾
+func syncPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), `/`)
+	if len(prefix) == 0 {
+		return ``
+	}
+	return path.Clean(prefix) + `/`
+}
+
+// plainETag 返回可用于比较内容的 ETag(即内容的 MD5)。分块上传的 ETag 不是内容的 MD5，返回空字符串
+func plainETag(etag string) string {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if len(etag) != 32 {
+		return ``
+	}
+	return etag
+}
+
+// syncNeeded 目标对象是否需要用源对象覆盖。
+// 大小不同时需要；双方的 ETag 都是内容的 MD5 时按 ETag 比较；否则目标对象比源对象旧时需要
+func syncNeeded(src, dst syncObject) bool {
+	if src.Size != dst.Size {
+		return true
+	}
+	srcETag, dstETag := plainETag(src.ETag), plainETag(dst.ETag)
+	if len(srcETag) > 0 && len(dstETag) > 0 {
+		return srcETag != dstETag
+	}
+	return dst.ModTime.Before(src.ModTime)
+}
+
+// syncPlan 同步计划
+type syncPlan struct {
+	Copy      []syncObject // 需要复制的源对象
+	Delete    []syncObject // 需要从目标中删除的对象(仅镜像方式)
+	Skipped   int          // 内容相同而跳过的对象数
+	CopyBytes int64
+}
+
+// planSync 比对源和目标中的对象，生成同步计划
+func planSync(ctx context.Context, src syncBucket, srcPrefix string, dst syncBucket, dstPrefix string, mirror bool) (*syncPlan, error) {
+	srcPrefix, dstPrefix = syncPrefix(srcPrefix), syncPrefix(dstPrefix)
+	existing := map[string]syncObject{}
+	err := dst.List(ctx, dstPrefix, func(obj syncObject) error {
+		existing[strings.TrimPrefix(obj.Key, dstPrefix)] = obj
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	plan := &syncPlan{}
+	err = src.List(ctx, srcPrefix, func(obj syncObject) error {
+		rel := strings.TrimPrefix(obj.Key, srcPrefix)
+		old, ok := existing[rel]
+		delete(existing, rel)
+		if ok && !syncNeeded(obj, old) {
+			plan.Skipped++
+			return nil
+		}
+		plan.Copy = append(plan.Copy, obj)
+		plan.CopyBytes += obj.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mirror {
+		for _, obj := range existing {
+			plan.Delete = append(plan.Delete, obj)
+		}
+		sort.Slice(plan.Delete, func(i, j int) bool {
+			return plan.Delete[i].Key < plan.Delete[j].Key
+		})
+	}
+	return plan, nil
+}
+
+// SyncSummary 同步结果统计
+type SyncSummary struct {
+	Copied      int
+	CopiedBytes int64
+	Deleted     int
+	Skipped     int
+	Failed      int
+	Elapsed     time.Duration
+}
+
+func (s *SyncSummary) String(ctx echo.Context, dryRun bool) string {
+	if dryRun {
+		return ctx.T(`预演：需要复制%d个文件(%s)，删除%d个文件，跳过%d个相同的文件`, s.Copied, com.FormatBytes(s.CopiedBytes), s.Deleted, s.Skipped)
+	}
+	return ctx.T(`已复制%d个文件(%s)，删除%d个文件，跳过%d个相同的文件，失败%d个，耗时%s`, s.Copied, com.FormatBytes(s.CopiedBytes), s.Deleted, s.Skipped, s.Failed, s.Elapsed.Round(time.Second))
+}
+
+// cloudSyncer 执行同步计划
+type cloudSyncer struct {
+	src       syncBucket
+	srcPrefix string
+	dst       syncBucket
+	dstPrefix string
+	workers   int
+	dryRun    bool
+	noticer   notice.NProgressor
+}
+
+func (s *cloudSyncer) send(msg string, state int) {
+	if s.noticer != nil {
+		s.noticer.Send(msg, state)
+	}
+}
+
+// run 按计划复制和删除对象。单个对象失败时记录并继续，ctx 取消时中止
+func (s *cloudSyncer) run(ctx context.Context, eCtx echo.Context, plan *syncPlan) (*SyncSummary, error) {
+	start := time.Now()
+	summary := &SyncSummary{Skipped: plan.Skipped}
+	srcPrefix, dstPrefix := syncPrefix(s.srcPrefix), syncPrefix(s.dstPrefix)
+	if s.dryRun {
+		for _, obj := range plan.Copy {
+			s.send(eCtx.T(`需要复制：%s`, obj.Key), notice.StateSuccess)
+		}
+		for _, obj := range plan.Delete {
+			s.send(eCtx.T(`需要删除：%s`, obj.Key), notice.StateSuccess)
+		}
+		summary.Copied = len(plan.Copy)
+		summary.CopiedBytes = plan.CopyBytes
+		summary.Deleted = len(plan.Delete)
+		summary.Elapsed = time.Since(start)
+		return summary, nil
+	}
+	if s.noticer != nil {
+		s.noticer.Add(plan.CopyBytes + int64(len(plan.Delete)))
+	}
+	workers := s.workers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		jobs = make(chan syncObject)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range jobs {
+				dstKey := dstPrefix + strings.TrimPrefix(obj.Key, srcPrefix)
+				err := s.copy(ctx, obj, dstKey)
+				mu.Lock()
+				if err != nil {
+					summary.Failed++
+				} else {
+					summary.Copied++
+					summary.CopiedBytes += obj.Size
+				}
+				mu.Unlock()
+				if s.noticer != nil {
+					s.noticer.Done(obj.Size)
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						s.send(eCtx.T(`复制失败：%s => %s: %v`, obj.Key, dstKey, err), notice.StateFailure)
+					}
+					continue
+				}
+				s.send(obj.Key+` => `+dstKey, notice.StateSuccess)
+			}
+		}()
+	}
+	for _, obj := range plan.Copy {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- obj
+	}
+	close(jobs)
+	wg.Wait()
+	for _, obj := range plan.Delete {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := s.dst.Remove(ctx, obj.Key); err != nil {
+			summary.Failed++
+			s.send(eCtx.T(`删除失败：%s: %v`, obj.Key, err), notice.StateFailure)
+		} else {
+			summary.Deleted++
+			s.send(eCtx.T(`已删除：%s`, obj.Key), notice.StateSuccess)
+		}
+		if s.noticer != nil {
+			s.noticer.Done(1)
+		}
+	}
+	summary.Elapsed = time.Since(start)
+	return summary, ctx.Err()
+}
+
+func (s *cloudSyncer) copy(ctx context.Context, obj syncObject, dstKey string) error {
+	r, err := s.src.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.dst.Put(ctx, dstKey, r, obj.Size)
+}
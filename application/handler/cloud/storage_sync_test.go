@@ -0,0 +1,155 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/echo/defaults"
+)
+
+type memSyncBucket struct {
+	mu      sync.Mutex
+	objects map[string]syncObject
+	data    map[string][]byte
+	now     time.Time
+}
+
+func newMemSyncBucket(now time.Time) *memSyncBucket {
+	return &memSyncBucket{objects: map[string]syncObject{}, data: map[string][]byte{}, now: now}
+}
+
+func (b *memSyncBucket) set(key string, content string, etag string, modTime time.Time) {
+	b.objects[key] = syncObject{Key: key, Size: int64(len(content)), ETag: etag, ModTime: modTime}
+	b.data[key] = []byte(content)
+}
+
+func (b *memSyncBucket) keys() []string {
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *memSyncBucket) List(ctx context.Context, prefix string, fn func(syncObject) error) error {
+	for _, key := range b.keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(b.objects[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memSyncBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(b.data[key])), nil
+}
+
+func (b *memSyncBucket) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = syncObject{Key: key, Size: int64(len(data)), ETag: `"` + hex.EncodeToString(sum[:]) + `"`, ModTime: b.now}
+	b.data[key] = data
+	return nil
+}
+
+func (b *memSyncBucket) Remove(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	delete(b.data, key)
+	return nil
+}
+
+func contentETag(content string) string {
+	sum := md5.Sum([]byte(content))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestSyncNeeded(t *testing.T) {
+	now := time.Now()
+	src := syncObject{Size: 3, ETag: contentETag(`abc`), ModTime: now}
+	assert.False(t, syncNeeded(src, syncObject{Size: 3, ETag: strings.ToUpper(contentETag(`abc`)), ModTime: now.Add(-time.Hour)}))
+	assert.True(t, syncNeeded(src, syncObject{Size: 3, ETag: contentETag(`abd`), ModTime: now.Add(time.Hour)}))
+	assert.True(t, syncNeeded(src, syncObject{Size: 4, ETag: contentETag(`abc`)}))
+	// 分块上传的 ETag 不是内容的 MD5，按修改时间比较
+	assert.False(t, syncNeeded(src, syncObject{Size: 3, ETag: `"0123456789abcdef0123456789abcdef-2"`, ModTime: now.Add(time.Minute)}))
+	assert.True(t, syncNeeded(src, syncObject{Size: 3, ETag: `"0123456789abcdef0123456789abcdef-2"`, ModTime: now.Add(-time.Minute)}))
+
+	assert.Equal(t, ``, syncPrefix(` / `))
+	assert.Equal(t, `media/2024/`, syncPrefix(`/media//2024`))
+}
+
+func TestCloudSync(t *testing.T) {
+	ctx := context.Background()
+	eCtx := defaults.NewMockContext()
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	src := newMemSyncBucket(now)
+	src.set(`media/a.jpg`, `aaa`, contentETag(`aaa`), old)
+	src.set(`media/sub/b.jpg`, `bbb`, contentETag(`bbb`), old)
+	src.set(`media/c.jpg`, `ccc2`, contentETag(`ccc2`), old)
+	src.set(`other/x.jpg`, `x`, contentETag(`x`), old)
+	dst := newMemSyncBucket(now)
+	dst.set(`mirror/a.jpg`, `aaa`, contentETag(`aaa`), old) // 相同
+	dst.set(`mirror/c.jpg`, `ccc`, contentETag(`ccc`), old) // 有改动
+	dst.set(`mirror/stale.jpg`, `s`, contentETag(`s`), old) // 源中没有
+
+	plan, err := planSync(ctx, src, `/media`, dst, `mirror`, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, plan.Skipped)
+	require.Len(t, plan.Copy, 2)
+	assert.Equal(t, int64(7), plan.CopyBytes)
+	require.Len(t, plan.Delete, 1)
+	assert.Equal(t, `mirror/stale.jpg`, plan.Delete[0].Key)
+
+	// 预演不做任何改动
+	dry := &cloudSyncer{src: src, srcPrefix: `/media`, dst: dst, dstPrefix: `mirror`, dryRun: true}
+	summary, err := dry.run(ctx, eCtx, plan)
+	require.NoError(t, err)
+	assert.Equal(t, 2, summary.Copied)
+	assert.Equal(t, 1, summary.Deleted)
+	assert.Equal(t, []string{`mirror/a.jpg`, `mirror/c.jpg`, `mirror/stale.jpg`}, dst.keys())
+
+	syncer := &cloudSyncer{src: src, srcPrefix: `/media`, dst: dst, dstPrefix: `mirror`, workers: 2}
+	summary, err = syncer.run(ctx, eCtx, plan)
+	require.NoError(t, err)
+	assert.Equal(t, 2, summary.Copied)
+	assert.Equal(t, int64(7), summary.CopiedBytes)
+	assert.Equal(t, 1, summary.Deleted)
+	assert.Zero(t, summary.Failed)
+	assert.Equal(t, []string{`mirror/a.jpg`, `mirror/c.jpg`, `mirror/sub/b.jpg`}, dst.keys())
+	assert.Equal(t, []byte(`ccc2`), dst.data[`mirror/c.jpg`])
+
+	plan, err = planSync(ctx, src, `media`, dst, `mirror`, true)
+	require.NoError(t, err)
+	assert.Empty(t, plan.Copy)
+	assert.Empty(t, plan.Delete)
+	assert.Equal(t, 3, plan.Skipped)
+
+	// 单向复制不删除目标中多余的文件
+	dst.set(`mirror/extra.jpg`, `e`, contentETag(`e`), old)
+	plan, err = planSync(ctx, src, `media`, dst, `mirror`, false)
+	require.NoError(t, err)
+	assert.Empty(t, plan.Delete)
+}
@@ -0,0 +1,67 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"context"
+	"io"
+
+	"github.com/admpub/log"
+
+	"github.com/coscms/webcore/library/config/cmder"
+)
+
+func newCmder() cmder.Cmder {
+	return &taskCmd{}
+}
+
+type taskCmd struct {
+}
+
+func (c *taskCmd) Boot() error {
+	return nil
+}
+
+func (c *taskCmd) StopHistory(_ ...string) error {
+	return nil
+}
+
+func (c *taskCmd) Start(writer ...io.Writer) error {
+	if startCluster() { // 由选举出的主节点加载定时任务
+		return nil
+	}
+	if err := initJobs(context.Background()); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+func (c *taskCmd) Stop() error {
+	stopCluster()
+	closeJobs()
+	return nil
+}
+
+func (c *taskCmd) Reload() error {
+	return nil
+}
+
+func (c *taskCmd) Restart(writer ...io.Writer) error {
+	c.Stop()
+	return c.Start(writer...)
+}
@@ -0,0 +1,116 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/backend"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/model"
+)
+
+// taskNames 获取任务名称 {id:name}
+func taskNames(ctx echo.Context, ids []uint) map[uint]string {
+	names := map[uint]string{}
+	if len(ids) == 0 {
+		return names
+	}
+	m := dbschema.NewNgingTask(ctx)
+	_, err := m.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.Select(`id`, `name`)
+	}, 0, -1, db.Cond{`id`: db.In(ids)})
+	if err != nil {
+		return names
+	}
+	for _, row := range m.Objects() {
+		names[row.Id] = row.Name
+	}
+	return names
+}
+
+// Flow 任务链运行记录
+func Flow(ctx echo.Context) error {
+	taskID := ctx.Formx(`taskId`).Uint()
+	totalRows := ctx.Formx(`rows`).Int()
+	page, size, totalRows, p := common.PagingWithPagination(ctx)
+	cond := db.Cond{}
+	var task *model.Task
+	var err error
+	if taskID > 0 {
+		task = model.NewTask(ctx)
+		err = task.Get(nil, `id`, taskID)
+		cond[`root_task_id`] = taskID
+	}
+	var rows []*FlowRun
+	cnt, err2 := newParam(tableTaskFlowRun).SetArgs(cond).SetRecv(&rows).SetMiddleware(func(r db.Result) db.Result {
+		return r.OrderBy(`-id`)
+	}).SetPage(page).SetSize(size).List()
+	if err2 != nil && err2 != db.ErrNoMoreRows {
+		err = err2
+	}
+	if totalRows <= 0 {
+		totalRows = int(cnt())
+		p.SetRows(totalRows)
+	}
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.RootTaskId)
+	}
+	names := taskNames(ctx, ids)
+	ctx.SetFunc(`taskName`, func(id uint) string {
+		return names[id]
+	})
+	ctx.Set(`listData`, rows)
+	ctx.Set(`pagination`, p)
+	ctx.Set(`task`, task)
+	ctx.Set(`activeURL`, `/task/index`)
+	return ctx.Render(`task/flow`, common.Err(ctx, err))
+}
+
+// FlowRunView 任务链运行详情
+func FlowRunView(ctx echo.Context) error {
+	id := ctx.Paramx(`id`).Uint64()
+	run := &FlowRun{}
+	err := newParam(tableTaskFlowRun).SetArgs(db.Cond{`id`: id}).SetRecv(run).One()
+	if err != nil {
+		common.SendFail(ctx, err.Error())
+		return ctx.Redirect(backend.URLFor(`/task/flow`))
+	}
+	var nodes []*FlowNode
+	err = newParam(tableTaskFlowNode).SetArgs(db.Cond{`run_id`: id}).SetRecv(&nodes).SetMiddleware(func(r db.Result) db.Result {
+		return r.OrderBy(`id`)
+	}).All()
+	if err == db.ErrNoMoreRows {
+		err = nil
+	}
+	ids := []uint{run.RootTaskId}
+	for _, node := range nodes {
+		ids = append(ids, node.TaskId)
+	}
+	names := taskNames(ctx, ids)
+	ctx.SetFunc(`taskName`, func(id uint) string {
+		return names[id]
+	})
+	ctx.Set(`data`, run)
+	ctx.Set(`nodes`, nodes)
+	ctx.Set(`activeURL`, `/task/index`)
+	return ctx.Render(`task/flow_run`, common.Err(ctx, err))
+}
@@ -42,15 +42,33 @@ func GroupAdd(ctx echo.Context) error {
 		if err == nil {
 			if len(m.Name) == 0 {
 				err = ctx.E(`分组名称不能为空`)
-			} else {
-				_, err = m.Insert()
 			}
 		}
+		var notify *TaskNotify
+		if err == nil {
+			notify, err = bindTaskNotify(ctx, 0, 0)
+		}
+		var retention *LogRetention
+		if err == nil {
+			retention, err = bindLogRetention(ctx, 0, 0)
+		}
+		if err == nil {
+			_, err = m.Insert()
+		}
+		if err == nil {
+			retention.GroupId = m.Id
+			err = saveLogRetention(nil, retention)
+		}
+		if err == nil {
+			notify.GroupId = m.Id
+			err = saveTaskNotify(nil, notify)
+		}
 		if err == nil {
 			common.SendOk(ctx, ctx.T(`操作成功`))
 			return ctx.Redirect(backend.URLFor(`/task/group`))
 		}
 	}
+	setTaskNotifyFormData(ctx)
 	ctx.Set(`activeURL`, `/task/group`)
 	return ctx.Render(`task/group_edit`, common.Err(ctx, err))
 }
@@ -69,16 +87,46 @@ func GroupEdit(ctx echo.Context) error {
 			m.Id = id
 			if len(m.Name) == 0 {
 				err = ctx.E(`分组名称不能为空`)
-			} else {
-				err = m.Update(nil, `id`, id)
 			}
 		}
+		var notify *TaskNotify
+		if err == nil {
+			notify, err = bindTaskNotify(ctx, id, 0)
+		}
+		var retention *LogRetention
+		if err == nil {
+			retention, err = bindLogRetention(ctx, id, 0)
+		}
+		if err == nil {
+			err = m.Update(nil, `id`, id)
+		}
+		if err == nil {
+			err = saveLogRetention(nil, retention)
+		}
+		if err == nil {
+			err = saveTaskNotify(nil, notify)
+		}
 		if err == nil {
 			common.SendOk(ctx, ctx.T(`修改成功`))
 			return ctx.Redirect(backend.URLFor(`/task/group`))
 		}
 	}
 	echo.StructToForm(ctx, m.NgingTaskGroup, ``, echo.LowerCaseFirstLetter)
+	if !ctx.IsPost() {
+		retention, e := getLogRetention(id, 0)
+		if e != nil {
+			err = e
+		} else {
+			setLogRetentionForm(ctx, retention)
+		}
+		notify, e := getTaskNotify(id, 0)
+		if e != nil {
+			err = e
+		} else {
+			setTaskNotifyForm(ctx, notify)
+		}
+	}
+	setTaskNotifyFormData(ctx)
 	ctx.Set(`activeURL`, `/task/group`)
 	return ctx.Render(`task/group_edit`, common.Err(ctx, err))
 }
@@ -87,6 +135,12 @@ func GroupDelete(ctx echo.Context) error {
 	id := ctx.Formx(`id`).Uint()
 	m := model.NewTaskGroup(ctx)
 	err := m.Delete(nil, db.Cond{`id`: id})
+	if err == nil {
+		err = deleteLogRetention(id, 0)
+	}
+	if err == nil {
+		err = deleteTaskNotify(id, 0)
+	}
 	if err == nil {
 		common.SendOk(ctx, ctx.T(`操作成功`))
 	} else {
@@ -0,0 +1,553 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cronlib "github.com/admpub/cron"
+	"github.com/admpub/log"
+	"github.com/webx-top/com"
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/config"
+	"github.com/coscms/webcore/library/config/extend"
+	"github.com/coscms/webcore/library/cron"
+)
+
+const (
+	tableTaskLease   = `nging_task_lease`
+	tableTaskLogNode = `nging_task_log_node`
+
+	// schedulerLeaseName 调度器租约名称。持有租约的节点为主节点，只有主节点执行定时任务
+	schedulerLeaseName = `nging.task.scheduler`
+)
+
+// 租约默认时长
+const (
+	defaultLeaseTTL  = 30 * time.Second
+	defaultHeartbeat = 10 * time.Second
+)
+
+// ClusterConfig 集群调度配置(配置文件中的 extend.taskCluster)。
+// 多个节点共用一个数据库时开启，通过数据库中的租约选出一个主节点来执行定时任务
+type ClusterConfig struct {
+	On        bool   `json:"on"`        // 是否开启
+	Node      string `json:"node"`      // 节点名称，每个节点不能相同。默认为主机名
+	LeaseTTL  uint   `json:"leaseTTL"`  // 租约时长(秒)。主节点失联超过此时长后由其它节点接替
+	Heartbeat uint   `json:"heartbeat"` // 续约间隔(秒)。应小于租约时长的一半
+}
+
+func (c *ClusterConfig) NodeName() string {
+	if len(c.Node) > 0 {
+		return c.Node
+	}
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = `node-` + com.RandomAlphanumeric(6)
+	}
+	c.Node = hostname
+	return c.Node
+}
+
+func (c *ClusterConfig) ttl() time.Duration {
+	if c.LeaseTTL > 0 {
+		return time.Duration(c.LeaseTTL) * time.Second
+	}
+	return defaultLeaseTTL
+}
+
+func (c *ClusterConfig) heartbeat() time.Duration {
+	if c.Heartbeat > 0 {
+		return time.Duration(c.Heartbeat) * time.Second
+	}
+	return defaultHeartbeat
+}
+
+func init() {
+	extend.Register(`taskCluster`, func() interface{} {
+		return &ClusterConfig{}
+	})
+}
+
+func getClusterConfig() *ClusterConfig {
+	cfg := config.FromFile()
+	if cfg == nil {
+		return nil
+	}
+	c, _ := cfg.Extend.Get(`taskCluster`).(*ClusterConfig)
+	if c == nil || !c.On {
+		return nil
+	}
+	return c
+}
+
+// TaskLease 租约
+type TaskLease struct {
+	Name    string `db:"name,pk" json:"name" xml:"name"`
+	Node    string `db:"node" json:"node" xml:"node"`
+	Expires uint64 `db:"expires" json:"expires" xml:"expires"` // 到期时间(毫秒时间戳)
+	Version uint64 `db:"version" json:"version" xml:"version"` // 定时任务配置的版本，在非主节点修改任务时递增，主节点据此重新加载
+	Updated uint   `db:"updated" json:"updated" xml:"updated"`
+}
+
+// leaseElector 基于数据库租约的主节点选举
+type leaseElector struct {
+	factory *factory.Factory
+	name    string
+	node    string
+	ttl     time.Duration
+
+	mu     sync.RWMutex
+	leader bool
+	until  time.Time // 本节点认为的租约到期时间
+}
+
+func newLeaseElector(f *factory.Factory, name string, node string, ttl time.Duration) *leaseElector {
+	return &leaseElector{factory: f, name: name, node: node, ttl: ttl}
+}
+
+func (e *leaseElector) param() *factory.Param {
+	return factory.NewParam(e.factory).SetCollection(dbschema.WithPrefix(tableTaskLease))
+}
+
+// Node 当前节点名称
+func (e *leaseElector) Node() string {
+	return e.node
+}
+
+// IsLeader 当前节点是否持有未到期的租约
+func (e *leaseElector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader && time.Now().Before(e.until)
+}
+
+func (e *leaseElector) setLeader(leader bool, until time.Time) {
+	e.mu.Lock()
+	e.leader = leader
+	e.until = until
+	e.mu.Unlock()
+}
+
+// acquire 获取或续约租约。返回是否成为主节点以及当前的任务配置版本
+func (e *leaseElector) acquire(now time.Time) (bool, uint64, error) {
+	nowMs := uint64(now.UnixMilli())
+	until := now.Add(e.ttl)
+	affected, err := e.param().SetArgs(db.And(
+		db.Cond{`name`: e.name},
+		db.Or(
+			db.Cond{`node`: e.node},
+			db.Cond{`expires`: db.Lt(nowMs)},
+		),
+	)).SetSend(echo.H{
+		`node`:    e.node,
+		`expires`: uint64(until.UnixMilli()),
+		`updated`: uint(now.Unix()),
+	}).Updatex()
+	if err != nil {
+		e.setLeader(false, time.Time{})
+		return false, 0, err
+	}
+	if affected == 0 {
+		exists, err := e.param().SetArgs(db.Cond{`name`: e.name}).Exists()
+		if err != nil {
+			e.setLeader(false, time.Time{})
+			return false, 0, err
+		}
+		if !exists {
+			_, err = e.param().SetSend(&TaskLease{
+				Name:    e.name,
+				Node:    e.node,
+				Expires: uint64(until.UnixMilli()),
+				Updated: uint(now.Unix()),
+			}).Insert()
+			// 其它节点同时插入时会因主键冲突而失败，视为未获得租约
+			affected = 1
+			if err != nil {
+				affected = 0
+			}
+		}
+	}
+	lease, err := e.get()
+	if err != nil {
+		e.setLeader(false, time.Time{})
+		return false, 0, err
+	}
+	leader := affected > 0 && lease.Node == e.node
+	if leader {
+		e.setLeader(true, until)
+	} else {
+		e.setLeader(false, time.Time{})
+	}
+	return leader, lease.Version, nil
+}
+
+func (e *leaseElector) get() (*TaskLease, error) {
+	lease := &TaskLease{}
+	err := e.param().SetArgs(db.Cond{`name`: e.name}).SetRecv(lease).One()
+	return lease, err
+}
+
+// release 主动释放租约，以便其它节点尽快接替
+func (e *leaseElector) release() error {
+	e.setLeader(false, time.Time{})
+	return e.param().SetArgs(db.Cond{`name`: e.name, `node`: e.node}).SetSend(echo.H{
+		`expires`: 0,
+		`updated`: uint(time.Now().Unix()),
+	}).Update()
+}
+
+// bumpVersion 递增任务配置版本，通知主节点重新加载定时任务
+func (e *leaseElector) bumpVersion() error {
+	return e.param().SetArgs(db.Cond{`name`: e.name}).SetSend(echo.H{
+		`version`: db.Raw(`version+1`),
+	}).Update()
+}
+
+// electionHandler 主节点状态变化时的回调
+type electionHandler struct {
+	onElected func()      // 成为主节点
+	onRevoked func()      // 失去主节点身份
+	onChanged func()      // 任务配置版本发生变化(仅主节点)
+	onError   func(error) // 访问数据库出错
+}
+
+// run 定期续约，直到ctx被取消
+func (e *leaseElector) run(ctx context.Context, heartbeat time.Duration, h electionHandler) {
+	var (
+		leading bool
+		version uint64
+	)
+	check := func() {
+		leader, ver, err := e.acquire(time.Now())
+		if err != nil && h.onError != nil {
+			h.onError(err)
+		}
+		switch {
+		case leader && !leading:
+			leading, version = true, ver
+			if h.onElected != nil {
+				h.onElected()
+			}
+		case !leader && leading:
+			leading = false
+			if h.onRevoked != nil {
+				h.onRevoked()
+			}
+		case leader && ver != version:
+			version = ver
+			if h.onChanged != nil {
+				h.onChanged()
+			}
+		}
+	}
+	check()
+	t := time.NewTicker(heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if leading {
+				if err := e.release(); err != nil && h.onError != nil {
+					h.onError(err)
+				}
+				if h.onRevoked != nil {
+					h.onRevoked()
+				}
+			}
+			return
+		case <-t.C:
+			check()
+		}
+	}
+}
+
+// taskScheduler 定时任务调度器。开启集群调度时参与主节点选举，只有主节点执行定时任务
+type taskScheduler struct {
+	cron    *cronlib.Cron                // 为nil时使用cron.MainCron
+	elector atomic.Pointer[leaseElector] // 未开启集群调度时为nil
+	running atomic.Bool                  // 是否已加载定时任务
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{} // 选举结束(已释放租约)时关闭
+}
+
+// defaultScheduler 本节点的调度器
+var defaultScheduler = &taskScheduler{}
+
+// startCluster 开启集群调度时启动主节点选举，由主节点加载定时任务。未开启时返回false
+func startCluster() bool {
+	cfg := getClusterConfig()
+	if cfg == nil {
+		return false
+	}
+	defaultScheduler.start(newLeaseElector(factory.DefaultFactory, schedulerLeaseName, cfg.NodeName(), cfg.ttl()), cfg.heartbeat())
+	return true
+}
+
+func stopCluster() {
+	defaultScheduler.stop()
+}
+
+// start 启动主节点选举，成为主节点后加载定时任务
+func (s *taskScheduler) start(e *leaseElector, heartbeat time.Duration) {
+	s.stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.elector.Store(e)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.cancel = cancel
+	s.done = done
+	go func() {
+		defer close(done)
+		e.run(ctx, heartbeat, electionHandler{
+			onElected: func() {
+				log.Infof(`[task] node %q is elected as the scheduler leader`, e.Node())
+				if err := s.loadJobs(context.Background()); err != nil {
+					log.Error(err)
+				}
+			},
+			onRevoked: func() {
+				log.Warnf(`[task] node %q is no longer the scheduler leader`, e.Node())
+				s.closeJobs()
+			},
+			onChanged: func() {
+				if err := s.reloadJobs(context.Background()); err != nil {
+					log.Error(err)
+				}
+			},
+			onError: func(err error) {
+				log.Errorf(`[task] failed to renew the scheduler lease: %v`, err)
+			},
+		})
+	}()
+}
+
+// stop 停止主节点选举，等待释放租约
+func (s *taskScheduler) stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// isLeader 当前节点是否可以执行定时任务。未开启集群调度时总是返回true
+func (s *taskScheduler) isLeader() bool {
+	e := s.elector.Load()
+	return e == nil || e.IsLeader()
+}
+
+// scheduleChanged 在非主节点修改了定时任务时调用，通知主节点重新加载
+func (s *taskScheduler) scheduleChanged() {
+	e := s.elector.Load()
+	if e == nil || e.IsLeader() {
+		return
+	}
+	if err := e.bumpVersion(); err != nil {
+		log.Errorf(`[task] failed to notify the scheduler leader: %v`, err)
+	}
+}
+
+func (s *taskScheduler) mainCron(mustStart bool) *cronlib.Cron {
+	if s.cron == nil {
+		return cron.MainCron(mustStart)
+	}
+	return s.cron
+}
+
+// addEntry 加入定时任务。已存在时返回false
+func (s *taskScheduler) addEntry(spec string, job *cron.Job) bool {
+	if s.cron == nil {
+		return cron.AddJob(spec, job)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range s.cron.Entries() {
+		if v, ok := entry.Job.(*cron.Job); ok && v.Id() == job.Id() {
+			return false
+		}
+	}
+	if _, err := s.cron.AddJob(spec, job); err != nil {
+		log.Errorf(`failed to cron.AddJob(%q): %v`, spec, err)
+		return false
+	}
+	return true
+}
+
+func (s *taskScheduler) removeEntry(id uint) {
+	s.mainCron(false).RemoveJob(func(e *cronlib.Entry) (bool, bool) {
+		v, ok := e.Job.(*cron.Job)
+		return ok && v.Id() == id, false
+	})
+}
+
+// removeJob 从定时任务中移除
+func (s *taskScheduler) removeJob(id uint) {
+	s.removeEntry(id)
+	s.scheduleChanged()
+}
+
+// reloadJobs 重新加载全部定时任务
+func (s *taskScheduler) reloadJobs(ctx context.Context) error {
+	for _, entry := range s.mainCron(false).Entries() {
+		if job, ok := entry.Job.(*cron.Job); ok {
+			s.removeEntry(job.Id())
+		}
+	}
+	return s.loadJobs(ctx)
+}
+
+// closeJobs 停止执行定时任务
+func (s *taskScheduler) closeJobs() {
+	if s.cron == nil {
+		cron.Close()
+	} else {
+		for _, entry := range s.cron.Entries() {
+			s.cron.Remove(entry.ID)
+		}
+	}
+	s.running.Store(false)
+}
+
+// clusterNode 开启集群调度时返回当前节点名称
+func clusterNode() string {
+	if e := defaultScheduler.elector.Load(); e != nil {
+		return e.Node()
+	}
+	return ``
+}
+
+// isSchedulerNode 当前节点是否可以执行定时任务。未开启集群调度时总是返回true
+func isSchedulerNode() bool {
+	return defaultScheduler.isLeader()
+}
+
+// currentLeader 当前主节点名称
+func currentLeader() string {
+	e := defaultScheduler.elector.Load()
+	if e == nil {
+		return ``
+	}
+	lease, err := e.get()
+	if err != nil || lease.Expires < uint64(time.Now().UnixMilli()) {
+		return ``
+	}
+	return lease.Node
+}
+
+// removeJob 从本节点的定时任务中移除
+func removeJob(id uint) {
+	defaultScheduler.removeJob(id)
+}
+
+// TaskLogNode 执行任务的节点
+type TaskLogNode struct {
+	LogId   uint64 `db:"log_id,pk" json:"log_id" xml:"log_id"`
+	TaskId  uint   `db:"task_id" json:"task_id" xml:"task_id"`
+	Node    string `db:"node" json:"node" xml:"node"`
+	Created uint   `db:"created" json:"created" xml:"created"`
+}
+
+// recordLogNode 记录执行任务的节点
+func recordLogNode(taskID uint, logID uint64, created uint) {
+	node := clusterNode()
+	if len(node) == 0 || logID == 0 {
+		return
+	}
+	_, err := newParam(tableTaskLogNode).SetSend(&TaskLogNode{LogId: logID, TaskId: taskID, Node: node, Created: created}).Insert()
+	if err != nil {
+		log.Errorf(`failed to record the node of task log(%d): %v`, logID, err)
+	}
+}
+
+// listLogNodes 获取日志对应的执行节点 {logID:node}
+func listLogNodes(logIDs []uint64) (map[uint64]string, error) {
+	nodes := map[uint64]string{}
+	if len(logIDs) == 0 {
+		return nodes, nil
+	}
+	var rows []*TaskLogNode
+	err := newParam(tableTaskLogNode).SetArgs(db.Cond{`log_id`: db.In(logIDs)}).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return nodes, err
+	}
+	for _, row := range rows {
+		nodes[row.LogId] = row.Node
+	}
+	return nodes, nil
+}
+
+// listLastNodes 获取任务最近一次执行的节点 {taskID:node}
+func listLastNodes(taskIDs []uint) (map[uint]string, error) {
+	nodes := map[uint]string{}
+	if len(taskIDs) == 0 {
+		return nodes, nil
+	}
+	var rows []*TaskLogNode
+	err := newParam(tableTaskLogNode).SetArgs(db.Cond{`task_id`: db.In(taskIDs)}).SetRecv(&rows).SetMiddleware(func(r db.Result) db.Result {
+		return r.Select(`task_id`, db.Raw(`MAX(log_id) AS log_id`)).Group(`task_id`)
+	}).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return nodes, err
+	}
+	logIDs := make([]uint64, len(rows))
+	for i, row := range rows {
+		logIDs[i] = row.LogId
+	}
+	byLog, err := listLogNodes(logIDs)
+	for _, row := range rows {
+		nodes[row.TaskId] = byLog[row.LogId]
+	}
+	return nodes, err
+}
+
+// deleteLogNodes 删除日志的节点记录
+func deleteLogNodes(cond db.Cond) error {
+	return newParam(tableTaskLogNode).SetArgs(cond).Delete()
+}
+
+// cleanLogNodes 清理已删除日志的节点记录
+func cleanLogNodes(taskID uint) error {
+	cond := db.Cond{`task_id`: taskID}
+	m := dbschema.NewNgingTaskLog(nil)
+	err := m.Get(func(r db.Result) db.Result {
+		return r.Select(`id`).OrderBy(`id`)
+	}, cond)
+	if err != nil {
+		if err != db.ErrNoMoreRows {
+			return err
+		}
+	} else {
+		cond[`log_id`] = db.Lt(m.Id)
+	}
+	return deleteLogNodes(cond)
+}
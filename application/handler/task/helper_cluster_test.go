@@ -0,0 +1,129 @@
+package task
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cronlib "github.com/admpub/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/db/sqlite"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cron"
+)
+
+func newLeaseFactory(t *testing.T, file string) *factory.Factory {
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: file})
+	require.NoError(t, err)
+	t.Cleanup(func() { sess.Close() })
+	_, err = sess.Exec("CREATE TABLE IF NOT EXISTS `nging_task_lease` (`name` varchar(100) NOT NULL PRIMARY KEY, `node` varchar(150) NOT NULL DEFAULT '', `expires` bigint NOT NULL DEFAULT 0, `version` bigint NOT NULL DEFAULT 0, `updated` int NOT NULL DEFAULT 0)")
+	require.NoError(t, err)
+	return factory.New().AddDB(sess)
+}
+
+func TestLeaseElector(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `lease.db`)
+	a := newLeaseElector(newLeaseFactory(t, file), schedulerLeaseName, `node-a`, time.Minute)
+	b := newLeaseElector(newLeaseFactory(t, file), schedulerLeaseName, `node-b`, time.Minute)
+	now := time.Now()
+
+	ok, _, err := a.acquire(now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, a.IsLeader())
+
+	ok, _, err = b.acquire(now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, b.IsLeader())
+
+	// 续约
+	ok, _, err = a.acquire(now.Add(30 * time.Second))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// 非主节点修改任务后递增版本
+	require.NoError(t, b.bumpVersion())
+	_, ver, err := a.acquire(now.Add(40 * time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), ver)
+
+	// 租约到期后由其它节点接替
+	ok, _, err = b.acquire(now.Add(2 * time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, _, err = a.acquire(now.Add(2 * time.Minute))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// 主动释放
+	require.NoError(t, b.release())
+	ok, _, err = a.acquire(now.Add(2 * time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSchedulersShareLease(t *testing.T) {
+	useTestDB(t)
+	cron.Initial(2)
+	task := addTestTask(t, `echo tick`)
+	task.CronSpec = `* * * * * *`
+	task.Concurrent = 1 // 两个调度器同时触发时各自执行，不因同一任务而被忽略
+	require.NoError(t, saveTaskExtra(nil, &TaskExtra{TaskId: task.Id, OverlapPolicy: OverlapAllow}))
+
+	file := filepath.Join(t.TempDir(), `lease.db`)
+	schedulers := map[string]*taskScheduler{}
+	for _, name := range []string{`node-a`, `node-b`} {
+		s := &taskScheduler{cron: cronlib.New(cronlib.WithSeconds())}
+		// 两个节点都已加载定时任务(例如原主节点尚未卸载)，由执行器判断是否为主节点
+		job, err := s.newJob(context.Background(), task)
+		require.NoError(t, err)
+		require.True(t, s.addEntry(task.CronSpec, job))
+		s.start(newLeaseElector(newLeaseFactory(t, file), schedulerLeaseName, name, 2*time.Second), 100*time.Millisecond)
+		s.cron.Start()
+		schedulers[name] = s
+	}
+	t.Cleanup(func() {
+		for _, s := range schedulers {
+			s.stop()
+			<-s.cron.Stop().Done()
+		}
+	})
+
+	var leader string
+	require.Eventually(t, func() bool {
+		for name, s := range schedulers {
+			if s.isLeader() {
+				leader = name
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 20*time.Millisecond)
+	time.Sleep(2500 * time.Millisecond)
+	stopped := time.Now()
+	schedulers[leader].stop() // 主节点退出后由另一个节点接替
+	time.Sleep(2500 * time.Millisecond)
+
+	logs := dbschema.NewNgingTaskLog(nil)
+	_, err := logs.ListByOffset(nil, nil, 0, -1, db.Cond{`task_id`: task.Id})
+	require.NoError(t, err)
+	seconds := map[uint]int{}
+	var afterStop int
+	for _, row := range logs.Objects() {
+		seconds[row.Created]++
+		if int64(row.Created) > stopped.Unix() {
+			afterStop++
+		}
+	}
+	assert.GreaterOrEqual(t, len(seconds), 3)
+	assert.Greater(t, afterStop, 0)
+	for second, n := range seconds {
+		assert.Equal(t, 1, n, second) // 每次触发只有主节点执行
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"strings"
+	"time"
+
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+)
+
+const tableTaskExtra = `nging_task_extra`
+
+// 任务执行重叠时的处理方式
+const (
+	OverlapSkip  = `skip`  // 跳过本次执行
+	OverlapQueue = `queue` // 排队等待上一次执行结束
+	OverlapAllow = `allow` // 允许同时执行
+)
+
+// OverlapPolicies 任务执行重叠时的处理方式
+var OverlapPolicies = echo.NewKVData().
+	Add(OverlapSkip, `跳过`).
+	Add(OverlapQueue, `排队`).
+	Add(OverlapAllow, `允许同时执行`)
+
+const (
+	maxRetryCount   = 10
+	maxRetryBackoff = 86400
+)
+
+// newParam 创建本模块数据表的查询参数
+func newParam(table string) *factory.Param {
+	return factory.NewParam(factory.DefaultFactory).SetCollection(dbschema.WithPrefix(table))
+}
+
+// TaskExtra 任务扩展配置
+type TaskExtra struct {
+	TaskId          uint   `db:"task_id,pk" json:"task_id" xml:"task_id"`
+	UpstreamFailure string `db:"upstream_failure" json:"upstream_failure" xml:"upstream_failure"`
+	RetryCount      uint   `db:"retry_count" json:"retry_count" xml:"retry_count"`
+	RetryBackoff    uint   `db:"retry_backoff" json:"retry_backoff" xml:"retry_backoff"`
+	OverlapPolicy   string `db:"overlap_policy" json:"overlap_policy" xml:"overlap_policy"`
+	SSHUserIds      string `db:"ssh_user_ids" json:"ssh_user_ids" xml:"ssh_user_ids"`
+	FanOut          string `db:"fan_out" json:"fan_out" xml:"fan_out"`
+	Timezone        string `db:"timezone" json:"timezone" xml:"timezone"`
+	Updated         uint   `db:"updated" json:"updated" xml:"updated"`
+}
+
+func (t *TaskExtra) setDefaults() {
+	if len(t.UpstreamFailure) == 0 {
+		t.UpstreamFailure = UpstreamFailureSkip
+	}
+	if len(t.OverlapPolicy) == 0 {
+		t.OverlapPolicy = OverlapSkip
+	}
+	if len(t.FanOut) == 0 {
+		t.FanOut = FanOutSequential
+	}
+}
+
+// overlapPolicy 获取实际生效的重叠处理方式。单实例任务总是跳过
+func (t *TaskExtra) overlapPolicy(task *dbschema.NgingTask) string {
+	if task.Concurrent == 0 {
+		return OverlapSkip
+	}
+	if t.OverlapPolicy == OverlapQueue {
+		return OverlapQueue
+	}
+	return OverlapAllow
+}
+
+// getTaskExtra 获取任务扩展配置，不存在时返回默认值
+func getTaskExtra(taskID uint) (*TaskExtra, error) {
+	row := &TaskExtra{}
+	err := newParam(tableTaskExtra).SetArgs(db.Cond{`task_id`: taskID}).SetRecv(row).One()
+	if err != nil {
+		if err != db.ErrNoMoreRows {
+			return nil, err
+		}
+		err = nil
+	}
+	row.TaskId = taskID
+	row.setDefaults()
+	return row, err
+}
+
+func saveTaskExtra(tx factory.Transactioner, row *TaskExtra) error {
+	row.setDefaults()
+	row.Updated = uint(time.Now().Unix())
+	cond := db.Cond{`task_id`: row.TaskId}
+	exists, err := newParam(tableTaskExtra).SetTrans(tx).SetArgs(cond).Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return newParam(tableTaskExtra).SetTrans(tx).SetArgs(cond).SetSend(row).Update()
+	}
+	_, err = newParam(tableTaskExtra).SetTrans(tx).SetSend(row).Insert()
+	return err
+}
+
+func deleteTaskExtra(taskID uint) error {
+	return newParam(tableTaskExtra).SetArgs(db.Cond{`task_id`: taskID}).Delete()
+}
+
+// bindTaskExtra 从表单获取任务扩展配置
+func bindTaskExtra(ctx echo.Context, taskID uint) (*TaskExtra, error) {
+	row, err := getTaskExtra(taskID)
+	if err != nil {
+		return nil, err
+	}
+	row.UpstreamFailure = ctx.Formx(`upstreamFailure`, row.UpstreamFailure).String()
+	if !UpstreamFailures.Has(row.UpstreamFailure) {
+		row.UpstreamFailure = UpstreamFailureSkip
+	}
+	row.RetryCount = ctx.Formx(`retryCount`).Uint()
+	if row.RetryCount > maxRetryCount {
+		return nil, ctx.NewError(code.InvalidParameter, `重试次数不能超过%d`, maxRetryCount).SetZone(`retryCount`)
+	}
+	row.RetryBackoff = ctx.Formx(`retryBackoff`).Uint()
+	if row.RetryBackoff > maxRetryBackoff {
+		return nil, ctx.NewError(code.InvalidParameter, `重试间隔不能超过%d秒`, maxRetryBackoff).SetZone(`retryBackoff`)
+	}
+	row.OverlapPolicy = ctx.Formx(`overlapPolicy`, OverlapSkip).String()
+	if !OverlapPolicies.Has(row.OverlapPolicy) {
+		row.OverlapPolicy = OverlapSkip
+	}
+	row.SSHUserIds = ``
+	if ctx.Form(`target`) == `ssh` {
+		row.SSHUserIds = joinIDs(parseIDs(strings.Join(ctx.FormValues(`sshUserIds`), `,`)))
+		if len(row.SSHUserIds) == 0 {
+			return nil, ctx.NewError(code.InvalidParameter, `请选择SSH主机`).SetZone(`sshUserIds`)
+		}
+	}
+	row.FanOut = ctx.Formx(`fanOut`, FanOutSequential).String()
+	if !FanOuts.Has(row.FanOut) {
+		row.FanOut = FanOutSequential
+	}
+	row.Timezone = strings.TrimSpace(ctx.Form(`timezone`))
+	if _, err = loadTimezone(row.Timezone); err != nil {
+		return nil, ctx.NewError(code.InvalidParameter, `无效的时区：%s`, row.Timezone).SetZone(`timezone`)
+	}
+	return row, nil
+}
+
+// applyOverlapPolicy 根据重叠处理方式设置任务是否允许多实例
+func applyOverlapPolicy(task *dbschema.NgingTask, row *TaskExtra) {
+	if row.OverlapPolicy == OverlapSkip {
+		task.Concurrent = 0
+	} else {
+		task.Concurrent = 1
+	}
+}
+
+func setTaskExtraForm(ctx echo.Context, task *dbschema.NgingTask, row *TaskExtra) {
+	form := ctx.Request().Form()
+	form.Set(`upstreamFailure`, row.UpstreamFailure)
+	form.Set(`retryCount`, param.AsString(row.RetryCount))
+	form.Set(`retryBackoff`, param.AsString(row.RetryBackoff))
+	form.Set(`overlapPolicy`, row.overlapPolicy(task))
+	form.Set(`timezone`, row.Timezone)
+	form.Set(`fanOut`, row.FanOut)
+	form.Del(`sshUserIds`)
+	if len(row.SSHUserIds) > 0 {
+		form.Set(`target`, `ssh`)
+		for _, id := range parseIDs(row.SSHUserIds) {
+			form.Add(`sshUserIds`, param.AsString(id))
+		}
+	} else {
+		form.Set(`target`, `local`)
+	}
+}
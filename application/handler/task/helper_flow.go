@@ -0,0 +1,536 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/registry/alert"
+)
+
+const (
+	tableTaskDependency = `nging_task_dependency`
+	tableTaskFlowRun    = `nging_task_flow_run`
+	tableTaskFlowNode   = `nging_task_flow_node`
+)
+
+// 上游任务失败时的处理方式
+const (
+	UpstreamFailureSkip     = `skip`
+	UpstreamFailureContinue = `continue`
+	UpstreamFailureAlert    = `alert`
+)
+
+// UpstreamFailures 上游任务失败时的处理方式
+var UpstreamFailures = echo.NewKVData().
+	Add(UpstreamFailureSkip, `跳过本任务`).
+	Add(UpstreamFailureContinue, `继续执行本任务`).
+	Add(UpstreamFailureAlert, `跳过本任务并发送告警`)
+
+// TaskDependency 任务依赖关系
+type TaskDependency struct {
+	Id         uint `db:"id,omitempty,pk" json:"id" xml:"id"`
+	TaskId     uint `db:"task_id" json:"task_id" xml:"task_id"`
+	UpstreamId uint `db:"upstream_id" json:"upstream_id" xml:"upstream_id"`
+	Created    uint `db:"created" json:"created" xml:"created"`
+}
+
+// FlowRun 任务链运行记录
+type FlowRun struct {
+	Id         uint64 `db:"id,omitempty,pk" json:"id" xml:"id"`
+	RootTaskId uint   `db:"root_task_id" json:"root_task_id" xml:"root_task_id"`
+	RootLogId  uint64 `db:"root_log_id" json:"root_log_id" xml:"root_log_id"`
+	Status     string `db:"status" json:"status" xml:"status"`
+	Created    uint   `db:"created" json:"created" xml:"created"`
+	Finished   uint   `db:"finished" json:"finished" xml:"finished"`
+}
+
+// FlowNode 任务链中各任务的执行结果
+type FlowNode struct {
+	Id      uint64 `db:"id,omitempty,pk" json:"id" xml:"id"`
+	RunId   uint64 `db:"run_id" json:"run_id" xml:"run_id"`
+	TaskId  uint   `db:"task_id" json:"task_id" xml:"task_id"`
+	LogId   uint64 `db:"log_id" json:"log_id" xml:"log_id"`
+	Status  string `db:"status" json:"status" xml:"status"`
+	Reason  string `db:"reason" json:"reason" xml:"reason"`
+	Created uint   `db:"created" json:"created" xml:"created"`
+}
+
+// listDependencies 获取全部依赖关系 {taskID:[upstreamID]}
+func listDependencies() (map[uint][]uint, error) {
+	var rows []*TaskDependency
+	err := newParam(tableTaskDependency).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return nil, err
+	}
+	deps := map[uint][]uint{}
+	for _, row := range rows {
+		deps[row.TaskId] = append(deps[row.TaskId], row.UpstreamId)
+	}
+	return deps, nil
+}
+
+func listUpstreamIDs(taskID uint) ([]uint, error) {
+	return listDependencyIDs(db.Cond{`task_id`: taskID}, func(row *TaskDependency) uint {
+		return row.UpstreamId
+	})
+}
+
+func listDownstreamIDs(taskID uint) ([]uint, error) {
+	return listDependencyIDs(db.Cond{`upstream_id`: taskID}, func(row *TaskDependency) uint {
+		return row.TaskId
+	})
+}
+
+func listDependencyIDs(cond db.Cond, getID func(*TaskDependency) uint) ([]uint, error) {
+	var rows []*TaskDependency
+	err := newParam(tableTaskDependency).SetArgs(cond).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return nil, err
+	}
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = getID(row)
+	}
+	return ids, nil
+}
+
+// findDependencyCycle 查找依赖关系中的环，返回构成环的任务ID(首尾相同)，无环时返回nil
+func findDependencyCycle(deps map[uint][]uint) []uint {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := map[uint]int{}
+	var stack []uint
+	var walk func(id uint) []uint
+	walk = func(id uint) []uint {
+		states[id] = visiting
+		stack = append(stack, id)
+		for _, upID := range deps[id] {
+			switch states[upID] {
+			case visiting:
+				for i, v := range stack {
+					if v == upID {
+						return append(append([]uint{}, stack[i:]...), upID)
+					}
+				}
+			case unvisited:
+				if cycle := walk(upID); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		states[id] = visited
+		return nil
+	}
+	ids := make([]uint, 0, len(deps))
+	for id := range deps {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if states[id] != unvisited {
+			continue
+		}
+		if cycle := walk(id); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// checkUpstreams 检查上游任务是否有效以及是否会形成循环依赖
+func checkUpstreams(ctx echo.Context, taskID uint, upstreamIDs []uint) error {
+	if len(upstreamIDs) == 0 {
+		return nil
+	}
+	task := dbschema.NewNgingTask(ctx)
+	for _, upID := range upstreamIDs {
+		if upID == taskID {
+			return ctx.E(`不能将任务自身设置为上游任务`)
+		}
+		err := task.Get(func(r db.Result) db.Result {
+			return r.Select(`id`, `name`, `command`)
+		}, `id`, upID)
+		if err != nil {
+			if err == db.ErrNoMoreRows {
+				return ctx.E(`上游任务不存在：%d`, upID)
+			}
+			return err
+		}
+		if isSystemCommand(task.Command) {
+			return ctx.E(`系统命令任务不支持作为上游任务：%s`, task.Name)
+		}
+	}
+	if taskID == 0 { // 新任务没有下游，不会构成环
+		return nil
+	}
+	deps, err := listDependencies()
+	if err != nil {
+		return err
+	}
+	deps[taskID] = upstreamIDs
+	if cycle := findDependencyCycle(deps); cycle != nil {
+		parts := make([]string, len(cycle))
+		for i, id := range cycle {
+			parts[i] = `#` + param.AsString(id)
+		}
+		return ctx.E(`任务依赖关系中存在循环：%s`, strings.Join(parts, ` -> `))
+	}
+	return nil
+}
+
+// saveUpstreams 保存上游任务
+func saveUpstreams(tx factory.Transactioner, taskID uint, upstreamIDs []uint) error {
+	err := newParam(tableTaskDependency).SetTrans(tx).SetArgs(db.Cond{`task_id`: taskID}).Delete()
+	if err != nil {
+		return err
+	}
+	now := uint(time.Now().Unix())
+	for _, upID := range upstreamIDs {
+		_, err = newParam(tableTaskDependency).SetTrans(tx).SetSend(&TaskDependency{
+			TaskId:     taskID,
+			UpstreamId: upID,
+			Created:    now,
+		}).Insert()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteDependencies 删除任务的依赖关系(删除任务时调用)。
+// 以该任务为上游的任务没有其它上游后改为按自身的定时规则执行，此时将其中启用的任务加入定时任务
+func deleteDependencies(taskID uint) error {
+	downstreamIDs, err := listDownstreamIDs(taskID)
+	if err != nil {
+		return err
+	}
+	err = newParam(tableTaskDependency).SetArgs(db.Or(
+		db.Cond{`task_id`: taskID},
+		db.Cond{`upstream_id`: taskID},
+	)).Delete()
+	if err != nil {
+		return err
+	}
+	for _, id := range downstreamIDs {
+		task := dbschema.NewNgingTask(nil)
+		err = task.Get(nil, `id`, id)
+		if err != nil {
+			if err == db.ErrNoMoreRows {
+				continue
+			}
+			return err
+		}
+		if task.Disabled != `N` {
+			continue
+		}
+		if _, err = addJob(context.Background(), task); err != nil {
+			log.Errorf(`failed to schedule task(%d) after its upstream task(%d) was deleted: %v`, id, taskID, err)
+		}
+	}
+	return nil
+}
+
+func formUpstreamIDs(ctx echo.Context) []uint {
+	var ids []uint
+	for _, v := range ctx.FormValues(`upstreamIds`) {
+		id := param.AsUint(v)
+		if id > 0 && !containsID(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// - 任务链执行 -
+
+// hasDownstream 是否有下游任务
+func hasDownstream(taskID uint) bool {
+	downIDs, err := listDownstreamIDs(taskID)
+	if err != nil {
+		log.Errorf(`failed to listDownstreamIDs(%d): %v`, taskID, err)
+		return false
+	}
+	return len(downIDs) > 0
+}
+
+type flowState struct {
+	mu      sync.Mutex
+	run     *FlowRun
+	members map[uint]struct{} // 起始任务及其全部下游任务
+	results map[uint]string
+	started map[uint]struct{}
+	running int
+	nesting int // 正在处理的finishNode层数(被跳过的下游任务在tryStart中递归调用finishNode)
+	failed  bool
+	alerts  []flowAlert // 等待发送的告警(在解锁后发送)
+}
+
+type flowAlert struct {
+	taskID uint
+	reason string
+}
+
+// sendFlowAlert 发送任务被跳过的告警
+var sendFlowAlert = sendSkippedAlert
+
+func startFlowRun(rootID uint, logID uint64, status string) {
+	s := &flowState{
+		run: &FlowRun{
+			RootTaskId: rootID,
+			RootLogId:  logID,
+			Status:     `running`,
+			Created:    uint(time.Now().Unix()),
+		},
+		members: map[uint]struct{}{rootID: {}},
+		results: map[uint]string{},
+		started: map[uint]struct{}{rootID: {}},
+	}
+	queue := []uint{rootID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		downIDs, err := listDownstreamIDs(id)
+		if err != nil {
+			log.Errorf(`failed to listDownstreamIDs(%d): %v`, id, err)
+			return
+		}
+		for _, downID := range downIDs {
+			if _, ok := s.members[downID]; ok {
+				continue
+			}
+			s.members[downID] = struct{}{}
+			queue = append(queue, downID)
+		}
+	}
+	pk, err := newParam(tableTaskFlowRun).SetSend(s.run).Insert()
+	if err != nil {
+		log.Errorf(`failed to insert %s: %v`, tableTaskFlowRun, err)
+		return
+	}
+	s.run.Id = param.AsUint64(pk)
+	s.mu.Lock()
+	s.finishNode(rootID, logID, status, ``)
+	s.mu.Unlock()
+	s.sendAlerts()
+}
+
+// finishNode 记录任务的执行结果并触发可以执行的下游任务(调用前须加锁)
+func (s *flowState) finishNode(taskID uint, logID uint64, status string, reason string) {
+	s.results[taskID] = status
+	if status != `success` {
+		s.failed = true
+	}
+	_, err := newParam(tableTaskFlowNode).SetSend(&FlowNode{
+		RunId:   s.run.Id,
+		TaskId:  taskID,
+		LogId:   logID,
+		Status:  status,
+		Reason:  reason,
+		Created: uint(time.Now().Unix()),
+	}).Insert()
+	if err != nil {
+		log.Errorf(`failed to insert %s: %v`, tableTaskFlowNode, err)
+	}
+	downIDs, err := listDownstreamIDs(taskID)
+	if err != nil {
+		log.Errorf(`failed to listDownstreamIDs(%d): %v`, taskID, err)
+	}
+	s.nesting++
+	for _, downID := range downIDs {
+		s.tryStart(downID)
+	}
+	s.nesting--
+	if s.nesting == 0 && s.running == 0 && s.run.Finished == 0 && len(s.results) == len(s.started) {
+		s.finish()
+	}
+}
+
+// tryStart 在全部上游任务都已结束时执行下游任务
+func (s *flowState) tryStart(taskID uint) {
+	if _, ok := s.members[taskID]; !ok {
+		return
+	}
+	if _, ok := s.started[taskID]; ok {
+		return
+	}
+	upIDs, err := listUpstreamIDs(taskID)
+	if err != nil {
+		log.Errorf(`failed to listUpstreamIDs(%d): %v`, taskID, err)
+		return
+	}
+	var failedUpIDs []string
+	for _, upID := range upIDs {
+		var status string
+		if _, ok := s.members[upID]; ok {
+			var finished bool
+			status, finished = s.results[upID]
+			if !finished {
+				return
+			}
+		} else { // 不在本任务链中的上游任务，以其最近一次的执行结果为准
+			status = latestLogStatus(upID)
+		}
+		if status != `success` {
+			failedUpIDs = append(failedUpIDs, `#`+param.AsString(upID))
+		}
+	}
+	s.started[taskID] = struct{}{}
+	if len(failedUpIDs) > 0 {
+		extra, err := getTaskExtra(taskID)
+		if err != nil {
+			log.Errorf(`failed to getTaskExtra(%d): %v`, taskID, err)
+			extra = &TaskExtra{UpstreamFailure: UpstreamFailureSkip}
+		}
+		if extra.UpstreamFailure != UpstreamFailureContinue {
+			reason := `上游任务未成功：` + strings.Join(failedUpIDs, `, `)
+			if extra.UpstreamFailure == UpstreamFailureAlert {
+				s.alerts = append(s.alerts, flowAlert{taskID: taskID, reason: reason})
+			}
+			s.finishNode(taskID, 0, `skipped`, reason)
+			return
+		}
+	}
+	s.running++
+	go s.runNode(taskID)
+}
+
+func (s *flowState) runNode(taskID uint) {
+	var (
+		logID  uint64
+		status = `skipped`
+		reason string
+	)
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.finishNode(taskID, logID, status, reason)
+		s.mu.Unlock()
+		s.sendAlerts()
+	}()
+	task := dbschema.NewNgingTask(nil)
+	err := task.Get(nil, `id`, taskID)
+	if err != nil {
+		reason = err.Error()
+		return
+	}
+	if task.Disabled == `Y` {
+		reason = `任务已停用`
+		return
+	}
+	job, state, err := newJob(context.Background(), task)
+	if err != nil {
+		reason = err.Error()
+		return
+	}
+	if state == nil {
+		reason = `系统命令任务不支持由任务链触发`
+		return
+	}
+	state.flow = s
+	job.Run()
+	logID = state.LogID()
+	status = state.Status()
+	if len(status) == 0 {
+		logID = job.LogID()
+		status = `skipped`
+		reason = `上一次执行尚未结束，本次被忽略`
+	}
+}
+
+func (s *flowState) finish() {
+	s.run.Finished = uint(time.Now().Unix())
+	if s.failed {
+		s.run.Status = `failure`
+	} else {
+		s.run.Status = `success`
+	}
+	err := newParam(tableTaskFlowRun).SetArgs(db.Cond{`id`: s.run.Id}).UpdateField(
+		`status`, s.run.Status,
+		`finished`, s.run.Finished,
+	)
+	if err != nil {
+		log.Errorf(`failed to update %s: %v`, tableTaskFlowRun, err)
+	}
+}
+
+// sendAlerts 发送已记录的告警
+func (s *flowState) sendAlerts() {
+	s.mu.Lock()
+	alerts := s.alerts
+	s.alerts = nil
+	s.mu.Unlock()
+	for _, a := range alerts {
+		sendFlowAlert(s.run.Id, a.taskID, a.reason)
+	}
+}
+
+func sendSkippedAlert(runID uint64, taskID uint, reason string) {
+	ctx := defaults.NewMockContext()
+	task := dbschema.NewNgingTask(ctx)
+	if err := task.Get(nil, `id`, taskID); err != nil {
+		log.Errorf(`failed to get task(%d): %v`, taskID, err)
+		return
+	}
+	title := fmt.Sprintf(`任务链通知 #%d: %s`, task.Id, `已跳过`)
+	content := fmt.Sprintf(`任务“%s”(#%d)因%s而被跳过。任务链运行记录：#%d`, task.Name, task.Id, reason, runID)
+	alertData := alert.NewData(title, alert.DefaultTextContent)
+	alertData.Data.Set(`email-content`, []byte(content))
+	alertData.Data.Set(`markdown-content`, []byte(`### `+title+"\n"+content))
+	if err := alert.SendTopic(ctx, `cron`, alertData); err != nil {
+		log.Errorf(`failed to send task flow alert: %v`, err)
+	}
+}
+
+func latestLogStatus(taskID uint) string {
+	taskLog := dbschema.NewNgingTaskLog(nil)
+	err := taskLog.Get(func(r db.Result) db.Result {
+		return r.Select(`status`).OrderBy(`-id`)
+	}, finalLogCond(taskID))
+	if err != nil {
+		return ``
+	}
+	return taskLog.Status
+}
@@ -0,0 +1,102 @@
+package task
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/db"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cron"
+)
+
+func TestFindDependencyCycle(t *testing.T) {
+	deps := map[uint][]uint{
+		2: {1},
+		3: {1, 2},
+		4: {3},
+	}
+	assert.Nil(t, findDependencyCycle(deps))
+
+	deps[1] = []uint{4}
+	assert.Equal(t, []uint{1, 4, 3, 1}, findDependencyCycle(deps))
+
+	assert.Equal(t, []uint{5, 5}, findDependencyCycle(map[uint][]uint{5: {5}}))
+}
+
+func TestFlowUpstreamFailure(t *testing.T) {
+	useTestDB(t)
+	var (
+		mu     sync.Mutex
+		alerts = map[uint]string{}
+	)
+	sendFlowAlert = func(_ uint64, taskID uint, reason string) {
+		mu.Lock()
+		alerts[taskID] = reason
+		mu.Unlock()
+	}
+	t.Cleanup(func() { sendFlowAlert = sendSkippedAlert })
+
+	root := addTestTask(t, `echo root; exit 1`)
+	require.NoError(t, saveTaskExtra(nil, &TaskExtra{TaskId: root.Id, RetryCount: 1, RetryBackoff: 1}))
+	downstreams := map[string]*dbschema.NgingTask{}
+	for _, policy := range []string{UpstreamFailureSkip, UpstreamFailureContinue, UpstreamFailureAlert} {
+		task := addTestTask(t, `echo `+policy)
+		require.NoError(t, saveTaskExtra(nil, &TaskExtra{TaskId: task.Id, UpstreamFailure: policy}))
+		require.NoError(t, saveUpstreams(nil, task.Id, []uint{root.Id}))
+		downstreams[policy] = task
+	}
+
+	job, state, err := newJob(context.Background(), root)
+	require.NoError(t, err)
+	job.Run()
+
+	flowRun := &FlowRun{}
+	require.Eventually(t, func() bool {
+		err := newParam(tableTaskFlowRun).SetArgs(db.Cond{`root_task_id`: root.Id}).SetRecv(flowRun).One()
+		return err == nil && flowRun.Status != `running`
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, `failure`, flowRun.Status)
+	// 任务链关联的是最终执行结果的日志，而不是重试前那一次的日志
+	assert.Equal(t, state.LogID(), flowRun.RootLogId)
+
+	var nodes []*FlowNode
+	require.NoError(t, newParam(tableTaskFlowNode).SetArgs(db.Cond{`run_id`: flowRun.Id}).SetRecv(&nodes).All())
+	results := map[uint]*FlowNode{}
+	for _, node := range nodes {
+		results[node.TaskId] = node
+	}
+	require.Len(t, results, 4)
+	assert.Equal(t, `failure`, results[root.Id].Status)
+	assert.Equal(t, `skipped`, results[downstreams[UpstreamFailureSkip].Id].Status)
+	assert.Equal(t, `success`, results[downstreams[UpstreamFailureContinue].Id].Status)
+	assert.NotZero(t, results[downstreams[UpstreamFailureContinue].Id].LogId)
+	assert.Equal(t, `skipped`, results[downstreams[UpstreamFailureAlert].Id].Status)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, alerts, 1)
+	assert.Contains(t, alerts[downstreams[UpstreamFailureAlert].Id], `上游任务未成功`)
+}
+
+func TestDeleteUpstreamSchedulesDownstream(t *testing.T) {
+	useTestDB(t)
+	cron.Initial(2)
+	root := addTestTask(t, `echo root`)
+	down := addTestTask(t, `echo down`)
+	require.NoError(t, down.UpdateField(nil, `cron_spec`, `0 0 1 * * *`, `id`, down.Id))
+	require.NoError(t, saveUpstreams(nil, down.Id, []uint{root.Id}))
+	added, err := addJob(context.Background(), down)
+	require.NoError(t, err)
+	assert.True(t, added)
+	assert.Nil(t, cron.GetEntryById(down.Id))
+
+	// 删除上游任务后，下游任务按自身的定时规则执行
+	require.NoError(t, deleteDependencies(root.Id))
+	assert.NotNil(t, cron.GetEntryById(down.Id))
+	removeJob(down.Id)
+}
@@ -0,0 +1,422 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+
+	"github.com/coscms/webcore/dbschema"
+)
+
+const tableTaskHTTP = `nging_task_http`
+
+// 任务类型(对应nging_task.type)
+const (
+	TaskTypeCommand = 0 // 执行命令
+	TaskTypeHTTP    = 1 // HTTP请求
+)
+
+// maxHTTPResponseLog 日志中保存的响应内容的最大字节数
+const maxHTTPResponseLog = 64 * 1024
+
+// HTTPMethods 支持的请求方法
+var HTTPMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodHead, http.MethodOptions,
+}
+
+// TaskHTTP HTTP请求任务配置
+type TaskHTTP struct {
+	TaskId       uint   `db:"task_id,pk" json:"task_id" xml:"task_id"`
+	Method       string `db:"method" json:"method" xml:"method"`
+	URL          string `db:"url" json:"url" xml:"url"`
+	Headers      string `db:"headers" json:"headers" xml:"headers"`
+	Body         string `db:"body" json:"body" xml:"body"`
+	ExpectStatus string `db:"expect_status" json:"expect_status" xml:"expect_status"`
+	ExpectBody   string `db:"expect_body" json:"expect_body" xml:"expect_body"`
+	Insecure     string `db:"insecure" json:"insecure" xml:"insecure"`
+	Updated      uint   `db:"updated" json:"updated" xml:"updated"`
+}
+
+func (t *TaskHTTP) setDefaults() {
+	t.Method = strings.ToUpper(strings.TrimSpace(t.Method))
+	if len(t.Method) == 0 {
+		t.Method = http.MethodGet
+	}
+	if t.Insecure != `Y` {
+		t.Insecure = `N`
+	}
+}
+
+// Command 用于显示在任务列表中的命令
+func (t *TaskHTTP) Command() string {
+	return t.Method + ` ` + t.URL
+}
+
+// validate 校验配置
+func (t *TaskHTTP) validate() error {
+	found := false
+	for _, m := range HTTPMethods {
+		if m == t.Method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf(`不支持的请求方法：%s`, t.Method)
+	}
+	if len(t.URL) == 0 {
+		return fmt.Errorf(`网址不能为空`)
+	}
+	if !strings.Contains(t.URL, `{{`) {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != `http` && u.Scheme != `https`) || len(u.Host) == 0 {
+			return fmt.Errorf(`无效的网址：%s`, t.URL)
+		}
+	}
+	for name, tpl := range map[string]string{`网址`: t.URL, `请求头`: t.Headers, `请求内容`: t.Body} {
+		if _, err := template.New(name).Parse(tpl); err != nil {
+			return fmt.Errorf(`%s模板有误：%v`, name, err)
+		}
+	}
+	if _, err := parseExpectStatus(t.ExpectStatus); err != nil {
+		return err
+	}
+	if len(t.ExpectBody) > 0 {
+		if _, err := regexp.Compile(t.ExpectBody); err != nil {
+			return fmt.Errorf(`无效的正则表达式：%v`, err)
+		}
+	}
+	return nil
+}
+
+func getTaskHTTP(taskID uint) (*TaskHTTP, error) {
+	row := &TaskHTTP{}
+	err := newParam(tableTaskHTTP).SetArgs(db.Cond{`task_id`: taskID}).SetRecv(row).One()
+	if err != nil {
+		if err != db.ErrNoMoreRows {
+			return nil, err
+		}
+		err = nil
+	}
+	row.TaskId = taskID
+	row.setDefaults()
+	return row, err
+}
+
+func saveTaskHTTP(tx factory.Transactioner, row *TaskHTTP) error {
+	row.setDefaults()
+	row.Updated = uint(time.Now().Unix())
+	cond := db.Cond{`task_id`: row.TaskId}
+	exists, err := newParam(tableTaskHTTP).SetTrans(tx).SetArgs(cond).Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return newParam(tableTaskHTTP).SetTrans(tx).SetArgs(cond).SetSend(row).Update()
+	}
+	_, err = newParam(tableTaskHTTP).SetTrans(tx).SetSend(row).Insert()
+	return err
+}
+
+func deleteTaskHTTP(tx factory.Transactioner, taskID uint) error {
+	return newParam(tableTaskHTTP).SetTrans(tx).SetArgs(db.Cond{`task_id`: taskID}).Delete()
+}
+
+// bindTaskHTTP 从表单获取HTTP请求任务配置
+func bindTaskHTTP(ctx echo.Context, taskID uint) (*TaskHTTP, error) {
+	row := &TaskHTTP{
+		TaskId:       taskID,
+		Method:       ctx.Form(`httpMethod`),
+		URL:          strings.TrimSpace(ctx.Form(`httpURL`)),
+		Headers:      strings.TrimSpace(ctx.Form(`httpHeaders`)),
+		Body:         ctx.Form(`httpBody`),
+		ExpectStatus: strings.TrimSpace(ctx.Form(`httpExpectStatus`)),
+		ExpectBody:   strings.TrimSpace(ctx.Form(`httpExpectBody`)),
+		Insecure:     ctx.Form(`httpInsecure`, `N`),
+	}
+	row.setDefaults()
+	if err := row.validate(); err != nil {
+		return nil, ctx.NewError(code.InvalidParameter, err.Error()).SetZone(`httpURL`)
+	}
+	return row, nil
+}
+
+// bindTaskType 根据任务类型获取HTTP请求配置。HTTP请求任务的命令为“请求方法 网址”，仅用于显示
+func bindTaskType(ctx echo.Context, m *dbschema.NgingTask) (*TaskHTTP, error) {
+	if m.Type != TaskTypeHTTP {
+		m.Type = TaskTypeCommand
+		return nil, nil
+	}
+	cfg, err := bindTaskHTTP(ctx, m.Id)
+	if err != nil {
+		return nil, err
+	}
+	m.Command = cfg.Command()
+	return cfg, nil
+}
+
+func setTaskHTTPForm(ctx echo.Context, row *TaskHTTP) {
+	form := ctx.Request().Form()
+	form.Set(`httpMethod`, row.Method)
+	form.Set(`httpURL`, row.URL)
+	form.Set(`httpHeaders`, row.Headers)
+	form.Set(`httpBody`, row.Body)
+	form.Set(`httpExpectStatus`, row.ExpectStatus)
+	form.Set(`httpExpectBody`, row.ExpectBody)
+	form.Set(`httpInsecure`, row.Insecure)
+}
+
+// parseExpectStatus 解析期望的状态码。支持 200、200,204、2xx 这些写法，为空时为2xx
+func parseExpectStatus(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return []string{`2xx`}, nil
+	}
+	var list []string
+	for _, v := range strings.Split(s, `,`) {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if len(v) == 0 {
+			continue
+		}
+		if len(v) != 3 {
+			return nil, fmt.Errorf(`无效的状态码：%s`, v)
+		}
+		if strings.HasSuffix(v, `xx`) {
+			if v[0] < '1' || v[0] > '5' {
+				return nil, fmt.Errorf(`无效的状态码：%s`, v)
+			}
+		} else if n, err := strconv.Atoi(v); err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf(`无效的状态码：%s`, v)
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// matchStatus 状态码是否符合期望
+func matchStatus(expected []string, status int) bool {
+	s := strconv.Itoa(status)
+	for _, v := range expected {
+		if v == s || (strings.HasSuffix(v, `xx`) && v[0] == s[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpTemplateData 请求模板中可以使用的数据
+type httpTemplateData struct {
+	Task *dbschema.NgingTask
+	Env  map[string]string
+	Now  time.Time
+}
+
+func renderHTTPTemplate(name string, tpl string, data *httpTemplateData) (string, error) {
+	if !strings.Contains(tpl, `{{`) {
+		return tpl, nil
+	}
+	t, err := template.New(name).Option(`missingkey=zero`).Parse(tpl)
+	if err != nil {
+		return ``, err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, data); err != nil {
+		return ``, err
+	}
+	return buf.String(), nil
+}
+
+// newHTTPRequest 根据配置生成请求
+func newHTTPRequest(ctx context.Context, cfg *TaskHTTP, data *httpTemplateData) (*http.Request, error) {
+	rawURL, err := renderHTTPTemplate(`url`, cfg.URL, data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := renderHTTPTemplate(`body`, cfg.Body, data)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := renderHTTPTemplate(`headers`, cfg.Headers, data)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, cfg.Method, strings.TrimSpace(rawURL), reader)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(headers, "\n") {
+		parts := strings.SplitN(line, `:`, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		if len(name) == 0 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.EqualFold(name, `Host`) {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+	return req, nil
+}
+
+// checkHTTPResponse 检查响应是否符合期望。响应内容以流的方式匹配正则表达式，不受日志中保存长度的限制
+func checkHTTPResponse(cfg *TaskHTTP, status int, body io.Reader) error {
+	expected, err := parseExpectStatus(cfg.ExpectStatus)
+	if err != nil {
+		return err
+	}
+	if !matchStatus(expected, status) {
+		return fmt.Errorf(`状态码为%d，不符合期望的状态码：%s`, status, strings.Join(expected, `,`))
+	}
+	if len(cfg.ExpectBody) > 0 {
+		re, err := regexp.Compile(cfg.ExpectBody)
+		if err != nil {
+			return err
+		}
+		r := &errReader{r: body}
+		matched := re.MatchReader(bufio.NewReader(r))
+		if r.err != nil && r.err != io.EOF {
+			return r.err
+		}
+		if !matched {
+			return fmt.Errorf(`响应内容不匹配正则表达式：%s`, cfg.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// errReader 记录读取时的错误(regexp.MatchReader会把读取错误当作内容结束)
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// headWriter 只保存写入内容的前limit字节
+type headWriter struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := w.limit - w.buf.Len(); n < len(p) {
+		w.buf.Write(p[:n])
+		w.truncated = true
+	} else {
+		w.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// dumpHTTPResponse 将响应转换为日志内容
+func dumpHTTPResponse(req *http.Request, resp *http.Response, body []byte, truncated bool) string {
+	var buf strings.Builder
+	buf.WriteString(req.Method + ` ` + req.URL.String() + "\n\n")
+	buf.WriteString(resp.Proto + ` ` + resp.Status + "\n")
+	resp.Header.Write(&buf)
+	buf.WriteString("\n")
+	buf.Write(body)
+	if truncated {
+		buf.WriteString(fmt.Sprintf("\n\n[响应内容超过%d字节，已截断]", maxHTTPResponseLog))
+	}
+	return buf.String()
+}
+
+// runHTTP 执行HTTP请求任务
+func (s *jobState) runHTTP(timeout time.Duration, live *liveRun) (string, string, error, bool) {
+	cfg, err := getTaskHTTP(s.task.Id)
+	if err != nil {
+		return ``, ``, err, false
+	}
+	env := map[string]string{}
+	for _, row := range s.env {
+		parts := strings.SplitN(row, `=`, 2)
+		if len(parts) == 2 {
+			env[strings.TrimSpace(parts[0])] = parts[1]
+		}
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	req, err := newHTTPRequest(ctx, cfg, &httpTemplateData{Task: s.task, Env: env, Now: time.Now()})
+	if err != nil {
+		return ``, ``, err, false
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Insecure == `Y` {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		isTimeout := ctx.Err() == context.DeadlineExceeded && s.ctx.Err() == nil
+		if isTimeout {
+			err = nil
+		}
+		return ``, ``, err, isTimeout
+	}
+	defer resp.Body.Close()
+	head := &headWriter{limit: maxHTTPResponseLog}
+	body := io.TeeReader(resp.Body, head)
+	checkErr := checkHTTPResponse(cfg, resp.StatusCode, body)
+	// 继续读取日志中需要保存的内容
+	_, err = io.Copy(io.Discard, io.LimitReader(body, int64(maxHTTPResponseLog-head.buf.Len()+1)))
+	out := dumpHTTPResponse(req, resp, head.buf.Bytes(), head.truncated)
+	live.write(`stdout`, []byte(out))
+	if ctx.Err() == context.DeadlineExceeded && s.ctx.Err() == nil {
+		return out, ``, nil, true
+	}
+	if checkErr != nil {
+		return out, ``, checkErr, false
+	}
+	return out, ``, err, false
+}
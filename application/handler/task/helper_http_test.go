@@ -0,0 +1,63 @@
+package task
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coscms/webcore/dbschema"
+)
+
+func TestParseExpectStatus(t *testing.T) {
+	list, err := parseExpectStatus(``)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`2xx`}, list)
+	assert.True(t, matchStatus(list, 204))
+	assert.False(t, matchStatus(list, 302))
+
+	list, err = parseExpectStatus(`200, 3XX`)
+	assert.NoError(t, err)
+	assert.True(t, matchStatus(list, 200))
+	assert.True(t, matchStatus(list, 301))
+	assert.False(t, matchStatus(list, 201))
+
+	for _, v := range []string{`20`, `600`, `6xx`, `abc`} {
+		_, err = parseExpectStatus(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestNewHTTPRequest(t *testing.T) {
+	cfg := &TaskHTTP{
+		Method:  `POST`,
+		URL:     `https://example.com/run?id={{.Task.Id}}`,
+		Headers: "Authorization: Bearer {{.Env.TOKEN}}\nHost: internal.local\ninvalid",
+		Body:    `{"name":"{{.Task.Name}}"}`,
+	}
+	data := &httpTemplateData{Task: &dbschema.NgingTask{Id: 3, Name: `backup`}, Env: map[string]string{`TOKEN`: `abc`}}
+	req, err := newHTTPRequest(context.Background(), cfg, data)
+	assert.NoError(t, err)
+	assert.Equal(t, `https://example.com/run?id=3`, req.URL.String())
+	assert.Equal(t, `Bearer abc`, req.Header.Get(`Authorization`))
+	assert.Equal(t, `internal.local`, req.Host)
+	body, _ := io.ReadAll(req.Body)
+	assert.Equal(t, `{"name":"backup"}`, string(body))
+}
+
+func TestCheckHTTPResponse(t *testing.T) {
+	cfg := &TaskHTTP{ExpectStatus: `200`, ExpectBody: `"ok":\s*true`}
+	assert.NoError(t, checkHTTPResponse(cfg, 200, strings.NewReader(`{"ok": true}`)))
+	assert.Error(t, checkHTTPResponse(cfg, 500, strings.NewReader(`{"ok": true}`)))
+	assert.Error(t, checkHTTPResponse(cfg, 200, strings.NewReader(`{"ok": false}`)))
+
+	// 超过日志保存长度的内容同样参与匹配
+	body := strings.Repeat(` `, maxHTTPResponseLog*2) + `{"ok": true}`
+	assert.NoError(t, checkHTTPResponse(cfg, 200, strings.NewReader(body)))
+	head := &headWriter{limit: maxHTTPResponseLog}
+	assert.NoError(t, checkHTTPResponse(cfg, 200, io.TeeReader(strings.NewReader(body), head)))
+	assert.Equal(t, maxHTTPResponseLog, head.buf.Len())
+	assert.True(t, head.truncated)
+}
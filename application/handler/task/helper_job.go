@@ -0,0 +1,481 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/com"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/engine"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/charset"
+	"github.com/coscms/webcore/library/cron"
+	cronWriter "github.com/coscms/webcore/library/cron/writer"
+)
+
+// proxyJobName 内部使用的系统任务名称。
+// 普通命令任务会被包装成此系统任务来执行，以便在执行前后加入依赖、重试等扩展逻辑
+const proxyJobName = `nging.task.proxy`
+
+var (
+	jobStates   sync.Map // token => *jobState
+	jobStateSeq atomic.Uint64
+	queueLocks  sync.Map // taskID => *sync.Mutex
+)
+
+// 重试间隔
+const (
+	defaultRetryBackoff = 10 * time.Second
+	maxRetryWait        = time.Hour
+)
+
+// ProxyJob 代理执行普通命令任务的系统任务
+var ProxyJob = &cron.Jobx{
+	Name:         proxyJobName,
+	RunnerGetter: proxyRunnerGetter,
+	Description:  `内部使用`,
+}
+
+type jobState struct {
+	ctx       context.Context
+	task      *dbschema.NgingTask
+	command   string
+	env       []string
+	extra     *TaskExtra
+	flow      *flowState     // 由任务链触发时不为nil
+	scheduler *taskScheduler // 由定时任务触发时为所属的调度器
+	status    atomic.Value
+	logID     atomic.Uint64 // 最近一次执行写入的日志ID
+	// nextLive 手动执行时预先创建的实时输出，仅用于下一次执行。其它情况下每次执行各自创建
+	nextLive atomic.Pointer[liveRun]
+}
+
+func (s *jobState) Status() string {
+	v, _ := s.status.Load().(string)
+	return v
+}
+
+func (s *jobState) LogID() uint64 {
+	return s.logID.Load()
+}
+
+// runner 执行任务并写入本次执行的日志，以便实时输出、通知和任务链关联到本次执行的日志。
+// 返回不记录日志的标记，cron.Job不再重复写入
+func (s *jobState) runner(timeout time.Duration) (cmdOut string, cmdErr string, err error, isTimeout bool) {
+	if s.scheduler != nil && !s.scheduler.isLeader() { // 集群中的主节点已变更，本次由新的主节点执行
+		cmdOut = cronWriter.NotRecordPrefixFlag + `当前节点不是主节点，跳过执行`
+		return
+	}
+	if s.extra.overlapPolicy(s.task) == OverlapQueue {
+		v, _ := queueLocks.LoadOrStore(s.task.Id, &sync.Mutex{})
+		mu := v.(*sync.Mutex)
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	live := s.nextLive.Swap(nil)
+	if live == nil {
+		live = newLiveRun(s.task.Id)
+	}
+	notify, e := findTaskNotify(s.task)
+	if e != nil {
+		log.Errorf(`failed to query task(%d) notify: %v`, s.task.Id, e)
+	}
+	var prevStatus string
+	if notify != nil {
+		prevStatus = prevTaskStatus(s.task.Id)
+	}
+	runStarted := time.Now()
+	attempts := int(s.extra.RetryCount) + 1
+	var status string
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		cmdOut, cmdErr, err, isTimeout = s.execute(timeout, live)
+		status = commandStatus(err, isTimeout)
+		reason := endReason(err, isTimeout, timeout)
+		if attempts > 1 {
+			reason = fmt.Sprintf(`第%d/%d次尝试：%s`, attempt, attempts, reason)
+		}
+		if status == `success` || attempt >= attempts || s.ctx.Err() != nil {
+			if status != `success` || attempt > 1 {
+				cmdErr = appendReason(cmdErr, reason)
+			}
+			break
+		}
+		wait := retryBackoff(s.extra.RetryBackoff, attempt)
+		live.write(`stderr`, []byte("\n"+reason+`，`+wait.String()+"后重试\n"))
+		s.recordLog(started, cmdOut, appendReason(cmdErr, reason+`，`+wait.String()+`后重试`), status)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			t.Stop()
+			err = s.ctx.Err()
+			status = `failure`
+			cmdErr = appendReason(``, endReason(err, false, timeout))
+		}
+		if s.ctx.Err() != nil {
+			break
+		}
+	}
+	if s.flow != nil { // 任务链中每次执行都使用单独的jobState
+		s.status.Store(status)
+	}
+	var logID uint64
+	if isLogRecorded(s.task, cmdOut, cmdErr) {
+		logID = s.insertLog(runStarted, cmdOut, cmdErr, status)
+	}
+	s.logID.Store(logID)
+	notifyByMail(s.task, logID, runStarted, err, cmdOut, cmdErr, isTimeout, timeout)
+	notifyRun(s.task, notify, prevStatus, runStarted, status, cmdOut, cmdErr, err, logID)
+	if s.flow == nil && hasDownstream(s.task.Id) {
+		go startFlowRun(s.task.Id, logID, status)
+	}
+	live.finish(logID)
+	return cronWriter.NotRecordPrefixFlag, ``, err, isTimeout
+}
+
+// isLogRecorded 执行结果是否会被记录到任务日志
+func isLogRecorded(task *dbschema.NgingTask, cmdOut string, cmdErr string) bool {
+	return task.ClosedLog == `N` && !strings.HasPrefix(cmdOut, cronWriter.NotRecordPrefixFlag) && !strings.HasPrefix(cmdErr, cronWriter.NotRecordPrefixFlag)
+}
+
+// execute 执行一次命令。HTTP请求任务发送请求；设置了SSH执行目标时在远程主机上执行，否则在本机执行
+func (s *jobState) execute(timeout time.Duration, live *liveRun) (string, string, error, bool) {
+	if s.task.Type == TaskTypeHTTP {
+		return s.runHTTP(timeout, live)
+	}
+	if len(s.extra.SSHUserIds) > 0 {
+		return s.runTargets(timeout, live)
+	}
+	return runCommand(s.ctx, s.task.Id, s.command, s.task.WorkDirectory, timeout, live, s.env...)
+}
+
+// newTaskLog 创建一条执行日志
+func (s *jobState) newTaskLog(started time.Time, cmdOut string, cmdErr string, status string) *dbschema.NgingTaskLog {
+	taskLog := dbschema.NewNgingTaskLog(nil)
+	taskLog.TaskId = s.task.Id
+	taskLog.Output = cmdOut
+	taskLog.Error = cmdErr
+	taskLog.Status = status
+	taskLog.Elapsed = uint(time.Since(started).Milliseconds())
+	taskLog.Created = uint(started.Unix())
+	return taskLog
+}
+
+// insertLog 写入本次执行的最终结果，返回日志ID
+func (s *jobState) insertLog(started time.Time, cmdOut string, cmdErr string, status string) uint64 {
+	taskLog := s.newTaskLog(started, cmdOut, cmdErr, status)
+	if _, err := taskLog.Insert(); err != nil {
+		log.Errorf(`failed to record task(%d) log: %v`, s.task.Id, err)
+		return 0
+	}
+	return taskLog.Id
+}
+
+// recordLog 记录一条执行结果(需要重试的某一次执行或多台主机中某台主机的执行)。最终执行结果由insertLog记录
+func (s *jobState) recordLog(started time.Time, cmdOut string, cmdErr string, status string) {
+	if !isLogRecorded(s.task, cmdOut, cmdErr) {
+		return
+	}
+	if err := insertPartLog(s.newTaskLog(started, cmdOut, cmdErr, status)); err != nil {
+		log.Errorf(`failed to record task(%d) attempt: %v`, s.task.Id, err)
+	}
+}
+
+func commandStatus(err error, isTimeout bool) string {
+	if isTimeout {
+		return `timeout`
+	}
+	if err != nil {
+		return `failure`
+	}
+	return `success`
+}
+
+// endReason 执行结束原因
+func endReason(err error, isTimeout bool, timeout time.Duration) string {
+	if isTimeout {
+		return fmt.Sprintf(`运行超过%d秒，已终止进程`, int64(timeout/time.Second))
+	}
+	if err == nil {
+		return `执行成功`
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return `已取消`
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Sprintf(`进程退出(退出码%d)`, exitErr.ExitCode())
+	}
+	if code, ok := isRemoteExitError(err); ok {
+		return fmt.Sprintf(`进程退出(退出码%d)`, code)
+	}
+	return `执行出错：` + err.Error()
+}
+
+func appendReason(cmdErr string, reason string) string {
+	if len(cmdErr) > 0 {
+		return cmdErr + "\n----------------------\n" + reason
+	}
+	return reason
+}
+
+// retryBackoff 第attempt次执行失败后的等待时间(指数退避)
+func retryBackoff(backoff uint, attempt int) time.Duration {
+	wait := defaultRetryBackoff
+	if backoff > 0 {
+		wait = time.Duration(backoff) * time.Second
+	}
+	for i := 1; i < attempt && wait < maxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+func proxyRunnerGetter(token string) cron.Runner {
+	v, ok := jobStates.LoadAndDelete(token)
+	if !ok {
+		return func(_ time.Duration) (string, string, error, bool) {
+			return ``, ``, fmt.Errorf(`invalid job token: %s`, token), false
+		}
+	}
+	return v.(*jobState).runner
+}
+
+func isSystemCommand(command string) bool {
+	return len(command) > 1 && command[0] == '>'
+}
+
+// listSystemJobs 列出可供选择的系统任务(不含内部使用的任务)
+func listSystemJobs() echo.KVList {
+	systemJobs := cron.ListSystemJobs()
+	list := make(echo.KVList, 0, len(systemJobs))
+	for _, sj := range systemJobs {
+		if sj.K == proxyJobName {
+			continue
+		}
+		list = append(list, sj)
+	}
+	return list
+}
+
+// newJob 根据任务创建Job。普通命令任务由本模块的执行器代理执行
+func newJob(ctx context.Context, task *dbschema.NgingTask) (*cron.Job, *jobState, error) {
+	if isSystemCommand(task.Command) {
+		job, err := cron.NewJobFromTask(ctx, task)
+		return job, nil, err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	extra, err := getTaskExtra(task.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := &jobState{ctx: ctx, task: task, command: task.Command, extra: extra}
+	task.Env = strings.TrimSpace(task.Env)
+	if len(task.Env) > 0 {
+		for _, row := range strings.Split(task.Env, "\n") {
+			row = strings.TrimSpace(row)
+			if len(row) > 0 {
+				state.env = append(state.env, row)
+			}
+		}
+	}
+	if task.GroupId > 0 {
+		group := dbschema.NewNgingTaskGroup(task.Context())
+		err := group.Get(nil, `id`, task.GroupId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(group.CmdPrefix) > 0 {
+			state.command = group.CmdPrefix + ` ` + state.command
+		}
+		if len(group.CmdSuffix) > 0 {
+			state.command += ` ` + group.CmdSuffix
+		}
+	}
+	token := param.AsString(jobStateSeq.Add(1))
+	jobStates.Store(token, state)
+	jobTask := *task
+	jobTask.Command = `>` + proxyJobName + `:` + token
+	jobTask.EnableNotify = cron.NotifyDisabled // 邮件通知由执行器在写入日志后发送
+	job, err := cron.NewJobFromTask(ctx, &jobTask)
+	jobStates.Delete(token)
+	return job, state, err
+}
+
+// addJob 添加到本节点的定时任务
+func addJob(ctx context.Context, task *dbschema.NgingTask) (bool, error) {
+	return defaultScheduler.addJob(ctx, task)
+}
+
+// addJob 添加到定时任务。有上游任务的任务由上游任务触发执行，不加入定时任务
+// 调用前须已保存任务的启用状态：集群中的非主节点只通知主节点从数据库重新加载
+func (s *taskScheduler) addJob(ctx context.Context, task *dbschema.NgingTask) (bool, error) {
+	upstreamIDs, err := listUpstreamIDs(task.Id)
+	if err != nil {
+		return false, err
+	}
+	if len(upstreamIDs) > 0 {
+		return true, nil
+	}
+	if !s.isLeader() { // 集群中由主节点加载
+		s.scheduleChanged()
+		return true, nil
+	}
+	extra, err := getTaskExtra(task.Id)
+	if err != nil {
+		return false, err
+	}
+	job, err := s.newJob(ctx, task)
+	if err != nil {
+		return false, err
+	}
+	return s.addEntry(cronSpecWithTimezone(task.CronSpec, extra.Timezone), job), nil
+}
+
+// newJob 创建由本调度器触发的Job
+func (s *taskScheduler) newJob(ctx context.Context, task *dbschema.NgingTask) (*cron.Job, error) {
+	job, state, err := newJob(ctx, task)
+	if state != nil {
+		state.scheduler = s
+	}
+	return job, err
+}
+
+func initJobs(ctx context.Context) error {
+	return defaultScheduler.loadJobs(ctx)
+}
+
+// loadJobs 加载全部启用的定时任务
+func (s *taskScheduler) loadJobs(ctx context.Context) error {
+	m := new(dbschema.NgingTask)
+	limit := 1000
+	cnt, err := m.ListByOffset(nil, nil, 0, limit, `disabled`, `N`)
+	if err != nil {
+		return fmt.Errorf(`failed to query nging_task list: %w`, err)
+	}
+	total := int(cnt())
+	for offset := 0; offset < total; offset += limit {
+		if offset > 0 {
+			_, err := m.ListByOffset(nil, nil, offset, limit, `disabled`, `N`)
+			if err != nil {
+				return err
+			}
+		}
+		for _, task := range m.Objects() {
+			if err := cron.SaveScriptFile(task); err != nil {
+				log.Errorf(`failed to SaveScriptFile(%d): %v`, task.Id, err)
+			}
+			if _, err := s.addJob(ctx, task); err != nil {
+				log.Errorf(`failed to task.initJobs(%d): %v`, task.Id, err)
+			}
+		}
+	}
+	if err := registerNotifyTopics(); err != nil {
+		log.Errorf(`failed to register task notify topics: %v`, err)
+	}
+	s.running.Store(true)
+	return nil
+}
+
+func closeJobs() {
+	defaultScheduler.closeJobs()
+}
+
+func runCommand(ctx context.Context, id uint, command string, dir string, timeout time.Duration, live *liveRun, env ...string) (string, string, error, bool) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	bufOut := cron.NewOutputWriter()
+	bufErr := cron.NewOutputWriter()
+	params := cron.CmdParams(cron.ScriptCommand(id, command))
+	cmd := exec.Command(params[0], params[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if live != nil {
+		cmd.Stdout = io.MultiWriter(bufOut, live.Writer(`stdout`))
+		cmd.Stderr = io.MultiWriter(bufErr, live.Writer(`stderr`))
+	} else {
+		cmd.Stdout = bufOut
+		cmd.Stderr = bufErr
+	}
+	cmd.WaitDelay = time.Second * 5
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return ``, ``, err, false
+	}
+	err, isTimeout := waitCommand(ctx, cmd, timeout)
+	if com.IsWindows {
+		bOut, e := charset.Convert(`gbk`, `utf-8`, bufOut.Bytes())
+		if e != nil {
+			log.Errorf(`failed to charset.Convert(bufOut, gbk, utf-8): %v`, e)
+		}
+		bErr, e := charset.Convert(`gbk`, `utf-8`, bufErr.Bytes())
+		if e != nil {
+			log.Errorf(`failed to charset.Convert(bufErr, gbk, utf-8): %v`, e)
+		}
+		return engine.Bytes2str(bOut), engine.Bytes2str(bErr), err, isTimeout
+	}
+	return bufOut.String(), bufErr.String(), err, isTimeout
+}
+
+func waitCommand(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) (error, bool) {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	kill := func() {
+		if err = killProcessTree(cmd); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			log.Errorf("进程[%d]无法关闭, 错误信息: %s", cmd.Process.Pid, err)
+		}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		log.Warnf("任务执行时间超过%d秒，强制关闭进程: %d", int(timeout/time.Second), cmd.Process.Pid)
+		kill()
+		<-done
+		return err, true
+	case <-ctx.Done():
+		kill()
+		<-done
+		return ctx.Err(), false
+	case err = <-done:
+		return err, false
+	}
+}
@@ -0,0 +1,175 @@
+package task
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/db/sqlite"
+	"github.com/webx-top/echo"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cron"
+	"github.com/coscms/webcore/library/notice"
+)
+
+var testTaskTables = []string{
+	"CREATE TABLE `nging_task` (`id` integer PRIMARY KEY AUTOINCREMENT, `uid` int NOT NULL DEFAULT 0, `group_id` int NOT NULL DEFAULT 0, `name` varchar(50) NOT NULL DEFAULT '', `type` int NOT NULL DEFAULT 0, `description` varchar(200) NOT NULL DEFAULT '', `cron_spec` varchar(100) NOT NULL DEFAULT '', `concurrent` int NOT NULL DEFAULT 0, `command` text NOT NULL DEFAULT '', `work_directory` varchar(255) NOT NULL DEFAULT '', `env` text NOT NULL DEFAULT '', `disabled` varchar(1) NOT NULL DEFAULT 'N', `enable_notify` int NOT NULL DEFAULT 0, `notify_email` text NOT NULL DEFAULT '', `timeout` bigint NOT NULL DEFAULT 0, `execute_times` int NOT NULL DEFAULT 0, `prev_time` int NOT NULL DEFAULT 0, `created` int NOT NULL DEFAULT 0, `updated` int NOT NULL DEFAULT 0, `closed_log` varchar(1) NOT NULL DEFAULT 'N')",
+	"CREATE TABLE `nging_task_group` (`id` integer PRIMARY KEY AUTOINCREMENT, `uid` int NOT NULL DEFAULT 0, `name` varchar(60) NOT NULL DEFAULT '', `description` varchar(255) NOT NULL DEFAULT '', `created` int NOT NULL DEFAULT 0, `updated` int NOT NULL DEFAULT 0, `cmd_prefix` varchar(255) NOT NULL DEFAULT '', `cmd_suffix` varchar(255) NOT NULL DEFAULT '')",
+	"CREATE TABLE `nging_task_log` (`id` integer PRIMARY KEY AUTOINCREMENT, `task_id` int NOT NULL DEFAULT 0, `output` text NOT NULL DEFAULT '', `error` text NOT NULL DEFAULT '', `status` varchar(10) NOT NULL DEFAULT 'success', `elapsed` int NOT NULL DEFAULT 0, `created` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_extra` (`task_id` int NOT NULL PRIMARY KEY, `upstream_failure` varchar(10) NOT NULL DEFAULT 'skip', `retry_count` int NOT NULL DEFAULT 0, `retry_backoff` int NOT NULL DEFAULT 0, `overlap_policy` varchar(10) NOT NULL DEFAULT 'skip', `ssh_user_ids` varchar(255) NOT NULL DEFAULT '', `fan_out` varchar(10) NOT NULL DEFAULT 'sequential', `timezone` varchar(64) NOT NULL DEFAULT '', `updated` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_dependency` (`id` integer PRIMARY KEY AUTOINCREMENT, `task_id` int NOT NULL, `upstream_id` int NOT NULL, `created` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_flow_run` (`id` integer PRIMARY KEY AUTOINCREMENT, `root_task_id` int NOT NULL DEFAULT 0, `root_log_id` bigint NOT NULL DEFAULT 0, `status` varchar(10) NOT NULL DEFAULT 'running', `created` int NOT NULL DEFAULT 0, `finished` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_flow_node` (`id` integer PRIMARY KEY AUTOINCREMENT, `run_id` bigint NOT NULL, `task_id` int NOT NULL, `log_id` bigint NOT NULL DEFAULT 0, `status` varchar(10) NOT NULL DEFAULT 'success', `reason` varchar(255) NOT NULL DEFAULT '', `created` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_log_retention` (`id` integer PRIMARY KEY AUTOINCREMENT, `group_id` int NOT NULL DEFAULT 0, `task_id` int NOT NULL DEFAULT 0, `keep_runs` int NOT NULL DEFAULT 0, `keep_days` int NOT NULL DEFAULT 0, `keep_failure_days` int NOT NULL DEFAULT 0, `updated` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_notify` (`id` integer PRIMARY KEY AUTOINCREMENT, `group_id` int NOT NULL DEFAULT 0, `task_id` int NOT NULL DEFAULT 0, `topic` varchar(100) NOT NULL DEFAULT '', `events` varchar(100) NOT NULL DEFAULT '', `title_template` varchar(255) NOT NULL DEFAULT '', `content_template` text NOT NULL DEFAULT '', `updated` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_log_node` (`log_id` bigint NOT NULL PRIMARY KEY, `task_id` int NOT NULL DEFAULT 0, `node` varchar(150) NOT NULL DEFAULT '', `created` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_log_part` (`log_id` bigint NOT NULL PRIMARY KEY, `task_id` int NOT NULL DEFAULT 0, `created` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_http` (`task_id` int NOT NULL PRIMARY KEY, `method` varchar(10) NOT NULL DEFAULT 'GET', `url` varchar(2000) NOT NULL DEFAULT '', `headers` text NOT NULL DEFAULT '', `body` text NOT NULL DEFAULT '', `expect_status` varchar(100) NOT NULL DEFAULT '', `expect_body` varchar(500) NOT NULL DEFAULT '', `insecure` varchar(1) NOT NULL DEFAULT 'N', `updated` int NOT NULL DEFAULT 0)",
+	"CREATE TABLE `nging_task_ssh_host_key` (`address` varchar(255) NOT NULL PRIMARY KEY, `key_type` varchar(50) NOT NULL DEFAULT '', `public_key` text NOT NULL DEFAULT '', `fingerprint` varchar(100) NOT NULL DEFAULT '', `created` int NOT NULL DEFAULT 0)",
+}
+
+// useTestDB 使用sqlite数据库执行测试，测试结束后恢复
+func useTestDB(t *testing.T) {
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: filepath.Join(t.TempDir(), `task.db`)})
+	require.NoError(t, err)
+	for _, ddl := range testTaskTables {
+		_, err = sess.Exec(ddl)
+		require.NoError(t, err)
+	}
+	old := factory.DefaultFactory
+	factory.DefaultFactory = factory.New().AddDB(sess)
+	ProxyJob.Register()
+	t.Cleanup(func() {
+		factory.DefaultFactory = old
+		sess.Close()
+	})
+}
+
+func addTestTask(t *testing.T, command string) *dbschema.NgingTask {
+	task := dbschema.NewNgingTask(nil)
+	task.Name = `test`
+	task.Command = command
+	task.ClosedLog = `N`
+	task.Disabled = `N`
+	_, err := task.Insert()
+	require.NoError(t, err)
+	return task
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, retryBackoff(0, 1))
+	assert.Equal(t, 20*time.Second, retryBackoff(0, 2))
+	assert.Equal(t, 12*time.Second, retryBackoff(3, 3))
+	assert.Equal(t, time.Hour, retryBackoff(3000, 5))
+}
+
+func TestLiveOutputEveryRun(t *testing.T) {
+	useTestDB(t)
+	task := addTestTask(t, `sleep 1; echo live-output`)
+	job, _, err := newJob(context.Background(), task)
+	require.NoError(t, err)
+	job.Run()
+	assert.Empty(t, listLiveRuns(task.Id))
+
+	// 同一个Job再次执行时，页面仍然能收到本次的输出
+	closeGetter, msgs, err := notice.Default().MakeMessageGetter(`tester`, liveNoticeType)
+	require.NoError(t, err)
+	defer closeGetter()
+	done := make(chan struct{})
+	go func() {
+		job.Run()
+		close(done)
+	}()
+	defer func() { <-done }()
+	var run *liveRun
+	require.Eventually(t, func() bool {
+		runs := listLiveRuns(task.Id)
+		if len(runs) == 0 {
+			return false
+		}
+		run = runs[0]
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	run.Subscribe(`tester`)
+	var output string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-msgs:
+			content, ok := msg.Content.(echo.H)
+			if !ok || content[`runId`] != run.ID {
+				continue
+			}
+			if chunks, ok := content[`chunks`].([]liveChunk); ok {
+				for _, chunk := range chunks {
+					output += chunk.Text
+				}
+			}
+			if content[`done`] == true {
+				assert.True(t, strings.Contains(output, `live-output`), output)
+				assert.NotZero(t, content[`logId`])
+				return
+			}
+		case <-timeout:
+			t.Fatalf(`no output received, got: %q`, output)
+		}
+	}
+}
+
+func TestOverlapPolicies(t *testing.T) {
+	useTestDB(t)
+	cron.Initial(2) // 执行池至少能同时执行两次
+	cases := map[string]string{
+		OverlapSkip:  `start,end`,
+		OverlapQueue: `start,end,start,end`,
+		OverlapAllow: `start,start,end,end`,
+	}
+	for policy, expected := range cases {
+		t.Run(policy, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), `events`)
+			task := addTestTask(t, `echo start >> '`+file+`'; sleep 1; echo end >> '`+file+`'`)
+			extra := &TaskExtra{TaskId: task.Id, OverlapPolicy: policy}
+			applyOverlapPolicy(task, extra)
+			require.NoError(t, saveTaskExtra(nil, extra))
+			job, _, err := newJob(context.Background(), task)
+			require.NoError(t, err)
+
+			// 第一次执行开始后再触发第二次执行
+			wg := sync.WaitGroup{}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				job.Run()
+			}()
+			require.Eventually(t, func() bool {
+				b, _ := os.ReadFile(file)
+				return len(b) > 0
+			}, 5*time.Second, 10*time.Millisecond)
+			go func() {
+				defer wg.Done()
+				job.Run()
+			}()
+			wg.Wait()
+
+			b, err := os.ReadFile(file)
+			require.NoError(t, err)
+			assert.Equal(t, expected, strings.Join(strings.Fields(string(b)), `,`))
+			n, err := dbschema.NewNgingTaskLog(nil).Count(nil, db.And(db.Cond{`task_id`: task.Id}, db.Cond{`output`: db.Like(`%上一次执行尚未结束%`)}))
+			require.NoError(t, err)
+			if policy == OverlapSkip {
+				assert.NotZero(t, n)
+			} else {
+				assert.Zero(t, n)
+			}
+		})
+	}
+}
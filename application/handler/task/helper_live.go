@@ -0,0 +1,227 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/library/notice"
+)
+
+// liveNoticeType 实时输出使用的消息类型
+const liveNoticeType = `taskOutput`
+
+const (
+	liveFlushInterval = 500 * time.Millisecond
+	liveMaxBuffered   = 512 * 1024 // 为后打开页面的用户保留的最大输出字节数
+	liveKeepAfterDone = time.Minute
+)
+
+var (
+	liveRuns   = map[string]*liveRun{}
+	liveRunsMu sync.RWMutex
+	liveRunSeq uint64
+)
+
+// liveRun 正在执行的任务的实时输出
+type liveRun struct {
+	ID      string
+	TaskID  uint
+	Started time.Time
+
+	mu      sync.Mutex
+	users   map[string]struct{}
+	out     []byte // 已输出内容(超过liveMaxBuffered时只保留最后部分)
+	pending []liveChunk
+	done    bool
+	logID   uint64
+	stop    chan struct{}
+}
+
+type liveChunk struct {
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+func newLiveRun(taskID uint) *liveRun {
+	liveRunsMu.Lock()
+	liveRunSeq++
+	r := &liveRun{
+		ID:      param.AsString(liveRunSeq),
+		TaskID:  taskID,
+		Started: time.Now(),
+		users:   map[string]struct{}{},
+		stop:    make(chan struct{}),
+	}
+	liveRuns[r.ID] = r
+	liveRunsMu.Unlock()
+	go r.flushLoop()
+	return r
+}
+
+func getLiveRun(id string) *liveRun {
+	liveRunsMu.RLock()
+	defer liveRunsMu.RUnlock()
+	return liveRuns[id]
+}
+
+// listLiveRuns 列出任务正在执行的实例
+func listLiveRuns(taskID uint) []*liveRun {
+	liveRunsMu.RLock()
+	list := []*liveRun{}
+	for _, r := range liveRuns {
+		if r.TaskID == taskID && !r.Done() {
+			list = append(list, r)
+		}
+	}
+	liveRunsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// Subscribe 订阅实时输出，返回已有的输出内容。
+// 尚未推送的输出会在下一次推送时发给新订阅者，不包含在返回内容中
+func (r *liveRun) Subscribe(user string) string {
+	notice.OpenMessage(user, liveNoticeType)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[user] = struct{}{}
+	end := len(r.out)
+	for _, chunk := range r.pending {
+		end -= len(chunk.Text)
+	}
+	if end <= 0 {
+		return ``
+	}
+	return string(r.out[:end])
+}
+
+func (r *liveRun) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done
+}
+
+func (r *liveRun) LogID() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.logID
+}
+
+func (r *liveRun) Writer(stream string) io.Writer {
+	return &liveWriter{run: r, stream: stream}
+}
+
+func (r *liveRun) write(stream string, p []byte) {
+	r.mu.Lock()
+	r.out = append(r.out, p...)
+	if over := len(r.out) - liveMaxBuffered; over > 0 {
+		for over < len(r.out) && !utf8.RuneStart(r.out[over]) { // 不截断多字节字符
+			over++
+		}
+		r.out = append(r.out[:0], r.out[over:]...)
+	}
+	if len(r.users) > 0 {
+		n := len(r.pending)
+		if n > 0 && r.pending[n-1].Stream == stream {
+			r.pending[n-1].Text += string(p)
+		} else {
+			r.pending = append(r.pending, liveChunk{Stream: stream, Text: string(p)})
+		}
+	}
+	r.mu.Unlock()
+}
+
+func (r *liveRun) flushLoop() {
+	t := time.NewTicker(liveFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.flush()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *liveRun) flush() {
+	r.mu.Lock()
+	chunks := r.pending
+	r.pending = nil
+	users := make([]string, 0, len(r.users))
+	for user := range r.users {
+		users = append(users, user)
+	}
+	r.mu.Unlock()
+	if len(chunks) == 0 {
+		return
+	}
+	r.send(users, echo.H{`runId`: r.ID, `taskId`: r.TaskID, `chunks`: chunks})
+}
+
+func (r *liveRun) send(users []string, content echo.H) {
+	for _, user := range users {
+		msg := notice.NewMessageWithValue(liveNoticeType, ``, content)
+		msg.SetID(r.ID).SetMode(`element`)
+		notice.Send(user, msg)
+	}
+}
+
+// finish 推送剩余输出和结束消息
+func (r *liveRun) finish(logID uint64) {
+	r.mu.Lock()
+	if r.done {
+		r.mu.Unlock()
+		return
+	}
+	r.done = true
+	r.logID = logID
+	r.mu.Unlock()
+	close(r.stop)
+	r.flush()
+	r.mu.Lock()
+	users := make([]string, 0, len(r.users))
+	for user := range r.users {
+		users = append(users, user)
+	}
+	r.mu.Unlock()
+	r.send(users, echo.H{`runId`: r.ID, `taskId`: r.TaskID, `done`: true, `logId`: logID})
+	time.AfterFunc(liveKeepAfterDone, func() {
+		liveRunsMu.Lock()
+		delete(liveRuns, r.ID)
+		liveRunsMu.Unlock()
+	})
+}
+
+type liveWriter struct {
+	run    *liveRun
+	stream string
+}
+
+func (w *liveWriter) Write(p []byte) (int, error) {
+	w.run.write(w.stream, p)
+	return len(p), nil
+}
@@ -0,0 +1,24 @@
+package task
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveRunBuffer(t *testing.T) {
+	r := &liveRun{users: map[string]struct{}{}}
+	r.write(`stdout`, []byte(`a`+strings.Repeat(`中`, liveMaxBuffered/3)))
+	assert.True(t, utf8.Valid(r.out))
+	assert.LessOrEqual(t, len(r.out), liveMaxBuffered)
+
+	// 新订阅者不会重复收到尚未推送的输出
+	r = &liveRun{users: map[string]struct{}{}}
+	r.write(`stdout`, []byte(`before`))
+	assert.Equal(t, `before`, r.Subscribe(`first`))
+	r.write(`stdout`, []byte(`after`))
+	assert.Equal(t, `before`, r.Subscribe(`second`))
+	assert.Equal(t, []liveChunk{{Stream: `stdout`, Text: `after`}}, r.pending)
+}
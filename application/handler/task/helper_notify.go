@@ -0,0 +1,513 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/defaults"
+	"github.com/webx-top/echo/middleware/tplfunc"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/cron"
+	"github.com/coscms/webcore/library/cron/send"
+	"github.com/coscms/webcore/library/httpserver"
+	"github.com/coscms/webcore/registry/alert"
+)
+
+const tableTaskNotify = `nging_task_notify`
+
+// 通知事件
+const (
+	NotifyEventFailure  = `failure`  // 执行失败
+	NotifyEventTimeout  = `timeout`  // 执行超时
+	NotifyEventRecovery = `recovery` // 失败或超时后恢复成功
+	NotifyEventSuccess  = `success`  // 执行成功
+)
+
+// NotifyEvents 通知事件
+var NotifyEvents = echo.NewKVData().
+	Add(NotifyEventFailure, `失败`).
+	Add(NotifyEventTimeout, `超时`).
+	Add(NotifyEventRecovery, `恢复`).
+	Add(NotifyEventSuccess, `成功`)
+
+// 通知内容中输出和错误信息的最大长度
+const (
+	notifyTailLines = 20
+	notifyTailBytes = 2000
+)
+
+var notifyTopicRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,100}$`)
+
+// DefaultNotifyTitle 默认的通知标题模板
+const DefaultNotifyTitle = `任务{{.EventName}}通知 #{{.Task.Id}}: {{.Task.Name}}`
+
+// DefaultNotifyContent 默认的通知内容模板
+const DefaultNotifyContent = `任务：{{.Task.Name}} (#{{.Task.Id}})
+事件：{{.EventName}}
+{{- if ge .ExitCode 0}}
+退出码：{{.ExitCode}}
+{{- end}}
+开始时间：{{.StartTime}}
+耗时：{{.Duration}}
+{{- if .Error}}
+错误信息：
+{{.Error}}
+{{- end}}
+{{- if .Output}}
+输出(末尾)：
+{{.Output}}
+{{- end}}
+{{- if .LogURL}}
+详情：{{.LogURL}}
+{{- end}}`
+
+// TaskNotify 任务通知规则。任务的规则优先于分组的规则
+type TaskNotify struct {
+	Id              uint   `db:"id,omitempty,pk" json:"id" xml:"id"`
+	GroupId         uint   `db:"group_id" json:"group_id" xml:"group_id"`
+	TaskId          uint   `db:"task_id" json:"task_id" xml:"task_id"`
+	Topic           string `db:"topic" json:"topic" xml:"topic"`
+	Events          string `db:"events" json:"events" xml:"events"`
+	TitleTemplate   string `db:"title_template" json:"title_template" xml:"title_template"`
+	ContentTemplate string `db:"content_template" json:"content_template" xml:"content_template"`
+	Updated         uint   `db:"updated" json:"updated" xml:"updated"`
+}
+
+// IsEmpty 是否未设置通知
+func (r *TaskNotify) IsEmpty() bool {
+	return len(r.Topic) == 0
+}
+
+// HasEvent 是否订阅了指定事件
+func (r *TaskNotify) HasEvent(event string) bool {
+	for _, v := range strings.Split(r.Events, `,`) {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *TaskNotify) titleTemplate() string {
+	if len(r.TitleTemplate) > 0 {
+		return r.TitleTemplate
+	}
+	return DefaultNotifyTitle
+}
+
+func (r *TaskNotify) contentTemplate() string {
+	if len(r.ContentTemplate) > 0 {
+		return r.ContentTemplate
+	}
+	return DefaultNotifyContent
+}
+
+// validate 校验主题、事件和模板
+func (r *TaskNotify) validate() error {
+	if r.IsEmpty() {
+		return nil
+	}
+	if !notifyTopicRegexp.MatchString(r.Topic) {
+		return fmt.Errorf(`无效的通知专题：%s`, r.Topic)
+	}
+	if len(r.Events) == 0 {
+		return fmt.Errorf(`请选择通知事件`)
+	}
+	for _, v := range strings.Split(r.Events, `,`) {
+		if !NotifyEvents.Has(v) {
+			return fmt.Errorf(`无效的通知事件：%s`, v)
+		}
+	}
+	if _, err := template.New(`title`).Parse(r.titleTemplate()); err != nil {
+		return fmt.Errorf(`通知标题模板有误：%v`, err)
+	}
+	if _, err := template.New(`content`).Parse(r.contentTemplate()); err != nil {
+		return fmt.Errorf(`通知内容模板有误：%v`, err)
+	}
+	return nil
+}
+
+func taskNotifyCond(groupID uint, taskID uint) db.Cond {
+	return db.Cond{`group_id`: groupID, `task_id`: taskID}
+}
+
+func getTaskNotify(groupID uint, taskID uint) (*TaskNotify, error) {
+	row := &TaskNotify{}
+	err := newParam(tableTaskNotify).SetArgs(taskNotifyCond(groupID, taskID)).SetRecv(row).One()
+	if err != nil {
+		if err != db.ErrNoMoreRows {
+			return nil, err
+		}
+		err = nil
+	}
+	row.GroupId = groupID
+	row.TaskId = taskID
+	return row, err
+}
+
+// saveTaskNotify 保存通知规则，未设置专题时删除
+func saveTaskNotify(tx factory.Transactioner, row *TaskNotify) error {
+	cond := taskNotifyCond(row.GroupId, row.TaskId)
+	if row.IsEmpty() {
+		return newParam(tableTaskNotify).SetTrans(tx).SetArgs(cond).Delete()
+	}
+	row.Updated = uint(time.Now().Unix())
+	exists, err := newParam(tableTaskNotify).SetTrans(tx).SetArgs(cond).Exists()
+	if err != nil {
+		return err
+	}
+	registerNotifyTopic(row.Topic)
+	if exists {
+		return newParam(tableTaskNotify).SetTrans(tx).SetArgs(cond).SetSend(echo.H{
+			`topic`:            row.Topic,
+			`events`:           row.Events,
+			`title_template`:   row.TitleTemplate,
+			`content_template`: row.ContentTemplate,
+			`updated`:          row.Updated,
+		}).Update()
+	}
+	_, err = newParam(tableTaskNotify).SetTrans(tx).SetSend(row).Insert()
+	return err
+}
+
+func deleteTaskNotify(groupID uint, taskID uint) error {
+	return newParam(tableTaskNotify).SetArgs(taskNotifyCond(groupID, taskID)).Delete()
+}
+
+func bindTaskNotify(ctx echo.Context, groupID uint, taskID uint) (*TaskNotify, error) {
+	var events []string
+	for _, v := range ctx.FormValues(`notifyEvents`) {
+		if NotifyEvents.Has(v) {
+			events = append(events, v)
+		}
+	}
+	row := &TaskNotify{
+		GroupId:         groupID,
+		TaskId:          taskID,
+		Topic:           strings.TrimSpace(ctx.Form(`notifyTopic`)),
+		Events:          strings.Join(events, `,`),
+		TitleTemplate:   strings.TrimSpace(ctx.Form(`notifyTitle`)),
+		ContentTemplate: strings.TrimSpace(ctx.Form(`notifyContent`)),
+	}
+	if err := row.validate(); err != nil {
+		return nil, ctx.NewError(code.InvalidParameter, err.Error()).SetZone(`notifyTopic`)
+	}
+	return row, nil
+}
+
+func setTaskNotifyForm(ctx echo.Context, row *TaskNotify) {
+	form := ctx.Request().Form()
+	form.Set(`notifyTopic`, row.Topic)
+	form.Del(`notifyEvents`)
+	if len(row.Events) > 0 {
+		for _, v := range strings.Split(row.Events, `,`) {
+			form.Add(`notifyEvents`, v)
+		}
+	}
+	form.Set(`notifyTitle`, row.TitleTemplate)
+	form.Set(`notifyContent`, row.ContentTemplate)
+}
+
+// setTaskNotifyFormData 设置通知规则表单需要的数据
+func setTaskNotifyFormData(ctx echo.Context) {
+	events := ctx.FormValues(`notifyEvents`)
+	if !ctx.IsPost() && len(ctx.Form(`notifyTopic`)) == 0 && len(events) == 0 {
+		events = []string{NotifyEventFailure, NotifyEventTimeout, NotifyEventRecovery}
+	}
+	ctx.Set(`notifyEvents`, NotifyEvents.Slice())
+	ctx.Set(`notifyTopics`, alert.Topics.Slice())
+	ctx.Set(`defaultNotifyTitle`, DefaultNotifyTitle)
+	ctx.Set(`defaultNotifyContent`, DefaultNotifyContent)
+	ctx.SetFunc(`isNotifyEvent`, func(event string) bool {
+		for _, v := range events {
+			if v == event {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func listTaskNotifies() (byGroup map[uint]*TaskNotify, byTask map[uint]*TaskNotify, err error) {
+	var rows []*TaskNotify
+	err = newParam(tableTaskNotify).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return
+	}
+	err = nil
+	byGroup = map[uint]*TaskNotify{}
+	byTask = map[uint]*TaskNotify{}
+	for _, row := range rows {
+		if row.TaskId > 0 {
+			byTask[row.TaskId] = row
+		} else if row.GroupId > 0 {
+			byGroup[row.GroupId] = row
+		}
+	}
+	return
+}
+
+var notifyTopicsMu sync.Mutex
+
+// registerNotifyTopic 注册告警专题，以便在“警报接收人”中为它设置接收人
+func registerNotifyTopic(topic string) {
+	notifyTopicsMu.Lock()
+	defer notifyTopicsMu.Unlock()
+	if !alert.Topics.Has(topic) {
+		alert.Topics.Add(topic, `定时任务：`+topic)
+	}
+}
+
+// registerNotifyTopics 注册所有通知规则使用的告警专题
+func registerNotifyTopics() error {
+	var rows []*TaskNotify
+	err := newParam(tableTaskNotify).SetRecv(&rows).SetMiddleware(func(r db.Result) db.Result {
+		return r.Select(`topic`).Group(`topic`)
+	}).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return err
+	}
+	for _, row := range rows {
+		registerNotifyTopic(row.Topic)
+	}
+	return nil
+}
+
+// findTaskNotify 获取任务生效的通知规则，没有时返回nil
+func findTaskNotify(task *dbschema.NgingTask) (*TaskNotify, error) {
+	row, err := getTaskNotify(0, task.Id)
+	if err != nil || !row.IsEmpty() {
+		return row, err
+	}
+	if task.GroupId > 0 {
+		row, err = getTaskNotify(task.GroupId, 0)
+		if err != nil || !row.IsEmpty() {
+			return row, err
+		}
+	}
+	return nil, nil
+}
+
+// notifyEvent 根据本次和上次的执行状态确定通知事件
+func notifyEvent(status string, prevStatus string) string {
+	switch status {
+	case `success`:
+		if prevStatus == `failure` || prevStatus == `timeout` {
+			return NotifyEventRecovery
+		}
+		return NotifyEventSuccess
+	case `timeout`:
+		return NotifyEventTimeout
+	default:
+		return NotifyEventFailure
+	}
+}
+
+// exitCode 获取进程退出码，无法获取时返回-1
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if code, ok := isRemoteExitError(err); ok {
+		return code
+	}
+	return -1
+}
+
+// tailText 获取文本末尾的若干行
+func tailText(s string) string {
+	s = strings.TrimRight(s, "\r\n\t ")
+	if len(s) > notifyTailBytes {
+		s = s[len(s)-notifyTailBytes:]
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		}
+		s = `...` + "\n" + strings.ToValidUTF8(s, ``)
+	}
+	lines := strings.Split(s, "\n")
+	if len(lines) > notifyTailLines {
+		s = `...` + "\n" + strings.Join(lines[len(lines)-notifyTailLines:], "\n")
+	}
+	return s
+}
+
+// NotifyData 通知模板中可以使用的数据
+type NotifyData struct {
+	Task       *dbschema.NgingTask
+	Event      string
+	EventName  string
+	Status     string
+	PrevStatus string
+	ExitCode   int
+	StartTime  string
+	Duration   time.Duration
+	Output     string // 输出的末尾部分
+	Error      string // 错误信息的末尾部分
+	LogID      uint64
+	LogURL     string
+}
+
+var lastStatuses sync.Map // taskID => status
+
+// sendNotify 发送任务通知
+var sendNotify = sendTaskNotify
+
+// prevTaskStatus 上次执行的状态
+func prevTaskStatus(taskID uint) string {
+	if v, ok := lastStatuses.Load(taskID); ok {
+		return v.(string)
+	}
+	return latestLogStatus(taskID)
+}
+
+// notifyRun 任务执行结束并写入日志后调用，订阅了本次的事件时发送通知。logID为本次执行的日志ID，不写日志时为0
+func notifyRun(task *dbschema.NgingTask, rule *TaskNotify, prevStatus string, started time.Time, status string, cmdOut string, cmdErr string, err error, logID uint64) {
+	lastStatuses.Store(task.Id, status)
+	if rule == nil {
+		return
+	}
+	event := notifyEvent(status, prevStatus)
+	if !rule.HasEvent(event) {
+		return
+	}
+	data := &NotifyData{
+		Task:       task,
+		Event:      event,
+		EventName:  NotifyEvents.Get(event),
+		Status:     status,
+		PrevStatus: prevStatus,
+		ExitCode:   exitCode(err),
+		StartTime:  started.Format(time.DateTime),
+		Duration:   time.Since(started).Round(time.Millisecond),
+		Output:     tailText(cmdOut),
+		Error:      tailText(cmdErr),
+		LogID:      logID,
+	}
+	if status == `timeout` {
+		data.ExitCode = -1
+	}
+	go sendNotify(rule, data)
+}
+
+// notifyByMail 按任务的邮件通知设置发送执行结果。内容与cron.Job发送的相同，链接到本次执行的日志
+func notifyByMail(task *dbschema.NgingTask, logID uint64, started time.Time, err error, cmdOut string, cmdErr string, isTimeout bool, timeout time.Duration) {
+	switch task.EnableNotify {
+	case cron.NotifyIfFail:
+		if err == nil {
+			return
+		}
+	case cron.NotifyIfEnd:
+	default:
+		return
+	}
+	out := cmdErr
+	if len(out) == 0 {
+		out = cmdOut
+	}
+	var title, status, statusText string
+	if isTimeout {
+		title = fmt.Sprintf("任务执行结果通知 #%d: %s", task.Id, "超时")
+		status = `timeout`
+		statusText = fmt.Sprintf("超时（%d秒）", int(timeout/time.Second))
+	} else if err != nil {
+		title = fmt.Sprintf("任务执行结果通知 #%d: %s", task.Id, "失败")
+		status = `failure`
+		statusText = "失败（" + err.Error() + "）"
+	} else {
+		title = fmt.Sprintf("任务执行结果通知 #%d: %s", task.Id, "成功")
+		status = `success`
+		statusText = "成功"
+	}
+	data := param.Store{
+		"task":       *task,
+		"startTime":  started.Format(time.DateTime),
+		"elapsed":    tplfunc.NumberTrim(float64(time.Since(started).Milliseconds())/1000, 6),
+		"output":     out,
+		"title":      title,
+		"status":     status,
+		"statusText": statusText,
+		"content":    send.NewContent(),
+		"detailURL":  logViewURL(logID),
+	}
+	if e := cron.Send(&alert.AlertData{Title: title, Content: send.NewContent(), Data: data}); e != nil {
+		log.Errorf(`failed to send cron job notify: %v`, e)
+	}
+}
+
+func logViewURL(logID uint64) string {
+	backendURL := strings.TrimSuffix(common.Setting(`base`).String(`backendURL`), `/`)
+	return backendURL + httpserver.Backend.Router.Prefix() + `/task/log_view/` + param.AsString(logID)
+}
+
+// renderNotify 生成通知标题和内容
+func renderNotify(rule *TaskNotify, data *NotifyData) (string, string, error) {
+	var title, content bytes.Buffer
+	t, err := template.New(`title`).Parse(rule.titleTemplate())
+	if err != nil {
+		return ``, ``, err
+	}
+	if err = t.Execute(&title, data); err != nil {
+		return ``, ``, err
+	}
+	t, err = template.New(`content`).Parse(rule.contentTemplate())
+	if err != nil {
+		return ``, ``, err
+	}
+	if err = t.Execute(&content, data); err != nil {
+		return ``, ``, err
+	}
+	return strings.TrimSpace(title.String()), strings.TrimSpace(content.String()), nil
+}
+
+func sendTaskNotify(rule *TaskNotify, data *NotifyData) {
+	if data.LogID > 0 {
+		data.LogURL = logViewURL(data.LogID)
+	}
+	title, content, err := renderNotify(rule, data)
+	if err != nil {
+		log.Errorf(`failed to render task(%d) notify: %v`, data.Task.Id, err)
+		return
+	}
+	alertData := alert.NewData(title, alert.DefaultTextContent)
+	alertData.Data.Set(`email-content`, []byte(content))
+	alertData.Data.Set(`markdown-content`, []byte(`### `+title+"\n"+strings.ReplaceAll(content, "\n", "  \n")))
+	if err := alert.SendTopic(defaults.NewMockContext(), rule.Topic, alertData); err != nil {
+		log.Errorf(`failed to send task(%d) notify to topic %q: %v`, data.Task.Id, rule.Topic, err)
+	}
+}
@@ -0,0 +1,117 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coscms/webcore/dbschema"
+)
+
+func TestNotifyEvent(t *testing.T) {
+	assert.Equal(t, NotifyEventFailure, notifyEvent(`failure`, `success`))
+	assert.Equal(t, NotifyEventTimeout, notifyEvent(`timeout`, `failure`))
+	assert.Equal(t, NotifyEventRecovery, notifyEvent(`success`, `timeout`))
+	assert.Equal(t, NotifyEventSuccess, notifyEvent(`success`, ``))
+}
+
+func TestTailText(t *testing.T) {
+	assert.Equal(t, "a\nb", tailText("a\nb\n"))
+	lines := make([]string, 30)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i)
+	}
+	tail := tailText(strings.Join(lines, "\n"))
+	assert.True(t, strings.HasPrefix(tail, "...\n10\n"))
+	assert.True(t, strings.HasSuffix(tail, "\n29"))
+	assert.LessOrEqual(t, len(tailText(strings.Repeat(`x`, 5000))), notifyTailBytes+4)
+}
+
+func TestRenderNotify(t *testing.T) {
+	rule := &TaskNotify{Topic: `ops`, Events: `failure,recovery`}
+	assert.NoError(t, rule.validate())
+	assert.True(t, rule.HasEvent(NotifyEventRecovery))
+	assert.False(t, rule.HasEvent(NotifyEventSuccess))
+	data := &NotifyData{
+		Task:      &dbschema.NgingTask{Id: 3, Name: `backup`},
+		Event:     NotifyEventFailure,
+		EventName: NotifyEvents.Get(NotifyEventFailure),
+		ExitCode:  2,
+		Duration:  1500 * time.Millisecond,
+		Error:     `disk full`,
+		LogURL:    `http://localhost/task/log_view/9`,
+	}
+	title, content, err := renderNotify(rule, data)
+	assert.NoError(t, err)
+	assert.Equal(t, `任务失败通知 #3: backup`, title)
+	assert.Contains(t, content, `退出码：2`)
+	assert.Contains(t, content, `耗时：1.5s`)
+	assert.Contains(t, content, "错误信息：\ndisk full")
+	assert.Contains(t, content, `http://localhost/task/log_view/9`)
+
+	rule.TitleTemplate = `{{.Task.Name`
+	assert.Error(t, rule.validate())
+	rule.TitleTemplate = ``
+	rule.Topic = `bad topic`
+	assert.Error(t, rule.validate())
+}
+
+func TestNotifyMatchesOwnLog(t *testing.T) {
+	useTestDB(t)
+	var (
+		mu   sync.Mutex
+		sent []*NotifyData
+	)
+	sendNotify = func(_ *TaskNotify, data *NotifyData) {
+		mu.Lock()
+		sent = append(sent, data)
+		mu.Unlock()
+	}
+	t.Cleanup(func() { sendNotify = sendTaskNotify })
+
+	// 第一次执行较慢，第二次执行先结束
+	marker := filepath.Join(t.TempDir(), `marker`)
+	task := addTestTask(t, `if [ -e `+marker+` ]; then echo second; else touch `+marker+`; sleep 1; echo first; fi`)
+	task.Concurrent = 1
+	require.NoError(t, task.UpdateField(nil, `concurrent`, 1, `id`, task.Id))
+	require.NoError(t, saveTaskExtra(nil, &TaskExtra{TaskId: task.Id, OverlapPolicy: OverlapAllow}))
+	require.NoError(t, saveTaskNotify(nil, &TaskNotify{TaskId: task.Id, Topic: `cron`, Events: NotifyEventSuccess}))
+
+	job, _, err := newJob(context.Background(), task)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		job.Run()
+	}()
+	time.Sleep(300 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		job.Run()
+	}()
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	outputs := map[string]struct{}{}
+	for _, data := range sent {
+		taskLog := dbschema.NewNgingTaskLog(nil)
+		require.NoError(t, taskLog.Get(nil, `id`, data.LogID))
+		assert.Equal(t, strings.TrimSpace(taskLog.Output), data.Output)
+		outputs[data.Output] = struct{}{}
+	}
+	assert.Len(t, outputs, 2)
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package task
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutKillsProcessTree(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `alive`)
+	started := time.Now()
+	_, _, _, isTimeout := runCommand(context.Background(), 0, `(sleep 1; echo alive > '`+file+`') & wait`, ``, 300*time.Millisecond, nil)
+	assert.True(t, isTimeout)
+	assert.Less(t, time.Since(started), time.Second)
+
+	// 超时后子进程也被终止，不会再写入文件
+	time.Sleep(2 * time.Second)
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package task
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessTree 终止进程及其全部子进程
+func killProcessTree(cmd *exec.Cmd) error {
+	err := exec.Command(`taskkill`, `/T`, `/F`, `/PID`, strconv.Itoa(cmd.Process.Pid)).Run()
+	if err == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
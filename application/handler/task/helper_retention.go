@@ -0,0 +1,301 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/code"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cron"
+)
+
+const (
+	tableTaskLogRetention = `nging_task_log_retention`
+	tableTaskLog          = `nging_task_log`
+)
+
+// logRetentionJobName 按保留规则清理任务日志的系统任务名称
+const logRetentionJobName = `taskLogRetention`
+
+// LogRetentionJob 按保留规则清理任务日志的系统任务
+var LogRetentionJob = &cron.Jobx{
+	Name:         logRetentionJobName,
+	Example:      `>` + logRetentionJobName,
+	Description:  `按保留规则清理任务日志`,
+	RunnerGetter: logRetentionRunnerGetter,
+}
+
+// LogRetention 任务日志保留规则。任务的规则优先于分组的规则
+type LogRetention struct {
+	Id              uint `db:"id,omitempty,pk" json:"id" xml:"id"`
+	GroupId         uint `db:"group_id" json:"group_id" xml:"group_id"`
+	TaskId          uint `db:"task_id" json:"task_id" xml:"task_id"`
+	KeepRuns        uint `db:"keep_runs" json:"keep_runs" xml:"keep_runs"`
+	KeepDays        uint `db:"keep_days" json:"keep_days" xml:"keep_days"`
+	KeepFailureDays uint `db:"keep_failure_days" json:"keep_failure_days" xml:"keep_failure_days"`
+	Updated         uint `db:"updated" json:"updated" xml:"updated"`
+}
+
+// IsEmpty 是否未设置任何规则
+func (r *LogRetention) IsEmpty() bool {
+	return r.KeepRuns == 0 && r.KeepDays == 0 && r.KeepFailureDays == 0
+}
+
+func logRetentionCond(groupID uint, taskID uint) db.Cond {
+	return db.Cond{`group_id`: groupID, `task_id`: taskID}
+}
+
+func getLogRetention(groupID uint, taskID uint) (*LogRetention, error) {
+	row := &LogRetention{}
+	err := newParam(tableTaskLogRetention).SetArgs(logRetentionCond(groupID, taskID)).SetRecv(row).One()
+	if err != nil {
+		if err != db.ErrNoMoreRows {
+			return nil, err
+		}
+		err = nil
+	}
+	row.GroupId = groupID
+	row.TaskId = taskID
+	return row, err
+}
+
+// saveLogRetention 保存保留规则，未设置任何规则时删除
+func saveLogRetention(tx factory.Transactioner, row *LogRetention) error {
+	cond := logRetentionCond(row.GroupId, row.TaskId)
+	if row.IsEmpty() {
+		return newParam(tableTaskLogRetention).SetTrans(tx).SetArgs(cond).Delete()
+	}
+	row.Updated = uint(time.Now().Unix())
+	exists, err := newParam(tableTaskLogRetention).SetTrans(tx).SetArgs(cond).Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return newParam(tableTaskLogRetention).SetTrans(tx).SetArgs(cond).SetSend(echo.H{
+			`keep_runs`:         row.KeepRuns,
+			`keep_days`:         row.KeepDays,
+			`keep_failure_days`: row.KeepFailureDays,
+			`updated`:           row.Updated,
+		}).Update()
+	}
+	_, err = newParam(tableTaskLogRetention).SetTrans(tx).SetSend(row).Insert()
+	return err
+}
+
+func deleteLogRetention(groupID uint, taskID uint) error {
+	return newParam(tableTaskLogRetention).SetArgs(logRetentionCond(groupID, taskID)).Delete()
+}
+
+func (r *LogRetention) validate() error {
+	if r.KeepFailureDays > 0 && r.KeepDays > 0 && r.KeepFailureDays <= r.KeepDays {
+		return fmt.Errorf(`失败记录的保留天数(%d)必须大于其它记录的保留天数(%d)`, r.KeepFailureDays, r.KeepDays)
+	}
+	return nil
+}
+
+func bindLogRetention(ctx echo.Context, groupID uint, taskID uint) (*LogRetention, error) {
+	row := &LogRetention{
+		GroupId:         groupID,
+		TaskId:          taskID,
+		KeepRuns:        ctx.Formx(`keepRuns`).Uint(),
+		KeepDays:        ctx.Formx(`keepDays`).Uint(),
+		KeepFailureDays: ctx.Formx(`keepFailureDays`).Uint(),
+	}
+	if err := row.validate(); err != nil {
+		return nil, ctx.NewError(code.InvalidParameter, err.Error()).SetZone(`keepFailureDays`)
+	}
+	return row, nil
+}
+
+func setLogRetentionForm(ctx echo.Context, row *LogRetention) {
+	form := ctx.Request().Form()
+	for name, value := range map[string]uint{
+		`keepRuns`:        row.KeepRuns,
+		`keepDays`:        row.KeepDays,
+		`keepFailureDays`: row.KeepFailureDays,
+	} {
+		if value > 0 {
+			form.Set(name, param.AsString(value))
+		} else {
+			form.Set(name, ``)
+		}
+	}
+}
+
+// applyLogRetention 按规则删除任务日志，返回删除的数量。
+// 同时设置了次数和天数时，只要满足其中一项就保留(即超出保留次数且超过保留天数的才删除)。
+// 保留次数只统计每次执行的最终结果，重试前的尝试和各台主机的执行记录随所属的执行一起删除。
+// 设置了失败记录保留天数时，失败记录只按此天数删除，不受其它规则限制
+func applyLogRetention(taskID uint, rule *LogRetention, now time.Time) (int64, error) {
+	if rule.IsEmpty() {
+		return 0, nil
+	}
+	var deleted int64
+	cond := db.NewCompounds().AddKV(`task_id`, taskID)
+	expired := rule.KeepDays > 0 || rule.KeepRuns > 0
+	if rule.KeepDays > 0 {
+		cond.AddKV(`created`, db.Lt(now.AddDate(0, 0, -int(rule.KeepDays)).Unix()))
+	}
+	if rule.KeepRuns > 0 {
+		// 保留的最早一次执行之前的那次执行，它及更早的日志都超出了保留次数
+		taskLog := dbschema.NewNgingTaskLog(nil)
+		err := taskLog.Get(func(r db.Result) db.Result {
+			return r.Select(`id`).OrderBy(`-id`).Offset(int(rule.KeepRuns))
+		}, finalLogCond(taskID))
+		if err == nil {
+			cond.AddKV(`id`, db.Lte(taskLog.Id))
+		} else if err == db.ErrNoMoreRows {
+			expired = false
+		} else {
+			return deleted, err
+		}
+	}
+	if expired {
+		if rule.KeepFailureDays > 0 {
+			cond.AddKV(`status`, `success`)
+		}
+		n, err := newParam(tableTaskLog).SetArgs(cond.And()).Deletex()
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	if rule.KeepFailureDays > 0 {
+		n, err := newParam(tableTaskLog).SetArgs(db.Cond{
+			`task_id`: taskID,
+			`status`:  db.NotEq(`success`),
+			`created`: db.Lt(now.AddDate(0, 0, -int(rule.KeepFailureDays)).Unix()),
+		}).Deletex()
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// listLogRetentions 获取全部保留规则
+func listLogRetentions() (byGroup map[uint]*LogRetention, byTask map[uint]*LogRetention, err error) {
+	var rows []*LogRetention
+	err = newParam(tableTaskLogRetention).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return
+	}
+	err = nil
+	byGroup = map[uint]*LogRetention{}
+	byTask = map[uint]*LogRetention{}
+	for _, row := range rows {
+		if row.TaskId > 0 {
+			byTask[row.TaskId] = row
+		} else if row.GroupId > 0 {
+			byGroup[row.GroupId] = row
+		}
+	}
+	return
+}
+
+// runLogRetention 对所有任务执行日志保留规则
+func runLogRetention(now time.Time) (string, error) {
+	byGroup, byTask, err := listLogRetentions()
+	if err != nil {
+		return ``, err
+	}
+	if len(byGroup) == 0 && len(byTask) == 0 {
+		return `没有设置日志保留规则`, nil
+	}
+	m := dbschema.NewNgingTask(nil)
+	_, err = m.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.Select(`id`, `group_id`, `name`).OrderBy(`id`)
+	}, 0, -1)
+	if err != nil {
+		return ``, err
+	}
+	var (
+		lines []string
+		total int64
+	)
+	for _, task := range m.Objects() {
+		rule, ok := byTask[task.Id]
+		if !ok {
+			rule, ok = byGroup[task.GroupId]
+		}
+		if !ok {
+			continue
+		}
+		n, err := applyLogRetention(task.Id, rule, now)
+		if n > 0 && err == nil {
+			err = cleanLogNodes(task.Id)
+		}
+		if n > 0 && err == nil {
+			err = cleanPartLogs(task.Id)
+		}
+		if n > 0 {
+			lines = append(lines, fmt.Sprintf(`[#%d %s] 删除日志 %d 条`, task.Id, task.Name, n))
+			total += n
+		}
+		if err != nil {
+			lines = append(lines, fmt.Sprintf(`[#%d %s] 出错：%v`, task.Id, task.Name, err))
+		}
+	}
+	lines = append(lines, fmt.Sprintf(`共删除日志 %d 条`, total))
+	return strings.Join(lines, "\n"), nil
+}
+
+func logRetentionRunnerGetter(_ string) cron.Runner {
+	return func(_ time.Duration) (string, string, error, bool) {
+		out, err := runLogRetention(time.Now())
+		if err != nil {
+			return out, err.Error(), err, false
+		}
+		return out, ``, nil, false
+	}
+}
+
+// TaskLogUsage 任务日志占用的空间
+type TaskLogUsage struct {
+	TaskId uint   `db:"task_id" json:"task_id" xml:"task_id"`
+	Count  uint64 `db:"cnt" json:"count" xml:"count"`
+	Size   uint64 `db:"size" json:"size" xml:"size"`
+}
+
+// listTaskLogUsages 统计任务日志的数量和占用空间(输出和错误信息的长度)
+func listTaskLogUsages(taskIDs []uint) (map[uint]*TaskLogUsage, error) {
+	usages := map[uint]*TaskLogUsage{}
+	if len(taskIDs) == 0 {
+		return usages, nil
+	}
+	var rows []*TaskLogUsage
+	err := newParam(tableTaskLog).SetArgs(db.Cond{`task_id`: db.In(taskIDs)}).SetRecv(&rows).SetMiddleware(func(r db.Result) db.Result {
+		return r.Select(`task_id`, db.Raw(`COUNT(1) AS cnt`), db.Raw(`SUM(LENGTH(output)+LENGTH(error)) AS size`)).Group(`task_id`)
+	}).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return usages, err
+	}
+	for _, row := range rows {
+		usages[row.TaskId] = row
+	}
+	return usages, nil
+}
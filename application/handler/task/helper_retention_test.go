@@ -0,0 +1,113 @@
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/param"
+)
+
+// addTestLogs 写入日志：重试前的尝试(part)写在所属执行的最终结果之前
+func addTestLogs(t *testing.T, taskID uint, now time.Time) {
+	rows := []struct {
+		daysAgo int
+		status  string
+		part    bool
+	}{
+		{11, `success`, false}, // 1
+		{9, `failure`, true},   // 2
+		{9, `success`, false},  // 3
+		{2, `failure`, true},   // 4
+		{2, `success`, false},  // 5
+		{0, `success`, false},  // 6
+	}
+	for _, row := range rows {
+		created := now.AddDate(0, 0, -row.daysAgo).Unix()
+		pk, err := newParam(tableTaskLog).SetSend(echo.H{
+			`task_id`: taskID,
+			`output`:  ``,
+			`error`:   ``,
+			`status`:  row.status,
+			`created`: created,
+		}).Insert()
+		require.NoError(t, err)
+		if row.part {
+			_, err = newParam(tableTaskLogPart).SetSend(&TaskLogPart{LogId: param.AsUint64(pk), TaskId: taskID, Created: uint(created)}).Insert()
+			require.NoError(t, err)
+		}
+	}
+}
+
+func remainingLogIDs(t *testing.T, taskID uint) []uint64 {
+	var rows []struct {
+		Id uint64 `db:"id"`
+	}
+	err := newParam(tableTaskLog).SetArgs(db.Cond{`task_id`: taskID}).SetRecv(&rows).SetMiddleware(func(r db.Result) db.Result {
+		return r.Select(`id`).OrderBy(`id`)
+	}).All()
+	require.NoError(t, err)
+	ids := make([]uint64, len(rows))
+	for i, row := range rows {
+		ids[i] = row.Id
+	}
+	return ids
+}
+
+func TestApplyLogRetention(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		rule    *LogRetention
+		deleted int64
+		remain  []uint64
+	}{
+		// 只统计最终结果：保留5、6两次执行以及5的重试记录
+		{`keepRuns`, &LogRetention{KeepRuns: 2}, 3, []uint64{4, 5, 6}},
+		// 满足其中一项就保留
+		{`keepRunsOrDays`, &LogRetention{KeepRuns: 2, KeepDays: 10}, 1, []uint64{2, 3, 4, 5, 6}},
+		{`keepDays`, &LogRetention{KeepDays: 5}, 3, []uint64{4, 5, 6}},
+		{`notEnoughRuns`, &LogRetention{KeepRuns: 4, KeepDays: 1}, 0, []uint64{1, 2, 3, 4, 5, 6}},
+		// 失败记录只按失败记录保留天数删除
+		{`keepFailureDays`, &LogRetention{KeepRuns: 1, KeepFailureDays: 5}, 4, []uint64{4, 6}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useTestDB(t)
+			addTestLogs(t, 1, now)
+			n, err := applyLogRetention(1, c.rule, now)
+			require.NoError(t, err)
+			assert.Equal(t, c.deleted, n)
+			assert.Equal(t, c.remain, remainingLogIDs(t, 1))
+
+			require.NoError(t, cleanPartLogs(1))
+			var parts []*TaskLogPart
+			require.NoError(t, newParam(tableTaskLogPart).SetRecv(&parts).All())
+			for _, part := range parts {
+				assert.Contains(t, c.remain, part.LogId)
+			}
+		})
+	}
+}
+
+func TestLatestLogStatus(t *testing.T) {
+	useTestDB(t)
+	now := time.Now()
+	addTestLogs(t, 1, now)
+	_, err := newParam(tableTaskLog).SetSend(echo.H{`task_id`: 1, `output`: ``, `error`: ``, `status`: `failure`, `created`: now.Unix()}).Insert()
+	require.NoError(t, err)
+	_, err = newParam(tableTaskLogPart).SetSend(&TaskLogPart{LogId: 7, TaskId: 1}).Insert()
+	require.NoError(t, err)
+	// 重试前的尝试不作为执行结果
+	assert.Equal(t, `success`, latestLogStatus(1))
+}
+
+func TestLogRetentionValidate(t *testing.T) {
+	assert.NoError(t, (&LogRetention{KeepDays: 7, KeepFailureDays: 30}).validate())
+	assert.NoError(t, (&LogRetention{KeepRuns: 10, KeepFailureDays: 3}).validate())
+	assert.Error(t, (&LogRetention{KeepDays: 7, KeepFailureDays: 7}).validate())
+	assert.Error(t, (&LogRetention{KeepDays: 30, KeepFailureDays: 7}).validate())
+}
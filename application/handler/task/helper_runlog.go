@@ -0,0 +1,78 @@
+/*
+   Nging is a toolbox for webmasters
+   Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package task
+
+import (
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+
+	"github.com/coscms/webcore/dbschema"
+)
+
+const tableTaskLogPart = `nging_task_log_part`
+
+func init() {
+	dbschema.DBI.On(factory.EventCreated, onTaskLogCreated, `nging_task_log`)
+}
+
+// TaskLogPart 不作为整次执行结果的日志(重试前的某一次尝试或多台主机中某台主机的执行)
+type TaskLogPart struct {
+	LogId   uint64 `db:"log_id,pk" json:"log_id" xml:"log_id"`
+	TaskId  uint   `db:"task_id" json:"task_id" xml:"task_id"`
+	Created uint   `db:"created" json:"created" xml:"created"`
+}
+
+// insertPartLog 写入某一次尝试或某台主机的执行日志
+func insertPartLog(taskLog *dbschema.NgingTaskLog) error {
+	_, err := taskLog.Insert()
+	if err != nil {
+		return err
+	}
+	_, err = newParam(tableTaskLogPart).SetSend(&TaskLogPart{LogId: taskLog.Id, TaskId: taskLog.TaskId, Created: taskLog.Created}).Insert()
+	return err
+}
+
+// finalLogCond 任务的最终执行结果日志(不含重试前的尝试和各台主机的执行日志)
+func finalLogCond(taskID uint) db.Compound {
+	return db.And(
+		db.Cond{`task_id`: taskID},
+		db.Raw(`id NOT IN (SELECT log_id FROM `+dbschema.WithPrefix(tableTaskLogPart)+` WHERE task_id = ?)`, taskID),
+	)
+}
+
+// cleanPartLogs 清理已删除日志的记录
+func cleanPartLogs(taskID uint) error {
+	return deletePartLogs(db.And(
+		db.Cond{`task_id`: taskID},
+		db.Raw(`log_id NOT IN (SELECT id FROM `+dbschema.WithPrefix(tableTaskLog)+` WHERE task_id = ?)`, taskID),
+	))
+}
+
+func deletePartLogs(cond db.Compound) error {
+	return newParam(tableTaskLogPart).SetArgs(cond).Delete()
+}
+
+func onTaskLogCreated(m factory.Model, _ ...string) error {
+	taskLog, ok := m.(*dbschema.NgingTaskLog)
+	if !ok {
+		return nil
+	}
+	recordLogNode(taskLog.TaskId, taskLog.Id, taskLog.Created)
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	cronlib "github.com/admpub/cron"
+)
+
+// maxPreviewRuns 预览执行时间的最大数量
+const maxPreviewRuns = 10
+
+var (
+	cronTimeRegexp   = regexp.MustCompile(`^(.+?)\s*(?:\bat\s+|\s)(\d{1,2}):(\d{2})(?::(\d{2}))?$`)
+	cronEveryRegexp  = regexp.MustCompile(`^(?:every|每)\s*(\d+)\s*(s|sec|secs|seconds?|m|min|mins|minutes?|h|hours?|秒|秒钟|分|分钟|时|小时)$`)
+	cronHourlyRegexp = regexp.MustCompile(`^(?:hourly|every hour|每小时)\s*(?:at\s*)?:?(\d{1,2})(?:分)?$`)
+)
+
+// cronWeekdays 星期名称对应的数字(0代表星期天)
+var cronWeekdays = map[string]string{
+	`sunday`: `0`, `monday`: `1`, `tuesday`: `2`, `wednesday`: `3`, `thursday`: `4`, `friday`: `5`, `saturday`: `6`,
+	`sun`: `0`, `mon`: `1`, `tue`: `2`, `wed`: `3`, `thu`: `4`, `fri`: `5`, `sat`: `6`,
+	`周日`: `0`, `周一`: `1`, `周二`: `2`, `周三`: `3`, `周四`: `4`, `周五`: `5`, `周六`: `6`,
+	`星期日`: `0`, `星期一`: `1`, `星期二`: `2`, `星期三`: `3`, `星期四`: `4`, `星期五`: `5`, `星期六`: `6`,
+	`星期天`: `0`, `周天`: `0`,
+}
+
+// cronDayAliases 日期简写对应的“日 月 周”字段
+var cronDayAliases = map[string]string{
+	`daily`:     `* * *`,
+	`every day`: `* * *`,
+	`everyday`:  `* * *`,
+	`每天`:        `* * *`,
+	`weekdays`:  `* * 1-5`,
+	`工作日`:       `* * 1-5`,
+	`weekends`:  `* * 0,6`,
+	`周末`:        `* * 0,6`,
+}
+
+// cronDayFields 将日期简写(如 weekdays、every monday、每周一)转换为“日 月 周”字段
+func cronDayFields(day string) (string, bool) {
+	if fields, ok := cronDayAliases[day]; ok {
+		return fields, true
+	}
+	day = strings.TrimPrefix(day, `every `)
+	day = strings.TrimPrefix(day, `每`)
+	if v, ok := cronWeekdays[day]; ok {
+		return `* * ` + v, true
+	}
+	if v, ok := cronWeekdays[strings.TrimSuffix(day, `s`)]; ok {
+		return `* * ` + v, true
+	}
+	return ``, false
+}
+
+// parseCronShorthand 将简写转换为Cron表达式。支持：
+// @every 5m、@daily 等预定义写法；5段式的标准crontab；
+// “weekdays at 02:30”、“every monday at 8:00”、“daily at 23:59:30”、“hourly at 15”、“every 5 minutes”；
+// 以及“工作日 02:30”、“每周一 08:00”、“每5分钟”等中文写法
+func parseCronShorthand(expr string) (string, error) {
+	expr = strings.Join(strings.Fields(expr), ` `)
+	if len(expr) == 0 {
+		return ``, fmt.Errorf(`empty spec string`)
+	}
+	if strings.HasPrefix(expr, `TZ=`) || strings.HasPrefix(expr, `CRON_TZ=`) {
+		return ``, fmt.Errorf(`timezone prefix is not allowed in spec: %s`, expr)
+	}
+	if strings.HasPrefix(expr, `@`) {
+		return expr, nil
+	}
+	lower := strings.ToLower(expr)
+	if m := cronEveryRegexp.FindStringSubmatch(lower); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if n <= 0 {
+			return ``, fmt.Errorf(`invalid interval: %s`, expr)
+		}
+		unit := `m`
+		switch m[2][0] {
+		case 's':
+			unit = `s`
+		case 'h':
+			unit = `h`
+		default:
+			switch {
+			case strings.HasPrefix(m[2], `秒`):
+				unit = `s`
+			case strings.HasSuffix(m[2], `时`):
+				unit = `h`
+			}
+		}
+		return `@every ` + m[1] + unit, nil
+	}
+	if m := cronHourlyRegexp.FindStringSubmatch(lower); m != nil {
+		minute, _ := strconv.Atoi(m[1])
+		if minute > 59 {
+			return ``, fmt.Errorf(`invalid minute: %s`, expr)
+		}
+		return fmt.Sprintf(`0 %d * * * *`, minute), nil
+	}
+	if m := cronTimeRegexp.FindStringSubmatch(lower); m != nil {
+		if fields, ok := cronDayFields(strings.TrimSpace(m[1])); ok {
+			hour, _ := strconv.Atoi(m[2])
+			minute, _ := strconv.Atoi(m[3])
+			second, _ := strconv.Atoi(m[4])
+			if hour > 23 || minute > 59 || second > 59 {
+				return ``, fmt.Errorf(`invalid time: %s`, expr)
+			}
+			return fmt.Sprintf(`%d %d %d %s`, second, minute, hour, fields), nil
+		}
+	}
+	if fields, ok := cronDayFields(lower); ok {
+		return `0 0 0 ` + fields, nil
+	}
+	if len(strings.Fields(expr)) == 5 {
+		return `0 ` + expr, nil
+	}
+	return expr, nil
+}
+
+// normalizeCronSpec 将简写转换为Cron表达式并校验
+func normalizeCronSpec(expr string) (string, error) {
+	spec, err := parseCronShorthand(expr)
+	if err != nil {
+		return ``, err
+	}
+	if _, err = cronlib.Parse(spec); err != nil {
+		return ``, err
+	}
+	return spec, nil
+}
+
+// normalizeCronSpecWithTimezone 将简写转换为Cron表达式，并校验加上时区后的表达式
+func normalizeCronSpecWithTimezone(expr string, timezone string) (string, error) {
+	spec, err := normalizeCronSpec(expr)
+	if err != nil {
+		return ``, err
+	}
+	if _, err = cronlib.Parse(cronSpecWithTimezone(spec, timezone)); err != nil {
+		return ``, err
+	}
+	return spec, nil
+}
+
+// loadTimezone 加载IANA时区，为空时使用服务器本地时区
+func loadTimezone(timezone string) (*time.Location, error) {
+	if len(timezone) == 0 {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timezone)
+}
+
+// cronSpecWithTimezone 为Cron表达式添加时区前缀
+func cronSpecWithTimezone(spec string, timezone string) string {
+	if len(timezone) == 0 {
+		return spec
+	}
+	return `CRON_TZ=` + timezone + ` ` + spec
+}
+
+// nextRunTimes 计算指定时间之后的n次执行时间，时间使用任务时区表示
+func nextRunTimes(spec string, timezone string, from time.Time, n int) ([]time.Time, error) {
+	loc, err := loadTimezone(timezone)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := cronlib.Parse(cronSpecWithTimezone(spec, timezone))
+	if err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, 0, n)
+	t := from
+	for i := 0; i < n; i++ {
+		t = schedule.Next(t)
+		if t.IsZero() {
+			break
+		}
+		times = append(times, t.In(loc))
+	}
+	return times, nil
+}
@@ -0,0 +1,49 @@
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronShorthand(t *testing.T) {
+	cases := map[string]string{
+		`@every 5m`:            `@every 5m`,
+		`@daily`:               `@daily`,
+		`*/5 * * * *`:          `0 */5 * * * *`,
+		`0 30 2 * * 1-5`:       `0 30 2 * * 1-5`,
+		`weekdays at 02:30`:    `0 30 2 * * 1-5`,
+		`Every Monday at 8:00`: `0 0 8 * * 1`,
+		`daily at 23:59:30`:    `30 59 23 * * *`,
+		`weekends`:             `0 0 0 * * 0,6`,
+		`hourly at 15`:         `0 15 * * * *`,
+		`every 5 minutes`:      `@every 5m`,
+		`every 2 hours`:        `@every 2h`,
+		`工作日 02:30`:            `0 30 2 * * 1-5`,
+		`每周一 08:00`:            `0 0 8 * * 1`,
+		`每5分钟`:                 `@every 5m`,
+		`每30秒`:                 `@every 30s`,
+	}
+	for expr, expected := range cases {
+		spec, err := normalizeCronSpec(expr)
+		assert.NoError(t, err, expr)
+		assert.Equal(t, expected, spec, expr)
+	}
+	for _, expr := range []string{``, `weekdays at 25:00`, `CRON_TZ=UTC @daily`, `sometimes`} {
+		_, err := normalizeCronSpec(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestNextRunTimes(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC) // 星期五
+	times, err := nextRunTimes(`0 30 2 * * 1-5`, `Asia/Shanghai`, from, maxPreviewRuns)
+	assert.NoError(t, err)
+	assert.Len(t, times, maxPreviewRuns)
+	assert.Equal(t, `2024-03-04 02:30:00 +0800`, times[0].Format(`2006-01-02 15:04:05 -0700`))
+	assert.Equal(t, `2024-03-05 02:30:00 +0800`, times[1].Format(`2006-01-02 15:04:05 -0700`))
+
+	_, err = nextRunTimes(`@daily`, `Invalid/Zone`, from, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,432 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/param"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/common"
+	"github.com/coscms/webcore/library/cron"
+)
+
+// sshUserModel sshmanager模块中SSH账号的数据模型名称
+const sshUserModel = `NgingSshUser`
+
+// errNoSSHManager 未安装sshmanager模块
+var errNoSSHManager = errors.New(`the sshmanager module is not installed`)
+
+const sshDialTimeout = 15 * time.Second
+
+// 在多台主机上执行时的方式
+const (
+	FanOutSequential = `sequential` // 依次执行
+	FanOutParallel   = `parallel`   // 同时执行
+	FanOutFailFast   = `fail_fast`  // 依次执行，遇到失败时停止
+)
+
+// FanOuts 在多台主机上执行时的方式
+var FanOuts = echo.NewKVData().
+	Add(FanOutSequential, `依次执行`).
+	Add(FanOutParallel, `同时执行`).
+	Add(FanOutFailFast, `依次执行，失败时停止`)
+
+// SSHTarget SSH执行目标(sshmanager模块中保存的SSH账号)
+type SSHTarget struct {
+	Id         uint   `db:"id" json:"id" xml:"id"`
+	Name       string `db:"name" json:"name" xml:"name"`
+	Host       string `db:"host" json:"host" xml:"host"`
+	Port       int    `db:"port" json:"port" xml:"port"`
+	Username   string `db:"username" json:"username" xml:"username"`
+	Password   string `db:"password" json:"-" xml:"-"`
+	PrivateKey string `db:"private_key" json:"-" xml:"-"`
+	Passphrase string `db:"passphrase" json:"-" xml:"-"`
+}
+
+// Address 主机地址
+func (t *SSHTarget) Address() string {
+	port := t.Port
+	if port <= 0 {
+		port = 22
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+func (t *SSHTarget) String() string {
+	return t.Username + `@` + t.Address()
+}
+
+// Title 显示名称
+func (t *SSHTarget) Title() string {
+	if len(t.Name) > 0 {
+		return t.Name
+	}
+	return t.String()
+}
+
+// clientConfig SSH连接配置。与sshmanager模块一致，密码和私钥口令是加密保存的
+func (t *SSHTarget) clientConfig() (*ssh.ClientConfig, error) {
+	var auths []ssh.AuthMethod
+	if len(t.PrivateKey) > 0 {
+		var (
+			signer ssh.Signer
+			err    error
+		)
+		if len(t.Passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(t.PrivateKey), []byte(common.Crypto().Decode(t.Passphrase)))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(t.PrivateKey))
+		}
+		if err != nil {
+			return nil, fmt.Errorf(`failed to parse private key: %w`, err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if len(t.Password) > 0 {
+		password := common.Crypto().Decode(t.Password)
+		auths = append(auths, ssh.Password(password), ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	return &ssh.ClientConfig{
+		User:            t.Username,
+		Auth:            auths,
+		HostKeyCallback: pinnedHostKey,
+		Timeout:         sshDialTimeout,
+	}, nil
+}
+
+// dial 连接到SSH主机
+func (t *SSHTarget) dial(ctx context.Context) (*ssh.Client, error) {
+	config, err := t.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, `tcp`, t.Address())
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.Address(), config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// listSSHTargets 获取SSH执行目标。ids为空时获取全部，否则按ids的顺序返回
+func listSSHTargets(ids []uint) ([]*SSHTarget, error) {
+	m := dbschema.DBI.NewModel(sshUserModel)
+	if m == nil {
+		return nil, errNoSSHManager
+	}
+	var args []interface{}
+	if len(ids) > 0 {
+		args = append(args, db.Cond{`id`: db.In(ids)})
+	}
+	var rows []*SSHTarget
+	err := m.Param(func(r db.Result) db.Result {
+		return r.Select(`id`, `name`, `host`, `port`, `username`, `password`, `private_key`, `passphrase`).OrderBy(`id`)
+	}, args...).SetRecv(&rows).All()
+	if err != nil && err != db.ErrNoMoreRows {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return rows, nil
+	}
+	byID := make(map[uint]*SSHTarget, len(rows))
+	for _, row := range rows {
+		byID[row.Id] = row
+	}
+	list := make([]*SSHTarget, 0, len(ids))
+	for _, id := range ids {
+		if row, ok := byID[id]; ok {
+			list = append(list, row)
+		}
+	}
+	return list, nil
+}
+
+// listSSHTargetsQuietly 获取全部SSH执行目标。未安装sshmanager模块时返回空列表
+func listSSHTargetsQuietly() []*SSHTarget {
+	rows, err := listSSHTargets(nil)
+	if err != nil && !errors.Is(err, errNoSSHManager) {
+		log.Warnf(`failed to query %s: %v`, sshUserModel, err)
+	}
+	return rows
+}
+
+// parseIDs 解析逗号分隔的ID列表
+func parseIDs(s string) []uint {
+	var ids []uint
+	for _, v := range strings.Split(s, `,`) {
+		if id := param.AsUint(strings.TrimSpace(v)); id > 0 && !containsID(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// joinIDs 将ID列表拼接为逗号分隔的字符串
+func joinIDs(ids []uint) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = param.AsString(id)
+	}
+	return strings.Join(parts, `,`)
+}
+
+// shellQuote 转义为shell单引号字符串
+func shellQuote(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `'\''`) + `'`
+}
+
+// remoteScript 生成在远程主机上执行的脚本：设置环境变量、切换工作目录后执行命令
+func remoteScript(command string, dir string, env []string) string {
+	var buf strings.Builder
+	for _, row := range env {
+		parts := strings.SplitN(row, `=`, 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			continue
+		}
+		buf.WriteString(`export ` + strings.TrimSpace(parts[0]) + `=` + shellQuote(parts[1]) + "\n")
+	}
+	if len(dir) > 0 {
+		buf.WriteString(`cd ` + shellQuote(dir) + " || exit 1\n")
+	}
+	buf.WriteString(command)
+	return buf.String()
+}
+
+// runRemoteCommand 在SSH主机上执行命令
+func runRemoteCommand(ctx context.Context, target *SSHTarget, command string, dir string, timeout time.Duration, stdout io.Writer, stderr io.Writer, env ...string) (string, string, error, bool) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	client, err := target.dial(dialCtx)
+	cancel()
+	if err != nil {
+		return ``, ``, fmt.Errorf(`failed to connect %s: %w`, target, err), false
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return ``, ``, err, false
+	}
+	defer session.Close()
+	bufOut := cron.NewOutputWriter()
+	bufErr := cron.NewOutputWriter()
+	session.Stdout = bufOut
+	session.Stderr = bufErr
+	if stdout != nil {
+		session.Stdout = io.MultiWriter(bufOut, stdout)
+	}
+	if stderr != nil {
+		session.Stderr = io.MultiWriter(bufErr, stderr)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(remoteScript(command, dir, env))
+	}()
+	stop := func() {
+		session.Signal(ssh.SIGKILL)
+		client.Close() // 关闭连接后远程进程会收到SIGHUP
+		<-done
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	isTimeout := false
+	select {
+	case <-t.C:
+		log.Warnf("任务在%s上执行时间超过%d秒，强制关闭连接", target, int(timeout/time.Second))
+		stop()
+		isTimeout = true
+	case <-ctx.Done():
+		stop()
+		err = ctx.Err()
+	case err = <-done:
+	}
+	return bufOut.String(), bufErr.String(), err, isTimeout
+}
+
+// targetResult 在某台主机上的执行结果
+type targetResult struct {
+	target *SSHTarget
+	status string
+	reason string
+}
+
+// prefixWriter 在每行开头添加前缀，用于区分多台主机的实时输出
+type prefixWriter struct {
+	w           io.Writer
+	prefix      []byte
+	mu          sync.Mutex
+	noLineStart bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !p.noLineStart {
+			buf.Write(p.prefix)
+		}
+		buf.Write(line)
+		p.noLineStart = line[len(line)-1] != '\n'
+	}
+	if _, err := p.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// runTargets 在SSH主机上执行命令。在多台主机上执行时，每台主机的执行结果单独记录日志，返回汇总结果
+func (s *jobState) runTargets(timeout time.Duration, live *liveRun) (string, string, error, bool) {
+	ids := parseIDs(s.extra.SSHUserIds)
+	targets, err := listSSHTargets(ids)
+	if err != nil {
+		return ``, ``, err, false
+	}
+	if len(targets) != len(ids) {
+		var missing []string
+		for _, id := range ids {
+			found := false
+			for _, t := range targets {
+				if t.Id == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, param.AsString(id))
+			}
+		}
+		return ``, ``, fmt.Errorf(`SSH账号不存在：%s`, strings.Join(missing, `,`)), false
+	}
+	if len(targets) == 1 {
+		return runRemoteCommand(s.ctx, targets[0], s.command, s.task.WorkDirectory, timeout, live.Writer(`stdout`), live.Writer(`stderr`), s.env...)
+	}
+	results := make([]*targetResult, len(targets))
+	run := func(i int) {
+		target := targets[i]
+		prefix := []byte(`[` + target.Title() + `] `)
+		started := time.Now()
+		cmdOut, cmdErr, err, isTimeout := runRemoteCommand(s.ctx, target, s.command, s.task.WorkDirectory, timeout,
+			&prefixWriter{w: live.Writer(`stdout`), prefix: prefix},
+			&prefixWriter{w: live.Writer(`stderr`), prefix: prefix},
+			s.env...)
+		result := &targetResult{
+			target: target,
+			status: commandStatus(err, isTimeout),
+			reason: endReason(err, isTimeout, timeout),
+		}
+		results[i] = result
+		header := `主机：` + target.Title() + ` (` + target.String() + ")\n"
+		s.recordLog(started, header+cmdOut, appendReason(cmdErr, result.reason), result.status)
+	}
+	switch s.extra.FanOut {
+	case FanOutParallel:
+		wg := sync.WaitGroup{}
+		for i := range targets {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+		}
+		wg.Wait()
+	default:
+		for i := range targets {
+			if s.ctx.Err() != nil {
+				break
+			}
+			run(i)
+			if s.extra.FanOut == FanOutFailFast && results[i].status != `success` {
+				break
+			}
+		}
+	}
+	return summarizeTargets(results)
+}
+
+// summarizeTargets 汇总在多台主机上的执行结果
+func summarizeTargets(results []*targetResult) (string, string, error, bool) {
+	var (
+		lines    []string
+		failed   int
+		timeouts int
+		skipped  int
+	)
+	for _, r := range results {
+		if r == nil {
+			skipped++
+			continue
+		}
+		lines = append(lines, `[`+r.target.Title()+`] `+r.reason)
+		switch r.status {
+		case `success`:
+		case `timeout`:
+			timeouts++
+			failed++
+		default:
+			failed++
+		}
+	}
+	if skipped > 0 {
+		lines = append(lines, fmt.Sprintf(`有%d台主机未执行`, skipped))
+	}
+	if failed == 0 && skipped == 0 {
+		return strings.Join(lines, "\n"), ``, nil, false
+	}
+	err := fmt.Errorf(`在%d台主机上执行失败，%d台未执行(共%d台)`, failed, skipped, len(results))
+	return strings.Join(lines, "\n"), ``, err, timeouts > 0 && timeouts == failed && skipped == 0
+}
+
+// isRemoteExitError 是否为远程命令的退出错误
+func isRemoteExitError(err error) (int, bool) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,81 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/webx-top/db"
+	"golang.org/x/crypto/ssh"
+)
+
+const tableTaskSSHHostKey = `nging_task_ssh_host_key`
+
+// TaskSSHHostKey 首次连接SSH主机时记录的主机公钥
+type TaskSSHHostKey struct {
+	Address     string `db:"address,pk" json:"address" xml:"address"`
+	KeyType     string `db:"key_type" json:"key_type" xml:"key_type"`
+	PublicKey   string `db:"public_key" json:"public_key" xml:"public_key"`
+	Fingerprint string `db:"fingerprint" json:"fingerprint" xml:"fingerprint"`
+	Created     uint   `db:"created" json:"created" xml:"created"`
+}
+
+var hostKeyMutex sync.Mutex
+
+// pinnedHostKey 首次连接时记录主机公钥，以后连接该主机时公钥必须与记录的一致
+func pinnedHostKey(address string, _ net.Addr, key ssh.PublicKey) error {
+	hostKeyMutex.Lock()
+	defer hostKeyMutex.Unlock()
+	publicKey := base64.StdEncoding.EncodeToString(key.Marshal())
+	row := &TaskSSHHostKey{}
+	err := newParam(tableTaskSSHHostKey).SetArgs(db.Cond{`address`: address}).SetRecv(row).One()
+	if err == nil {
+		if row.KeyType == key.Type() && row.PublicKey == publicKey {
+			return nil
+		}
+		return fmt.Errorf(`host key mismatch for %s: expected %s %s, got %s %s (if the host key was changed on purpose, reset the trusted host key on the task edit page)`,
+			address, row.KeyType, row.Fingerprint, key.Type(), ssh.FingerprintSHA256(key))
+	}
+	if err != db.ErrNoMoreRows {
+		return err
+	}
+	_, err = newParam(tableTaskSSHHostKey).SetSend(&TaskSSHHostKey{
+		Address:     address,
+		KeyType:     key.Type(),
+		PublicKey:   publicKey,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Created:     uint(time.Now().Unix()),
+	}).Insert()
+	return err
+}
+
+// resetHostKeys 删除记录的主机公钥，下次连接时重新记录
+func resetHostKeys(targets []*SSHTarget) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	addresses := make([]string, len(targets))
+	for i, t := range targets {
+		addresses[i] = t.Address()
+	}
+	return newParam(tableTaskSSHHostKey).SetArgs(db.Cond{`address`: db.In(addresses)}).Delete()
+}
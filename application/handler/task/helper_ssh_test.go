@@ -0,0 +1,66 @@
+package task
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRemoteScript(t *testing.T) {
+	script := remoteScript(`echo $A`, `/tmp/it's`, []string{`A=1 2`, `invalid`})
+	assert.Equal(t, "export A='1 2'\ncd '/tmp/it'\\''s' || exit 1\necho $A", script)
+}
+
+func TestPrefixWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := &prefixWriter{w: buf, prefix: []byte(`[a] `)}
+	w.Write([]byte("line1\nli"))
+	w.Write([]byte("ne2\n"))
+	assert.Equal(t, "[a] line1\n[a] line2\n", buf.String())
+}
+
+func TestSummarizeTargets(t *testing.T) {
+	a := &SSHTarget{Name: `a`}
+	b := &SSHTarget{Name: `b`}
+	out, _, err, isTimeout := summarizeTargets([]*targetResult{
+		{target: a, status: `success`, reason: `执行成功`},
+		{target: b, status: `success`, reason: `执行成功`},
+	})
+	assert.NoError(t, err)
+	assert.False(t, isTimeout)
+	assert.Equal(t, "[a] 执行成功\n[b] 执行成功", out)
+
+	_, _, err, isTimeout = summarizeTargets([]*targetResult{
+		{target: a, status: `failure`, reason: endReason(errors.New(`x`), false, 0)},
+		nil,
+	})
+	assert.Error(t, err)
+	assert.False(t, isTimeout)
+}
+
+func TestPinnedHostKey(t *testing.T) {
+	useTestDB(t)
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		return key
+	}
+	key := newKey()
+	target := &SSHTarget{Host: `127.0.0.1`, Port: 2222}
+	assert.NoError(t, pinnedHostKey(target.Address(), nil, key))
+	assert.NoError(t, pinnedHostKey(target.Address(), nil, key))
+
+	// 公钥改变时拒绝连接，重新信任后记录新的公钥
+	other := newKey()
+	assert.Error(t, pinnedHostKey(target.Address(), nil, other))
+	require.NoError(t, resetHostKeys([]*SSHTarget{target}))
+	assert.NoError(t, pinnedHostKey(target.Address(), nil, other))
+	assert.Error(t, pinnedHostKey(target.Address(), nil, key))
+}
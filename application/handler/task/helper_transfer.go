@@ -0,0 +1,942 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/webx-top/db"
+	"github.com/webx-top/db/lib/factory"
+	"github.com/webx-top/echo"
+	"gopkg.in/yaml.v3"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cron"
+)
+
+// 导入导出的文件格式
+const (
+	FormatYAML = `yaml`
+	FormatJSON = `json`
+)
+
+// definitionVersion 导出文件的格式版本
+const definitionVersion = 1
+
+// 导入时的操作
+const (
+	ImportCreate    = `create`
+	ImportUpdate    = `update`
+	ImportUnchanged = `unchanged`
+)
+
+// TaskDefinitions 导入导出的任务和分组定义
+type TaskDefinitions struct {
+	Version int                `json:"version" yaml:"version"`
+	Groups  []*GroupDefinition `json:"groups" yaml:"groups"`
+	Tasks   []*TaskDefinition  `json:"tasks" yaml:"tasks"`
+
+	sshTargets map[string]uint // SSH主机名称 => ID
+}
+
+// GroupDefinition 分组定义
+type GroupDefinition struct {
+	Name         string               `json:"name" yaml:"name"`
+	Description  string               `json:"description,omitempty" yaml:"description,omitempty"`
+	CmdPrefix    string               `json:"cmd_prefix,omitempty" yaml:"cmd_prefix,omitempty"`
+	CmdSuffix    string               `json:"cmd_suffix,omitempty" yaml:"cmd_suffix,omitempty"`
+	LogRetention *RetentionDefinition `json:"log_retention,omitempty" yaml:"log_retention,omitempty"`
+	Notify       *NotifyDefinition    `json:"notify,omitempty" yaml:"notify,omitempty"`
+}
+
+// TaskDefinition 任务定义。分组和上游任务均以名称关联
+type TaskDefinition struct {
+	Name            string               `json:"name" yaml:"name"`
+	Group           string               `json:"group,omitempty" yaml:"group,omitempty"`
+	Description     string               `json:"description,omitempty" yaml:"description,omitempty"`
+	CronSpec        string               `json:"cron_spec" yaml:"cron_spec"`
+	Timezone        string               `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	HTTP            *HTTPDefinition      `json:"http,omitempty" yaml:"http,omitempty"`
+	Targets         []string             `json:"targets,omitempty" yaml:"targets,omitempty"`
+	FanOut          string               `json:"fan_out,omitempty" yaml:"fan_out,omitempty"`
+	Command         string               `json:"command" yaml:"command"`
+	WorkDirectory   string               `json:"work_directory,omitempty" yaml:"work_directory,omitempty"`
+	Env             string               `json:"env,omitempty" yaml:"env,omitempty"`
+	Timeout         uint64               `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Disabled        bool                 `json:"disabled" yaml:"disabled"`
+	EnableNotify    uint                 `json:"enable_notify,omitempty" yaml:"enable_notify,omitempty"`
+	NotifyEmail     string               `json:"notify_email,omitempty" yaml:"notify_email,omitempty"`
+	ClosedLog       bool                 `json:"closed_log,omitempty" yaml:"closed_log,omitempty"`
+	OverlapPolicy   string               `json:"overlap_policy,omitempty" yaml:"overlap_policy,omitempty"`
+	RetryCount      uint                 `json:"retry_count,omitempty" yaml:"retry_count,omitempty"`
+	RetryBackoff    uint                 `json:"retry_backoff,omitempty" yaml:"retry_backoff,omitempty"`
+	Upstreams       []string             `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+	UpstreamFailure string               `json:"upstream_failure,omitempty" yaml:"upstream_failure,omitempty"`
+	LogRetention    *RetentionDefinition `json:"log_retention,omitempty" yaml:"log_retention,omitempty"`
+	Notify          *NotifyDefinition    `json:"notify,omitempty" yaml:"notify,omitempty"`
+}
+
+// HTTPDefinition HTTP请求任务定义。设置后任务类型为HTTP请求，command字段被忽略
+type HTTPDefinition struct {
+	Method       string `json:"method" yaml:"method"`
+	URL          string `json:"url" yaml:"url"`
+	Headers      string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body         string `json:"body,omitempty" yaml:"body,omitempty"`
+	ExpectStatus string `json:"expect_status,omitempty" yaml:"expect_status,omitempty"`
+	ExpectBody   string `json:"expect_body,omitempty" yaml:"expect_body,omitempty"`
+	Insecure     bool   `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+}
+
+func (h *HTTPDefinition) String() string {
+	if h == nil {
+		return ``
+	}
+	return fmt.Sprintf(`%s %s`, h.Method, h.URL)
+}
+
+func newHTTPDefinition(row *TaskHTTP) *HTTPDefinition {
+	return &HTTPDefinition{
+		Method:       row.Method,
+		URL:          row.URL,
+		Headers:      row.Headers,
+		Body:         row.Body,
+		ExpectStatus: row.ExpectStatus,
+		ExpectBody:   row.ExpectBody,
+		Insecure:     row.Insecure == `Y`,
+	}
+}
+
+func (h *HTTPDefinition) taskHTTP() *TaskHTTP {
+	row := &TaskHTTP{
+		Method:       h.Method,
+		URL:          h.URL,
+		Headers:      h.Headers,
+		Body:         h.Body,
+		ExpectStatus: h.ExpectStatus,
+		ExpectBody:   h.ExpectBody,
+		Insecure:     boolYN(h.Insecure),
+	}
+	row.setDefaults()
+	return row
+}
+
+// RetentionDefinition 日志保留规则定义
+type RetentionDefinition struct {
+	KeepRuns        uint `json:"keep_runs,omitempty" yaml:"keep_runs,omitempty"`
+	KeepDays        uint `json:"keep_days,omitempty" yaml:"keep_days,omitempty"`
+	KeepFailureDays uint `json:"keep_failure_days,omitempty" yaml:"keep_failure_days,omitempty"`
+}
+
+func (r *RetentionDefinition) String() string {
+	if r == nil {
+		return ``
+	}
+	return fmt.Sprintf(`keep_runs=%d keep_days=%d keep_failure_days=%d`, r.KeepRuns, r.KeepDays, r.KeepFailureDays)
+}
+
+func newRetentionDefinition(row *LogRetention) *RetentionDefinition {
+	if row == nil || row.IsEmpty() {
+		return nil
+	}
+	return &RetentionDefinition{
+		KeepRuns:        row.KeepRuns,
+		KeepDays:        row.KeepDays,
+		KeepFailureDays: row.KeepFailureDays,
+	}
+}
+
+func (r *RetentionDefinition) validate() error {
+	if r == nil {
+		return nil
+	}
+	row := &LogRetention{}
+	r.apply(row)
+	return row.validate()
+}
+
+func (r *RetentionDefinition) apply(row *LogRetention) {
+	row.KeepRuns, row.KeepDays, row.KeepFailureDays = 0, 0, 0
+	if r != nil {
+		row.KeepRuns = r.KeepRuns
+		row.KeepDays = r.KeepDays
+		row.KeepFailureDays = r.KeepFailureDays
+	}
+}
+
+// NotifyDefinition 告警通知规则定义
+type NotifyDefinition struct {
+	Topic   string   `json:"topic" yaml:"topic"`
+	Events  []string `json:"events" yaml:"events"`
+	Title   string   `json:"title,omitempty" yaml:"title,omitempty"`
+	Content string   `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+func (n *NotifyDefinition) String() string {
+	if n == nil {
+		return ``
+	}
+	return fmt.Sprintf(`topic=%s events=%s`, n.Topic, strings.Join(n.Events, `,`))
+}
+
+func newNotifyDefinition(row *TaskNotify) *NotifyDefinition {
+	if row == nil || row.IsEmpty() {
+		return nil
+	}
+	return &NotifyDefinition{
+		Topic:   row.Topic,
+		Events:  strings.Split(row.Events, `,`),
+		Title:   row.TitleTemplate,
+		Content: row.ContentTemplate,
+	}
+}
+
+func (n *NotifyDefinition) apply(row *TaskNotify) {
+	row.Topic, row.Events, row.TitleTemplate, row.ContentTemplate = ``, ``, ``, ``
+	if n != nil {
+		row.Topic = n.Topic
+		row.Events = strings.Join(n.Events, `,`)
+		row.TitleTemplate = n.Title
+		row.ContentTemplate = n.Content
+	}
+}
+
+func (n *NotifyDefinition) normalize() *NotifyDefinition {
+	if n == nil {
+		return nil
+	}
+	n.Topic = strings.TrimSpace(n.Topic)
+	if len(n.Topic) == 0 {
+		return nil
+	}
+	n.Title = strings.TrimSpace(n.Title)
+	n.Content = strings.TrimSpace(n.Content)
+	return n
+}
+
+func (n *NotifyDefinition) validate() error {
+	if n == nil {
+		return nil
+	}
+	row := &TaskNotify{}
+	n.apply(row)
+	return row.validate()
+}
+
+// normalize 统一默认值，以便比较
+func (t *TaskDefinition) normalize() {
+	t.Name = strings.TrimSpace(t.Name)
+	t.Group = strings.TrimSpace(t.Group)
+	t.Command = strings.TrimSpace(t.Command)
+	t.Env = strings.TrimSpace(t.Env)
+	t.NotifyEmail = strings.TrimSpace(t.NotifyEmail)
+	t.Timezone = strings.TrimSpace(t.Timezone)
+	if spec, err := normalizeCronSpec(t.CronSpec); err == nil {
+		t.CronSpec = spec
+	}
+	if len(t.OverlapPolicy) == 0 {
+		t.OverlapPolicy = OverlapSkip
+	}
+	if len(t.UpstreamFailure) == 0 {
+		t.UpstreamFailure = UpstreamFailureSkip
+	}
+	sort.Strings(t.Upstreams)
+	if t.HTTP != nil {
+		t.HTTP.Method = strings.ToUpper(strings.TrimSpace(t.HTTP.Method))
+		if len(t.HTTP.Method) == 0 {
+			t.HTTP.Method = http.MethodGet
+		}
+		t.HTTP.URL = strings.TrimSpace(t.HTTP.URL)
+		t.Command = t.HTTP.String()
+	}
+	if len(t.Targets) == 0 {
+		t.FanOut = ``
+	} else if len(t.FanOut) == 0 {
+		t.FanOut = FanOutSequential
+	}
+	if t.LogRetention != nil && *t.LogRetention == (RetentionDefinition{}) {
+		t.LogRetention = nil
+	}
+	t.Notify = t.Notify.normalize()
+}
+
+func (g *GroupDefinition) normalize() {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.LogRetention != nil && *g.LogRetention == (RetentionDefinition{}) {
+		g.LogRetention = nil
+	}
+	g.Notify = g.Notify.normalize()
+}
+
+// Marshal 序列化为指定格式
+func (d *TaskDefinitions) Marshal(format string) ([]byte, error) {
+	if format == FormatJSON {
+		return json.MarshalIndent(d, ``, `  `)
+	}
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(d); err != nil {
+		return nil, err
+	}
+	err := enc.Close()
+	return buf.Bytes(), err
+}
+
+// detectFormat 根据内容判断格式
+func detectFormat(content []byte) string {
+	content = bytes.TrimSpace(content)
+	if len(content) > 0 && content[0] == '{' {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// parseDefinitions 解析导入内容(YAML兼容JSON)
+func parseDefinitions(content []byte) (*TaskDefinitions, error) {
+	defs := &TaskDefinitions{}
+	var err error
+	if detectFormat(content) == FormatJSON {
+		err = json.Unmarshal(content, defs)
+	} else {
+		err = yaml.Unmarshal(content, defs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if defs.Version > definitionVersion {
+		return nil, fmt.Errorf(`unsupported version: %d`, defs.Version)
+	}
+	for _, g := range defs.Groups {
+		g.normalize()
+	}
+	for _, t := range defs.Tasks {
+		t.normalize()
+	}
+	return defs, nil
+}
+
+// exportDefinitions 导出任务定义。taskIDs为空时导出全部任务
+func exportDefinitions(taskIDs []uint) (*TaskDefinitions, error) {
+	defs := &TaskDefinitions{Version: definitionVersion}
+	mg := dbschema.NewNgingTaskGroup(nil)
+	_, err := mg.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.OrderBy(`id`)
+	}, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	byGroup, byTask, err := listLogRetentions()
+	if err != nil {
+		return nil, err
+	}
+	notifyByGroup, notifyByTask, err := listTaskNotifies()
+	if err != nil {
+		return nil, err
+	}
+	groupNames := map[uint]string{}
+	for _, g := range mg.Objects() {
+		groupNames[g.Id] = g.Name
+	}
+	defs.sshTargets = map[string]uint{}
+	sshTargetNames := map[uint]string{}
+	for _, t := range listSSHTargetsQuietly() {
+		defs.sshTargets[t.Title()] = t.Id
+		sshTargetNames[t.Id] = t.Title()
+	}
+	m := dbschema.NewNgingTask(nil)
+	cond := db.Cond{}
+	if len(taskIDs) > 0 {
+		cond[`id`] = db.In(taskIDs)
+	}
+	_, err = m.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.OrderBy(`id`)
+	}, 0, -1, cond)
+	if err != nil {
+		return nil, err
+	}
+	tasks := m.Objects()
+	// 上游任务的名称需要查询全部任务
+	allNames := map[uint]string{}
+	mAll := dbschema.NewNgingTask(nil)
+	_, err = mAll.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.Select(`id`, `name`)
+	}, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range mAll.Objects() {
+		allNames[t.Id] = t.Name
+	}
+	deps, err := listDependencies()
+	if err != nil {
+		return nil, err
+	}
+	usedGroups := map[uint]struct{}{}
+	for _, t := range tasks {
+		extra, err := getTaskExtra(t.Id)
+		if err != nil {
+			return nil, err
+		}
+		def := &TaskDefinition{
+			Name:            t.Name,
+			Group:           groupNames[t.GroupId],
+			Description:     t.Description,
+			CronSpec:        t.CronSpec,
+			Timezone:        extra.Timezone,
+			Command:         t.Command,
+			WorkDirectory:   t.WorkDirectory,
+			Env:             t.Env,
+			Timeout:         t.Timeout,
+			Disabled:        t.Disabled == `Y`,
+			EnableNotify:    t.EnableNotify,
+			NotifyEmail:     t.NotifyEmail,
+			ClosedLog:       t.ClosedLog == `Y`,
+			OverlapPolicy:   extra.overlapPolicy(t),
+			RetryCount:      extra.RetryCount,
+			RetryBackoff:    extra.RetryBackoff,
+			UpstreamFailure: extra.UpstreamFailure,
+			LogRetention:    newRetentionDefinition(byTask[t.Id]),
+			Notify:          newNotifyDefinition(notifyByTask[t.Id]),
+		}
+		if t.Type == TaskTypeHTTP {
+			httpCfg, err := getTaskHTTP(t.Id)
+			if err != nil {
+				return nil, err
+			}
+			def.HTTP = newHTTPDefinition(httpCfg)
+		}
+		for _, id := range parseIDs(extra.SSHUserIds) {
+			if name, ok := sshTargetNames[id]; ok {
+				def.Targets = append(def.Targets, name)
+			}
+		}
+		if len(def.Targets) > 0 {
+			def.FanOut = extra.FanOut
+		}
+		for _, upID := range deps[t.Id] {
+			if name, ok := allNames[upID]; ok {
+				def.Upstreams = append(def.Upstreams, name)
+			}
+		}
+		def.normalize()
+		defs.Tasks = append(defs.Tasks, def)
+		if t.GroupId > 0 {
+			usedGroups[t.GroupId] = struct{}{}
+		}
+	}
+	for _, g := range mg.Objects() {
+		if _, ok := usedGroups[g.Id]; !ok && len(taskIDs) > 0 {
+			continue
+		}
+		def := &GroupDefinition{
+			Name:         g.Name,
+			Description:  g.Description,
+			CmdPrefix:    g.CmdPrefix,
+			CmdSuffix:    g.CmdSuffix,
+			LogRetention: newRetentionDefinition(byGroup[g.Id]),
+			Notify:       newNotifyDefinition(notifyByGroup[g.Id]),
+		}
+		def.normalize()
+		defs.Groups = append(defs.Groups, def)
+	}
+	return defs, nil
+}
+
+// FieldChange 字段变化
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// ImportChange 导入时对某个分组或任务的操作
+type ImportChange struct {
+	Name    string
+	Action  string
+	Changes []*FieldChange
+}
+
+// ImportPlan 导入计划(试运行结果)
+type ImportPlan struct {
+	Groups []*ImportChange
+	Tasks  []*ImportChange
+	Errors []string
+}
+
+// HasError 导入内容是否有错误
+func (p *ImportPlan) HasError() bool {
+	return len(p.Errors) > 0
+}
+
+// Count 统计指定操作的数量
+func (p *ImportPlan) Count(action string) int {
+	var n int
+	for _, list := range [][]*ImportChange{p.Groups, p.Tasks} {
+		for _, c := range list {
+			if c.Action == action {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// diffFields 比较两个相同类型结构体的字段(跳过Name)
+func diffFields(oldV interface{}, newV interface{}) []*FieldChange {
+	var changes []*FieldChange
+	ov := reflect.ValueOf(oldV).Elem()
+	nv := reflect.ValueOf(newV).Elem()
+	typ := ov.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Name == `Name` {
+			continue
+		}
+		o := ov.Field(i).Interface()
+		n := nv.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		name := strings.SplitN(field.Tag.Get(`yaml`), `,`, 2)[0]
+		changes = append(changes, &FieldChange{Field: name, Old: fieldString(o), New: fieldString(n)})
+	}
+	return changes
+}
+
+func fieldString(v interface{}) string {
+	switch x := v.(type) {
+	case []string:
+		return strings.Join(x, `, `)
+	case *RetentionDefinition:
+		return x.String()
+	case *NotifyDefinition:
+		return x.String()
+	case *HTTPDefinition:
+		if x == nil {
+			return ``
+		}
+		b, _ := json.Marshal(x)
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// keepDisabledState 导入时保持启用状态：新建的任务停用，已有任务保持原有状态
+func keepDisabledState(current *TaskDefinitions, incoming *TaskDefinitions) {
+	disabled := map[string]bool{}
+	for _, t := range current.Tasks {
+		if _, ok := disabled[t.Name]; !ok {
+			disabled[t.Name] = t.Disabled
+		}
+	}
+	for _, t := range incoming.Tasks {
+		if v, ok := disabled[t.Name]; ok {
+			t.Disabled = v
+		} else {
+			t.Disabled = true
+		}
+	}
+}
+
+// diffDefinitions 比较当前定义和导入的定义，生成导入计划。不会删除导入内容中不存在的任务
+func diffDefinitions(current *TaskDefinitions, incoming *TaskDefinitions) *ImportPlan {
+	plan := &ImportPlan{}
+	currentGroups := map[string]*GroupDefinition{}
+	for _, g := range current.Groups {
+		currentGroups[g.Name] = g
+	}
+	incomingGroups := map[string]struct{}{}
+	for _, g := range incoming.Groups {
+		if len(g.Name) == 0 {
+			plan.Errors = append(plan.Errors, `分组名称不能为空`)
+			continue
+		}
+		if _, ok := incomingGroups[g.Name]; ok {
+			plan.Errors = append(plan.Errors, fmt.Sprintf(`分组名称重复：%s`, g.Name))
+			continue
+		}
+		incomingGroups[g.Name] = struct{}{}
+		if err := g.Notify.validate(); err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf(`[%s] %v`, g.Name, err))
+		}
+		if err := g.LogRetention.validate(); err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf(`[%s] %v`, g.Name, err))
+		}
+		change := &ImportChange{Name: g.Name, Action: ImportCreate}
+		if old, ok := currentGroups[g.Name]; ok {
+			change.Changes = diffFields(old, g)
+			if len(change.Changes) > 0 {
+				change.Action = ImportUpdate
+			} else {
+				change.Action = ImportUnchanged
+			}
+		}
+		plan.Groups = append(plan.Groups, change)
+	}
+	currentTasks := map[string]*TaskDefinition{}
+	for _, t := range current.Tasks {
+		if _, ok := currentTasks[t.Name]; !ok {
+			currentTasks[t.Name] = t
+		}
+	}
+	incomingTasks := map[string]*TaskDefinition{}
+	for _, t := range incoming.Tasks {
+		if len(t.Name) == 0 {
+			plan.Errors = append(plan.Errors, `任务名称不能为空`)
+			continue
+		}
+		if _, ok := incomingTasks[t.Name]; ok {
+			plan.Errors = append(plan.Errors, fmt.Sprintf(`任务名称重复：%s`, t.Name))
+			continue
+		}
+		incomingTasks[t.Name] = t
+		plan.Errors = append(plan.Errors, checkTaskDefinition(t, currentGroups, incomingGroups, current.sshTargets)...)
+		change := &ImportChange{Name: t.Name, Action: ImportCreate}
+		if old, ok := currentTasks[t.Name]; ok {
+			change.Changes = diffFields(old, t)
+			if len(change.Changes) > 0 {
+				change.Action = ImportUpdate
+			} else {
+				change.Action = ImportUnchanged
+			}
+		}
+		plan.Tasks = append(plan.Tasks, change)
+	}
+	plan.Errors = append(plan.Errors, checkImportDependencies(current, incomingTasks)...)
+	return plan
+}
+
+func checkTaskDefinition(t *TaskDefinition, currentGroups map[string]*GroupDefinition, incomingGroups map[string]struct{}, sshTargets map[string]uint) []string {
+	var errs []string
+	if len(t.Group) > 0 {
+		_, ok := currentGroups[t.Group]
+		if _, ok2 := incomingGroups[t.Group]; !ok && !ok2 {
+			errs = append(errs, fmt.Sprintf(`[%s] 分组不存在：%s`, t.Name, t.Group))
+		}
+	}
+	if _, err := loadTimezone(t.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf(`[%s] 无效的时区：%s`, t.Name, t.Timezone))
+	} else if _, err := normalizeCronSpecWithTimezone(t.CronSpec, t.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf(`[%s] 无效的Cron时间：%s`, t.Name, t.CronSpec))
+	}
+	if !OverlapPolicies.Has(t.OverlapPolicy) {
+		errs = append(errs, fmt.Sprintf(`[%s] 无效的overlap_policy：%s`, t.Name, t.OverlapPolicy))
+	}
+	if !UpstreamFailures.Has(t.UpstreamFailure) {
+		errs = append(errs, fmt.Sprintf(`[%s] 无效的upstream_failure：%s`, t.Name, t.UpstreamFailure))
+	}
+	if t.RetryCount > maxRetryCount {
+		errs = append(errs, fmt.Sprintf(`[%s] 重试次数不能超过%d`, t.Name, maxRetryCount))
+	}
+	for _, name := range t.Targets {
+		if _, ok := sshTargets[name]; !ok {
+			errs = append(errs, fmt.Sprintf(`[%s] SSH主机不存在：%s`, t.Name, name))
+		}
+	}
+	if t.HTTP != nil {
+		if err := t.HTTP.taskHTTP().validate(); err != nil {
+			errs = append(errs, fmt.Sprintf(`[%s] %v`, t.Name, err))
+		}
+	}
+	if err := t.Notify.validate(); err != nil {
+		errs = append(errs, fmt.Sprintf(`[%s] %v`, t.Name, err))
+	}
+	if err := t.LogRetention.validate(); err != nil {
+		errs = append(errs, fmt.Sprintf(`[%s] %v`, t.Name, err))
+	}
+	if len(t.Targets) > 0 {
+		if t.HTTP != nil {
+			errs = append(errs, fmt.Sprintf(`[%s] HTTP请求任务只能在本机执行`, t.Name))
+		}
+		if !FanOuts.Has(t.FanOut) {
+			errs = append(errs, fmt.Sprintf(`[%s] 无效的fan_out：%s`, t.Name, t.FanOut))
+		}
+		if isSystemCommand(t.Command) {
+			errs = append(errs, fmt.Sprintf(`[%s] 系统命令任务只能在本机执行`, t.Name))
+		}
+	}
+	if len(t.Upstreams) > 0 && isSystemCommand(t.Command) {
+		errs = append(errs, fmt.Sprintf(`[%s] 系统命令任务不支持设置上游任务`, t.Name))
+	}
+	return errs
+}
+
+// checkImportDependencies 检查导入后的依赖关系是否有效
+func checkImportDependencies(current *TaskDefinitions, incomingTasks map[string]*TaskDefinition) []string {
+	var errs []string
+	ids := map[string]uint{}
+	commands := map[string]string{}
+	deps := map[string][]string{}
+	for _, t := range current.Tasks {
+		ids[t.Name] = uint(len(ids) + 1)
+		commands[t.Name] = t.Command
+		deps[t.Name] = t.Upstreams
+	}
+	for name, t := range incomingTasks {
+		if _, ok := ids[name]; !ok {
+			ids[name] = uint(len(ids) + 1)
+		}
+		commands[name] = t.Command
+		deps[name] = t.Upstreams
+	}
+	names := make([]string, len(ids)+1)
+	for name, id := range ids {
+		names[id] = name
+	}
+	graph := map[uint][]uint{}
+	for name, upstreams := range deps {
+		for _, up := range upstreams {
+			upID, ok := ids[up]
+			if !ok {
+				errs = append(errs, fmt.Sprintf(`[%s] 上游任务不存在：%s`, name, up))
+				continue
+			}
+			if isSystemCommand(commands[up]) {
+				errs = append(errs, fmt.Sprintf(`[%s] 系统命令任务不支持作为上游任务：%s`, name, up))
+				continue
+			}
+			graph[ids[name]] = append(graph[ids[name]], upID)
+		}
+	}
+	if cycle := findDependencyCycle(graph); cycle != nil {
+		parts := make([]string, len(cycle))
+		for i, id := range cycle {
+			parts[i] = names[id]
+		}
+		errs = append(errs, `任务依赖关系中存在循环：`+strings.Join(parts, ` -> `))
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// importDefinitions 导入任务定义。keepDisabled为true时新建的任务保持停用，已有任务保持原有状态。
+// 所有数据在同一个事务中保存，任一项失败时全部回滚
+func importDefinitions(ctx echo.Context, uid uint, defs *TaskDefinitions, keepDisabled bool) error {
+	p := factory.NewParam(factory.DefaultFactory)
+	err := p.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	imported, err := saveDefinitions(ctx, p.Trans(), uid, defs, keepDisabled)
+	if err != nil {
+		p.Rollback(ctx)
+		return err
+	}
+	if err = p.Commit(ctx); err != nil {
+		return err
+	}
+	for _, t := range imported {
+		if err = cron.SaveScriptFile(t); err != nil {
+			return err
+		}
+	}
+	// 重新加载定时任务
+	for _, t := range imported {
+		removeJob(t.Id)
+		if t.Disabled == `N` {
+			if _, err = addJob(context.Background(), t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveDefinitions 在事务tx中保存导入的分组和任务，返回导入的任务
+func saveDefinitions(ctx echo.Context, tx factory.Transactioner, uid uint, defs *TaskDefinitions, keepDisabled bool) ([]*dbschema.NgingTask, error) {
+	mg := dbschema.NewNgingTaskGroup(ctx)
+	mg.Use(tx)
+	_, err := mg.ListByOffset(nil, nil, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	groupIDs := map[string]uint{}
+	for _, g := range mg.Objects() {
+		if _, ok := groupIDs[g.Name]; !ok {
+			groupIDs[g.Name] = g.Id
+		}
+	}
+	sshTargets := map[string]uint{}
+	for _, t := range listSSHTargetsQuietly() {
+		sshTargets[t.Title()] = t.Id
+	}
+	for _, def := range defs.Groups {
+		g := dbschema.NewNgingTaskGroup(ctx)
+		g.Use(tx)
+		groupID, exists := groupIDs[def.Name]
+		if exists {
+			err = g.Get(nil, `id`, groupID)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			g.Uid = uid
+			g.Name = def.Name
+		}
+		g.Description = def.Description
+		g.CmdPrefix = def.CmdPrefix
+		g.CmdSuffix = def.CmdSuffix
+		if exists {
+			err = g.Update(nil, `id`, groupID)
+		} else {
+			_, err = g.Insert()
+			groupID = g.Id
+			groupIDs[def.Name] = groupID
+		}
+		if err != nil {
+			return nil, err
+		}
+		retention := &LogRetention{GroupId: groupID}
+		def.LogRetention.apply(retention)
+		if err = saveLogRetention(tx, retention); err != nil {
+			return nil, err
+		}
+		notify := &TaskNotify{GroupId: groupID}
+		def.Notify.apply(notify)
+		if err = saveTaskNotify(tx, notify); err != nil {
+			return nil, err
+		}
+	}
+	m := dbschema.NewNgingTask(ctx)
+	m.Use(tx)
+	_, err = m.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.OrderBy(`id`)
+	}, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	taskIDs := map[string]uint{}
+	existing := map[uint]*dbschema.NgingTask{}
+	for _, t := range m.Objects() {
+		if _, ok := taskIDs[t.Name]; !ok {
+			taskIDs[t.Name] = t.Id
+			existing[t.Id] = t
+		}
+	}
+	imported := make([]*dbschema.NgingTask, 0, len(defs.Tasks))
+	for _, def := range defs.Tasks {
+		taskID, exists := taskIDs[def.Name]
+		t := dbschema.NewNgingTask(ctx)
+		if exists {
+			t = existing[taskID]
+			t.SetContext(ctx)
+		}
+		t.Use(tx)
+		if !exists {
+			t.Uid = uid
+			t.Name = def.Name
+			t.Disabled = `Y`
+		}
+		t.GroupId = groupIDs[def.Group]
+		t.Description = def.Description
+		t.CronSpec, err = normalizeCronSpecWithTimezone(def.CronSpec, def.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf(`[%s] 无效的Cron时间：%s: %w`, def.Name, def.CronSpec, err)
+		}
+		t.Command = def.Command
+		t.Type = TaskTypeCommand
+		if def.HTTP != nil {
+			t.Type = TaskTypeHTTP
+		}
+		t.WorkDirectory = def.WorkDirectory
+		t.Env = def.Env
+		t.Timeout = def.Timeout
+		t.EnableNotify = def.EnableNotify
+		t.NotifyEmail = def.NotifyEmail
+		t.ClosedLog = boolYN(def.ClosedLog)
+		if !keepDisabled {
+			t.Disabled = boolYN(def.Disabled)
+		}
+		extra := &TaskExtra{
+			UpstreamFailure: def.UpstreamFailure,
+			RetryCount:      def.RetryCount,
+			RetryBackoff:    def.RetryBackoff,
+			OverlapPolicy:   def.OverlapPolicy,
+			Timezone:        def.Timezone,
+			FanOut:          def.FanOut,
+		}
+		sshUserIDs := make([]uint, 0, len(def.Targets))
+		for _, name := range def.Targets {
+			if id, ok := sshTargets[name]; ok {
+				sshUserIDs = append(sshUserIDs, id)
+			}
+		}
+		extra.SSHUserIds = joinIDs(sshUserIDs)
+		applyOverlapPolicy(t, extra)
+		if exists {
+			err = t.Update(nil, `id`, taskID)
+		} else {
+			_, err = t.Insert()
+			taskID = t.Id
+			taskIDs[def.Name] = taskID
+		}
+		if err != nil {
+			return nil, err
+		}
+		extra.TaskId = taskID
+		if err = saveTaskExtra(tx, extra); err != nil {
+			return nil, err
+		}
+		if def.HTTP != nil {
+			httpCfg := def.HTTP.taskHTTP()
+			httpCfg.TaskId = taskID
+			err = saveTaskHTTP(tx, httpCfg)
+		} else {
+			err = deleteTaskHTTP(tx, taskID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		retention := &LogRetention{TaskId: taskID}
+		def.LogRetention.apply(retention)
+		if err = saveLogRetention(tx, retention); err != nil {
+			return nil, err
+		}
+		notify := &TaskNotify{TaskId: taskID}
+		def.Notify.apply(notify)
+		if err = saveTaskNotify(tx, notify); err != nil {
+			return nil, err
+		}
+		imported = append(imported, t)
+	}
+	for _, def := range defs.Tasks {
+		upstreamIDs := make([]uint, 0, len(def.Upstreams))
+		for _, up := range def.Upstreams {
+			upstreamIDs = append(upstreamIDs, taskIDs[up])
+		}
+		if err = saveUpstreams(tx, taskIDs[def.Name], upstreamIDs); err != nil {
+			return nil, err
+		}
+	}
+	return imported, nil
+}
+
+func boolYN(v bool) string {
+	if v {
+		return `Y`
+	}
+	return `N`
+}
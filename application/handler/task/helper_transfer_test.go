@@ -0,0 +1,97 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/webx-top/db"
+	"github.com/webx-top/echo/defaults"
+
+	"github.com/coscms/webcore/dbschema"
+	"github.com/coscms/webcore/library/cron"
+)
+
+func TestDiffDefinitions(t *testing.T) {
+	current := &TaskDefinitions{
+		Groups: []*GroupDefinition{{Name: `g1`}},
+		Tasks: []*TaskDefinition{
+			{Name: `a`, Group: `g1`, CronSpec: `* * * * * *`, Command: `echo a`},
+			{Name: `b`, CronSpec: `* * * * * *`, Command: `echo b`, Upstreams: []string{`a`}},
+		},
+	}
+	for _, v := range current.Tasks {
+		v.normalize()
+	}
+	incoming, err := parseDefinitions([]byte(`
+version: 1
+tasks:
+  - name: a
+    group: g1
+    cron_spec: "* * * * * *"
+    command: echo a2
+  - name: c
+    cron_spec: "* * * * * *"
+    command: echo c
+    upstreams: [b]
+`))
+	assert.NoError(t, err)
+	plan := diffDefinitions(current, incoming)
+	assert.False(t, plan.HasError())
+	assert.Equal(t, 1, plan.Count(ImportUpdate))
+	assert.Equal(t, 1, plan.Count(ImportCreate))
+	assert.Equal(t, `command`, plan.Tasks[0].Changes[0].Field)
+
+	keepDisabledState(current, incoming)
+	assert.False(t, incoming.Tasks[0].Disabled)
+	assert.True(t, incoming.Tasks[1].Disabled)
+
+	incoming.Tasks[0].Upstreams = []string{`c`}
+	plan = diffDefinitions(current, incoming)
+	assert.True(t, plan.HasError())
+}
+
+func TestImportDefinitionsRollback(t *testing.T) {
+	useTestDB(t)
+	cron.Initial(1)
+	ctx := defaults.NewMockContext()
+	defs := &TaskDefinitions{
+		Groups: []*GroupDefinition{{Name: `g1`}},
+		Tasks:  []*TaskDefinition{{Name: `a`, Group: `g1`, CronSpec: `* * * * * *`, Command: `echo a`, Disabled: true}},
+	}
+	require.NoError(t, importDefinitions(ctx, 1, defs, false))
+
+	// 保存过程中出错时，已写入的分组和任务全部回滚
+	_, err := newParam(tableTaskDependency).DB().Exec("DROP TABLE `nging_task_dependency`")
+	require.NoError(t, err)
+	defs.Groups = append(defs.Groups, &GroupDefinition{Name: `g2`})
+	defs.Tasks[0].Command = `echo a2`
+	defs.Tasks = append(defs.Tasks, &TaskDefinition{Name: `b`, CronSpec: `* * * * * *`, Command: `echo b`, Disabled: true})
+	assert.Error(t, importDefinitions(ctx, 1, defs, false))
+
+	m := dbschema.NewNgingTask(ctx)
+	_, err = m.ListByOffset(nil, nil, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, m.Objects(), 1)
+	assert.Equal(t, `echo a`, m.Objects()[0].Command)
+	n, err := dbschema.NewNgingTaskGroup(ctx).Count(nil, db.Cond{`name`: `g2`})
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestCheckTaskDefinitionCronSpec(t *testing.T) {
+	for spec, valid := range map[string]bool{
+		`every 5 minutes`: true,
+		`* * * * * *`:     true,
+		`sometimes`:       false,
+	} {
+		def := &TaskDefinition{Name: `a`, CronSpec: spec, Command: `echo a`, Timezone: `Asia/Shanghai`}
+		def.normalize()
+		errs := checkTaskDefinition(def, nil, nil, nil)
+		if valid {
+			assert.Empty(t, errs, spec)
+		} else {
+			assert.Equal(t, []string{`[a] 无效的Cron时间：` + spec}, errs)
+		}
+	}
+}
@@ -29,6 +29,8 @@ func init() {
 		g.Route(`GET,POST`, `/index`, metaHandler(echo.H{`name`: `任务列表`}, Index))
 		g.Route(`GET,POST`, `/add`, metaHandler(echo.H{`name`: `添加任务`}, Add))
 		g.Route(`GET,POST`, `/edit`, metaHandler(echo.H{`name`: `修改任务`}, Edit))
+		g.Route(`GET,POST`, `/cron_preview`, metaHandler(echo.H{`name`: `预览执行时间`}, CronPreview))
+		g.Route(`POST`, `/ssh_host_key_reset`, metaHandler(echo.H{`name`: `重新信任SSH主机公钥`}, SSHHostKeyReset))
 		g.Route(`GET,POST`, `/delete`, metaHandler(echo.H{`name`: `删除任务`}, Delete))
 		g.Route(`GET,POST`, `/start`, metaHandler(echo.H{`name`: `启动任务`}, Start))
 		g.Route(`GET,POST`, `/pause`, metaHandler(echo.H{`name`: `暂停任务`}, Pause))
@@ -41,7 +43,12 @@ func init() {
 		g.Route(`GET,POST`, `/group_delete`, metaHandler(echo.H{`name`: `删除分组`}, GroupDelete))
 		g.Route(`GET,POST`, `/log`, metaHandler(echo.H{`name`: `任务日志列表`}, Log))
 		g.Route(`GET,POST`, `/log_view/:id`, metaHandler(echo.H{`name`: `任务日志详情`}, LogView))
+		g.Route(`GET`, `/log_live/:id`, metaHandler(echo.H{`name`: `任务实时输出`}, LogLive))
 		g.Route(`GET,POST`, `/log_delete`, metaHandler(echo.H{`name`: `删除任务日志`}, LogDelete))
+		g.Route(`GET,POST`, `/flow`, metaHandler(echo.H{`name`: `任务链运行记录`}, Flow))
+		g.Route(`GET,POST`, `/flow_run/:id`, metaHandler(echo.H{`name`: `任务链运行详情`}, FlowRunView))
+		g.Route(`GET,POST`, `/export`, metaHandler(echo.H{`name`: `导出任务`}, Export))
+		g.Route(`GET,POST`, `/import`, metaHandler(echo.H{`name`: `导入任务`}, Import))
 		g.Route(`GET,POST`, `/email_test`, metaHandler(echo.H{`name`: `测试E-mail`}, EmailTest))
 	})
 }
@@ -0,0 +1,208 @@
+--
+-- Table structure for table `nging_task_extra`
+--
+
+DROP TABLE IF EXISTS `nging_task_extra`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_extra` (
+  `task_id` int unsigned NOT NULL COMMENT '任务ID',
+  `upstream_failure` enum('skip','continue','alert') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'skip' COMMENT '上游任务失败时的处理方式(skip-跳过;continue-继续;alert-跳过并告警)',
+  `retry_count` tinyint unsigned NOT NULL DEFAULT '0' COMMENT '失败重试次数',
+  `retry_backoff` int unsigned NOT NULL DEFAULT '0' COMMENT '首次重试间隔(秒)，之后每次翻倍',
+  `overlap_policy` enum('skip','queue','allow') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'skip' COMMENT '执行重叠时的处理方式(skip-跳过;queue-排队;allow-允许)',
+  `ssh_user_ids` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '在这些SSH主机上执行(nging_ssh_user的ID，逗号分隔)，为空时在本机执行',
+  `fan_out` enum('sequential','parallel','fail_fast') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'sequential' COMMENT '在多台主机上执行的方式(sequential-依次执行;parallel-同时执行;fail_fast-依次执行，失败时停止)',
+  `timezone` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '时区(IANA名称，为空时使用服务器时区)',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '修改时间',
+  PRIMARY KEY (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务扩展配置';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_dependency`
+--
+
+DROP TABLE IF EXISTS `nging_task_dependency`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_dependency` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `task_id` int unsigned NOT NULL COMMENT '任务ID',
+  `upstream_id` int unsigned NOT NULL COMMENT '上游任务ID',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `task_dependency_uniq` (`task_id`,`upstream_id`),
+  KEY `task_dependency_upstream_id` (`upstream_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务依赖';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_flow_run`
+--
+
+DROP TABLE IF EXISTS `nging_task_flow_run`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_flow_run` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `root_task_id` int unsigned NOT NULL DEFAULT '0' COMMENT '起始任务ID',
+  `root_log_id` bigint unsigned NOT NULL DEFAULT '0' COMMENT '起始任务日志ID',
+  `status` enum('running','success','failure') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'running' COMMENT '状态',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  `finished` int unsigned NOT NULL DEFAULT '0' COMMENT '结束时间',
+  PRIMARY KEY (`id`),
+  KEY `task_flow_run_root_task_id` (`root_task_id`,`created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务链运行记录';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_flow_node`
+--
+
+DROP TABLE IF EXISTS `nging_task_flow_node`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_flow_node` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `run_id` bigint unsigned NOT NULL COMMENT '运行记录ID',
+  `task_id` int unsigned NOT NULL COMMENT '任务ID',
+  `log_id` bigint unsigned NOT NULL DEFAULT '0' COMMENT '任务日志ID',
+  `status` enum('success','timeout','failure','skipped') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'success' COMMENT '状态',
+  `reason` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '说明',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `task_flow_node_run_id` (`run_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务链节点';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_log_retention`
+--
+
+DROP TABLE IF EXISTS `nging_task_log_retention`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_log_retention` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `group_id` int unsigned NOT NULL DEFAULT '0' COMMENT '任务分组ID',
+  `task_id` int unsigned NOT NULL DEFAULT '0' COMMENT '任务ID',
+  `keep_runs` int unsigned NOT NULL DEFAULT '0' COMMENT '保留最近执行次数(0为不限)',
+  `keep_days` int unsigned NOT NULL DEFAULT '0' COMMENT '保留天数(0为不限)',
+  `keep_failure_days` int unsigned NOT NULL DEFAULT '0' COMMENT '失败记录保留天数(0为与其它记录相同)',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '修改时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `task_log_retention_uniq` (`group_id`,`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务日志保留规则';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_http`
+--
+
+DROP TABLE IF EXISTS `nging_task_http`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_http` (
+  `task_id` int unsigned NOT NULL COMMENT '任务ID',
+  `method` varchar(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'GET' COMMENT '请求方法',
+  `url` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '网址(支持模板)',
+  `headers` text CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL COMMENT '请求头(一行一个，格式为：Name: value。支持模板)',
+  `body` text CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL COMMENT '请求内容(支持模板)',
+  `expect_status` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '期望的状态码(逗号分隔，支持2xx写法，为空时为2xx)',
+  `expect_body` varchar(500) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '响应内容需匹配的正则表达式',
+  `insecure` enum('Y','N') CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT 'N' COMMENT '是否跳过HTTPS证书校验',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '修改时间',
+  PRIMARY KEY (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='HTTP请求任务配置';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_notify`
+--
+
+DROP TABLE IF EXISTS `nging_task_notify`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_notify` (
+  `id` int unsigned NOT NULL AUTO_INCREMENT,
+  `group_id` int unsigned NOT NULL DEFAULT '0' COMMENT '任务分组ID',
+  `task_id` int unsigned NOT NULL DEFAULT '0' COMMENT '任务ID',
+  `topic` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '告警专题',
+  `events` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '通知事件(failure-失败;timeout-超时;recovery-恢复;success-成功。逗号分隔)',
+  `title_template` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '通知标题模板(为空时使用默认模板)',
+  `content_template` text CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL COMMENT '通知内容模板(为空时使用默认模板)',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '修改时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `task_notify_uniq` (`group_id`,`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务通知规则';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_lease`
+--
+
+DROP TABLE IF EXISTS `nging_task_lease`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_lease` (
+  `name` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL COMMENT '租约名称',
+  `node` varchar(150) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '持有租约的节点',
+  `expires` bigint unsigned NOT NULL DEFAULT '0' COMMENT '到期时间(毫秒时间戳)',
+  `version` bigint unsigned NOT NULL DEFAULT '0' COMMENT '定时任务配置的版本',
+  `updated` int unsigned NOT NULL DEFAULT '0' COMMENT '更新时间',
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务调度租约';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_log_node`
+--
+
+DROP TABLE IF EXISTS `nging_task_log_node`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_log_node` (
+  `log_id` bigint unsigned NOT NULL COMMENT '日志ID',
+  `task_id` int unsigned NOT NULL DEFAULT '0' COMMENT '任务ID',
+  `node` varchar(150) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '执行节点',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`log_id`),
+  KEY `task_log_node_task_id` (`task_id`,`log_id`),
+  KEY `task_log_node_created` (`created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务日志的执行节点';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_log_part`
+--
+
+DROP TABLE IF EXISTS `nging_task_log_part`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_log_part` (
+  `log_id` bigint unsigned NOT NULL COMMENT '日志ID',
+  `task_id` int unsigned NOT NULL DEFAULT '0' COMMENT '任务ID',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`log_id`),
+  KEY `task_log_part_task_id` (`task_id`,`log_id`),
+  KEY `task_log_part_created` (`created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务日志中不作为执行结果的记录(重试前的尝试或多台主机中某台主机的执行)';
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nging_task_ssh_host_key`
+--
+
+DROP TABLE IF EXISTS `nging_task_ssh_host_key`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `nging_task_ssh_host_key` (
+  `address` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL COMMENT '主机地址(host:port)',
+  `key_type` varchar(50) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '公钥类型',
+  `public_key` text CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL COMMENT '公钥(base64)',
+  `fingerprint` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL DEFAULT '' COMMENT '公钥指纹(SHA256)',
+  `created` int unsigned NOT NULL DEFAULT '0' COMMENT '创建时间',
+  PRIMARY KEY (`address`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci COMMENT='任务在SSH主机上执行时信任的主机公钥';
+/*!40101 SET character_set_client = @saved_cs_client */;
@@ -59,10 +59,24 @@ func Log(ctx echo.Context) error {
 	}
 	ctx.Set(`listData`, m.Objects())
 	ctx.Set(`pagination`, p)
+	logIDs := make([]uint64, len(m.Objects()))
+	for i, row := range m.Objects() {
+		logIDs[i] = row.Id
+	}
+	logNodes, err2 := listLogNodes(logIDs)
+	if err2 != nil && err == nil {
+		err = err2
+	}
+	if len(logNodes) > 0 {
+		ctx.Set(`logNodes`, logNodes)
+	}
 	if task == nil {
 		task = model.NewTask(ctx)
 	}
 	ctx.Set(`task`, task)
+	if taskID > 0 {
+		ctx.Set(`liveRuns`, listLiveRuns(taskID))
+	}
 	ret := common.Err(ctx, err)
 	ctx.Set(`activeURL`, `/task/index`)
 	ctx.Set(`notRecordPrefixFlag`, cronWriter.NotRecordPrefixFlag)
@@ -72,6 +86,9 @@ func Log(ctx echo.Context) error {
 func renderLogViewData(ctx echo.Context, m *dbschema.NgingTaskLog, err error) error {
 	ctx.Set(`data`, m)
 	ctx.Set(`activeURL`, `/task/index`)
+	if logNodes, _ := listLogNodes([]uint64{m.Id}); len(logNodes[m.Id]) > 0 {
+		ctx.Set(`logNode`, logNodes[m.Id])
+	}
 	var task *model.Task
 	if m.TaskId > 0 {
 		task = model.NewTask(ctx)
@@ -88,7 +105,7 @@ func renderLogViewData(ctx echo.Context, m *dbschema.NgingTaskLog, err error) er
 	ctx.Set(`task`, task)
 	ctx.Set(`extra`, ex)
 	ctx.Set(`notRecordPrefixFlag`, cronWriter.NotRecordPrefixFlag)
-	systemJobs := cron.ListSystemJobs()
+	systemJobs := listSystemJobs()
 	ctx.SetFunc(`systemJobInfo`, func(command string) *echo.KV {
 		return getSystemJobInfo(systemJobs, command)
 	})
@@ -106,6 +123,32 @@ func LogView(ctx echo.Context) error {
 	return renderLogViewData(ctx, m.NgingTaskLog, err)
 }
 
+// LogLive 实时查看正在执行的任务的输出
+func LogLive(ctx echo.Context) error {
+	live := getLiveRun(ctx.Param(`id`))
+	if live == nil {
+		common.SendFail(ctx, ctx.T(`任务执行已结束`))
+		return ctx.Redirect(backend.URLFor(`/task/index`))
+	}
+	if live.Done() {
+		if logID := live.LogID(); logID > 0 {
+			return ctx.Redirect(backend.URLFor(fmt.Sprintf(`/task/log_view/%d`, logID)))
+		}
+		return ctx.Redirect(backend.URLFor(`/task/log`) + fmt.Sprintf(`?taskId=%d`, live.TaskID))
+	}
+	task := model.NewTask(ctx)
+	err := task.Get(nil, `id`, live.TaskID)
+	if err != nil {
+		common.SendFail(ctx, err.Error())
+		return ctx.Redirect(backend.URLFor(`/task/index`))
+	}
+	ctx.Set(`task`, task)
+	ctx.Set(`live`, live)
+	ctx.Set(`output`, live.Subscribe(backend.User(ctx).Username))
+	ctx.Set(`activeURL`, `/task/index`)
+	return ctx.Render(`task/log_live`, nil)
+}
+
 func LogDelete(ctx echo.Context) error {
 	id := ctx.Formx(`id`).Uint()
 	taskId := ctx.Formx(`taskId`).Uint()
@@ -158,6 +201,20 @@ func LogDelete(ctx echo.Context) error {
 		}
 	}
 	err = m.Delete(nil, cond)
+	if err == nil {
+		if id > 0 {
+			err = deleteLogNodes(db.Cond{`log_id`: id})
+		} else {
+			err = deleteLogNodes(cond)
+		}
+	}
+	if err == nil {
+		if id > 0 {
+			err = deletePartLogs(db.Cond{`log_id`: id})
+		} else {
+			err = deletePartLogs(cond)
+		}
+	}
 	if err == nil {
 		common.SendOk(ctx, ctx.T(`操作成功`))
 	} else {
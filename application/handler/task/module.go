@@ -1,19 +1,33 @@
 package task
 
 import (
+	_ "embed"
+
+	"github.com/coscms/webcore/library/config"
 	"github.com/coscms/webcore/library/config/cmder"
-	cronCmder "github.com/coscms/webcore/library/cron/cmder"
+	"github.com/coscms/webcore/library/cron"
 	"github.com/coscms/webcore/library/module"
 )
 
 const ID = `task`
 
+//go:embed install.sql
+var installSQL string
+
 var Module = module.Module{
 	Startup: ID,
 	Cmder: map[string]cmder.Cmder{
-		ID: cronCmder.New(),
+		ID: newCmder(),
 	},
 	Navigate: func(nc module.Navigate) {
 		nc.Backend().AddLeftItems(-1, LeftNavigate)
 	},
+	SQLCollection: func(sc *config.SQLCollection) {
+		sc.RegisterInstall(ID, installSQL)
+	},
+	CronJobs: []*cron.Jobx{
+		ProxyJob,
+		LogRetentionJob,
+	},
+	DBSchemaVer: 0.0010,
 }
@@ -23,6 +23,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/admpub/log"
 	"github.com/webx-top/com"
 	"github.com/webx-top/db"
 	"github.com/webx-top/echo"
@@ -71,7 +72,9 @@ func Index(ctx echo.Context) error {
 		return r.OrderBy(`-id`)
 	}, cond.And()))
 	extraList := make([]*extra, len(tasks))
+	taskIDs := make([]uint, len(tasks))
 	for k, u := range tasks {
+		taskIDs[k] = u.Id
 		ex := &extra{}
 		entry := cron.GetEntryById(u.Id)
 		if entry != nil {
@@ -89,11 +92,39 @@ func Index(ctx echo.Context) error {
 	ctx.Set(`listData`, tasks)
 	ctx.Set(`extraList`, extraList)
 	ctx.Set(`cronRunning`, cron.Running())
-	ctx.Set(`histroyRunning`, cron.HistoryJobsRunning())
+	ctx.Set(`histroyRunning`, defaultScheduler.running.Load())
 	ctx.Set(`notRecordPrefixFlag`, cronWriter.NotRecordPrefixFlag)
 	ctx.Set(`groupList`, groupList)
 	ctx.Set(`groupId`, groupId)
-	systemJobs := cron.ListSystemJobs()
+	deps, e := listDependencies()
+	if e != nil && err == nil {
+		err = e
+	}
+	ctx.SetFunc(`upstreamIDs`, func(taskID uint) []uint {
+		return deps[taskID]
+	})
+	if node := clusterNode(); len(node) > 0 {
+		ctx.Set(`clusterNode`, node)
+		ctx.Set(`clusterLeader`, currentLeader())
+		lastNodes, e := listLastNodes(taskIDs)
+		if e != nil && err == nil {
+			err = e
+		}
+		ctx.SetFunc(`lastNode`, func(taskID uint) string {
+			return lastNodes[taskID]
+		})
+	}
+	logUsages, e := listTaskLogUsages(taskIDs)
+	if e != nil && err == nil {
+		err = e
+	}
+	ctx.SetFunc(`logUsage`, func(taskID uint) *TaskLogUsage {
+		if usage, ok := logUsages[taskID]; ok {
+			return usage
+		}
+		return &TaskLogUsage{TaskId: taskID}
+	})
+	systemJobs := listSystemJobs()
 	ctx.Set(`systemJobs`, systemJobs)
 	ctx.SetFunc(`systemJobInfo`, func(command string) *echo.KV {
 		return getSystemJobInfo(systemJobs, command)
@@ -113,7 +144,11 @@ func getSystemJobInfo(systemJobs echo.KVList, command string) *echo.KV {
 	return nil
 }
 
+// getCronSpec 获取表单中的Cron表达式。填写了简写时优先使用简写
 func getCronSpec(ctx echo.Context) string {
+	if expr := strings.TrimSpace(ctx.Form(`cronExpr`)); len(expr) > 0 {
+		return expr
+	}
 	seconds := ctx.Form(`seconds`)
 	minutes := ctx.Form(`minutes`)
 	hours := ctx.Form(`hours`)
@@ -135,9 +170,124 @@ func checkTaskData(ctx echo.Context, m *dbschema.NgingTask) error {
 			}
 		}
 	}
-	if err := cron.Parse(m.CronSpec); err != nil {
-		return ctx.NewError(code.InvalidParameter, `无效的Cron时间：%s`, m.CronSpec).SetZone(`cronSpec`)
+	spec, err := normalizeCronSpec(m.CronSpec)
+	if err != nil {
+		return ctx.NewError(code.InvalidParameter, `无效的Cron时间：%s`, m.CronSpec).SetZone(`cronExpr`)
+	}
+	m.CronSpec = spec
+	return nil
+}
+
+// checkTaskTarget 检查执行目标。系统命令和HTTP请求只能在本机执行
+func checkTaskTarget(ctx echo.Context, m *dbschema.NgingTask, extra *TaskExtra) error {
+	if len(extra.SSHUserIds) > 0 && isSystemCommand(m.Command) {
+		return ctx.NewError(code.InvalidParameter, `系统命令任务只能在本机执行`).SetZone(`target`)
+	}
+	if len(extra.SSHUserIds) > 0 && m.Type == TaskTypeHTTP {
+		return ctx.NewError(code.InvalidParameter, `HTTP请求任务只能在本机执行`).SetZone(`target`)
+	}
+	return nil
+}
+
+func checkTaskUpstreams(ctx echo.Context, m *dbschema.NgingTask, upstreamIDs []uint) error {
+	if len(upstreamIDs) > 0 && isSystemCommand(m.Command) {
+		return ctx.NewError(code.InvalidParameter, `系统命令任务不支持设置上游任务`).SetZone(`upstreamIds`)
+	}
+	return checkUpstreams(ctx, m.Id, upstreamIDs)
+}
+
+// saveTaskExtraData 保存上游任务、扩展配置、日志保留规则、通知规则和HTTP请求配置
+func saveTaskExtraData(taskID uint, upstreamIDs []uint, extra *TaskExtra, retention *LogRetention, notify *TaskNotify, httpCfg *TaskHTTP) error {
+	err := saveUpstreams(nil, taskID, upstreamIDs)
+	if err != nil {
+		return err
+	}
+	if httpCfg != nil {
+		httpCfg.TaskId = taskID
+		err = saveTaskHTTP(nil, httpCfg)
+	} else {
+		err = deleteTaskHTTP(nil, taskID)
+	}
+	if err != nil {
+		return err
+	}
+	extra.TaskId = taskID
+	err = saveTaskExtra(nil, extra)
+	if err != nil {
+		return err
+	}
+	retention.TaskId = taskID
+	err = saveLogRetention(nil, retention)
+	if err != nil {
+		return err
+	}
+	notify.TaskId = taskID
+	return saveTaskNotify(nil, notify)
+}
+
+// setExtraFormData 设置上游任务和扩展配置表单数据
+func setExtraFormData(ctx echo.Context, task *dbschema.NgingTask) error {
+	taskID := task.Id
+	var upstreamIDs []uint
+	if ctx.IsPost() {
+		upstreamIDs = formUpstreamIDs(ctx)
+	} else if taskID > 0 {
+		var err error
+		upstreamIDs, err = listUpstreamIDs(taskID)
+		if err != nil {
+			return err
+		}
+		extra, err := getTaskExtra(taskID)
+		if err != nil {
+			return err
+		}
+		setTaskExtraForm(ctx, task, extra)
+		retention, err := getLogRetention(0, taskID)
+		if err != nil {
+			return err
+		}
+		setLogRetentionForm(ctx, retention)
+		notify, err := getTaskNotify(0, taskID)
+		if err != nil {
+			return err
+		}
+		setTaskNotifyForm(ctx, notify)
+		if task.Type == TaskTypeHTTP {
+			httpCfg, err := getTaskHTTP(taskID)
+			if err != nil {
+				return err
+			}
+			setTaskHTTPForm(ctx, httpCfg)
+		}
+	}
+	m := dbschema.NewNgingTask(ctx)
+	_, err := m.ListByOffset(nil, func(r db.Result) db.Result {
+		return r.Select(`id`, `name`, `command`).OrderBy(`id`)
+	}, 0, -1, db.Cond{`id`: db.NotEq(taskID)})
+	if err != nil {
+		return err
+	}
+	taskList := make([]*dbschema.NgingTask, 0, len(m.Objects()))
+	for _, row := range m.Objects() {
+		if !isSystemCommand(row.Command) {
+			taskList = append(taskList, row)
+		}
 	}
+	ctx.Set(`taskList`, taskList)
+	ctx.Set(`upstreamFailures`, UpstreamFailures.Slice())
+	setTaskNotifyFormData(ctx)
+	ctx.Set(`overlapPolicies`, OverlapPolicies.Slice())
+	ctx.Set(`maxRetryCount`, maxRetryCount)
+	ctx.Set(`sshTargets`, listSSHTargetsQuietly())
+	ctx.Set(`fanOuts`, FanOuts.Slice())
+	ctx.Set(`httpMethods`, HTTPMethods)
+	sshUserIDs := parseIDs(strings.Join(ctx.FormValues(`sshUserIds`), `,`))
+	ctx.SetFunc(`isSSHTarget`, func(id uint) bool {
+		return containsID(sshUserIDs, id)
+	})
+	ctx.SetFunc(`isUpstream`, func(id uint) bool {
+		return containsID(upstreamIDs, id)
+	})
 	return nil
 }
 
@@ -154,14 +304,48 @@ func Add(ctx echo.Context) error {
 		m.CronSpec = getCronSpec(ctx)
 		m.Disabled = `Y`
 		m.Uid = backend.User(ctx).Id
+		var extra *TaskExtra
+		extra, err = bindTaskExtra(ctx, 0)
+		if err != nil {
+			goto END
+		}
+		applyOverlapPolicy(m.NgingTask, extra)
+		var httpCfg *TaskHTTP
+		httpCfg, err = bindTaskType(ctx, m.NgingTask)
+		if err != nil {
+			goto END
+		}
+		var notify *TaskNotify
+		notify, err = bindTaskNotify(ctx, 0, 0)
+		if err != nil {
+			goto END
+		}
+		var retention *LogRetention
+		retention, err = bindLogRetention(ctx, 0, 0)
+		if err != nil {
+			goto END
+		}
 		err = checkTaskData(ctx, m.NgingTask)
 		if err != nil {
 			goto END
 		}
+		err = checkTaskTarget(ctx, m.NgingTask, extra)
+		if err != nil {
+			goto END
+		}
+		upstreamIDs := formUpstreamIDs(ctx)
+		err = checkTaskUpstreams(ctx, m.NgingTask, upstreamIDs)
+		if err != nil {
+			goto END
+		}
 		_, err = m.Insert()
 		if err != nil {
 			goto END
 		}
+		err = saveTaskExtraData(m.Id, upstreamIDs, extra, retention, notify, httpCfg)
+		if err != nil {
+			goto END
+		}
 		err = cron.SaveScriptFile(m.NgingTask)
 		if err != nil {
 			goto END
@@ -180,12 +364,15 @@ func Add(ctx echo.Context) error {
 	}
 
 END:
+	if e := setExtraFormData(ctx, m.NgingTask); e != nil {
+		err = e
+	}
 	mg := model.NewTaskGroup(ctx)
 	if _, e := mg.ListByOffset(nil, nil, 0, -1); e != nil {
 		err = e
 	}
 	ctx.Set(`groupList`, mg.Objects())
-	systemJobs := cron.ListSystemJobs()
+	systemJobs := listSystemJobs()
 	ctx.Set(`systemJobs`, systemJobs)
 	ctx.SetFunc(`systemJobInfo`, func(command string) *echo.KV {
 		return getSystemJobInfo(systemJobs, command)
@@ -198,6 +385,10 @@ END:
 
 func setFormData(ctx echo.Context, m *model.Task) {
 	specs := strings.Split(m.CronSpec, ` `)
+	if strings.HasPrefix(m.CronSpec, `@`) {
+		ctx.Request().Form().Set(`cronExpr`, m.CronSpec)
+		specs = nil
+	}
 	switch len(specs) {
 	case 6:
 		ctx.Request().Form().Set(`dayOfWeek`, specs[5])
@@ -237,14 +428,56 @@ func Edit(ctx echo.Context) error {
 		m.NotifyEmail = strings.TrimSpace(m.NotifyEmail)
 		m.Command = strings.TrimSpace(m.Command)
 		m.CronSpec = getCronSpec(ctx)
+		var extra *TaskExtra
+		extra, err = bindTaskExtra(ctx, id)
+		if err != nil {
+			goto END
+		}
+		applyOverlapPolicy(m.NgingTask, extra)
+		var httpCfg *TaskHTTP
+		httpCfg, err = bindTaskType(ctx, m.NgingTask)
+		if err != nil {
+			goto END
+		}
+		var notify *TaskNotify
+		notify, err = bindTaskNotify(ctx, 0, id)
+		if err != nil {
+			goto END
+		}
+		var retention *LogRetention
+		retention, err = bindLogRetention(ctx, 0, id)
+		if err != nil {
+			goto END
+		}
 		err = checkTaskData(ctx, m.NgingTask)
 		if err != nil {
 			goto END
 		}
+		err = checkTaskTarget(ctx, m.NgingTask, extra)
+		if err != nil {
+			goto END
+		}
+		upstreamIDs := formUpstreamIDs(ctx)
+		err = checkTaskUpstreams(ctx, m.NgingTask, upstreamIDs)
+		if err != nil {
+			goto END
+		}
 		err = m.Update(nil, `id`, id)
 		if err != nil {
 			goto END
 		}
+		err = saveTaskExtraData(id, upstreamIDs, extra, retention, notify, httpCfg)
+		if err != nil {
+			goto END
+		}
+		if len(upstreamIDs) > 0 { // 由上游任务触发执行
+			removeJob(id)
+		} else if m.Disabled == `N` { // 按新的执行时间和时区重新加载
+			removeJob(id)
+			if _, err = addJob(context.Background(), m.NgingTask); err != nil {
+				goto END
+			}
+		}
 		err = cron.SaveScriptFile(m.NgingTask)
 		if err != nil {
 			goto END
@@ -255,12 +488,15 @@ func Edit(ctx echo.Context) error {
 
 END:
 	setFormData(ctx, m)
+	if e := setExtraFormData(ctx, m.NgingTask); e != nil {
+		err = e
+	}
 	mg := model.NewTaskGroup(ctx)
 	if _, e := mg.ListByOffset(nil, nil, 0, -1); e != nil {
 		err = e
 	}
 	ctx.Set(`groupList`, mg.Objects())
-	systemJobs := cron.ListSystemJobs()
+	systemJobs := listSystemJobs()
 	ctx.Set(`systemJobs`, systemJobs)
 	ctx.SetFunc(`systemJobInfo`, func(command string) *echo.KV {
 		return getSystemJobInfo(systemJobs, command)
@@ -273,15 +509,82 @@ END:
 	return ctx.Render(`task/edit`, common.Err(ctx, err))
 }
 
+// CronPreview 预览Cron表达式接下来的执行时间
+func CronPreview(ctx echo.Context) error {
+	data := ctx.Data()
+	timezone := strings.TrimSpace(ctx.Form(`timezone`))
+	spec, err := normalizeCronSpec(getCronSpec(ctx))
+	if err != nil {
+		data.SetError(ctx.NewError(code.InvalidParameter, `无效的Cron时间：%v`, err).SetZone(`cronExpr`))
+		return ctx.JSON(data)
+	}
+	times, err := nextRunTimes(spec, timezone, time.Now(), maxPreviewRuns)
+	if err != nil {
+		data.SetError(ctx.NewError(code.InvalidParameter, `无效的时区：%s`, timezone).SetZone(`timezone`))
+		return ctx.JSON(data)
+	}
+	list := make([]string, len(times))
+	for i, t := range times {
+		list[i] = t.Format(`2006-01-02 15:04:05 -0700 Mon`)
+	}
+	data.SetData(echo.H{
+		`spec`:     spec,
+		`timezone`: timezone,
+		`times`:    list,
+	})
+	return ctx.JSON(data)
+}
+
+// SSHHostKeyReset 重新信任所选SSH主机的公钥
+func SSHHostKeyReset(ctx echo.Context) error {
+	data := ctx.Data()
+	ids := parseIDs(strings.Join(ctx.FormValues(`sshUserIds`), `,`))
+	if len(ids) == 0 {
+		data.SetError(ctx.NewError(code.InvalidParameter, `请选择SSH主机`).SetZone(`sshUserIds`))
+		return ctx.JSON(data)
+	}
+	targets, err := listSSHTargets(ids)
+	if err == nil {
+		err = resetHostKeys(targets)
+	}
+	if err != nil {
+		data.SetError(err)
+		return ctx.JSON(data)
+	}
+	data.SetInfo(ctx.T(`已清除所选主机的公钥记录，下次连接时将重新记录`))
+	return ctx.JSON(data)
+}
+
 func Delete(ctx echo.Context) error {
 	id := ctx.Formx(`id`).Uint()
 	next := ctx.Query("next")
 	m := model.NewTask(ctx)
 	err := m.Delete(nil, db.Cond{`id`: id})
 	if err == nil {
-		cron.RemoveJob(id)
+		removeJob(id)
 		logM := model.NewTaskLog(ctx)
 		err = logM.Delete(nil, db.Cond{`task_id`: id})
+		if err == nil {
+			err = deleteDependencies(id)
+		}
+		if err == nil {
+			err = deleteTaskExtra(id)
+		}
+		if err == nil {
+			err = deleteLogRetention(0, id)
+		}
+		if err == nil {
+			err = deleteTaskHTTP(nil, id)
+		}
+		if err == nil {
+			err = deleteTaskNotify(0, id)
+		}
+		if err == nil {
+			err = deleteLogNodes(db.Cond{`task_id`: id})
+		}
+		if err == nil {
+			err = deletePartLogs(db.Cond{`task_id`: id})
+		}
 		if err == nil {
 			cron.DeleteScriptFile(id)
 			common.SendOk(ctx, ctx.T(`操作成功`))
@@ -307,14 +610,19 @@ func Start(ctx echo.Context) error {
 		return err
 	}
 
-	job, err := cron.NewJobFromTask(context.Background(), m.NgingTask)
+	// 先保存启用状态，集群中的主节点收到变更通知后才能加载到本任务
+	disabled := m.Disabled
+	m.Disabled = `N`
+	err = m.UpdateField(nil, `disabled`, m.Disabled, `id`, id)
 	if err != nil {
 		return err
 	}
-
-	if cron.AddJob(m.CronSpec, job) {
-		m.Disabled = `N`
-		err = m.Update(nil, `id`, id)
+	added, err := addJob(context.Background(), m.NgingTask)
+	if err != nil || !added {
+		m.Disabled = disabled
+		if e := m.UpdateField(nil, `disabled`, m.Disabled, `id`, id); e != nil {
+			log.Errorf(`failed to restore task(%d) status: %v`, id, e)
+		}
 		if err != nil {
 			return err
 		}
@@ -349,12 +657,12 @@ func Pause(ctx echo.Context) error {
 		return err
 	}
 
-	cron.RemoveJob(id)
 	m.Disabled = `Y`
 	err = m.Update(nil, `id`, id)
 	if err != nil {
 		return err
 	}
+	removeJob(id)
 
 	if ctx.Format() == `json` {
 		ex := echo.Store{`Running`: false, `Disabled`: m.Disabled}
@@ -386,7 +694,24 @@ func Run(ctx echo.Context) error {
 		return err
 	}
 
-	job, err := cron.NewJobFromTask(ctx.Request().StdRequest().Context(), m.NgingTask)
+	if !isSystemCommand(m.Command) { // 在后台执行，通过实时输出页面查看执行过程
+		job, state, err := newJob(context.Background(), m.NgingTask)
+		if err != nil {
+			return err
+		}
+		live := newLiveRun(id)
+		state.nextLive.Store(live)
+		go func() {
+			job.Run()
+			live.finish(job.LogID()) // 本次未执行(上一次执行尚未结束)时也结束实时输出
+		}()
+		if len(next) == 0 {
+			next = backend.URLFor(`/task/log_live/` + live.ID)
+		}
+		return ctx.Redirect(next)
+	}
+
+	job, _, err := newJob(ctx.Request().StdRequest().Context(), m.NgingTask)
 	if err != nil {
 		return err
 	}
@@ -407,7 +732,7 @@ func Run(ctx echo.Context) error {
 
 // Exit 关闭所有任务
 func Exit(ctx echo.Context) error {
-	cron.Close()
+	closeJobs()
 	next := ctx.Query("next")
 	if len(next) == 0 {
 		next = backend.URLFor(`/task/index`)
@@ -418,8 +743,10 @@ func Exit(ctx echo.Context) error {
 
 // StartHistory 继续历史任务
 func StartHistory(ctx echo.Context) error {
-	if !cron.HistoryJobsRunning() {
-		err := cron.InitJobs(context.Background())
+	if !isSchedulerNode() {
+		common.SendFail(ctx, ctx.T(`当前节点不是主节点，定时任务由主节点“%s”执行`, currentLeader()))
+	} else if !defaultScheduler.running.Load() {
+		err := initJobs(context.Background())
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,142 @@
+/*
+Nging is a toolbox for webmasters
+Copyright (C) 2018-present Wenhui Shen <swh@admpub.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package task
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/webx-top/echo"
+	"github.com/webx-top/echo/param"
+
+	"github.com/coscms/webcore/library/backend"
+	"github.com/coscms/webcore/library/common"
+)
+
+// maxImportSize 导入内容的最大字节数
+const maxImportSize = 4 * 1024 * 1024
+
+// Export 导出任务和分组
+func Export(ctx echo.Context) error {
+	format := ctx.Form(`format`, FormatYAML)
+	if format != FormatJSON {
+		format = FormatYAML
+	}
+	var taskIDs []uint
+	for _, v := range ctx.FormValues(`id`) {
+		for _, id := range strings.Split(v, `,`) {
+			if n := param.AsUint(id); n > 0 {
+				taskIDs = append(taskIDs, n)
+			}
+		}
+	}
+	defs, err := exportDefinitions(taskIDs)
+	if err != nil {
+		return err
+	}
+	content, err := defs.Marshal(format)
+	if err != nil {
+		return err
+	}
+	fileName := `nging-tasks-` + time.Now().Format(`20060102150405`) + `.` + format
+	header := ctx.Response().Header()
+	header.Set(echo.HeaderContentDisposition, `attachment; filename=`+fileName)
+	if format == FormatJSON {
+		header.Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	} else {
+		header.Set(echo.HeaderContentType, `application/x-yaml; charset=utf-8`)
+	}
+	return ctx.Blob(content)
+}
+
+// readImportContent 从上传文件或文本框读取导入内容
+func readImportContent(ctx echo.Context) ([]byte, error) {
+	file, _, err := ctx.Request().FormFile(`file`)
+	if err == nil {
+		defer file.Close()
+		content, err := io.ReadAll(io.LimitReader(file, maxImportSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > maxImportSize {
+			return nil, ctx.E(`导入内容不能超过%dMB`, maxImportSize/1024/1024)
+		}
+		if len(strings.TrimSpace(string(content))) > 0 {
+			return content, nil
+		}
+	}
+	content := ctx.Form(`content`)
+	if len(strings.TrimSpace(content)) == 0 {
+		return nil, ctx.E(`请上传文件或填写导入内容`)
+	}
+	if len(content) > maxImportSize {
+		return nil, ctx.E(`导入内容不能超过%dMB`, maxImportSize/1024/1024)
+	}
+	return []byte(content), nil
+}
+
+// Import 导入任务和分组。先试运行查看差异，确认后再导入
+func Import(ctx echo.Context) error {
+	var (
+		err     error
+		plan    *ImportPlan
+		defs    *TaskDefinitions
+		current *TaskDefinitions
+		content []byte
+
+		keepDisabled bool
+	)
+	if ctx.IsPost() {
+		content, err = readImportContent(ctx)
+		if err != nil {
+			goto END
+		}
+		defs, err = parseDefinitions(content)
+		if err != nil {
+			err = ctx.E(`解析导入内容失败：%v`, err)
+			goto END
+		}
+		current, err = exportDefinitions(nil)
+		if err != nil {
+			goto END
+		}
+		keepDisabled = ctx.Formx(`keepDisabled`).Bool()
+		if keepDisabled {
+			keepDisabledState(current, defs)
+		}
+		plan = diffDefinitions(current, defs)
+		ctx.Request().Form().Set(`content`, string(content))
+		if plan.HasError() || ctx.Form(`confirm`) != `1` {
+			goto END
+		}
+		err = importDefinitions(ctx, backend.User(ctx).Id, defs, keepDisabled)
+		if err != nil {
+			goto END
+		}
+		common.SendOk(ctx, ctx.T(`导入成功：新增%d个，更新%d个`, plan.Count(ImportCreate), plan.Count(ImportUpdate)))
+		return ctx.Redirect(backend.URLFor(`/task/index`))
+	} else {
+		ctx.Request().Form().Set(`keepDisabled`, `1`)
+	}
+
+END:
+	ctx.Set(`plan`, plan)
+	ctx.Set(`activeURL`, `/task/index`)
+	return ctx.Render(`task/import`, common.Err(ctx, err))
+}